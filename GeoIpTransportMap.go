@@ -18,25 +18,40 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/oschwald/geoip2-golang"
 	log "github.com/sirupsen/logrus"
 	cli "gopkg.in/urfave/cli.v1"
 	"io"
-	"math/rand"
+	"io/ioutil"
 	"net"
 	"os"
+	"sort"
 	"strings"
 	"time"
 )
 
-var destinationMap map[string][]string
-var defaultTarget string
+var geoipDbPath string
+var countryDb *geoip2.Reader
 
-func init() {
-	destinationMap = make(map[string][]string)
+var ispDbPath string
+var ispDb *geoip2.Reader
+
+var webFallback bool
+
+var listenConfigs []listenerConfig
+
+// runUser and runGroup to switch to after binding listeners.
+var runUser string
+var runGroup string
 
+// chrootDir and landlock sandbox the process after binding listeners.
+var chrootDir string
+var landlock bool
+
+func init() {
 	// Log as JSON instead of the default ASCII formatter.
 	log.SetFormatter(&log.JSONFormatter{})
 
@@ -54,32 +69,106 @@ func main() {
 	// Args handling setup
 	app.Action = argsHandler
 
+	// Started by Windows service control manager
+	if runAsService(app) {
+		return
+	}
+
 	// Args parse
 	err := app.Run(os.Args)
 	if err != nil {
-		log.Fatalf("Parse args error: ", err.Error())
+		log.Fatalf("Parse args error: %s", err.Error())
+	}
+}
+
+// serve start admin API and all listeners. Never return.
+func serve() {
+	err := writePidFile(pidFile)
+	if err != nil {
+		log.Fatalf("Pid file error: %s", err.Error())
+	}
+
+	startAdminServer()
+	startGrpcServer()
+	err = startPeers()
+	if err != nil {
+		log.Fatalf("Peer mode error: %s", err.Error())
 	}
+	handleShutdownSignals()
+	handleStatsSignal()
+	handleReloadSignal()
+	startAmbiguousReport()
+	startUnmappedReport()
+	startAnomalyCheck()
+	startSloCheck()
+	startResolverProbe()
+	startFeedbackPoller()
+	startRuleHitsFlush()
+	startEvents()
 
-	// TODO: handle geoip db update
-	listenInterface := "0.0.0.0"
-	listenPort := "2527"
+	listeners := make([]net.Listener, 0, len(listenConfigs))
+	for _, config := range listenConfigs {
+		listener, err := listen(config.address)
+		if err != nil {
+			log.Fatalf("Listen %s error: %s", config.address, err.Error())
+		}
+		log.Infof("Listen on %s with rule set %s, protocol %s.", config.address, config.ruleSet, config.protocol)
+		listeners = append(listeners, listener)
+	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%s", listenInterface, listenPort))
+	// All ports bound and files opened, sandbox and drop privileges before serving any request.
+	var uid, gid int
+	uid, gid, err = lookupRunIds(runUser, runGroup)
+	if err != nil {
+		log.Fatalf("Drop privileges error: %s", err.Error())
+	}
+	err = enterChroot(chrootDir)
+	if err != nil {
+		log.Fatalf("Chroot error: %s", err.Error())
+	}
+	err = dropPrivileges(uid, gid)
 	if err != nil {
-		log.Fatalf("Listen %s:%s error: %s", listenInterface, listenPort, err.Error())
+		log.Fatalf("Drop privileges error: %s", err.Error())
+	}
+	if landlock {
+		err = applyLandlock()
+		if err != nil {
+			log.Fatalf("Landlock error: %s", err.Error())
+		}
+	}
+
+	// After privileges dropped, so downloaded DBs owned by the run user.
+	startGeoipRefresh()
+
+	for i, config := range listenConfigs {
+		go serveListener(listeners[i], config)
 	}
+
+	select {}
+}
+
+func serveListener(listener net.Listener, config listenerConfig) {
 	defer listener.Close()
+	if config.protocol == protocolHttp {
+		serveHttpListener(listener, config)
+		return
+	}
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Errorf("Connection accept error for %v.", conn.RemoteAddr())
+			if isShuttingDown() {
+				return
+			}
+			log.Errorf("Connection accept error on %v: %s", listener.Addr(), err.Error())
 			continue
 		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetNoDelay(tcpNoDelay)
+		}
 
-		go handleConnection(conn)
+		go handleConnection(conn, config)
 	}
-
 }
 
 func argsParserSetup() *cli.App {
@@ -89,19 +178,626 @@ func argsParserSetup() *cli.App {
 	app.Flags = []cli.Flag{
 		cli.StringSliceFlag{
 			Name:  "target,t",
-			Usage: `Target destination mapping. Format: "XX:MTA". XX=ISO alpha-2 Country code. MTA is nexthop MTA IP/Hostname.`,
+			Usage: `Target destination mapping. Format: "XX:MTA". XX=ISO alpha-2 Country code. MTA is nexthop MTA IP/Hostname. Options can follow, e.g. "US:mta1 label=us-primary" (also for schedule-target and isp-target).`,
 			//EnvVar: "TARGET_MAPPING",
 		},
+		cli.StringSliceFlag{
+			Name:  "pool",
+			Usage: `Named target pool. Format: "NAME=MTA1,MTA2". Use as MTA of target mapping, or in traffic split "XX:70%pool-a/30%pool-b", which route a stable 70% of domains to pool-a by hash of domain.`,
+		},
+		cli.StringFlag{
+			Name:  "balance",
+			Usage: `How to pick a target from a pool with more than one. "random", "least-recent" pick the one not selected for longest, even out streaks on small pools, or "latency" prefer the one with lower delivery latency and deferral rate for the country by relay feedback. Selection history in /admin/stats.`,
+			Value: "random",
+		},
+		cli.StringFlag{
+			Name:        "feedback-prometheus",
+			Usage:       `Prometheus URL to query relay feedback of --balance latency, e.g. "http://prometheus:9090".`,
+			Destination: &feedbackPrometheusUrl,
+		},
+		cli.StringFlag{
+			Name:        "feedback-latency-query",
+			Usage:       `PromQL of delivery latency in seconds, by "target" and optional "country" label.`,
+			Destination: &feedbackLatencyQuery,
+		},
+		cli.StringFlag{
+			Name:        "feedback-deferral-query",
+			Usage:       `PromQL of deferral rate (0 to 1), by "target" and optional "country" label.`,
+			Destination: &feedbackDeferralQuery,
+		},
+		cli.DurationFlag{
+			Name:        "feedback-interval",
+			Usage:       "Interval of --feedback-prometheus queries.",
+			Value:       time.Minute,
+			Destination: &feedbackInterval,
+		},
+		cli.DurationFlag{
+			Name:        "feedback-max-age",
+			Usage:       "Ignore relay feedback not updated for this long. 0 to keep forever.",
+			Value:       15 * time.Minute,
+			Destination: &feedbackMaxAge,
+		},
+		cli.DurationFlag{
+			Name:        "feedback-deferral-penalty",
+			Usage:       "Cost of 100% deferral rate, compared with delivery latency, in --balance latency.",
+			Value:       time.Minute,
+			Destination: &feedbackDeferralPenalty,
+		},
+		cli.StringSliceFlag{
+			Name:  "target-cap",
+			Usage: `Soft cap of decisions per --target-cap-window of a target. Format: "MTA=N". Saturated target skipped while other pool members under cap. Load and saturation in /admin/stats.`,
+		},
+		cli.DurationFlag{
+			Name:        "target-cap-window",
+			Usage:       "Sliding window of --target-cap.",
+			Value:       time.Minute,
+			Destination: &targetCapWindow,
+		},
+		cli.StringSliceFlag{
+			Name:  "schedule-target,s",
+			Usage: `Time windowed destination mapping. Format: "XX:MTA@HH:MM-HH:MM" in UTC. Take precedence over target mapping while in window.`,
+		},
+		cli.StringFlag{
+			Name:  "default,d",
+			Usage: "Default target. If country not in target mapping, use this default.",
+		},
+		cli.StringFlag{
+			Name:        "unknown-country",
+			Usage:       `Pseudo country of MX IPs GeoIP DB has no country for (e.g. satellite or anonymous ranges) or special codes EU, AP, A1, A2, O1. Can be mapped like a country, e.g. "??:mta1". Empty to fail them as geoip_miss.`,
+			Value:       "??",
+			Destination: &unknownCountry,
+		},
+		cli.StringSliceFlag{
+			Name:  "isp-target,i",
+			Usage: `ISP/organization destination mapping. Format: "ORG:MTA". ORG is ISP, organization or AS organization name (e.g. "Google LLC"). Need --isp-db.`,
+		},
+		cli.StringSliceFlag{
+			Name:  "anonymous-target",
+			Usage: `Destination mapping of MX IPs flagged in Anonymous IP DB, e.g. scrutiny relay. Format: "FLAG:MTA". FLAG is tor, public_proxy, residential_proxy, vpn, hosting or anonymous. Need --anonymous-ip-db.`,
+		},
+		cli.StringFlag{
+			Name:        "geoip-db",
+			Usage:       "GeoIP2/GeoLite2 Country or City DB file, or http(s) URL of mmdb or MaxMind .tar.gz downloaded to --cache-dir at startup.",
+			Value:       "GeoLite2-Country.mmdb",
+			Destination: &geoipDbPath,
+		},
+		cli.StringFlag{
+			Name:  "maxmind-license-key",
+			Usage: `MaxMind license key for --geoip-db/--isp-db URLs on download.maxmind.com. Secret reference "file:/path", "env:NAME", "vault:PATH#FIELD" or "exec:COMMAND", so key isn't in process listing.`,
+		},
+		cli.StringFlag{
+			Name:        "maxmind-account-id",
+			Usage:       "MaxMind account ID. If set, license key sent by basic auth, as current download URLs need. Otherwise as license_key URL parameter.",
+			Destination: &maxmindAccountId,
+		},
+		cli.StringFlag{
+			Name:        "cache-dir",
+			Usage:       "Writable directory of downloaded DBs, so other paths can be on read-only filesystem. Default system temp dir.",
+			Destination: &cacheDir,
+		},
+		cli.DurationFlag{
+			Name:        "geoip-refresh-interval",
+			Usage:       "Check DB files changed and reopen them at this interval. URL DBs downloaded again, by only one instance sharing --cache-dir (or the leader of --peer-bind peers). 0 to disable.",
+			Destination: &geoipRefreshInterval,
+		},
+		cli.StringFlag{
+			Name:        "isp-db",
+			Usage:       "GeoIP2-ISP, GeoLite2-ASN or GeoIP2-Enterprise DB file or URL for ISP target mapping.",
+			Destination: &ispDbPath,
+		},
+		cli.StringFlag{
+			Name:        "anonymous-ip-db",
+			Usage:       "GeoIP2-Anonymous-IP DB file or URL. Flags of MX IPs (vpn, hosting, proxy, tor) added to decisions, and used by anonymous rule.",
+			Destination: &anonymousDbPath,
+		},
+		cli.StringFlag{
+			Name:  "db-open-mode",
+			Usage: `How to open GeoIP DB files. "mmap" only load used pages (suit large City DB on small container), "memory" read whole file.`,
+			Value: dbOpenMmap,
+		},
+		cli.BoolFlag{
+			Name:        "allow-unusable-ips",
+			Usage:       "Keep loopback, private, link-local and unspecified MX addresses, e.g. for internal domains. By default they are dropped and logged before geolocation.",
+			Destination: &allowUnusableIps,
+		},
+		cli.BoolFlag{
+			Name:        "web-fallback",
+			Usage:       "When MX hosts can't be geolocated, use domain apex or www A record's country before use default target.",
+			Destination: &webFallback,
+		},
+		cli.BoolFlag{
+			Name:        "tld-fallback",
+			Usage:       "When DNS resolution fails, guess country from recipient domain's ccTLD (e.g. .de -> DE) before use default target.",
+			Destination: &tldFallback,
+		},
+		cli.StringFlag{
+			Name:  "rule-order",
+			Usage: "Comma separated rule evaluation order. First matched rule win, default target used if no rule match. Available: script, anonymous, isp, schedule, country, web, tld.",
+			Value: defaultRuleOrder,
+		},
+		cli.StringFlag{
+			Name:  "geo-source",
+			Usage: `Addresses geolocated for country of a domain. "mx" MX hosts, "a" domain apex A/AAAA, or weighted combination like "mx=1,a=2", country with most weight win.`,
+			Value: geoSourceMx,
+		},
+		cli.StringSliceFlag{
+			Name:  "allow-country",
+			Usage: `Country allow-list. Format: "XX[,XX...]". Only relay to MX in these countries, others get --disallowed-reply. Country unknown because resolvers failed is deferred.`,
+		},
+		cli.StringFlag{
+			Name:  "disallowed-reply",
+			Usage: `Reply to countries not in --allow-country. Postfix transport value, e.g. "retry:4.7.1 Not licensed" to defer instead of bounce.`,
+			Value: defaultDisallowedReply,
+		},
+		cli.StringSliceFlag{
+			Name:  "rule-set",
+			Usage: `Extra rule set. Format: "NAME=FILE". Each line of FILE is "<flag name> <value>" for target, default, schedule-target, isp-target, anonymous-target, script, rule-order, geo-source, allow-country, disallowed-reply and pool. FILE ending in .yaml, .yml or .json is a map of same keys instead, see "schema" command. FILE can be a directory of fragments, and "include" key merge other files. Flags above are rule set "default", unless "default=FILE" given. Files reloaded on SIGHUP or admin API /admin/reload, previous rule sets kept if any file invalid.`,
+		},
+		cli.Float64Flag{
+			Name:        "reload-confirm-percent",
+			Usage:       "Reload change decisions of more than this percent of recently captured lookups wait confirmation by admin API /admin/reload/confirm. 0 to apply without confirmation.",
+			Destination: &reloadConfirmPercent,
+		},
+		cli.StringSliceFlag{
+			Name:  "shadow",
+			Usage: `Shadow rule set. Format: "LIVE=CANDIDATE". Queries of rule set or blue/green slot LIVE also evaluated by rule set CANDIDATE, without plugin call, log when decision differ. Always answer from LIVE.`,
+		},
+		cli.StringSliceFlag{
+			Name:  "blue-green",
+			Usage: `Blue/green rule set. Format: "NAME=BLUE,GREEN". Rule set NAME is served by BLUE or GREEN, switched by admin API. BLUE is active at start.`,
+		},
+		cli.StringSliceFlag{
+			Name:  "listen,l",
+			Usage: `Listen address. Format: "[PROTOCOL://]ADDRESS[=RULESET]", e.g. "socketmap://127.0.0.1:2528=marketing". Use --protocol and rule set "default" if not specified. IPv6 address bracketed, e.g. "[::]:2527". (default: "0.0.0.0:2527")`,
+		},
+		cli.StringSliceFlag{
+			Name:  "script",
+			Usage: `CEL expression return target, or fallthrough() to try next rule. Variables: email, domain, mx, ip, country, asn, isp (asn/isp need --isp-db). e.g. 'country == "US" && asn == 8075 ? "relay-o365" : fallthrough()'`,
+		},
+		cli.StringFlag{
+			Name:        "plugin",
+			Usage:       `Decision plugin. "http(s)://..." POST JSON to the URL, "exec:/path/to/program" write JSON to program's stdin, "wasm:/path/to/module.wasm" call WASM module. Response JSON {"action": "accept|override|veto", "target": "MTA"}.`,
+			Destination: &pluginUrl,
+		},
+		cli.DurationFlag{
+			Name:        "plugin-timeout",
+			Usage:       "Decision plugin timeout.",
+			Value:       time.Second,
+			Destination: &pluginTimeout,
+		},
+		cli.StringFlag{
+			Name:  "plugin-fail",
+			Usage: `Decision plugin error handling. "open" keep the decision, "closed" treat as veto and use default target.`,
+			Value: "open",
+		},
+		cli.StringFlag{
+			Name:  "explain",
+			Usage: "Print decision trace of the email address and exit.",
+		},
+		cli.StringFlag{
+			Name:  "fail-policy",
+			Usage: `When no rule matched and lookup failed: "open" use default target, "temp" reply 400 (Postfix defer), "notfound" reply 500.`,
+			Value: failOpen,
+		},
+		cli.StringSliceFlag{
+			Name:  "fail-policy-for",
+			Usage: `Override fail policy by failure type. Format: "TYPE=POLICY". TYPE is key, mx, ip, geoip, script or dnssec.`,
+		},
+		cli.StringFlag{
+			Name:  "dnssec",
+			Usage: `DNSSEC mode. "off", "validate" bogus answers fail as "dnssec" failure (default fail policy temp), "require" also fail answers without AD bit. Need a validating resolver.`,
+			Value: dnssecOff,
+		},
+		cli.StringFlag{
+			Name:  "protocol",
+			Usage: `Protocol of listeners without one. "postfix" for tcp_table, "json" for one JSON decision object per line, "socketmap" for Postfix socketmap, "policy" for Postfix policy service replying FILTER, or "http" for GET /lookup/{email}.`,
+			Value: protocolPostfix,
+		},
+		cli.StringFlag{
+			Name:  "address-family",
+			Usage: `Which MX IP to geolocate, should match how relay connect to MX. "any", "ipv4", "ipv6", "prefer-ipv4" or "prefer-ipv6".`,
+			Value: familyAny,
+		},
+		cli.StringSliceFlag{
+			Name:  "dns-server",
+			Usage: `DNS server address (e.g. "127.0.0.1:53"), tried in order. Use nameservers in /etc/resolv.conf if not specified. Must be validating resolver for DNSSEC mode.`,
+		},
+		cli.DurationFlag{
+			Name:        "dns-timeout",
+			Usage:       "Timeout of each DNS query to each server.",
+			Value:       2 * time.Second,
+			Destination: &dnsTimeout,
+		},
+		cli.StringFlag{
+			Name:  "dns-client-subnet",
+			Usage: `EDNS Client Subnet sent on DNS queries. "default" send none and let resolver decide, "disable" ask resolver not to send one (source prefix 0), or a CIDR to pin it, e.g. "203.0.113.0/24" near the relays.`,
+			Value: ecsDefault,
+		},
+		cli.DurationFlag{
+			Name:        "dns-probe-interval",
+			Usage:       "Probe each DNS server at this interval. Server failed 3 queries or probes in a row is tried after healthy ones until a probe succeed. 0 to disable probe, then a successful query bring server back.",
+			Value:       10 * time.Second,
+			Destination: &dnsProbeInterval,
+		},
+		cli.StringFlag{
+			Name:        "dns-probe-name",
+			Usage:       "Name of NS query sent as DNS server probe.",
+			Value:       ".",
+			Destination: &dnsProbeName,
+		},
+		cli.IntFlag{
+			Name:        "dns-edns0-size",
+			Usage:       "EDNS0 UDP buffer size. Answer larger than this retry over TCP.",
+			Value:       1232,
+			Destination: &dnsEdns0Size,
+		},
+		cli.DurationFlag{
+			Name:        "dns-cache-max-ttl",
+			Usage:       "DNS answers cached by TTL, up to this duration. 0 to disable DNS cache.",
+			Value:       time.Hour,
+			Destination: &dnsCacheMaxTtl,
+		},
+		cli.DurationFlag{
+			Name:        "dns-negative-ttl",
+			Usage:       "Cache duration of NXDOMAIN and empty DNS answers.",
+			Value:       time.Minute,
+			Destination: &dnsNegativeTtl,
+		},
+		cli.DurationFlag{
+			Name:        "decision-cache-ttl",
+			Usage:       "Cache decision of each domain (each email if script or plugin used) for this duration. 0 to disable.",
+			Destination: &decisionCacheTtl,
+		},
+		cli.DurationFlag{
+			Name:        "serve-stale-ttl",
+			Usage:       "Keep last good decision of each domain for this duration, and serve it instead of default target when DNS resolvers fail. 0 to disable.",
+			Destination: &serveStaleTtl,
+		},
+		cli.IntFlag{
+			Name:        "domain-concurrency",
+			Usage:       "Maximum simultaneous evaluations of one domain. Excess queries wait and share result of an in-flight one. 0 for no limit.",
+			Destination: &domainConcurrency,
+		},
+		cli.IntFlag{
+			Name:        "cache-max-entries",
+			Usage:       "Maximum entries of all caches (DNS, negative DNS, decision). Least recently used evicted first.",
+			Value:       100000,
+			Destination: &cacheMaxEntries,
+		},
+		cli.IntFlag{
+			Name:        "cache-max-bytes",
+			Usage:       "Approximate maximum bytes of all caches. 0 for no byte limit.",
+			Value:       64 * 1024 * 1024,
+			Destination: &cacheMaxBytes,
+		},
+		cli.DurationFlag{
+			Name:        "sticky-ttl",
+			Usage:       "Keep first target of a recipient domain for this long, even if DNS answers or pool pick change. 0 to disable.",
+			Destination: &stickyTtl,
+		},
+		cli.DurationFlag{
+			Name:        "country-switch-duration",
+			Usage:       "Default duration of country switch set by admin API /admin/country-switch, expired automatically.",
+			Value:       time.Hour,
+			Destination: &countrySwitchDuration,
+		},
+		cli.DurationFlag{
+			Name:        "country-switch-max-duration",
+			Usage:       "Maximum duration of country switch.",
+			Value:       24 * time.Hour,
+			Destination: &countrySwitchMaxDuration,
+		},
+		cli.DurationFlag{
+			Name:        "demote-duration",
+			Usage:       "Default cool-down of target demotion set by admin API /admin/demote, restored automatically.",
+			Value:       time.Hour,
+			Destination: &demoteDuration,
+		},
+		cli.DurationFlag{
+			Name:        "demote-max-duration",
+			Usage:       "Maximum cool-down of target demotion.",
+			Value:       24 * time.Hour,
+			Destination: &demoteMaxDuration,
+		},
+		cli.StringFlag{
+			Name:        "pin-db",
+			Usage:       "File of persistent domain to target pins (created if not exist). Pinned domains skip rules. Manage by admin API /admin/pin.",
+			Destination: &pinDbPath,
+		},
+		cli.StringSliceFlag{
+			Name:  "auto-pin",
+			Usage: `Pin domains match the pattern (e.g. "*.example.com") to their first target. Need --pin-db.`,
+		},
+		cli.StringFlag{
+			Name:        "rule-hits-db",
+			Usage:       "File of persistent per-mapping match counts (created if not exist), so admin API /admin/rule-hits report mappings not matched for days across restarts.",
+			Destination: &ruleHitsDbPath,
+		},
+		cli.StringFlag{
+			Name:        "event-sink",
+			Usage:       `Publish each decision as JSON event. "nats://[USER:PASS@]HOST:PORT/SUBJECT", or Kafka REST Proxy "kafka+http://HOST:PORT/TOPIC" ("kafka+https" for TLS). Can be secret reference like "env:NAME" to keep password out of process listing. Disabled if empty.`,
+			Destination: &eventSink,
+		},
+		cli.IntFlag{
+			Name:        "event-queue",
+			Usage:       "Max decision events waiting to publish. Events dropped when full, lookups never wait.",
+			Value:       10000,
+			Destination: &eventQueueSize,
+		},
+		cli.BoolFlag{
+			Name:  "static",
+			Usage: "Start in static mode. Answer every query with default target without DNS and GeoIP lookup. Can change by admin API.",
+		},
+		cli.DurationFlag{
+			Name:        "slow-threshold",
+			Usage:       "Log and count lookups take longer than this, with per phase timings. 0 to disable.",
+			Value:       time.Second,
+			Destination: &slowThreshold,
+		},
+		cli.StringSliceFlag{
+			Name:  "latency-slo",
+			Usage: `Lookup latency objective. Format: "PERCENT%<DURATION", e.g. "99%<50ms". Compliance, error budget and burn rates in /admin/stats, fast burn logged.`,
+		},
+		cli.DurationFlag{
+			Name:        "latency-slo-window",
+			Usage:       "Window of --latency-slo error budget.",
+			Value:       24 * time.Hour,
+			Destination: &sloWindow,
+		},
+		cli.DurationFlag{
+			Name:        "ambiguous-report-interval",
+			Usage:       "Log domains with MX hosts in different countries at this interval. 0 to disable.",
+			Value:       time.Hour,
+			Destination: &ambiguousReportInterval,
+		},
+		cli.Float64Flag{
+			Name:        "anomaly-z-score",
+			Usage:       "Log and count country share of decisions moved more than this many standard deviations from its learned mean, a canary of GeoIP DB regressions, DNS hijacks or broken reloads. 0 to disable.",
+			Value:       4,
+			Destination: &anomalyZScore,
+		},
+		cli.DurationFlag{
+			Name:        "anomaly-interval",
+			Usage:       "Interval of country shares compared by --anomaly-z-score.",
+			Value:       5 * time.Minute,
+			Destination: &anomalyInterval,
+		},
+		cli.DurationFlag{
+			Name:        "unmapped-report-interval",
+			Usage:       "Log top countries of lookups use default target at this interval, to find mappings with most impact. 0 to disable.",
+			Value:       time.Hour,
+			Destination: &unmappedReportInterval,
+		},
+		cli.IntFlag{
+			Name:        "capture-size",
+			Usage:       "Keep last N lookups in memory for admin API /admin/capture. 0 to disable.",
+			Value:       1000,
+			Destination: &captureSize,
+		},
+		cli.BoolFlag{
+			Name:        "reuse-port",
+			Usage:       "Listen with SO_REUSEPORT, so a new process can take over listen address before old process exit.",
+			Destination: &reusePort,
+		},
+		cli.DurationFlag{
+			Name:        "drain-timeout",
+			Usage:       "On SIGTERM/SIGINT, stop accepting and wait existing connections up to this duration before exit.",
+			Value:       10 * time.Second,
+			Destination: &drainTimeout,
+		},
+		cli.DurationFlag{
+			Name:        "shutdown-delay",
+			Usage:       "On SIGTERM/SIGINT, keep accepting for this duration with /health returning 503 before drain, so load balancer (e.g. Kubernetes endpoints) stop sending first.",
+			Destination: &shutdownDelay,
+		},
+		cli.DurationFlag{
+			Name:        "tcp-keepalive",
+			Usage:       "TCP keepalive interval of Postfix connections. 0 use default (15s), negative to disable.",
+			Destination: &tcpKeepAlive,
+		},
+		cli.BoolTFlag{
+			Name:        "tcp-nodelay",
+			Usage:       "Set TCP_NODELAY on Postfix connections, so replies not delayed by Nagle. Use --tcp-nodelay=false to disable.",
+			Destination: &tcpNoDelay,
+		},
+		cli.IntFlag{
+			Name:        "listen-backlog",
+			Usage:       "Listen backlog of Postfix listeners. 0 use system default.",
+			Destination: &listenBacklog,
+		},
+		cli.StringFlag{
+			Name:        "admin-listen",
+			Usage:       `Admin and lookup API listen address (e.g. "127.0.0.1:8080"). Disabled if empty.`,
+			Destination: &adminListen,
+		},
+		cli.StringSliceFlag{
+			Name:  "admin-token",
+			Usage: `Admin API token. Format: "SCOPE=SECRET", SCOPE "read" (GET and lookups) or "write" (also change state). SECRET can be secret reference like "file:/path". Sent as "Authorization: Bearer TOKEN", or basic auth password by browsers.`,
+		},
+		cli.IntFlag{
+			Name:        "audit-size",
+			Usage:       "Runtime changes kept for /admin/audit.",
+			Value:       1000,
+			Destination: &auditSize,
+		},
+		cli.StringFlag{
+			Name:  "audit-log",
+			Usage: "Append each runtime change (admin API or signal) to this file as JSON line, with who, previous and new value.",
+		},
+		cli.StringFlag{
+			Name:  "admin-tls-cert",
+			Usage: "Certificate file of admin API, serve HTTPS.",
+		},
+		cli.StringFlag{
+			Name:  "admin-tls-key",
+			Usage: "Private key file of --admin-tls-cert.",
+		},
+		cli.StringFlag{
+			Name:  "admin-client-ca",
+			Usage: "CA file of admin API client certificates (mTLS). Verified certificates have read scope, or write scope if listed in --admin-write-cn.",
+		},
+		cli.StringSliceFlag{
+			Name:  "admin-write-cn",
+			Usage: "Common name of client certificate with write scope.",
+		},
+		cli.IntFlag{
+			Name:        "client-stats-max",
+			Usage:       `Maximum client IPs with own stats in /admin/clients and metrics. Others counted as "other".`,
+			Value:       1000,
+			Destination: &clientStatsMax,
+		},
+		cli.IntFlag{
+			Name:        "bulk-max",
+			Usage:       "Maximum emails in one bulk lookup request.",
+			Value:       1000,
+			Destination: &bulkMax,
+		},
+		cli.StringFlag{
+			Name:        "grpc-listen",
+			Usage:       `gRPC lookup API listen address (e.g. "127.0.0.1:9090"). Disabled if empty. Use TLS and authentication of admin API, WarmCache need write scope.`,
+			Destination: &grpcListen,
+		},
+		cli.BoolFlag{
+			Name:        "strict-targets",
+			Usage:       "Fail startup if any configured target can't be resolved. Only log warning if not set.",
+			Destination: &strictTargets,
+		},
+		cli.StringFlag{
+			Name:  "fixtures",
+			Usage: `Simulation mode. DNS and GeoIP results from the fixture file instead of network and GeoIP DB. Each line is a DNS record in zone file format, or "geoip CIDR COUNTRY".`,
+		},
+		cli.StringSliceFlag{
+			Name:  "chaos-dns-timeout",
+			Usage: `Testing only. DNS queries of names match the glob pattern (e.g. "*.example.com") time out.`,
+		},
+		cli.StringSliceFlag{
+			Name:  "chaos-geoip-miss",
+			Usage: "Testing only. GeoIP lookup of IPs in the CIDR fail.",
+		},
+		cli.StringSliceFlag{
+			Name:  "chaos-latency",
+			Usage: `Testing only. Add latency to lookups of domains match the pattern. Format: "PATTERN=DURATION", e.g. "*=200ms".`,
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Usage: "Log level: debug, info, warning, error. Can change by admin API /admin/log.",
+			Value: "info",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "Log format: json or text.",
+			Value: "json",
+		},
+		cli.StringFlag{
+			Name:  "log-file",
+			Usage: "Append logs to this file instead of stdout. Needed when run as Windows service.",
+		},
+		cli.StringFlag{
+			Name:        "user",
+			Usage:       "Switch to this user after binding listeners and opening files as root.",
+			Destination: &runUser,
+		},
+		cli.StringFlag{
+			Name:        "group",
+			Usage:       "Switch to this group after binding listeners. Default primary group of --user.",
+			Destination: &runGroup,
+		},
+		cli.BoolFlag{
+			Name:  "allow-root",
+			Usage: "Allow running as root without --user.",
+		},
+		cli.StringFlag{
+			Name:        "peer-bind",
+			Usage:       `Peer mode gossip address (e.g. "0.0.0.0:7946"). Instances gossip decision and sticky cache entries, all must have same rule sets. Disabled if empty.`,
+			Destination: &peerBind,
+		},
+		cli.StringFlag{
+			Name:        "peer-advertise",
+			Usage:       "Peer address advertised to other peers, if different from --peer-bind (e.g. NAT or 0.0.0.0 bind).",
+			Destination: &peerAdvertise,
+		},
+		cli.StringSliceFlag{
+			Name:  "peer-join",
+			Usage: `Peer address to join at startup (e.g. "10.0.0.2:7946" or a headless service name). Only one need to be up.`,
+		},
+		cli.StringFlag{
+			Name:        "peer-key-file",
+			Usage:       "File of 16, 24 or 32 bytes key to encrypt gossip. Same on all peers. Required by --peer-bind.",
+			Destination: &peerKeyFile,
+		},
+		cli.StringFlag{
+			Name:        "pidfile",
+			Usage:       "Write PID to this file, removed on shutdown. Refuse to start if the PID in it still running, stale file overwritten.",
+			Destination: &pidFile,
+		},
 		cli.StringFlag{
-			Name:        "default,d",
-			Usage:       "Default target. If country not in target mapping, use this default.",
-			Destination: &defaultTarget,
+			Name:        "chroot",
+			Usage:       "Chroot to this directory (normally empty) after binding listeners and opening files. Need run as root.",
+			Destination: &chrootDir,
+		},
+		cli.BoolFlag{
+			Name:        "landlock",
+			Usage:       "Linux only. Deny all filesystem access by Landlock after binding listeners and opening files. Need binary built with CGO_ENABLED=0.",
+			Destination: &landlock,
+		},
+		cli.StringFlag{
+			Name:  "auth-token-file",
+			Usage: `File of shared secret. Each connection must send "auth TOKEN" as first line, for clients (or a proxy) can send it. Postfix itself can't. "http" listeners need "Authorization: Bearer TOKEN" instead. Not checked by "socketmap" and "policy" listeners.`,
+		},
+		cli.StringFlag{
+			Name:  "auth-token",
+			Usage: `Shared secret as --auth-token-file, by secret reference "file:/path", "env:NAME", "vault:PATH#FIELD" or "exec:COMMAND".`,
+		},
+		cli.DurationFlag{
+			Name:        "auth-timeout",
+			Usage:       "Close connection not authenticated within this time.",
+			Value:       5 * time.Second,
+			Destination: &authTimeout,
+		},
+		cli.IntFlag{
+			Name:        "max-protocol-violations",
+			Usage:       "Close connection after this many invalid request lines (e.g. with NUL). Each is replied 500.",
+			Value:       3,
+			Destination: &maxProtocolViolations,
+		},
+		cli.StringSliceFlag{
+			Name:  "key-normalizer",
+			Usage: `Normalize lookup keys before lookup and caching. Available: "subaddress" (strip "+tag" of local part).`,
+		},
+		cli.StringSliceFlag{
+			Name:  "special-key-reply",
+			Usage: `Reply of special keys Postfix may query: postmaster, double-bounce or empty. Format: "KEY=REPLY", REPLY is default (default target), notfound or a Postfix nexthop, e.g. "postmaster=local:".`,
+		},
+		cli.StringFlag{
+			Name:        "subaddress-separator",
+			Usage:       "Separator of subaddress tag for subaddress key normalizer.",
+			Value:       "+",
+			Destination: &subaddressSeparator,
+		},
+		cli.IntFlag{
+			Name:        "log-sample",
+			Usage:       "Log 1 in N relay decisions at info level. Failures always logged. Suppressed lines counted in /admin/stats.",
+			Value:       1,
+			Destination: &logSample,
+		},
+		cli.StringSliceFlag{
+			Name:  "trace-domain",
+			Usage: `Log every lookup step of domains match the pattern, e.g. "*.example.com". Can change by admin API /admin/log.`,
 		},
 		cli.BoolFlag{
 			Name:  "help,h",
 			Usage: "Print this help.",
 		},
 	}
+	app.Commands = []cli.Command{
+		diffCommand(),
+		replayCommand(),
+		schemaCommand(),
+		importCommand(),
+		exportCommand(),
+		applyCommand(),
+	}
+	app.Commands = append(app.Commands, serviceCommands()...)
 	app.HideVersion = true
 	app.HideHelp = true
 
@@ -113,84 +809,437 @@ func argsHandler(c *cli.Context) error {
 	if needHelp {
 		cli.ShowAppHelpAndExit(c, 1)
 	}
+	startupFlags = recordFlags(c)
+	if isRunningAsRoot() && runUser == "" && !c.Bool("allow-root") {
+		return errors.New("Refuse to run as root. Use --user to drop privileges after start, or --allow-root.")
+	}
+	err := setLogLevel(c.String("log-level"))
+	if err != nil {
+		return err
+	}
+	err = setLogFormat(c.String("log-format"))
+	if err != nil {
+		return err
+	}
+	if path := c.String("log-file"); path != "" {
+		err = setLogFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	if shutdownDelay+drainTimeout+time.Second >= kubernetesGracePeriod {
+		log.Warnf("Shutdown delay %v + drain timeout %v exceed Kubernetes default grace period %v, may be killed before drained.", shutdownDelay, drainTimeout, kubernetesGracePeriod)
+	}
+	peerJoin = c.StringSlice("peer-join")
+	err = validateUnknownCountry(unknownCountry)
+	if err != nil {
+		return err
+	}
+	err = validateAnomalyFlags()
+	if err != nil {
+		return err
+	}
+	err = setupTracedDomains(c.StringSlice("trace-domain"))
+	if err != nil {
+		return err
+	}
+	err = setupKeyNormalizers(c.StringSlice("key-normalizer"))
+	if err != nil {
+		return err
+	}
+	if path := c.String("auth-token-file"); path != "" {
+		err = loadAuthToken(path)
+		if err != nil {
+			return err
+		}
+	}
+	err = setupSecrets(c)
+	if err != nil {
+		return err
+	}
+	err = openAuditLog(c.String("audit-log"))
+	if err != nil {
+		return err
+	}
+	err = setupAdminAuth(c.StringSlice("admin-token"), c.String("admin-tls-cert"), c.String("admin-tls-key"), c.String("admin-client-ca"), c.StringSlice("admin-write-cn"))
+	if err != nil {
+		return err
+	}
+	for _, value := range c.StringSlice("special-key-reply") {
+		key, reply, err := parseSpecialKeyFlag(value)
+		if err != nil {
+			return err
+		}
+		specialKeyReplies[key] = reply
+	}
+
+	for _, value := range c.StringSlice("rule-set") {
+		name, path, err := parseRuleSetFlag(value)
+		if err != nil {
+			return err
+		}
+		if _, ok := ruleSetFiles[name]; ok {
+			return errors.New(fmt.Sprintf("Duplicated rule set: %s", name))
+		}
+		rs, err := loadRuleSetFile(name, path)
+		if err != nil {
+			return err
+		}
+		ruleSetFiles[name] = path
+		setRuleSet(rs)
+	}
 
-	mapping := c.StringSlice("target")
+	for _, value := range c.StringSlice("blue-green") {
+		slot, err := parseBlueGreenFlag(value)
+		if err != nil {
+			return err
+		}
+		if _, ok := ruleSetFiles[slot.Name]; ok {
+			return errors.New(fmt.Sprintf("Rule set %s defined by both --rule-set and --blue-green.", slot.Name))
+		}
+		if _, ok := blueGreenSlots[slot.Name]; ok {
+			return errors.New(fmt.Sprintf("Duplicated blue/green rule set: %s", slot.Name))
+		}
+		for _, color := range slot.Colors {
+			if _, ok := ruleSetFiles[color]; !ok {
+				return errors.New(fmt.Sprintf("Rule set %s of blue/green %s not defined by --rule-set.", color, value))
+			}
+		}
+		blueGreenSlots[slot.Name] = slot
+	}
+
+	// Rule set "default" from flags, unless loaded from file or blue/green so it can be reloaded or switched.
+	if _, ok := blueGreenSlots[defaultRuleSetName]; ok {
+		if len(c.StringSlice("target")) > 0 {
+			return errors.New("Rule set default defined by both --target and --blue-green.")
+		}
+	} else if _, ok := ruleSetFiles[defaultRuleSetName]; ok {
+		if len(c.StringSlice("target")) > 0 {
+			return errors.New("Rule set default defined by both --target and --rule-set.")
+		}
+	} else {
+		rs, err := newRuleSet(defaultRuleSetName, ruleSetConfig{
+			targets:          c.StringSlice("target"),
+			defaultTarget:    c.String("default"),
+			scheduleTargets:  c.StringSlice("schedule-target"),
+			ispTargets:       c.StringSlice("isp-target"),
+			anonymousTargets: c.StringSlice("anonymous-target"),
+			scripts:          c.StringSlice("script"),
+			ruleOrder:        c.String("rule-order"),
+			geoSource:        c.String("geo-source"),
+			allowCountries:   c.StringSlice("allow-country"),
+			disallowedReply:  c.String("disallowed-reply"),
+			pools:            c.StringSlice("pool"),
+		})
+		if err != nil {
+			cli.ShowAppHelp(c)
+			return err
+		}
+		setRuleSet(rs)
+	}
+	defaultRuleSet := getRuleSet(defaultRuleSetName)
+
+	for _, value := range c.StringSlice("shadow") {
+		live, candidate, err := parseShadowFlag(value)
+		if err != nil {
+			return err
+		}
+		if getRuleSet(live) == nil || getRuleSet(candidate) == nil {
+			return errors.New(fmt.Sprintf("Rule set of shadow %s not defined.", value))
+		}
+		shadowRuleSets[live] = candidate
+	}
+
+	protocol, err = parseProtocol(c.String("protocol"))
+	if err != nil {
+		return err
+	}
+
+	listenValues := c.StringSlice("listen")
+	if len(listenValues) < 1 {
+		listenValues = []string{"0.0.0.0:2527"}
+	}
+	listenConfigs = nil
+	for _, value := range listenValues {
+		config, err := parseListenFlag(value)
+		if err != nil {
+			return err
+		}
+		if getRuleSet(config.ruleSet) == nil {
+			return errors.New(fmt.Sprintf("Rule set %s of listener %s not defined.", config.ruleSet, value))
+		}
+		if authToken != "" && (config.protocol == protocolSocketmap || config.protocol == protocolPolicy) {
+			log.Warnf("Auth token not supported by %s protocol, listener %s accept connections without authentication.", config.protocol, value)
+		}
+		listenConfigs = append(listenConfigs, config)
+	}
 
-	if len(mapping) < 1 {
-		cli.ShowAppHelp(c)
-		return errors.New("Can't process with empty target mapping.")
+	needIspDb := false
+	needAnonymousDb := false
+	for _, rs := range ruleSets {
+		if len(rs.ispMap) > 0 {
+			needIspDb = true
+		}
+		if len(rs.anonymousMap) > 0 {
+			needAnonymousDb = true
+		}
 	}
 
-	for _, value := range mapping {
-		splitedMap := strings.Split(value, ":")
-		if len(splitedMap) != 2 {
-			return errors.New(fmt.Sprintf("Invalid mapping format: %s", value))
+	if needIspDb && ispDbPath == "" {
+		return errors.New("ISP target mapping need --isp-db.")
+	}
+	if needAnonymousDb && anonymousDbPath == "" {
+		return errors.New("Anonymous target mapping need --anonymous-ip-db.")
+	}
+
+	balanceStrategy, err = parseBalanceStrategy(c.String("balance"))
+	if err != nil {
+		return err
+	}
+	if feedbackPrometheusUrl != "" && feedbackLatencyQuery == "" && feedbackDeferralQuery == "" {
+		return errors.New("--feedback-prometheus need --feedback-latency-query or --feedback-deferral-query.")
+	}
+	if feedbackPrometheusUrl == "" && (feedbackLatencyQuery != "" || feedbackDeferralQuery != "") {
+		return errors.New("Feedback query need --feedback-prometheus.")
+	}
+	err = setupLatencySlo(c.StringSlice("latency-slo"))
+	if err != nil {
+		return err
+	}
+	for _, value := range c.StringSlice("target-cap") {
+		target, limit, err := parseTargetCapFlag(value)
+		if err != nil {
+			return err
 		}
-		country := strings.ToUpper(splitedMap[0])
-		if len(country) != 2 {
+		targetCaps[target] = limit
+	}
+
+	dbOpenMode, err = parseDbOpenMode(c.String("db-open-mode"))
+	if err != nil {
+		return err
+	}
+
+	if path := c.String("fixtures"); path != "" {
+		err = loadFixtures(path)
+	} else {
+		err = openGeoipDbs()
+	}
+	if err != nil {
+		return err
+	}
+
+	dnsClientSubnet, err = parseEcsMode(c.String("dns-client-subnet"))
+	if err != nil {
+		return err
+	}
+	dnssecMode, err = parseDnssecMode(c.String("dnssec"))
+	if err != nil {
+		return err
+	}
+
+	addressFamily, err = parseAddressFamily(c.String("address-family"))
+	if err != nil {
+		return err
+	}
+
+	err = setupDnsServers(c.StringSlice("dns-server"))
+	if err != nil {
+		return err
+	}
+
+	err = parseChaosFlags(c.StringSlice("chaos-dns-timeout"), c.StringSlice("chaos-geoip-miss"), c.StringSlice("chaos-latency"))
+	if err != nil {
+		return err
+	}
 
-			return errors.New(fmt.Sprintf("Invalid country code: %s", country))
+	failPolicy, err = parseFailPolicy(c.String("fail-policy"))
+	if err != nil {
+		return err
+	}
+	for _, value := range c.StringSlice("fail-policy-for") {
+		failureType, policy, err := parseFailPolicyFor(value)
+		if err != nil {
+			return err
 		}
-		target := splitedMap[1]
-		if len(target) < 1 {
-			return errors.New(fmt.Sprintf("Invalid target on %s: %s", country, target))
+		failPolicies[failureType] = policy
+	}
+
+	err = parsePluginFail(c.String("plugin-fail"))
+	if err != nil {
+		return err
+	}
+
+	if isWasmPlugin() {
+		err = loadWasmPlugin()
+		if err != nil {
+			return err
 		}
+	}
 
-		destinationMap[country] = append(destinationMap[country], target)
+	if c.Bool("static") {
+		setStaticMode(true)
 	}
 
-	defaultTarget = strings.ToUpper(defaultTarget)
+	err = setupPins(pinDbPath, c.StringSlice("auto-pin"))
+	if err != nil {
+		return err
+	}
+	if ruleHitsDbPath != "" {
+		err = openRuleHitsDb(ruleHitsDbPath)
+		if err != nil {
+			return err
+		}
+	}
+	err = setupEvents()
+	if err != nil {
+		return err
+	}
+
+	for _, rs := range ruleSets {
+		log.Infof("Rule set %s with target map: %v, schedule map: %v, ISP map: %v, default: %s, rule order: %v", rs.name, rs.destinationMap, rs.scheduleMap, rs.ispMap, rs.defaultTarget, rs.getRuleOrderNames())
+	}
 
-	if _, ok := destinationMap[defaultTarget]; !ok {
-		cli.ShowAppHelp(c)
-		return errors.New(fmt.Sprintf(`Default target "%s" not in target map.`, defaultTarget))
+	if email := c.String("explain"); email != "" {
+		result, _ := json.MarshalIndent(evaluate(defaultRuleSet, email), "", "  ")
+		fmt.Println(string(result))
+		os.Exit(0)
 	}
 
-	log.Infof("Start with target map: %v, default: %s", destinationMap, defaultTarget)
+	err = preflightTargets()
+	if err != nil {
+		return err
+	}
 
+	serve()
 	return nil
 }
 
-func handleConnection(conn net.Conn) {
+func handleConnection(conn net.Conn, config listenerConfig) {
+	trackConnection(conn)
+	defer untrackConnection(conn)
+	recordConnectionOpen()
+	defer recordConnectionClose()
+
 	log.Infof("Start handle connection '%v'.", conn.RemoteAddr())
-	reader := bufio.NewReader(conn)
+	connStats := newConnectionStats()
+	connStats.client = recordClientConnect(conn.RemoteAddr())
+	defer recordClientDisconnect(connStats.client)
+	defer connStats.log(conn)
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, maxRequestLine)
+	switch config.protocol {
+	case protocolSocketmap:
+		serveSocketmap(conn, reader, config.ruleSet, connStats)
+		return
+	case protocolPolicy:
+		servePolicy(conn, reader, config.ruleSet, connStats)
+		return
+	}
+
+	if authToken != "" && !authenticate(conn, reader) {
+		connStats.errors++
+		return
+	}
+	violations := 0
 	for {
-		data, err := reader.ReadBytes('\n')
+		data, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			recordProtocolViolation(conn.RemoteAddr(), violationTooLong)
+			connStats.errors++
+			conn.Write([]byte(genResponse(config.protocol, protocolViolationDecision(violationTooLong))))
+			return
+		}
 		if err != nil {
-			if err == io.EOF {
-				log.Infof("Connection closed from %v.", conn.RemoteAddr())
-			} else {
+			if err == io.EOF && len(data) > 0 {
+				recordProtocolViolation(conn.RemoteAddr(), violationNoNewline)
+				connStats.errors++
+			} else if err != io.EOF {
 				log.Errorf("Read from %v error: '%s'.", conn.RemoteAddr(), err.Error())
+				connStats.errors++
 			}
-			conn.Close()
 			return
 		}
 		length := len(data)
 		//if length < 1{
-		dataString := string(data[:length-1])
+		line := string(data[:length-1])
+		dataString := decodeRequestKey(line)
 
-		log.Infof("Received '%s'", dataString)
+		if violation := checkRequest(line, dataString); violation != "" {
+			recordProtocolViolation(conn.RemoteAddr(), violation)
+			connStats.errors++
+			violations++
+			_, err = conn.Write([]byte(genResponse(config.protocol, protocolViolationDecision(violation))))
+			if err != nil || violations >= maxProtocolViolations {
+				return
+			}
+			continue
+		}
 
-		result := getResult(dataString)
-		conn.Write([]byte(genPostfixResponse(result)))
-		log.Infof("Email %s use %s as next hop.", dataString, result)
+		err = answerQuery(conn, config.ruleSet, dataString, connStats, func(result decision) string {
+			return genResponse(config.protocol, result)
+		})
+		if err != nil {
+			log.Errorf("Write to %v error: '%s'.", conn.RemoteAddr(), err.Error())
+		}
 	}
 }
 
+// answerQuery look up the key with the rule set, write reply and log it. Return write error.
+func answerQuery(conn net.Conn, ruleSetName string, key string, connStats *connectionStats, reply func(decision) string) error {
+	sampled := sampleLookupLog()
+	if sampled {
+		log.Infof("Received '%s'", key)
+	}
+
+	start := time.Now()
+	result := getResult(getRuleSet(ruleSetName), key)
+	_, err := conn.Write([]byte(reply(result)))
+	connStats.record(result, time.Since(start), err)
+	logTrace(key, conn.RemoteAddr(), result)
+	logDecision(key, result, sampled)
+	return err
+}
+
+// logDecision log decision of a query. Successful lookups only logged if sampled.
+func logDecision(key string, result decision, sampled bool) {
+	if result.Action != "" {
+		if !sampled {
+			log.Infof("Received '%s'", key)
+		}
+		log.WithField("error_code", result.ErrorCode).Infof("Email %s reply %s on %s failure.", key, result.Action, result.Failure)
+	} else if !sampled {
+		suppressLookupLog(2)
+	} else {
+		if result.Label != "" {
+			log.Infof("Email %s use %s (%s) as next hop.", key, result.Target, result.Label)
+		} else {
+			log.Infof("Email %s use %s as next hop.", key, result.Target)
+		}
+	}
+}
+
+// getEmailDomain return domain of the email. Internationalized domain converted to A-label, local part can be UTF-8.
+// Domain keys Postfix may probe, "example.com" and parent domain ".example.com", return the domain.
 func getEmailDomain(email string) (string, error) {
 	splitedEmail := strings.Split(email, "@")
+	if len(splitedEmail) == 1 && isDomainKey(email) {
+		return toAsciiDomain(strings.TrimPrefix(email, "."))
+	}
 	if len(splitedEmail) != 2 {
-		errorMsg := fmt.Sprintf("Email address invalid: %v", email)
-		log.Warnln(errorMsg)
-		return "", errors.New(errorMsg)
+		return "", errors.New(fmt.Sprintf("Email address invalid: %v", email))
 	}
 
-	return splitedEmail[1], nil
+	return toAsciiDomain(splitedEmail[1])
+}
+
+func sortMx(mxs []*net.MX) {
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
 }
 
 func getMx(domain string) ([]*net.MX, error) {
-	// LookupMX will return a MX list sorted by priority. So no need to sort
-	mxs, err := net.LookupMX(domain)
+	mxs, err := lookupMX(domain)
 
 	if err != nil {
 		log.Warnf("Get MX error on %v: %v", domain, err)
@@ -207,81 +1256,218 @@ func isIpv4(ip net.IP) bool {
 	return true
 }
 
-func getIp(mx *net.MX) (net.IP, error) {
-	ips, err := net.LookupIP(mx.Host)
+// getIp return one usable IP of the MX host of the domain.
+func getIp(domain string, mx *net.MX) (net.IP, error) {
+	ips, err := lookupIP(mx.Host)
 	if err != nil {
 		log.Warnf("Get IP error on %v: %v", mx.Host, err)
-		return net.IP{}, errors.New(fmt.Sprint("Get IP error from MX record(s)."))
+		if isDnssecError(err) || isDnsFailure(err) {
+			return net.IP{}, err
+		}
+		return net.IP{}, errors.New("Get IP error from MX record(s).")
 	}
 
+	ips = selectIpsByFamily(filterUnusableIps(domain, mx.Host, ips))
 	length := len(ips)
 	switch {
-	// TODO: handle IPv4/IPv6
 	case length == 1:
 		return ips[0], nil
 	case length > 1:
 		// Get a random IP from IP slice
-		rand.Seed(time.Now().UnixNano())
-
-		// TODO: need extra check for ip correct?
-		return ips[rand.Intn(length)], nil
+		return ips[random.Intn(length)], nil
 	}
 
-	return net.IP{}, errors.New(fmt.Sprint("Can't get IP from \"%s\" MX record(s).", mx.Host))
+	return net.IP{}, fmt.Errorf("Can't get IP from %q MX record(s).", mx.Host)
 }
 
-func getCountryByIp(ipAddress net.IP) (string, error) {
-	// TODO: reduce read file. should read from cache by geoip2.FromBytes()
-	db, err := geoip2.Open("GeoLite2-Country.mmdb")
+// DB open modes.
+const (
+	// dbOpenMmap map DB file into memory, pages only loaded when used. Not supported on some platforms, read
+	// fully instead there.
+	dbOpenMmap = "mmap"
+	// dbOpenMemory read whole DB file into heap.
+	dbOpenMemory = "memory"
+)
+
+var dbOpenMode = dbOpenMmap
+
+func parseDbOpenMode(value string) (string, error) {
+	value = strings.ToLower(value)
+	switch value {
+	case dbOpenMmap, dbOpenMemory:
+		return value, nil
+	}
+	return "", errors.New(fmt.Sprintf("Invalid DB open mode: %s", value))
+}
+
+// openGeoipDb open mmdb file by DB open mode.
+func openGeoipDb(path string) (*geoip2.Reader, error) {
+	path, err := fetchDb(path)
 	if err != nil {
-		log.Fatalf("Open GeoIP DB file error: %s", err.Error())
+		return nil, err
 	}
-	defer db.Close()
+	if dbOpenMode == dbOpenMemory {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return geoip2.FromBytes(data)
+	}
+	return geoip2.Open(path)
+}
 
-	record, err := db.Country(ipAddress)
+// usingEmbeddedGeoipDb is true if --geoip-db can't be opened and embedded DB in use.
+var usingEmbeddedGeoipDb bool
+
+// openGeoipDbs open country DB, and ISP and Anonymous IP DB if configured. Fallback to embedded country DB if built with it.
+func openGeoipDbs() error {
+	db, err := openGeoipDb(geoipDbPath)
+	if err != nil && embeddedGeoipDb != nil {
+		log.Errorf("Open GeoIP DB file error: %s. USING EMBEDDED FALLBACK DB, decisions may be outdated.", err.Error())
+		db, err = geoip2.FromBytes(embeddedGeoipDb)
+		usingEmbeddedGeoipDb = err == nil
+	}
 	if err != nil {
-		log.Warnf("Get country error on %v: %v", ipAddress.String(), err)
+		return errors.New(fmt.Sprintf("Open GeoIP DB file error: %s", err.Error()))
+	}
+	countryDb = db
+	if !usingEmbeddedGeoipDb {
+		recordDbTime("country", geoipDbPath)
+	}
+
+	if ispDbPath != "" {
+		db, err := openGeoipDb(ispDbPath)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Open ISP DB file error: %s", err.Error()))
+		}
+		ispDb = db
+		recordDbTime("isp", ispDbPath)
+	}
+
+	if anonymousDbPath != "" {
+		db, err := openGeoipDb(anonymousDbPath)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Open Anonymous IP DB file error: %s", err.Error()))
+		}
+		if dbType := db.Metadata().DatabaseType; !strings.Contains(dbType, "Anonymous-IP") {
+			return errors.New(fmt.Sprintf("--anonymous-ip-db is %s DB, not Anonymous IP DB.", dbType))
+		}
+		anonymousDb = db
+		recordDbTime("anonymous", anonymousDbPath)
+	}
+	return nil
+}
+
+func getCountryByIp(ipAddress net.IP) (string, error) {
+	if err := chaosGeoipMiss(ipAddress); err != nil {
 		return "", err
 	}
+	code := ""
+	if fixtures != nil {
+		fixtureCode, err := fixtureCountry(ipAddress)
+		if err != nil {
+			return "", err
+		}
+		code = fixtureCode
+	} else {
+		record, err := getCountryDb().Country(ipAddress)
+		if err != nil {
+			log.Warnf("Get country error on %v: %v", ipAddress.String(), err)
+			return "", err
+		}
+		code = record.Country.IsoCode
+	}
 
-	return record.Country.IsoCode, nil
+	country, ok := normalizeCountry(code)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("%s has no country in GeoIP DB", ipAddress.String()))
+	}
+	if country != code {
+		log.Debugf("GeoIP country %q of %s normalized to %s", code, ipAddress.String(), country)
+	}
+	return country, nil
 }
 
-func genPostfixResponse(destination string) string {
-	return fmt.Sprintf("200 relay:[%s]\n", destination)
+// getIspByIp return ASN and all known provider names of the IP. Which fields available depends on DB type.
+func getIspByIp(ipAddress net.IP) (uint, []string, error) {
+	names := []string{}
+	ispDb := getIspDb()
+	dbType := ispDb.Metadata().DatabaseType
+
+	switch {
+	case strings.Contains(dbType, "Enterprise"):
+		record, err := ispDb.Enterprise(ipAddress)
+		if err != nil {
+			log.Warnf("Get ISP error on %v: %v", ipAddress.String(), err)
+			return 0, names, err
+		}
+		names = append(names, record.Traits.ISP, record.Traits.Organization, record.Traits.AutonomousSystemOrganization)
+		return record.Traits.AutonomousSystemNumber, names, nil
+	case strings.Contains(dbType, "ISP"):
+		record, err := ispDb.ISP(ipAddress)
+		if err != nil {
+			log.Warnf("Get ISP error on %v: %v", ipAddress.String(), err)
+			return 0, names, err
+		}
+		names = append(names, record.ISP, record.Organization, record.AutonomousSystemOrganization)
+		return record.AutonomousSystemNumber, names, nil
+	default:
+		record, err := ispDb.ASN(ipAddress)
+		if err != nil {
+			log.Warnf("Get ISP error on %v: %v", ipAddress.String(), err)
+			return 0, names, err
+		}
+		names = append(names, record.AutonomousSystemOrganization)
+		return record.AutonomousSystemNumber, names, nil
+	}
 }
 
-func getResult(email string) string {
-	rand.Seed(time.Now().UnixNano())
-	destination := destinationMap[defaultTarget][rand.Intn(len(destinationMap[defaultTarget]))]
+func genPostfixResponse(result decision) string {
+	switch result.Action {
+	case failTemp:
+		return fmt.Sprintf("400 %s\n", failureText(result))
+	case failNotFound:
+		return fmt.Sprintf("500 %s\n", failureText(result))
+	}
+	return fmt.Sprintf("200 %s\n", transportValue(result))
+}
 
-	domain, domainErr := getEmailDomain(email)
-	if domainErr != nil {
-		return destination
+// transportValue return Postfix transport map value of the decision, e.g. "relay:[mta1]".
+func transportValue(result decision) string {
+	if result.Nexthop == "" {
+		return fmt.Sprintf("relay:[%s]", result.Target)
 	}
+	return result.Nexthop
+}
 
-	mxs, mxErr := getMx(domain)
-	if mxErr != nil {
-		return destination
+func failureText(result decision) string {
+	return fmt.Sprintf("%s: %s lookup failed", result.ErrorCode, result.Failure)
+}
+
+// getWebCountry geolocate domain apex or www A record. Only used when --web-fallback enabled.
+func getWebCountry(domain string) (string, bool) {
+	if !webFallback {
+		return "", false
 	}
 
-	for _, mx := range mxs {
-		ip, ipErr := getIp(mx)
-		if ipErr != nil {
+	for _, host := range []string{domain, "www." + domain} {
+		ips, err := lookupIP(host)
+		if err != nil {
 			continue
 		}
-
-		country, countryErr := getCountryByIp(ip)
-		if countryErr != nil {
+		ips = filterUnusableIps(domain, host, ips)
+		if len(ips) < 1 {
 			continue
 		}
 
-		log.Infof("Got country code: %s for domain:%s", country, domain)
-		if value, ok := destinationMap[country]; ok {
-			destination = value[rand.Intn(len(value))]
+		country, err := getCountryByIp(ips[random.Intn(len(ips))])
+		if err != nil {
+			continue
 		}
-		break
+
+		log.Infof("MX of domain:%s can't be geolocated, use country code: %s from %s A record", domain, country, host)
+		return country, true
 	}
 
-	return destination
+	return "", false
 }
@@ -0,0 +1,137 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+var adminListen string
+
+// staticMode is 1 when all queries answered by default target without DNS and GeoIP lookup.
+var staticMode int32
+
+func isStaticMode() bool {
+	return atomic.LoadInt32(&staticMode) == 1
+}
+
+// setStaticMode change static mode. Cached decisions purged, so none made in the other mode is served.
+func setStaticMode(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&staticMode, 1)
+	} else {
+		atomic.StoreInt32(&staticMode, 0)
+	}
+	decisionCache.purge()
+	log.Warnf("Static mode set to %v.", enabled)
+	notifyChange(changeStatic, "", strconv.FormatBool(enabled))
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJsonError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
+
+// adminStaticHandler GET return static mode status. PUT/POST with "enabled=true|false" change it.
+func adminStaticHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, "Invalid enabled value.")
+			return
+		}
+		previous := isStaticMode()
+		setStaticMode(enabled)
+		auditRequest(r, "static", "", "", previous, enabled)
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]bool{"enabled": isStaticMode()})
+}
+
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/static", adminStaticHandler)
+	mux.HandleFunc("/admin/drain", adminDrainHandler)
+	mux.HandleFunc("/admin/country-switch", adminCountrySwitchHandler)
+	mux.HandleFunc("/admin/demote", adminDemoteHandler)
+	mux.HandleFunc("/admin/plugin/reload", adminPluginReloadHandler)
+	mux.HandleFunc("/admin/shadow", adminShadowHandler)
+	mux.HandleFunc("/admin/capture", adminCaptureHandler)
+	mux.HandleFunc("/admin/slow", adminSlowHandler)
+	mux.HandleFunc("/admin/ambiguous", adminAmbiguousHandler)
+	mux.HandleFunc("/admin/unmapped", adminUnmappedHandler)
+	mux.HandleFunc("/admin/pin", adminPinHandler)
+	mux.HandleFunc("/admin/export", adminExportHandler)
+	mux.HandleFunc("/admin/audit", adminAuditHandler)
+	mux.HandleFunc("/admin/stats", adminStatsHandler)
+	mux.HandleFunc("/admin/clients", adminClientsHandler)
+	mux.HandleFunc("/admin/relay-feedback", adminRelayFeedbackHandler)
+	mux.HandleFunc("/admin/dashboard", adminDashboardHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/admin/rule-hits", adminRuleHitsHandler)
+	mux.HandleFunc("/admin/config", adminConfigHandler)
+	mux.HandleFunc("/admin/log", adminLogHandler)
+	mux.HandleFunc("/admin/reload", adminReloadHandler)
+	mux.HandleFunc("/admin/reload/confirm", adminReloadConfirmHandler)
+	mux.HandleFunc("/admin/apply", adminApplyHandler)
+	mux.HandleFunc("/admin/blue-green", adminBlueGreenHandler)
+	mux.HandleFunc("/admin/blue-green/rollback", adminBlueGreenRollbackHandler)
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/lookup", bulkLookupHandler)
+	mux.HandleFunc("/lookup/", lookupHandler)
+	mux.HandleFunc("/cache", cacheHandler)
+	mux.HandleFunc("/cache/", cacheHandler)
+	return mux
+}
+
+func startAdminServer() {
+	if adminListen == "" {
+		return
+	}
+
+	// Listen before serve, so it is bound before privileges dropped.
+	listener, err := net.Listen("tcp", adminListen)
+	if err != nil {
+		log.Fatalf("Admin API listen %s error: %s", adminListen, err.Error())
+	}
+	if adminTlsConfig != nil {
+		listener = tls.NewListener(listener, adminTlsConfig)
+	}
+	log.Infof("Admin API listen on %s.", adminListen)
+	go func() {
+		err := http.Serve(listener, adminAuthHandler(newAdminMux()))
+		if err != nil {
+			log.Fatalf("Admin API serve %s error: %s", adminListen, err.Error())
+		}
+	}()
+}
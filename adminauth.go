@@ -0,0 +1,231 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Admin API scopes. Read scope can use GET of every endpoint and lookups, write scope also change state, e.g. drain,
+// pin, reload and static mode.
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+// adminToken is a token of --admin-token and its scope.
+type adminToken struct {
+	scope string
+	token string
+}
+
+var adminTokens []adminToken
+
+// adminTlsConfig is TLS config of admin API, nil for plain HTTP.
+var adminTlsConfig *tls.Config
+
+// adminWriteCns are common names of client certificates with write scope. Other verified certificates have read scope.
+var adminWriteCns = make(map[string]bool)
+
+var adminAuthFailures uint64
+
+type adminPrincipalKey struct{}
+
+// adminAuthEnabled is true if token or client certificate needed.
+func adminAuthEnabled() bool {
+	return len(adminTokens) > 0 || (adminTlsConfig != nil && adminTlsConfig.ClientCAs != nil)
+}
+
+// parseAdminTokenFlag parse "SCOPE=SECRET", SECRET can be secret reference.
+func parseAdminTokenFlag(value string) (adminToken, error) {
+	splitedValue := strings.SplitN(value, "=", 2)
+	if len(splitedValue) != 2 || splitedValue[1] == "" {
+		return adminToken{}, errors.New(fmt.Sprintf(`Invalid admin token format, must be "read=SECRET" or "write=SECRET": %s`, redactAdminTokenFlag(value)))
+	}
+	scope := strings.ToLower(splitedValue[0])
+	if scope != scopeRead && scope != scopeWrite {
+		return adminToken{}, errors.New(fmt.Sprintf(`Unknown admin token scope %s, must be "read" or "write".`, splitedValue[0]))
+	}
+	token, err := resolveSecret("admin-token", splitedValue[1])
+	if err != nil {
+		return adminToken{}, err
+	}
+	return adminToken{scope: scope, token: token}, nil
+}
+
+// redactAdminTokenFlag hide literal secret of "SCOPE=SECRET", keep secret reference.
+func redactAdminTokenFlag(value string) string {
+	splitedValue := strings.SplitN(value, "=", 2)
+	if len(splitedValue) == 2 && isSecretReference(splitedValue[1]) {
+		return value
+	}
+	return splitedValue[0] + "=<redacted>"
+}
+
+// setupAdminAuth load tokens, and TLS certificates before privileges dropped.
+func setupAdminAuth(tokens []string, certFile string, keyFile string, clientCaFile string, writeCns []string) error {
+	for _, value := range tokens {
+		token, err := parseAdminTokenFlag(value)
+		if err != nil {
+			return err
+		}
+		adminTokens = append(adminTokens, token)
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("Need both --admin-tls-cert and --admin-tls-key.")
+	}
+	if clientCaFile != "" && certFile == "" {
+		return errors.New("--admin-client-ca need --admin-tls-cert and --admin-tls-key.")
+	}
+	if len(writeCns) > 0 && clientCaFile == "" {
+		return errors.New("--admin-write-cn need --admin-client-ca.")
+	}
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Load admin TLS certificate error: %s", err.Error()))
+		}
+		adminTlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	}
+	if clientCaFile != "" {
+		data, err := ioutil.ReadFile(clientCaFile)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Read admin client CA error: %s", err.Error()))
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New(fmt.Sprintf("No certificate in admin client CA %s.", clientCaFile))
+		}
+		adminTlsConfig.ClientCAs = pool
+		// Token still usable without certificate, if any configured.
+		adminTlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if len(adminTokens) < 1 {
+			adminTlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	for _, cn := range writeCns {
+		adminWriteCns[cn] = true
+	}
+	if adminAuthEnabled() {
+		log.Infof("Admin API need authentication, %d token(s), client certificate: %v.", len(adminTokens), clientCaFile != "")
+	}
+	return nil
+}
+
+// requiredScope return scope of the request. Lookups are read, though bulk lookup is POST.
+func requiredScope(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return scopeRead
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/lookup" {
+		return scopeRead
+	}
+	return scopeWrite
+}
+
+// requestToken return bearer token, or password of basic auth, which browsers can send for the dashboard.
+func requestToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if strings.HasPrefix(header, "Basic ") {
+		credentials, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Basic "))
+		if err == nil {
+			if sepIndex := strings.Index(string(credentials), ":"); sepIndex >= 0 {
+				return string(credentials[sepIndex+1:])
+			}
+		}
+	}
+	return ""
+}
+
+// authenticateAdmin return principal and scope of the request, from client certificate or token. Empty scope if none
+// valid.
+func authenticateAdmin(r *http.Request) (string, string) {
+	return authenticateCredentials(r.TLS, requestToken(r))
+}
+
+// authenticateCredentials return principal and scope of verified client certificate of the connection, or token.
+// Shared by admin API and gRPC API.
+func authenticateCredentials(state *tls.ConnectionState, token string) (string, string) {
+	if state != nil && len(state.VerifiedChains) > 0 {
+		cn := state.VerifiedChains[0][0].Subject.CommonName
+		if adminWriteCns[cn] {
+			return "cert:" + cn, scopeWrite
+		}
+		return "cert:" + cn, scopeRead
+	}
+	if token == "" {
+		return "", ""
+	}
+	for index, candidate := range adminTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate.token)) == 1 {
+			return fmt.Sprintf("token:%s#%d", candidate.scope, index+1), candidate.scope
+		}
+	}
+	return "", ""
+}
+
+// adminPrincipal return authenticated principal of the request, e.g. "cert:ops" or "token:write#1". Empty if
+// authentication disabled.
+func adminPrincipal(r *http.Request) string {
+	principal, _ := r.Context().Value(adminPrincipalKey{}).(string)
+	return principal
+}
+
+// adminAuthHandler check token or client certificate, and scope of the request. /health is open for probes.
+func adminAuthHandler(next http.Handler) http.Handler {
+	if !adminAuthEnabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		principal, scope := authenticateAdmin(r)
+		required := requiredScope(r)
+		if scope == "" {
+			atomic.AddUint64(&adminAuthFailures, 1)
+			log.Debugf("Admin API %s %s from %s not authenticated.", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer, Basic realm="GeoIpTransportMap admin"`)
+			writeJsonError(w, http.StatusUnauthorized, "Authentication required.")
+			return
+		}
+		if required == scopeWrite && scope != scopeWrite {
+			atomic.AddUint64(&adminAuthFailures, 1)
+			log.Warnf("Admin API %s %s from %s denied, %s has no write scope.", r.Method, r.URL.Path, r.RemoteAddr, principal)
+			writeJsonError(w, http.StatusForbidden, "Write scope required.")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminPrincipalKey{}, principal)))
+	})
+}
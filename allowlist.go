@@ -0,0 +1,96 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Country allow-list mode relay only to recipient MX in listed countries, for senders only licensed to deliver into
+// some markets. Other countries get the disallowed reply of the rule set instead of a target.
+
+// defaultDisallowedReply bounce the mail. "retry:4.7.1 ..." defer it instead.
+const defaultDisallowedReply = "error:5.7.1 Destination country not allowed"
+
+// parseAllowCountries parse "XX[,XX...]" values. Return nil if none, all countries allowed then.
+func parseAllowCountries(values []string) (map[string]bool, error) {
+	if len(values) < 1 {
+		return nil, nil
+	}
+	countries := make(map[string]bool)
+	for _, value := range values {
+		for _, country := range strings.Split(value, ",") {
+			country = strings.ToUpper(strings.TrimSpace(country))
+			if err := validateCountryCode(country); err != nil {
+				return nil, newConfigError("allow-country", value, err)
+			}
+			countries[country] = true
+		}
+	}
+	return countries, nil
+}
+
+// parseDisallowedReply check reply is a Postfix transport value like "error:5.7.1 text".
+func parseDisallowedReply(value string) (string, error) {
+	if value == "" {
+		return defaultDisallowedReply, nil
+	}
+	if !strings.Contains(value, ":") {
+		return "", errors.New(fmt.Sprintf("Disallowed reply %s has no transport.", value))
+	}
+	return value, nil
+}
+
+func (rs *ruleSet) getAllowCountries() []string {
+	countries := make([]string, 0, len(rs.allowCountries))
+	for country := range rs.allowCountries {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	return countries
+}
+
+// applyAllowList replace relay decision to a country not in allow-list with disallowed reply. Applied after decision
+// cache like country switch, so allow-list change take effect immediately. Pinned domains and special keys are chosen
+// by operator, so exempt. Unknown country, e.g. resolvers failed, static mode or MX can't be geolocated, is deferred,
+// not bounced, as it may be allowed.
+func applyAllowList(rs *ruleSet, d *decision) {
+	if rs.allowCountries == nil || d.Action != "" || rs.allowCountries[d.Country] || d.Rule == "pin" || d.Rule == "special" {
+		return
+	}
+
+	if d.Country == "" {
+		d.Trace = append(d.Trace, "allow-list: country unknown, deferred")
+		d.Action = failTemp
+		d.Failure = "country"
+		d.ErrorCode = errorCountryUnverified
+		d.Rule = "allow_list"
+		return
+	}
+
+	d.Trace = append(d.Trace, fmt.Sprintf("allow-list: %s not allowed, reply %s instead of %s", d.Country, rs.disallowedReply, d.Target))
+	d.Target = ""
+	d.Pool = nil
+	d.Label = ""
+	d.Nexthop = rs.disallowedReply
+	d.ErrorCode = errorCountryNotAllowed
+	d.Rule = "allow_list"
+	d.matchKey = ""
+}
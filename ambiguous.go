@@ -0,0 +1,152 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ambiguousMax is max number of ambiguous domains kept. Least recently seen dropped first.
+const ambiguousMax = 1000
+
+var ambiguousReportInterval time.Duration
+var ambiguousLookups uint64
+
+// ambiguousDomain is a domain whose MX hosts geolocate to different countries.
+type ambiguousDomain struct {
+	Domain    string    `json:"domain"`
+	Countries []string  `json:"countries"`
+	Count     uint64    `json:"count"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+var ambiguousDomains = struct {
+	sync.Mutex
+	domains map[string]*ambiguousDomain
+}{domains: make(map[string]*ambiguousDomain)}
+
+// recordAmbiguous record the domain if its MX countries disagree.
+func recordAmbiguous(domain string, countries []string) {
+	if len(countries) < 2 {
+		return
+	}
+	atomic.AddUint64(&ambiguousLookups, 1)
+
+	sorted := append([]string{}, countries...)
+	sort.Strings(sorted)
+
+	ambiguousDomains.Lock()
+	defer ambiguousDomains.Unlock()
+	entry, ok := ambiguousDomains.domains[domain]
+	if !ok {
+		if len(ambiguousDomains.domains) >= ambiguousMax {
+			dropOldestAmbiguous()
+		}
+		entry = &ambiguousDomain{Domain: domain}
+		ambiguousDomains.domains[domain] = entry
+	}
+	entry.Countries = sorted
+	entry.Count++
+	entry.LastSeen = time.Now()
+}
+
+// dropOldestAmbiguous must be called with ambiguousDomains locked.
+func dropOldestAmbiguous() {
+	oldest := ""
+	for domain, entry := range ambiguousDomains.domains {
+		if oldest == "" || entry.LastSeen.Before(ambiguousDomains.domains[oldest].LastSeen) {
+			oldest = domain
+		}
+	}
+	delete(ambiguousDomains.domains, oldest)
+}
+
+// getAmbiguousDomains return ambiguous domains, most seen first.
+func getAmbiguousDomains() []ambiguousDomain {
+	ambiguousDomains.Lock()
+	domains := make([]ambiguousDomain, 0, len(ambiguousDomains.domains))
+	for _, entry := range ambiguousDomains.domains {
+		domains = append(domains, *entry)
+	}
+	ambiguousDomains.Unlock()
+
+	sort.Slice(domains, func(i, j int) bool {
+		if domains[i].Count != domains[j].Count {
+			return domains[i].Count > domains[j].Count
+		}
+		return domains[i].Domain < domains[j].Domain
+	})
+	return domains
+}
+
+func countAmbiguousDomains() int {
+	ambiguousDomains.Lock()
+	defer ambiguousDomains.Unlock()
+	return len(ambiguousDomains.domains)
+}
+
+// startAmbiguousReport log ambiguous domains every ambiguousReportInterval, to add explicit mapping for them.
+func startAmbiguousReport() {
+	if ambiguousReportInterval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(ambiguousReportInterval) {
+			domains := getAmbiguousDomains()
+			if len(domains) == 0 {
+				continue
+			}
+			lines := make([]string, 0, len(domains))
+			for _, entry := range domains {
+				lines = append(lines, entry.Domain+"="+strings.Join(entry.Countries, "|"))
+			}
+			log.WithFields(log.Fields{
+				"domains": lines,
+				"lookups": atomic.LoadUint64(&ambiguousLookups),
+			}).Warn("Domains with MX hosts in different countries.")
+		}
+	}()
+}
+
+// adminAmbiguousHandler GET return domains with MX hosts in different countries.
+func adminAmbiguousHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"lookups": atomic.LoadUint64(&ambiguousLookups),
+		"domains": getAmbiguousDomains(),
+	})
+}
+
+func containsString(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Routing anomaly detection compare per country share of decisions of each interval with its exponentially weighted
+// mean and variance of past intervals. A sudden shift, e.g. a country disappear after GeoIP DB update, DNS hijack
+// route domains to one country, or a broken reload, is logged and counted.
+
+var anomalyInterval time.Duration
+var anomalyZScore float64
+
+const (
+	// anomalyMinDecisions is min decisions of an interval of a rule set to check, small samples are noisy.
+	anomalyMinDecisions = 100
+	// anomalyWarmup is intervals before checking, so mean and variance are learned.
+	anomalyWarmup = 12
+	// anomalyAlpha is weight of newest interval in mean and variance.
+	anomalyAlpha = 0.1
+	// anomalyMinStddev is floor of share standard deviation, so stable shares don't flag on tiny moves.
+	anomalyMinStddev = 0.01
+	// anomalyRecent is number of recent anomalies kept for stats.
+	anomalyRecent = 20
+	// anomalyNoCountry is country key of decisions without country, e.g. DNS failures.
+	anomalyNoCountry = "none"
+)
+
+type shareBaseline struct {
+	mean     float64
+	variance float64
+}
+
+type routingAnomaly struct {
+	Time     time.Time `json:"time"`
+	RuleSet  string    `json:"rule_set"`
+	Country  string    `json:"country"`
+	Share    float64   `json:"share"`
+	Expected float64   `json:"expected"`
+	ZScore   float64   `json:"z_score"`
+}
+
+type ruleSetDistribution struct {
+	// counts of current interval by country.
+	counts    map[string]uint64
+	baselines map[string]*shareBaseline
+	intervals int
+}
+
+var routingDistribution = struct {
+	sync.Mutex
+	ruleSets map[string]*ruleSetDistribution
+	recent   []routingAnomaly
+	// anomalies count by rule set and country, for metrics.
+	anomalies map[[2]string]uint64
+}{ruleSets: make(map[string]*ruleSetDistribution), anomalies: make(map[[2]string]uint64)}
+
+func validateAnomalyFlags() error {
+	if anomalyZScore < 0 {
+		return errors.New("Anomaly z-score must not be negative.")
+	}
+	if anomalyZScore > 0 && anomalyInterval < time.Minute {
+		return errors.New(fmt.Sprintf("Anomaly interval %v too short, must be at least 1m.", anomalyInterval))
+	}
+	return nil
+}
+
+// recordDistribution count country of a decision in current interval.
+func recordDistribution(d decision) {
+	if anomalyZScore <= 0 {
+		return
+	}
+	country := d.Country
+	if country == "" {
+		country = anomalyNoCountry
+	}
+
+	routingDistribution.Lock()
+	defer routingDistribution.Unlock()
+	distribution, ok := routingDistribution.ruleSets[d.RuleSet]
+	if !ok {
+		distribution = &ruleSetDistribution{counts: make(map[string]uint64), baselines: make(map[string]*shareBaseline)}
+		routingDistribution.ruleSets[d.RuleSet] = distribution
+	}
+	distribution.counts[country]++
+}
+
+// checkDistribution compare shares of the ended interval with baselines, then update baselines. Return anomalies,
+// sorted by rule set and country.
+func checkDistribution(now time.Time) []routingAnomaly {
+	routingDistribution.Lock()
+	defer routingDistribution.Unlock()
+
+	anomalies := []routingAnomaly{}
+	for ruleSetName, distribution := range routingDistribution.ruleSets {
+		var total uint64
+		for _, count := range distribution.counts {
+			total += count
+		}
+		// Skip quiet intervals entirely, they neither flag nor teach the baseline.
+		if total < anomalyMinDecisions {
+			distribution.counts = make(map[string]uint64)
+			continue
+		}
+
+		countries := make(map[string]bool)
+		for country := range distribution.counts {
+			countries[country] = true
+		}
+		for country := range distribution.baselines {
+			countries[country] = true
+		}
+		for country := range countries {
+			share := float64(distribution.counts[country]) / float64(total)
+			baseline, ok := distribution.baselines[country]
+			if !ok {
+				// Before first interval share is unknown, not 0, so start from it.
+				baseline = &shareBaseline{}
+				if distribution.intervals == 0 {
+					baseline.mean = share
+				}
+				distribution.baselines[country] = baseline
+			}
+			if distribution.intervals >= anomalyWarmup {
+				stddev := math.Max(math.Sqrt(baseline.variance), anomalyMinStddev)
+				zScore := (share - baseline.mean) / stddev
+				if math.Abs(zScore) >= anomalyZScore {
+					anomalies = append(anomalies, routingAnomaly{Time: now, RuleSet: ruleSetName, Country: country, Share: share, Expected: baseline.mean, ZScore: zScore})
+				}
+			}
+			// Exponentially weighted mean and variance.
+			diff := share - baseline.mean
+			increment := anomalyAlpha * diff
+			baseline.mean += increment
+			baseline.variance = (1 - anomalyAlpha) * (baseline.variance + diff*increment)
+		}
+		distribution.intervals++
+		distribution.counts = make(map[string]uint64)
+	}
+
+	sort.Slice(anomalies, func(i, j int) bool {
+		if anomalies[i].RuleSet != anomalies[j].RuleSet {
+			return anomalies[i].RuleSet < anomalies[j].RuleSet
+		}
+		return anomalies[i].Country < anomalies[j].Country
+	})
+	for _, anomaly := range anomalies {
+		routingDistribution.anomalies[[2]string{anomaly.RuleSet, anomaly.Country}]++
+	}
+	routingDistribution.recent = append(routingDistribution.recent, anomalies...)
+	if len(routingDistribution.recent) > anomalyRecent {
+		routingDistribution.recent = routingDistribution.recent[len(routingDistribution.recent)-anomalyRecent:]
+	}
+	return anomalies
+}
+
+func startAnomalyCheck() {
+	if anomalyZScore <= 0 {
+		return
+	}
+
+	go func() {
+		for now := range time.Tick(anomalyInterval) {
+			for _, anomaly := range checkDistribution(now) {
+				log.WithFields(log.Fields{
+					"rule_set": anomaly.RuleSet,
+					"country":  anomaly.Country,
+					"share":    anomaly.Share,
+					"expected": anomaly.Expected,
+					"z_score":  anomaly.ZScore,
+				}).Warn("Routing distribution anomaly, check GeoIP DB, resolvers and recent reloads.")
+			}
+		}
+	}()
+}
+
+func getAnomalyStats() map[string]interface{} {
+	if anomalyZScore <= 0 {
+		return nil
+	}
+	routingDistribution.Lock()
+	defer routingDistribution.Unlock()
+	var count uint64
+	for _, value := range routingDistribution.anomalies {
+		count += value
+	}
+	return map[string]interface{}{
+		"count":  count,
+		"recent": append([]routingAnomaly{}, routingDistribution.recent...),
+	}
+}
+
+func (m *metricsWriter) writeAnomalyMetrics() {
+	routingDistribution.Lock()
+	defer routingDistribution.Unlock()
+	keys := make([][2]string, 0, len(routingDistribution.anomalies))
+	for key := range routingDistribution.anomalies {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	m.family("routing_anomalies", "counter", "Country share shifts beyond --anomaly-z-score by rule set and country.")
+	for _, key := range keys {
+		m.sample("routing_anomalies_total", []string{"rule_set", key[0], "country", key[1]}, float64(routingDistribution.anomalies[key]))
+	}
+}
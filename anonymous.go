@@ -0,0 +1,128 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/oschwald/geoip2-golang"
+	"net"
+	"strings"
+	"time"
+)
+
+var anonymousDbPath string
+var anonymousDb *geoip2.Reader
+
+// anonymousFlags of GeoIP2 Anonymous IP DB, most specific first. "anonymous" is set for any of the others, except
+// hosting. Anonymous rule use target of first flag of MX IPs in this order.
+var anonymousFlags = []string{"tor", "public_proxy", "residential_proxy", "vpn", "hosting", "anonymous"}
+
+func getAnonymousDb() *geoip2.Reader {
+	geoipDbLock.RLock()
+	defer geoipDbLock.RUnlock()
+	return anonymousDb
+}
+
+// parseAnonymousMapping parse "FLAG:MTA".
+func parseAnonymousMapping(value string) (string, string, error) {
+	flag, target, ok := splitMapping(value)
+	if !ok || len(target) < 1 {
+		return "", "", errors.New(fmt.Sprintf("Invalid anonymous mapping format: %s", value))
+	}
+	flag = strings.ToLower(strings.TrimSpace(flag))
+	if !containsString(anonymousFlags, flag) {
+		return "", "", errors.New(fmt.Sprintf("Unknown anonymous flag on %s, must be one of: %s", value, strings.Join(anonymousFlags, ", ")))
+	}
+	return flag, target, nil
+}
+
+// getAnonymousByIp return flags of the IP in Anonymous IP DB, in anonymousFlags order. Empty if not listed.
+func getAnonymousByIp(ipAddress net.IP) ([]string, error) {
+	record, err := getAnonymousDb().AnonymousIP(ipAddress)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]bool{
+		"tor":               record.IsTorExitNode,
+		"public_proxy":      record.IsPublicProxy,
+		"residential_proxy": record.IsResidentialProxy,
+		"vpn":               record.IsAnonymousVPN,
+		"hosting":           record.IsHostingProvider,
+		"anonymous":         record.IsAnonymous,
+	}
+	flags := []string{}
+	for _, flag := range anonymousFlags {
+		if set[flag] {
+			flags = append(flags, flag)
+		}
+	}
+	return flags, nil
+}
+
+// getAnonymous return flags of all MX IPs in Anonymous IP DB, in anonymousFlags order.
+func (l *lookup) getAnonymous() []string {
+	if l.anonymousResolved {
+		return l.anonymous
+	}
+	l.anonymousResolved = true
+
+	if getAnonymousDb() == nil {
+		return l.anonymous
+	}
+
+	set := make(map[string]bool)
+	for _, ip := range l.getIps() {
+		start := time.Now()
+		flags, err := getAnonymousByIp(ip)
+		l.addTiming("anonymous", start)
+		if err != nil {
+			continue
+		}
+		if len(flags) > 0 {
+			l.tracef("MX IP %s flagged %s", ip.String(), strings.Join(flags, ", "))
+		}
+		for _, flag := range flags {
+			set[flag] = true
+		}
+	}
+	for _, flag := range anonymousFlags {
+		if set[flag] {
+			l.anonymous = append(l.anonymous, flag)
+		}
+	}
+	return l.anonymous
+}
+
+func matchAnonymousRule(l *lookup) ([]string, bool) {
+	if getAnonymousDb() == nil {
+		l.tracef("anonymous: no Anonymous IP DB")
+		return nil, false
+	}
+	if len(l.rules.anonymousMap) < 1 {
+		l.tracef("anonymous: no mapping")
+		return nil, false
+	}
+
+	for _, flag := range l.getAnonymous() {
+		if pool, ok := l.rules.anonymousMap[flag]; ok {
+			l.matchKey = "anonymous:" + flag
+			return pool, true
+		}
+	}
+	return nil, false
+}
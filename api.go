@@ -0,0 +1,62 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requestRuleSet return rule set in "rule_set" query parameter, or default rule set.
+func requestRuleSet(r *http.Request) (*ruleSet, bool) {
+	name := r.URL.Query().Get("rule_set")
+	if name == "" {
+		name = defaultRuleSetName
+	}
+	rs := getRuleSet(name)
+	return rs, rs != nil
+}
+
+// lookupHandler GET /lookup/{email} return decision of the email, same as Postfix query to the listener.
+// Not cached, not counted in stats, capture and shadow comparison, and not start sticky window.
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	email := strings.TrimPrefix(r.URL.Path, "/lookup/")
+	if email == "" {
+		writeJsonError(w, http.StatusBadRequest, "Missing email.")
+		return
+	}
+	rs, ok := requestRuleSet(r)
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, "Rule set not found.")
+		return
+	}
+
+	writeJson(w, http.StatusOK, lookupDecision(rs, email))
+}
+
+// lookupDecision return decision of the email like Postfix query, without cache and side effects.
+func lookupDecision(rs *ruleSet, email string) decision {
+	d := evaluate(rs, email)
+	applyDecisionLayers(rs, email, &d, time.Now(), false)
+	return d
+}
@@ -0,0 +1,433 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v1"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Apply push a rule set file to running daemon. Client first request a plan (dry run) with fingerprint of the rule
+// set it was made against, then apply with the fingerprint, so changes made by others after the plan are never
+// overwritten silently.
+
+// applyRequest is body of POST /admin/apply.
+type applyRequest struct {
+	RuleSet string `json:"rule_set"`
+	// Format is "conf", "yaml" or "json".
+	Format  string `json:"format"`
+	Content string `json:"content"`
+	DryRun  bool   `json:"dry_run"`
+	// Base is fingerprint returned by the plan. Apply refused if rule set changed since.
+	Base string `json:"base"`
+}
+
+type applyResult struct {
+	RuleSet string     `json:"rule_set"`
+	Base    string     `json:"base"`
+	Plan    []planItem `json:"plan"`
+	Applied bool       `json:"applied"`
+	// File is rule set file the content written to, empty if the rule set has no file.
+	File string `json:"file,omitempty"`
+}
+
+// planItem is one change of a config value. Action is "add", "change" or "delete".
+type planItem struct {
+	Action   string      `json:"action"`
+	Object   string      `json:"object"`
+	Previous interface{} `json:"previous,omitempty"`
+	New      interface{} `json:"new,omitempty"`
+}
+
+func jsonText(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+func (item planItem) String() string {
+	switch item.Action {
+	case "add":
+		return fmt.Sprintf("+ %s: %s", item.Object, jsonText(item.New))
+	case "delete":
+		return fmt.Sprintf("- %s: %s", item.Object, jsonText(item.Previous))
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", item.Object, jsonText(item.Previous), jsonText(item.New))
+}
+
+// planConfig return config of the rule set as plain JSON values, without source file.
+func planConfig(rs *ruleSet) map[string]interface{} {
+	config := rs.getConfig()
+	delete(config, "source")
+	data, _ := json.Marshal(config)
+	normalized := make(map[string]interface{})
+	json.Unmarshal(data, &normalized)
+	return normalized
+}
+
+// configFingerprint identify current config of the rule set.
+func configFingerprint(rs *ruleSet) string {
+	data, _ := json.Marshal(planConfig(rs))
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+func isEmptyValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func sortedKeys(maps ...map[string]interface{}) []string {
+	seen := make(map[string]bool)
+	keys := []string{}
+	for _, values := range maps {
+		for key := range values {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func appendPlanItem(plan []planItem, object string, previous interface{}, new interface{}) []planItem {
+	switch {
+	case isEmptyValue(previous) && isEmptyValue(new), reflect.DeepEqual(previous, new):
+		return plan
+	case isEmptyValue(previous):
+		return append(plan, planItem{Action: "add", Object: object, New: new})
+	case isEmptyValue(new):
+		return append(plan, planItem{Action: "delete", Object: object, Previous: previous})
+	}
+	return append(plan, planItem{Action: "change", Object: object, Previous: previous, New: new})
+}
+
+// planRuleSet return changes from current to candidate config. Map values, e.g. targets, compared per key.
+func planRuleSet(current *ruleSet, candidate *ruleSet) []planItem {
+	currentConfig := planConfig(current)
+	candidateConfig := planConfig(candidate)
+	plan := []planItem{}
+	for _, field := range sortedKeys(currentConfig, candidateConfig) {
+		currentMap, currentIsMap := currentConfig[field].(map[string]interface{})
+		candidateMap, candidateIsMap := candidateConfig[field].(map[string]interface{})
+		if !currentIsMap || !candidateIsMap {
+			plan = appendPlanItem(plan, field, currentConfig[field], candidateConfig[field])
+			continue
+		}
+		for _, key := range sortedKeys(currentMap, candidateMap) {
+			plan = appendPlanItem(plan, field+" "+key, currentMap[key], candidateMap[key])
+		}
+	}
+	return plan
+}
+
+// parseApplyContent load content as rule set. Includes are relative to directory of the rule set file, or working
+// directory if none.
+func parseApplyContent(name string, format string, content string) (*ruleSet, error) {
+	switch format {
+	case "conf", "yaml", "json":
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid format %q, must be conf, yaml or json.", format))
+	}
+	file, err := ioutil.TempFile("", "geoip-apply-*."+format)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(content)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	source := newRuleSetSource(file.Name())
+	source.includeDir = "."
+	if path, ok := ruleSetFiles[name]; ok {
+		source.includeDir = filepath.Dir(path)
+	}
+	rs, err := loadRuleSetSource(name, source)
+	if err == nil {
+		err = checkRuleSetDatabases(rs)
+	}
+	if err != nil {
+		return nil, errors.New(strings.Replace(err.Error(), file.Name(), "applied file", -1))
+	}
+	return rs, nil
+}
+
+// applyTargetFile return rule set file to write applied content to, empty if the rule set not loaded from file.
+func applyTargetFile(name string, format string) (string, error) {
+	path, ok := ruleSetFiles[name]
+	if !ok {
+		return "", nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", errors.New(fmt.Sprintf("Rule set %s loaded from directory %s, apply only replace a single file.", name, path))
+	}
+	if isStructuredRuleSetFile(path) == (format == "conf") {
+		return "", errors.New(fmt.Sprintf("Rule set file %s is not %s format.", path, format))
+	}
+	return path, nil
+}
+
+// writeApplyFile replace the rule set file, so reload and restart keep applied content.
+func writeApplyFile(path string, content string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// adminApplyHandler POST /admin/apply with applyRequest. Dry run return plan, otherwise replace the rule set and its
+// file at once, like a reload.
+func adminApplyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	request := applyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err.Error()))
+		return
+	}
+	if request.RuleSet == "" {
+		request.RuleSet = defaultRuleSetName
+	}
+	if isBlueGreenSlot(request.RuleSet) {
+		writeJsonError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Rule set %s is blue/green, apply to one of its rule sets.", request.RuleSet))
+		return
+	}
+	candidate, err := parseApplyContent(request.RuleSet, request.Format, request.Content)
+	if err != nil {
+		writeJsonError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	current := getRuleSet(request.RuleSet)
+	if current == nil {
+		writeJsonError(w, http.StatusNotFound, "Rule set not found.")
+		return
+	}
+	path, err := applyTargetFile(request.RuleSet, request.Format)
+	if err != nil {
+		writeJsonError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	result := applyResult{RuleSet: request.RuleSet, Base: configFingerprint(current), Plan: planRuleSet(current, candidate), File: path}
+	if request.DryRun {
+		writeJson(w, http.StatusOK, result)
+		return
+	}
+	if request.Base != "" && request.Base != result.Base {
+		writeJsonError(w, http.StatusConflict, "Rule set changed since plan, plan again.")
+		return
+	}
+	if len(result.Plan) == 0 {
+		writeJson(w, http.StatusOK, result)
+		return
+	}
+
+	if path != "" {
+		if err := writeApplyFile(path, request.Content); err != nil {
+			writeJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Write rule set file error: %s", err.Error()))
+			return
+		}
+	} else {
+		log.Warnf("Rule set %s has no rule set file, applied config is lost on restart.", request.RuleSet)
+	}
+	changes := []string{}
+	for _, item := range result.Plan {
+		log.Infof("Apply rule set %s: %s", request.RuleSet, item)
+		changes = append(changes, item.String())
+	}
+	reloadStatus.Lock()
+	applyRuleSets(map[string]*ruleSet{request.RuleSet: candidate})
+	reloadStatus.Unlock()
+	auditRequest(r, "apply", path, request.RuleSet, nil, changes)
+	result.Applied = true
+	writeJson(w, http.StatusOK, result)
+}
+
+func applyCommand() cli.Command {
+	return cli.Command{
+		Name:      "apply",
+		Usage:     "Push rule set file to running daemon, after showing plan of changes.",
+		ArgsUsage: "FILE",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "admin-url",
+				Usage: `Admin API of running daemon, e.g. "http://127.0.0.1:8080".`,
+			},
+			cli.StringFlag{
+				Name:  "admin-token",
+				Usage: `Token of admin API with write scope. Can be secret reference like "env:NAME".`,
+			},
+			cli.StringFlag{
+				Name:  "rule-set",
+				Usage: "Rule set name to replace.",
+				Value: defaultRuleSetName,
+			},
+			cli.BoolFlag{
+				Name:  "auto-approve",
+				Usage: "Apply without asking confirmation.",
+			},
+		},
+		Action: applyHandler,
+	}
+}
+
+// postApply send apply request to running daemon.
+func postApply(adminUrl string, token string, request applyRequest) (applyResult, error) {
+	result := applyResult{}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return result, err
+	}
+	httpRequest, err := http.NewRequest(http.MethodPost, strings.TrimRight(adminUrl, "/")+"/admin/apply", bytes.NewReader(body))
+	if err != nil {
+		return result, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(httpRequest)
+	if err != nil {
+		return result, err
+	}
+	defer response.Body.Close()
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return result, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return result, errors.New(fmt.Sprintf("Apply to %s error: %s %s", redactUrl(adminUrl), response.Status, strings.TrimSpace(string(body))))
+	}
+	err = json.Unmarshal(body, &result)
+	return result, err
+}
+
+// applyFormat return format of rule set file by extension.
+func applyFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	}
+	return "conf"
+}
+
+func applyHandler(c *cli.Context) error {
+	if c.String("admin-url") == "" || c.NArg() != 1 {
+		cli.ShowCommandHelp(c, "apply")
+		return errors.New("Need --admin-url and FILE.")
+	}
+	token := ""
+	if value := c.String("admin-token"); value != "" {
+		var err error
+		token, err = resolveSecret("admin-token", value)
+		if err != nil {
+			return err
+		}
+	}
+	content, err := ioutil.ReadFile(c.Args().First())
+	if err != nil {
+		return err
+	}
+	request := applyRequest{RuleSet: c.String("rule-set"), Format: applyFormat(c.Args().First()), Content: string(content), DryRun: true}
+
+	plan, err := postApply(c.String("admin-url"), token, request)
+	if err != nil {
+		return err
+	}
+	if len(plan.Plan) == 0 {
+		fmt.Printf("No changes. Rule set %s is up to date.\n", plan.RuleSet)
+		return nil
+	}
+	counts := make(map[string]int)
+	fmt.Printf("Rule set %s will be changed:\n", plan.RuleSet)
+	for _, item := range plan.Plan {
+		fmt.Printf("  %s\n", item)
+		counts[item.Action]++
+	}
+	fmt.Printf("\nPlan: %d to add, %d to change, %d to delete.\n", counts["add"], counts["change"], counts["delete"])
+	if plan.File == "" {
+		fmt.Println("Rule set has no rule set file on the daemon, applied config is lost on restart.")
+	}
+
+	if !c.Bool("auto-approve") {
+		fmt.Print("\nApply these changes? Only 'yes' will be accepted: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			return errors.New("Apply cancelled.")
+		}
+	}
+
+	request.DryRun = false
+	request.Base = plan.Base
+	result, err := postApply(c.String("admin-url"), token, request)
+	if err != nil {
+		return err
+	}
+	if !result.Applied {
+		fmt.Println("No changes applied.")
+		return nil
+	}
+	fmt.Printf("Applied %d change(s) to rule set %s.\n", len(result.Plan), result.RuleSet)
+	return nil
+}
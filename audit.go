@@ -0,0 +1,164 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Audit trail record who changed what at runtime, by admin API or signal, with previous and new values. Last
+// auditSize entries kept in memory for /admin/audit, all appended to --audit-log as JSON lines.
+
+var auditSize int
+
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Principal is authenticated admin API client, e.g. "cert:ops" or "token:write#1", "anonymous" if
+	// authentication disabled, or "signal:SIGHUP".
+	Principal string      `json:"principal"`
+	Remote    string      `json:"remote,omitempty"`
+	Action    string      `json:"action"`
+	Object    string      `json:"object,omitempty"`
+	RuleSet   string      `json:"rule_set,omitempty"`
+	Previous  interface{} `json:"previous"`
+	New       interface{} `json:"new"`
+}
+
+// auditBuffer is a ring buffer of last auditSize entries.
+var auditBuffer []auditEntry
+var auditNext int
+var auditLock sync.Mutex
+
+// auditFile is --audit-log, opened at startup before privileges dropped.
+var auditFile *os.File
+
+func openAuditLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Open audit log %s error: %s", path, err.Error()))
+	}
+	auditFile = file
+	return nil
+}
+
+// recordAudit keep and log a runtime change.
+func recordAudit(entry auditEntry) {
+	entry.Time = time.Now()
+	log.WithFields(log.Fields{
+		"principal": entry.Principal,
+		"remote":    entry.Remote,
+		"object":    entry.Object,
+		"rule_set":  entry.RuleSet,
+		"previous":  entry.Previous,
+		"new":       entry.New,
+	}).Infof("Audit: %s", entry.Action)
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if auditFile != nil {
+		encoder := json.NewEncoder(auditFile)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(entry); err != nil {
+			log.Errorf("Write audit log error: %s", err.Error())
+		}
+	}
+	if auditSize < 1 {
+		return
+	}
+	if len(auditBuffer) < auditSize {
+		auditBuffer = append(auditBuffer, entry)
+		return
+	}
+	auditBuffer[auditNext] = entry
+	auditNext = (auditNext + 1) % auditSize
+}
+
+// auditRequest record a change made by admin API request.
+func auditRequest(r *http.Request, action string, object string, ruleSet string, previous interface{}, new interface{}) {
+	principal := adminPrincipal(r)
+	if principal == "" {
+		principal = "anonymous"
+	}
+	recordAudit(auditEntry{Principal: principal, Remote: r.RemoteAddr, Action: action, Object: object, RuleSet: ruleSet, Previous: previous, New: new})
+}
+
+// getAuditEntries return last limit entries matching action (all if empty), oldest first. limit < 1 return all.
+func getAuditEntries(limit int, action string) []auditEntry {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	entries := make([]auditEntry, 0, len(auditBuffer))
+	for _, entry := range append(append([]auditEntry{}, auditBuffer[auditNext:]...), auditBuffer[:auditNext]...) {
+		if action == "" || entry.Action == action {
+			entries = append(entries, entry)
+		}
+	}
+	if limit > 0 && limit < len(entries) {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries
+}
+
+// adminAuditHandler GET return audit trail. Optional "limit=N" return last N only, "action=drain" only that action.
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	limit := 0
+	if value := r.FormValue("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, "Invalid limit value.")
+			return
+		}
+		limit = parsed
+	}
+
+	writeJson(w, http.StatusOK, map[string][]auditEntry{"entries": getAuditEntries(limit, r.FormValue("action"))})
+}
+
+// auditValue return value if ok, nil otherwise, so absent previous value is null.
+func auditValue(value interface{}, ok bool) interface{} {
+	if !ok {
+		return nil
+	}
+	return value
+}
+
+// reloadChanges flatten changes of reload as "RULE_SET: CHANGE".
+func reloadChanges(diffs []ruleSetDiff) []string {
+	changes := []string{}
+	for _, diff := range diffs {
+		for _, change := range diff.Changes {
+			changes = append(changes, diff.RuleSet+": "+change)
+		}
+	}
+	return changes
+}
@@ -0,0 +1,72 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// authToken is shared secret each connection must send as first line "auth TOKEN" before lookups. Empty to disable.
+// Postfix itself can't send it, only for clients (or a proxy in front of Postfix) that can.
+var authToken string
+var authTimeout time.Duration
+var authFailures uint64
+
+// loadAuthToken read token from file, so it is not shown in process list.
+func loadAuthToken(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Read auth token file error: %s", err.Error()))
+	}
+	authToken = strings.TrimSpace(string(data))
+	if authToken == "" {
+		return errors.New(fmt.Sprintf("Auth token file %s is empty.", path))
+	}
+	log.Info("Connections need auth token.")
+	return nil
+}
+
+// authenticate read "auth TOKEN" line within auth timeout, and reply "200 ok" or "500 authentication failed".
+func authenticate(conn net.Conn, reader *bufio.Reader) bool {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	data, err := reader.ReadSlice('\n')
+	conn.SetReadDeadline(time.Time{})
+
+	token := strings.TrimPrefix(strings.TrimRight(string(data), "\r\n"), "auth ")
+	if err == nil && strings.HasPrefix(string(data), "auth ") && subtle.ConstantTimeCompare([]byte(token), []byte(authToken)) == 1 {
+		conn.Write([]byte("200 ok\n"))
+		return true
+	}
+
+	atomic.AddUint64(&authFailures, 1)
+	reason := "invalid token"
+	if err != nil {
+		reason = err.Error()
+	}
+	log.Warnf("Authentication of %v failed: %s", conn.RemoteAddr(), reason)
+	conn.Write([]byte("500 authentication failed\n"))
+	return false
+}
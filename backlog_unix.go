@@ -0,0 +1,47 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+// setListenBacklog call listen(2) again on the listening socket, which update its backlog.
+func setListenBacklog(listener net.Listener, backlog int) error {
+	rawListener, ok := listener.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rawConn, err := rawListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	err = rawConn.Control(func(fd uintptr) {
+		listenErr = unix.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Balance strategies of picking a target from a pool.
+const (
+	balanceRandom = "random"
+	// balanceLeastRecent pick target not selected for longest, so small pools don't get random streaks.
+	balanceLeastRecent = "least-recent"
+	// balanceLatency prefer target with lower delivery latency and deferral rate of the country, by relay feedback.
+	balanceLatency = "latency"
+)
+
+var balanceStrategy string
+
+// random pick targets of pools and IPs of MX hosts. Seeded once at start, simulation mode replace it by a fixed
+// seed one.
+var random = newRandom(time.Now().UnixNano())
+
+// lockedSource make a rand.Source safe for concurrent lookups.
+type lockedSource struct {
+	sync.Mutex
+	source rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.source.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.source.Seed(seed)
+}
+
+func newRandom(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{source: rand.NewSource(seed)})
+}
+
+// selectionHistorySize is number of recent selections kept per pool, shown in admin stats.
+const selectionHistorySize = 20
+
+type poolHistory struct {
+	// lastSelected is sequence number of last selection of each target, larger is more recent.
+	lastSelected map[string]uint64
+	recent       []string
+	counts       map[string]uint64
+}
+
+var selectionHistory = make(map[string]*poolHistory)
+var selectionSequence uint64
+var selectionHistoryLock sync.Mutex
+
+func parseBalanceStrategy(value string) (string, error) {
+	switch value {
+	case balanceRandom, balanceLeastRecent, balanceLatency:
+		return value, nil
+	}
+	return "", errors.New(fmt.Sprintf("Invalid balance strategy: %s", value))
+}
+
+// poolKey identify a pool by its sorted targets.
+func poolKey(pool []string) string {
+	sorted := append([]string{}, pool...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// recordSelection add relay decision to selection history of its pool. Only queries counted in stats recorded, API
+// lookups don't affect balancing.
+func recordSelection(d decision) {
+	if d.Action != "" || len(d.Pool) < 2 {
+		return
+	}
+	key := poolKey(d.Pool)
+
+	selectionHistoryLock.Lock()
+	defer selectionHistoryLock.Unlock()
+	history, ok := selectionHistory[key]
+	if !ok {
+		history = &poolHistory{lastSelected: make(map[string]uint64), counts: make(map[string]uint64)}
+		selectionHistory[key] = history
+	}
+	selectionSequence++
+	history.lastSelected[d.Target] = selectionSequence
+	history.counts[d.Target]++
+	history.recent = append(history.recent, d.Target)
+	if len(history.recent) > selectionHistorySize {
+		history.recent = history.recent[len(history.recent)-selectionHistorySize:]
+	}
+}
+
+// leastRecentTarget return available target of the pool not selected for longest. Never selected first, tie random.
+func leastRecentTarget(pool []string, available []string) string {
+	selectionHistoryLock.Lock()
+	history := selectionHistory[poolKey(pool)]
+	candidates := make([]string, 0, len(available))
+	var oldest uint64
+	for _, target := range available {
+		var sequence uint64
+		if history != nil {
+			sequence = history.lastSelected[target]
+		}
+		if len(candidates) == 0 || sequence < oldest {
+			candidates = append(candidates[:0], target)
+			oldest = sequence
+		} else if sequence == oldest {
+			candidates = append(candidates, target)
+		}
+	}
+	selectionHistoryLock.Unlock()
+	return candidates[random.Intn(len(candidates))]
+}
+
+// getSelectionStats return selection counts and recent selections of each pool.
+func getSelectionStats() map[string]interface{} {
+	selectionHistoryLock.Lock()
+	defer selectionHistoryLock.Unlock()
+	stats := make(map[string]interface{})
+	for key, history := range selectionHistory {
+		stats[key] = map[string]interface{}{
+			"selected": copyCounts(history.counts),
+			"recent":   append([]string{}, history.recent...),
+		}
+	}
+	return stats
+}
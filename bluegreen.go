@@ -0,0 +1,193 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Blue/green switch a rule set name between two complete rule sets. Listeners and APIs using the name get the active
+// one, so switching and rollback are instant and never mix mappings of both. Decisions, cache and pins keep the
+// color's own rule set name.
+
+// blueGreenSlot is a rule set name served by one of two rule sets. Active and previous guarded by ruleSetsLock, so
+// getRuleSet always see a complete switch.
+type blueGreenSlot struct {
+	Name     string     `json:"name"`
+	Colors   []string   `json:"colors"`
+	Active   string     `json:"active"`
+	Previous string     `json:"previous,omitempty"`
+	Switched *time.Time `json:"switched,omitempty"`
+}
+
+// blueGreenSlots keyed by slot name.
+var blueGreenSlots = make(map[string]*blueGreenSlot)
+
+// parseBlueGreenFlag parse "NAME=BLUE,GREEN". First rule set is active at start.
+func parseBlueGreenFlag(value string) (*blueGreenSlot, error) {
+	splitedValue := strings.SplitN(value, "=", 2)
+	if len(splitedValue) != 2 || splitedValue[0] == "" {
+		return nil, errors.New(fmt.Sprintf("Invalid blue/green format: %s", value))
+	}
+	colors := strings.Split(splitedValue[1], ",")
+	if len(colors) != 2 || colors[0] == "" || colors[1] == "" || colors[0] == colors[1] {
+		return nil, errors.New(fmt.Sprintf("Invalid blue/green format: %s, need two different rule sets.", value))
+	}
+	for _, color := range colors {
+		if color == splitedValue[0] {
+			return nil, errors.New(fmt.Sprintf("Invalid blue/green format: %s, rule set can't be the name itself.", value))
+		}
+	}
+	return &blueGreenSlot{Name: splitedValue[0], Colors: colors, Active: colors[0]}, nil
+}
+
+func isBlueGreenSlot(name string) bool {
+	ruleSetsLock.RLock()
+	defer ruleSetsLock.RUnlock()
+	_, ok := blueGreenSlots[name]
+	return ok
+}
+
+// activeBlueGreenSlot return name of the slot whose active rule set is the color.
+func activeBlueGreenSlot(color string) (string, bool) {
+	ruleSetsLock.RLock()
+	defer ruleSetsLock.RUnlock()
+	for name, slot := range blueGreenSlots {
+		if slot.Active == color {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// switchBlueGreen make color active rule set of the slot. Empty color switch to the other one.
+func switchBlueGreen(name string, color string) (blueGreenSlot, error) {
+	ruleSetsLock.Lock()
+	defer ruleSetsLock.Unlock()
+	slot, ok := blueGreenSlots[name]
+	if !ok {
+		return blueGreenSlot{}, errors.New(fmt.Sprintf("Blue/green rule set %s not found.", name))
+	}
+	if color == "" {
+		color = slot.Colors[0]
+		if slot.Active == color {
+			color = slot.Colors[1]
+		}
+	}
+	if color != slot.Colors[0] && color != slot.Colors[1] {
+		return *slot, errors.New(fmt.Sprintf("Rule set %s is not blue/green rule set of %s, must be one of: %s.", color, name, strings.Join(slot.Colors, ", ")))
+	}
+	if color == slot.Active {
+		return *slot, nil
+	}
+
+	slot.Previous = slot.Active
+	slot.Active = color
+	now := time.Now()
+	slot.Switched = &now
+	log.Warnf("Blue/green rule set %s switched from %s to %s.", name, slot.Previous, slot.Active)
+	notifyChange(changeRuleSet, name, slot.Active)
+	return *slot, nil
+}
+
+// rollbackBlueGreen switch back to previous active rule set.
+func rollbackBlueGreen(name string) (blueGreenSlot, error) {
+	ruleSetsLock.RLock()
+	slot, ok := blueGreenSlots[name]
+	previous := ""
+	if ok {
+		previous = slot.Previous
+	}
+	ruleSetsLock.RUnlock()
+	if ok && previous == "" {
+		return *slot, errors.New(fmt.Sprintf("Blue/green rule set %s never switched.", name))
+	}
+	return switchBlueGreen(name, previous)
+}
+
+func getBlueGreenSlots() []blueGreenSlot {
+	ruleSetsLock.RLock()
+	defer ruleSetsLock.RUnlock()
+	slots := []blueGreenSlot{}
+	for _, slot := range blueGreenSlots {
+		slots = append(slots, *slot)
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].Name < slots[j].Name
+	})
+	return slots
+}
+
+// adminBlueGreenHandler GET return blue/green rule sets. POST with "name" and "active=RULESET" switch, without
+// "active" switch to the other one.
+func adminBlueGreenHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, getBlueGreenSlots())
+	case http.MethodPost:
+		name := r.FormValue("name")
+		if name == "" {
+			name = defaultRuleSetName
+		}
+		if !isBlueGreenSlot(name) {
+			writeJsonError(w, http.StatusNotFound, "Blue/green rule set not found.")
+			return
+		}
+		previous := getRuleSet(name).name
+		slot, err := switchBlueGreen(name, r.FormValue("active"))
+		if err != nil {
+			writeJsonError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if slot.Active != previous {
+			auditRequest(r, "blue_green", name, "", previous, slot.Active)
+		}
+		writeJson(w, http.StatusOK, slot)
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+	}
+}
+
+// adminBlueGreenRollbackHandler POST with "name" switch back to previous active rule set.
+func adminBlueGreenRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		name = defaultRuleSetName
+	}
+	if !isBlueGreenSlot(name) {
+		writeJsonError(w, http.StatusNotFound, "Blue/green rule set not found.")
+		return
+	}
+	previous := getRuleSet(name).name
+	slot, err := rollbackBlueGreen(name)
+	if err != nil {
+		writeJsonError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	auditRequest(r, "blue_green_rollback", name, "", previous, slot.Active)
+	writeJson(w, http.StatusOK, slot)
+}
@@ -0,0 +1,99 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// bulkMax is maximum emails in one bulk lookup request.
+var bulkMax int
+
+type bulkRequest struct {
+	Emails  []string `json:"emails"`
+	RuleSet string   `json:"rule_set"`
+}
+
+type bulkResult struct {
+	Email string `json:"email"`
+	decision
+}
+
+// bulkEvaluate return decisions of emails in same order, with layers applied like Postfix query. Each domain
+// evaluated once, other emails of the domain pick own target from the pool so predicted distribution still follow
+// the pool.
+func bulkEvaluate(rs *ruleSet, emails []string) []decision {
+	now := time.Now()
+	evaluated := make(map[string]decision)
+	decisions := make([]decision, 0, len(emails))
+	for _, email := range emails {
+		key := decisionKey(rs, email)
+		d, ok := evaluated[key]
+		if !ok {
+			d = evaluate(rs, email)
+			evaluated[key] = d
+		} else {
+			d.Cached = true
+			if d.Action == "" && len(d.Pool) > 1 {
+				if target, ok := pickCountryTarget(d.Country, d.Pool); ok {
+					d.Target = target
+					rs.applyMappingOptions(&d)
+				}
+			}
+		}
+		d.Trace = append([]string(nil), d.Trace...)
+		applyDecisionLayers(rs, email, &d, now, false)
+		decisions = append(decisions, d)
+	}
+	return decisions
+}
+
+// bulkLookupHandler POST /lookup with {"emails": [...], "rule_set": "NAME"} return decision of each email.
+func bulkLookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	request := bulkRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err.Error()))
+		return
+	}
+	if len(request.Emails) > bulkMax {
+		writeJsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Too many emails, maximum %d.", bulkMax))
+		return
+	}
+	if request.RuleSet == "" {
+		request.RuleSet = defaultRuleSetName
+	}
+	rs := getRuleSet(request.RuleSet)
+	if rs == nil {
+		writeJsonError(w, http.StatusNotFound, "Rule set not found.")
+		return
+	}
+
+	results := []bulkResult{}
+	for i, d := range bulkEvaluate(rs, request.Emails) {
+		d.Trace = nil
+		results = append(results, bulkResult{Email: request.Emails[i], decision: d})
+	}
+	writeJson(w, http.StatusOK, map[string][]bulkResult{"decisions": results})
+}
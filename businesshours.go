@@ -0,0 +1,197 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	// tzdata embed zone database, hosts like Windows may have none for tz option.
+	_ "time/tzdata"
+)
+
+// Business hours of a mapping turn recipient geography into send time policy, e.g. hold marketing mail to APAC
+// until local morning. Outside hours the mapping reply a deferral instead of its target, and Postfix retry later.
+
+// defaultDeferReply is reply of a mapping outside its business hours.
+const defaultDeferReply = "retry:4.7.0 Outside business hours of destination"
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// businessHours of a mapping, in its own time zone.
+type businessHours struct {
+	// window of a day, all day if nil.
+	window *timeWindow
+	// days of week open, bit of time.Weekday. Zero is every day.
+	days     uint8
+	location *time.Location
+	reply    string
+}
+
+// parseWeekdays parse "mon-fri" or "mon,wed,sat-sun". Range may wrap the week, e.g. "fri-mon".
+func parseWeekdays(value string) (uint8, error) {
+	var days uint8
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, ok := weekdayNames[bounds[0]]
+		if !ok {
+			return 0, errors.New(fmt.Sprintf("Invalid day %s", bounds[0]))
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, ok = weekdayNames[bounds[1]]
+			if !ok {
+				return 0, errors.New(fmt.Sprintf("Invalid day %s", bounds[1]))
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days |= 1 << uint(day)
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseHours parse "HH:MM-HH:MM". End before start cross midnight.
+func parseHours(value string) (*timeWindow, error) {
+	bounds := strings.Split(value, "-")
+	if len(bounds) != 2 {
+		return nil, errors.New(fmt.Sprintf("Invalid hours: %s", value))
+	}
+	start, err := parseClock(bounds[0])
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(bounds[1])
+	if err != nil {
+		return nil, err
+	}
+	return &timeWindow{start: start, end: end}, nil
+}
+
+// setBusinessHoursOption set hours, days, tz or defer_reply option. Return false if key is not one of them.
+func (options *mappingOptions) setBusinessHoursOption(mapping string, key string, value string) (bool, error) {
+	var err error
+	hours := options.businessHours
+	if hours == nil {
+		hours = &businessHours{location: time.UTC}
+	}
+	switch key {
+	case "hours":
+		hours.window, err = parseHours(value)
+	case "days":
+		hours.days, err = parseWeekdays(value)
+	case "tz":
+		hours.location, err = time.LoadLocation(value)
+	case "defer_reply":
+		if !strings.Contains(value, ":") {
+			err = errors.New(fmt.Sprintf(`must be "transport:nexthop": %s`, value))
+		}
+		hours.reply = value
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, errors.New(fmt.Sprintf("Invalid %s option on %s: %s", key, mapping, err.Error()))
+	}
+	options.businessHours = hours
+	return true, nil
+}
+
+// validate options of business hours together. tz or defer_reply without hours or days has no effect.
+func (hours *businessHours) validate(mapping string) error {
+	if hours.window == nil && hours.days == 0 {
+		return errors.New(fmt.Sprintf("Option tz or defer_reply on %s need hours or days option", mapping))
+	}
+	return nil
+}
+
+// open return if now is within business hours. A window crossing midnight belong to the day it start, e.g.
+// "hours=22:00-02:00 days=fri" is open from Friday 22:00 to Saturday 02:00.
+func (hours *businessHours) open(now time.Time) bool {
+	local := now.In(hours.location)
+	day := local.Weekday()
+	if hours.window != nil {
+		minute := local.Hour()*60 + local.Minute()
+		if !hours.window.containsMinute(minute) {
+			return false
+		}
+		if hours.window.start > hours.window.end && minute < hours.window.end {
+			day = (day + 6) % 7
+		}
+	}
+	return hours.days == 0 || hours.days&(1<<uint(day)) != 0
+}
+
+func (hours *businessHours) getReply() string {
+	if hours.reply == "" {
+		return defaultDeferReply
+	}
+	return hours.reply
+}
+
+// String return options in mapping flag format, e.g. "hours=08:00-18:00 days=mon-fri tz=Asia/Tokyo".
+func (hours *businessHours) String() string {
+	values := []string{}
+	if hours.window != nil {
+		values = append(values, fmt.Sprintf("hours=%02d:%02d-%02d:%02d", hours.window.start/60, hours.window.start%60, hours.window.end/60, hours.window.end%60))
+	}
+	if hours.days != 0 {
+		days := []string{}
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if hours.days&(1<<uint(day)) != 0 {
+				days = append(days, strings.ToLower(day.String()[:3]))
+			}
+		}
+		values = append(values, "days="+strings.Join(days, ","))
+	}
+	if hours.location != time.UTC {
+		values = append(values, "tz="+hours.location.String())
+	}
+	if hours.reply != "" {
+		values = append(values, fmt.Sprintf("defer_reply=%q", hours.reply))
+	}
+	return strings.Join(values, " ")
+}
+
+// applyBusinessHours reply deferral if mapping of the decision is outside its business hours. Applied after decision
+// cache, so a cached decision is still held when hours end.
+func applyBusinessHours(rs *ruleSet, d *decision, now time.Time) {
+	if d.Action != "" || d.Target == "" {
+		return
+	}
+	hours := rs.getMappingOptions(d.matchKey, d.Target).businessHours
+	if hours == nil || hours.open(now) {
+		return
+	}
+	d.Trace = append(d.Trace, fmt.Sprintf("business hours: %s closed (%s), reply %s instead of %s", d.Target, hours.String(), hours.getReply(), d.Target))
+	d.Target = ""
+	d.Pool = nil
+	d.Nexthop = hours.getReply()
+	d.ErrorCode = errorOutsideHours
+}
@@ -0,0 +1,86 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWeekdays(t *testing.T) {
+	tests := []struct {
+		value string
+		days  uint8
+		ok    bool
+	}{
+		{"mon-fri", 1<<time.Monday | 1<<time.Tuesday | 1<<time.Wednesday | 1<<time.Thursday | 1<<time.Friday, true},
+		{"fri-mon", 1<<time.Friday | 1<<time.Saturday | 1<<time.Sunday | 1<<time.Monday, true},
+		{"sat-sun", 1<<time.Saturday | 1<<time.Sunday, true},
+		{"mon,wed,sat-sun", 1<<time.Monday | 1<<time.Wednesday | 1<<time.Saturday | 1<<time.Sunday, true},
+		{"MON, Fri", 1<<time.Monday | 1<<time.Friday, true},
+		{"sun-sun", 1 << time.Sunday, true},
+		{"funday", 0, false},
+		{"mon-xyz", 0, false},
+		{"monday", 0, false},
+		{"mon,,fri", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		days, err := parseWeekdays(test.value)
+		if (err == nil) != test.ok || days != test.days {
+			t.Errorf("parseWeekdays(%q) = %07b, %v, want %07b, ok %v", test.value, days, err, test.days, test.ok)
+		}
+	}
+}
+
+func TestBusinessHoursOpen(t *testing.T) {
+	tests := []struct {
+		options map[string]string
+		now     time.Time
+		open    bool
+	}{
+		// 2026-10-16 is Friday. Window crossing midnight belong to the day it start.
+		{map[string]string{"hours": "22:00-02:00", "days": "fri"}, time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC), true},
+		{map[string]string{"hours": "22:00-02:00", "days": "fri"}, time.Date(2026, 10, 17, 1, 0, 0, 0, time.UTC), true},
+		{map[string]string{"hours": "22:00-02:00", "days": "fri"}, time.Date(2026, 10, 17, 2, 0, 0, 0, time.UTC), false},
+		{map[string]string{"hours": "22:00-02:00", "days": "fri"}, time.Date(2026, 10, 16, 1, 0, 0, 0, time.UTC), false},
+		{map[string]string{"hours": "22:00-02:00", "days": "fri"}, time.Date(2026, 10, 17, 23, 0, 0, 0, time.UTC), false},
+		{map[string]string{"hours": "22:00-02:00", "days": "fri", "tz": "America/New_York"}, time.Date(2026, 10, 17, 5, 30, 0, 0, time.UTC), true},
+		{map[string]string{"hours": "22:00-02:00", "days": "fri", "tz": "America/New_York"}, time.Date(2026, 10, 17, 6, 30, 0, 0, time.UTC), false},
+		// Weekday and hours of the time zone, not UTC.
+		{map[string]string{"hours": "08:00-18:00", "days": "mon-fri", "tz": "Asia/Tokyo"}, time.Date(2026, 10, 16, 0, 30, 0, 0, time.UTC), true},
+		{map[string]string{"hours": "08:00-18:00", "days": "mon-fri", "tz": "Asia/Tokyo"}, time.Date(2026, 10, 16, 23, 30, 0, 0, time.UTC), false},
+		{map[string]string{"hours": "08:00-18:00", "days": "mon-fri", "tz": "Asia/Tokyo"}, time.Date(2026, 10, 18, 23, 30, 0, 0, time.UTC), true},
+		{map[string]string{"days": "sat-sun"}, time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC), true},
+		{map[string]string{"days": "sat-sun"}, time.Date(2026, 10, 16, 23, 59, 0, 0, time.UTC), false},
+		{map[string]string{"hours": "09:00-17:00"}, time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC), true},
+		{map[string]string{"hours": "09:00-17:00"}, time.Date(2026, 10, 16, 17, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		options := &mappingOptions{}
+		for _, key := range []string{"hours", "days", "tz"} {
+			if value, ok := test.options[key]; ok {
+				if _, err := options.setBusinessHoursOption("test", key, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if open := options.businessHours.open(test.now); open != test.open {
+			t.Errorf("%s open at %s = %v, want %v", options.businessHours.String(), test.now.Format(time.RFC3339), open, test.open)
+		}
+	}
+}
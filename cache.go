@@ -0,0 +1,231 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// All caches share one LRU list under cache budget, least recently used entry of any cache evicted first.
+var cacheMaxEntries int
+var cacheMaxBytes int
+
+var cacheBudget = struct {
+	sync.Mutex
+	lru     *list.List
+	entries int
+	bytes   int
+}{
+	lru: list.New(),
+}
+
+type cacheEntry struct {
+	cache   *lruCache
+	key     string
+	value   interface{}
+	size    int
+	expires time.Time
+}
+
+// lruCache is a named cache with TTL. Entries and stats guarded by cache budget lock.
+type lruCache struct {
+	name      string
+	items     map[string]*list.Element
+	bytes     int
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func newLruCache(name string) *lruCache {
+	c := &lruCache{name: name, items: make(map[string]*list.Element)}
+	registerCacheStats(name, c.stats)
+	return c
+}
+
+// removeElement must called with cache budget lock held.
+func removeElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	cacheBudget.lru.Remove(element)
+	delete(entry.cache.items, entry.key)
+	cacheBudget.entries--
+	cacheBudget.bytes -= entry.size
+	entry.cache.bytes -= entry.size
+}
+
+// get return cached value and remaining TTL.
+func (c *lruCache) get(key string) (interface{}, time.Duration, bool) {
+	cacheBudget.Lock()
+	defer cacheBudget.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, 0, false
+	}
+	entry := element.Value.(*cacheEntry)
+	remaining := time.Until(entry.expires)
+	if remaining <= 0 {
+		removeElement(element)
+		c.misses++
+		return nil, 0, false
+	}
+	cacheBudget.lru.MoveToFront(element)
+	c.hits++
+	return entry.value, remaining, true
+}
+
+// peek return cached value and expire time, without updating LRU order and hit stats.
+func (c *lruCache) peek(key string) (interface{}, time.Time, bool) {
+	cacheBudget.Lock()
+	defer cacheBudget.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !time.Now().Before(entry.expires) {
+		return nil, time.Time{}, false
+	}
+	return entry.value, entry.expires, true
+}
+
+func (c *lruCache) delete(key string) bool {
+	cacheBudget.Lock()
+	defer cacheBudget.Unlock()
+	element, ok := c.items[key]
+	if ok {
+		removeElement(element)
+	}
+	return ok
+}
+
+// set cache value for TTL. size is approximate bytes used by key and value.
+func (c *lruCache) set(key string, value interface{}, size int, ttl time.Duration) {
+	if ttl <= 0 || cacheMaxEntries < 1 {
+		return
+	}
+
+	cacheBudget.Lock()
+	defer cacheBudget.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		removeElement(element)
+	}
+	entry := &cacheEntry{cache: c, key: key, value: value, size: size, expires: time.Now().Add(ttl)}
+	c.items[key] = cacheBudget.lru.PushFront(entry)
+	cacheBudget.entries++
+	cacheBudget.bytes += size
+	c.bytes += size
+
+	for cacheBudget.entries > cacheMaxEntries || (cacheMaxBytes > 0 && cacheBudget.bytes > cacheMaxBytes) {
+		oldest := cacheBudget.lru.Back()
+		if oldest == nil {
+			break
+		}
+		oldest.Value.(*cacheEntry).cache.evictions++
+		removeElement(oldest)
+	}
+}
+
+func (c *lruCache) purge() {
+	cacheBudget.Lock()
+	defer cacheBudget.Unlock()
+	for _, element := range c.items {
+		removeElement(element)
+	}
+}
+
+type cacheItem struct {
+	key       string
+	value     interface{}
+	remaining time.Duration
+}
+
+// snapshot return unexpired entries, without updating LRU order and hit stats.
+func (c *lruCache) snapshot() []cacheItem {
+	cacheBudget.Lock()
+	defer cacheBudget.Unlock()
+	now := time.Now()
+	items := make([]cacheItem, 0, len(c.items))
+	for key, element := range c.items {
+		entry := element.Value.(*cacheEntry)
+		if remaining := entry.expires.Sub(now); remaining > 0 {
+			items = append(items, cacheItem{key: key, value: entry.value, remaining: remaining})
+		}
+	}
+	return items
+}
+
+func (c *lruCache) stats() cacheStats {
+	cacheBudget.Lock()
+	defer cacheBudget.Unlock()
+	stats := cacheStats{Size: len(c.items), Bytes: c.bytes, Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+	if c.hits+c.misses > 0 {
+		stats.HitRate = float64(c.hits) / float64(c.hits+c.misses)
+	}
+	return stats
+}
+
+// decisionCacheTtl is cache time of decisions, 0 to disable decision cache.
+var decisionCacheTtl time.Duration
+
+var decisionCache = newLruCache("decision")
+
+// getCachedDecision return cached decision of the email. Target picked again from pool, so pool
+// distribution and drained targets still respected. None in static mode, all queries get default target.
+func getCachedDecision(rs *ruleSet, email string) (decision, bool) {
+	if decisionCacheTtl <= 0 || isStaticMode() {
+		return decision{}, false
+	}
+	value, remaining, ok := decisionCache.get(rs.name + " " + decisionKey(rs, email))
+	if !ok {
+		return decision{}, false
+	}
+	now := time.Now()
+	if rs.validityChanged(now.Add(remaining-decisionCacheTtl), now) {
+		return decision{}, false
+	}
+
+	d := value.(decision)
+	target, ok := pickCountryTarget(d.Country, d.Pool)
+	if !ok {
+		return decision{}, false
+	}
+	d.Target = target
+	rs.applyMappingOptions(&d)
+	d.Cached = true
+	return d, true
+}
+
+// cacheDecision cache relay decision. Failure replies and static mode decisions not cached.
+func cacheDecision(rs *ruleSet, email string, d decision) {
+	if decisionCacheTtl <= 0 || d.Action != "" || d.Rule == "static" {
+		return
+	}
+	key := rs.name + " " + decisionKey(rs, email)
+	size := len(key) + 128
+	for _, values := range [][]string{d.Pool, d.Errors, d.Trace} {
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	decisionCache.set(key, d, size, decisionCacheTtl)
+	broadcastPeerDecision(key, d)
+}
@@ -0,0 +1,51 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStaticModeAfterDecisionCached(t *testing.T) {
+	savedTtl, savedEntries := decisionCacheTtl, cacheMaxEntries
+	decisionCacheTtl, cacheMaxEntries = time.Minute, 100
+	defer func() {
+		decisionCacheTtl, cacheMaxEntries = savedTtl, savedEntries
+		setStaticMode(false)
+	}()
+
+	rs := &ruleSet{name: "static", defaultTarget: "US", destinationMap: map[string][]string{"US": {"mta-us"}, "JP": {"mta-jp1", "mta-jp2"}}}
+	decisionCache.set(rs.name+" example.com", decision{RuleSet: rs.name, Target: "mta-jp1", Pool: []string{"mta-jp1", "mta-jp2"}, Rule: "country", Country: "JP"}, 128, decisionCacheTtl)
+	if _, cached := getCachedDecision(rs, "user@example.com"); !cached {
+		t.Fatal("decision not cached before static mode")
+	}
+
+	setStaticMode(true)
+	if _, cached := getCachedDecision(rs, "user@example.com"); cached {
+		t.Error("cached decision served in static mode")
+	}
+	if d := getResult(rs, "user@example.com"); d.Rule != "static" || d.Target != "mta-us" {
+		t.Errorf("getResult in static mode = %s %s, want static mta-us", d.Rule, d.Target)
+	}
+
+	// Static decisions cached in static mode not served after it ends.
+	setStaticMode(false)
+	if d, cached := getCachedDecision(rs, "user@example.com"); cached {
+		t.Errorf("decision %s %s cached in static mode served after it ended", d.Rule, d.Target)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cachedDecision is a decision cache entry with TTL, for tools pre-warm or inspect cache without map queries.
+type cachedDecision struct {
+	Key      string    `json:"key"`
+	Decision decision  `json:"decision"`
+	TtlMs    int64     `json:"ttl_ms"`
+	Expires  time.Time `json:"expires"`
+}
+
+func newCachedDecision(key string, d decision, expires time.Time) cachedDecision {
+	d.Trace = nil
+	entry := cachedDecision{Key: key, Decision: d}
+	if !expires.IsZero() {
+		entry.TtlMs = int64(time.Until(expires) / time.Millisecond)
+		entry.Expires = expires.UTC()
+	}
+	return entry
+}
+
+// readThroughDecision return cached decision of the email. If not cached, evaluate and cache it, unless peek. TTL
+// is 0 if the decision not cacheable (failure reply or static mode). Not counted in stats.
+func readThroughDecision(rs *ruleSet, email string, peek bool) (cachedDecision, bool) {
+	key := decisionKey(rs, email)
+	value, expires, ok := decisionCache.peek(rs.name + " " + key)
+	if ok {
+		d := value.(decision)
+		d.Cached = true
+		return newCachedDecision(key, d, expires), true
+	}
+	if peek {
+		return cachedDecision{}, false
+	}
+
+	d := evaluateLimited(rs, normalizeKey(email))
+	cacheDecision(rs, email, d)
+	_, expires, _ = decisionCache.peek(rs.name + " " + key)
+	return newCachedDecision(key, d, expires), true
+}
+
+// listCachedDecisions return cached decisions of the rule set, longest TTL first. limit 0 for all.
+func listCachedDecisions(rs *ruleSet, limit int) []cachedDecision {
+	prefix := rs.name + " "
+	entries := make([]cachedDecision, 0)
+	for _, item := range decisionCache.snapshot() {
+		if !strings.HasPrefix(item.key, prefix) {
+			continue
+		}
+		d := item.value.(decision)
+		d.Cached = true
+		entries = append(entries, newCachedDecision(strings.TrimPrefix(item.key, prefix), d, time.Now().Add(item.remaining)))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].TtlMs > entries[j].TtlMs
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// cacheHandler manage decision cache of rule set in "rule_set" query parameter.
+// GET /cache list entries (optional "limit"), GET /cache/{email} read-through ("peek=true" don't evaluate),
+// POST /cache with {"emails": [...]} pre-warm, DELETE /cache/{email} remove entry.
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	if decisionCacheTtl <= 0 {
+		writeJsonError(w, http.StatusConflict, "Decision cache disabled, set --decision-cache-ttl.")
+		return
+	}
+	email := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/cache"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && email == "":
+		rs, ok := requestRuleSet(r)
+		if !ok {
+			writeJsonError(w, http.StatusNotFound, "Rule set not found.")
+			return
+		}
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		writeJson(w, http.StatusOK, map[string][]cachedDecision{"entries": listCachedDecisions(rs, limit)})
+	case r.Method == http.MethodGet:
+		rs, ok := requestRuleSet(r)
+		if !ok {
+			writeJsonError(w, http.StatusNotFound, "Rule set not found.")
+			return
+		}
+		peek, _ := strconv.ParseBool(r.URL.Query().Get("peek"))
+		entry, ok := readThroughDecision(rs, email, peek)
+		if !ok {
+			writeJsonError(w, http.StatusNotFound, "Not cached.")
+			return
+		}
+		writeJson(w, http.StatusOK, entry)
+	case r.Method == http.MethodPost && email == "":
+		request := bulkRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err.Error()))
+			return
+		}
+		if len(request.Emails) > bulkMax {
+			writeJsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Too many emails, maximum %d.", bulkMax))
+			return
+		}
+		if request.RuleSet == "" {
+			request.RuleSet = defaultRuleSetName
+		}
+		rs := getRuleSet(request.RuleSet)
+		if rs == nil {
+			writeJsonError(w, http.StatusNotFound, "Rule set not found.")
+			return
+		}
+		entries := make([]cachedDecision, 0, len(request.Emails))
+		for _, email := range request.Emails {
+			entry, _ := readThroughDecision(rs, email, false)
+			entries = append(entries, entry)
+		}
+		writeJson(w, http.StatusOK, map[string][]cachedDecision{"entries": entries})
+	case r.Method == http.MethodDelete && email != "":
+		rs, ok := requestRuleSet(r)
+		if !ok {
+			writeJsonError(w, http.StatusNotFound, "Rule set not found.")
+			return
+		}
+		if !decisionCache.delete(rs.name + " " + decisionKey(rs, email)) {
+			writeJsonError(w, http.StatusNotFound, "Not cached.")
+			return
+		}
+		auditRequest(r, "cache_delete", decisionKey(rs, email), rs.name, nil, nil)
+		writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+	}
+}
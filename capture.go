@@ -0,0 +1,107 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var captureSize int
+
+type captureEntry struct {
+	Time       time.Time `json:"time"`
+	Key        string    `json:"key"`
+	RuleSet    string    `json:"rule_set"`
+	Target     string    `json:"target"`
+	Rule       string    `json:"rule"`
+	Label      string    `json:"label,omitempty"`
+	Country    string    `json:"country,omitempty"`
+	DurationMs float64   `json:"duration_ms"`
+	Errors     []string  `json:"errors,omitempty"`
+	// Timings is milliseconds spent on each lookup phase.
+	Timings map[string]float64 `json:"timings_ms,omitempty"`
+}
+
+// captureBuffer is a ring buffer of last captureSize lookups.
+var captureBuffer []captureEntry
+var captureNext int
+var captureLock sync.Mutex
+
+func recordCapture(key string, d decision, duration time.Duration) {
+	if captureSize < 1 {
+		return
+	}
+
+	entry := captureEntry{
+		Time:       time.Now(),
+		Key:        key,
+		RuleSet:    d.RuleSet,
+		Target:     d.Target,
+		Rule:       d.Rule,
+		Label:      d.Label,
+		Country:    d.Country,
+		DurationMs: float64(duration) / float64(time.Millisecond),
+		Errors:     d.Errors,
+		Timings:    d.Timings,
+	}
+
+	captureLock.Lock()
+	defer captureLock.Unlock()
+	if len(captureBuffer) < captureSize {
+		captureBuffer = append(captureBuffer, entry)
+		return
+	}
+	captureBuffer[captureNext] = entry
+	captureNext = (captureNext + 1) % captureSize
+}
+
+// getCaptures return last limit lookups, oldest first. limit < 1 return all.
+func getCaptures(limit int) []captureEntry {
+	captureLock.Lock()
+	defer captureLock.Unlock()
+
+	entries := make([]captureEntry, 0, len(captureBuffer))
+	entries = append(entries, captureBuffer[captureNext:]...)
+	entries = append(entries, captureBuffer[:captureNext]...)
+	if limit > 0 && limit < len(entries) {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries
+}
+
+// adminCaptureHandler GET return captured lookups. Optional "limit=N" return last N only.
+func adminCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	limit := 0
+	if value := r.FormValue("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, "Invalid limit value.")
+			return
+		}
+		limit = parsed
+	}
+
+	writeJson(w, http.StatusOK, getCaptures(limit))
+}
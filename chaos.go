@@ -0,0 +1,113 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// Fault injection for testing failure handling in staging. Never enable in production.
+var chaosDnsTimeoutPatterns []string
+var chaosGeoipMissNets []*net.IPNet
+var chaosLatencies []chaosLatency
+
+type chaosLatency struct {
+	pattern string
+	delay   time.Duration
+}
+
+func (latency chaosLatency) String() string {
+	return latency.pattern + "=" + latency.delay.String()
+}
+
+var errChaosDnsTimeout = errors.New("i/o timeout (chaos)")
+var errChaosGeoipMiss = errors.New("GeoIP miss (chaos)")
+
+// matchDomainPattern match glob pattern (e.g. "*.example.com") against domain or host name.
+func matchDomainPattern(pattern string, name string) bool {
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(strings.TrimSuffix(name, ".")))
+	return matched
+}
+
+// parseChaosFlags parse fault injection flags.
+func parseChaosFlags(dnsTimeouts []string, geoipMisses []string, latencies []string) error {
+	for _, pattern := range dnsTimeouts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New(fmt.Sprintf("Invalid chaos DNS timeout pattern: %s", pattern))
+		}
+		chaosDnsTimeoutPatterns = append(chaosDnsTimeoutPatterns, pattern)
+	}
+	for _, value := range geoipMisses {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid chaos GeoIP miss CIDR: %s", value))
+		}
+		chaosGeoipMissNets = append(chaosGeoipMissNets, ipNet)
+	}
+	for _, value := range latencies {
+		sepIndex := strings.LastIndex(value, "=")
+		if sepIndex < 1 {
+			return errors.New(fmt.Sprintf("Invalid chaos latency format: %s", value))
+		}
+		delay, err := time.ParseDuration(value[sepIndex+1:])
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid chaos latency duration: %s", value))
+		}
+		chaosLatencies = append(chaosLatencies, chaosLatency{pattern: value[:sepIndex], delay: delay})
+	}
+
+	if len(chaosDnsTimeoutPatterns) > 0 || len(chaosGeoipMissNets) > 0 || len(chaosLatencies) > 0 {
+		log.Warnf("Fault injection enabled. DNS timeout: %v, GeoIP miss: %v, latency: %v", chaosDnsTimeoutPatterns, chaosGeoipMissNets, chaosLatencies)
+	}
+	return nil
+}
+
+// chaosDnsTimeout wait DNS timeout and return error if the name match a DNS timeout pattern.
+func chaosDnsTimeout(name string) error {
+	for _, pattern := range chaosDnsTimeoutPatterns {
+		if matchDomainPattern(pattern, name) {
+			time.Sleep(dnsTimeout)
+			return errChaosDnsTimeout
+		}
+	}
+	return nil
+}
+
+func chaosGeoipMiss(ip net.IP) error {
+	for _, ipNet := range chaosGeoipMissNets {
+		if ipNet.Contains(ip) {
+			return errChaosGeoipMiss
+		}
+	}
+	return nil
+}
+
+// chaosDelay sleep for latency of first pattern match the domain.
+func chaosDelay(domain string) {
+	for _, latency := range chaosLatencies {
+		if matchDomainPattern(latency.pattern, domain) {
+			time.Sleep(latency.delay)
+			return
+		}
+	}
+}
@@ -0,0 +1,241 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Per client IP stats, usually one IP per Postfix host, to find which one send anomalous queries. Clients over
+// --client-stats-max counted as "other", so memory and metric labels stay bounded.
+
+// clientRateWindow is seconds of query rate.
+const clientRateWindow = 60
+
+const clientOther = "other"
+
+// clientStatsMax is maximum client IPs tracked.
+var clientStatsMax int
+
+type clientCounters struct {
+	connections uint64
+	current     int64
+	queries     uint64
+	failures    uint64
+	violations  uint64
+	firstSeen   time.Time
+	lastSeen    time.Time
+	// perSecond count queries of second in seconds, by unix second modulo window.
+	perSecond [clientRateWindow]uint64
+	seconds   [clientRateWindow]int64
+}
+
+// clientSummary is stats of a client for admin API.
+type clientSummary struct {
+	Client             string    `json:"client"`
+	Connections        uint64    `json:"connections"`
+	CurrentConnections int64     `json:"current_connections"`
+	Queries            uint64    `json:"queries"`
+	Qps                float64   `json:"qps"`
+	Failures           uint64    `json:"failures"`
+	ProtocolViolations uint64    `json:"protocol_violations"`
+	ErrorRate          float64   `json:"error_rate"`
+	FirstSeen          time.Time `json:"first_seen"`
+	LastSeen           time.Time `json:"last_seen"`
+}
+
+var clientStats = struct {
+	sync.Mutex
+	clients map[string]*clientCounters
+}{clients: make(map[string]*clientCounters)}
+
+// clientIp return IP of remote address, without port.
+func clientIp(remote net.Addr) string {
+	if remote == nil {
+		return "local"
+	}
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		host = remote.String()
+	}
+	if host == "" || host == "@" {
+		return "local"
+	}
+	return host
+}
+
+// getClient must called with client stats lock held.
+func getClient(remote net.Addr) *clientCounters {
+	ip := clientIp(remote)
+	client, ok := clientStats.clients[ip]
+	if !ok {
+		if len(clientStats.clients) >= clientStatsMax {
+			ip = clientOther
+			client = clientStats.clients[ip]
+		}
+		if client == nil {
+			client = &clientCounters{firstSeen: time.Now()}
+			clientStats.clients[ip] = client
+		}
+	}
+	client.lastSeen = time.Now()
+	return client
+}
+
+func recordClientConnect(remote net.Addr) *clientCounters {
+	clientStats.Lock()
+	defer clientStats.Unlock()
+	client := getClient(remote)
+	client.connections++
+	client.current++
+	return client
+}
+
+func recordClientDisconnect(client *clientCounters) {
+	clientStats.Lock()
+	defer clientStats.Unlock()
+	client.current--
+}
+
+// recordClientQuery count a query of connection client, or of remote if client is nil.
+func recordClientQuery(client *clientCounters, remote net.Addr, d decision) {
+	clientStats.Lock()
+	defer clientStats.Unlock()
+	if client == nil {
+		client = getClient(remote)
+	} else {
+		client.lastSeen = time.Now()
+	}
+	client.queries++
+	if d.Action != "" {
+		client.failures++
+	}
+	second := client.lastSeen.Unix()
+	slot := second % clientRateWindow
+	if client.seconds[slot] != second {
+		client.seconds[slot] = second
+		client.perSecond[slot] = 0
+	}
+	client.perSecond[slot]++
+}
+
+func recordClientViolation(remote net.Addr) {
+	clientStats.Lock()
+	defer clientStats.Unlock()
+	getClient(remote).violations++
+}
+
+func (client *clientCounters) summary(ip string, now time.Time) clientSummary {
+	recent := uint64(0)
+	for slot, second := range client.seconds {
+		if now.Unix()-second < clientRateWindow {
+			recent += client.perSecond[slot]
+		}
+	}
+	summary := clientSummary{
+		Client:             ip,
+		Connections:        client.connections,
+		CurrentConnections: client.current,
+		Queries:            client.queries,
+		Qps:                float64(recent) / clientRateWindow,
+		Failures:           client.failures,
+		ProtocolViolations: client.violations,
+		FirstSeen:          client.firstSeen.UTC(),
+		LastSeen:           client.lastSeen.UTC(),
+	}
+	// Error rate is share of requests answered with failure or rejected as protocol violation.
+	if requests := client.queries + client.violations; requests > 0 {
+		summary.ErrorRate = float64(client.failures+client.violations) / float64(requests)
+	}
+	return summary
+}
+
+// getClientStats return stats of clients, most queries first.
+func getClientStats() []clientSummary {
+	now := time.Now()
+	clientStats.Lock()
+	summaries := make([]clientSummary, 0, len(clientStats.clients))
+	for ip, client := range clientStats.clients {
+		summaries = append(summaries, client.summary(ip, now))
+	}
+	clientStats.Unlock()
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Queries != summaries[j].Queries {
+			return summaries[i].Queries > summaries[j].Queries
+		}
+		return summaries[i].Client < summaries[j].Client
+	})
+	return summaries
+}
+
+func countClients() int {
+	clientStats.Lock()
+	defer clientStats.Unlock()
+	return len(clientStats.clients)
+}
+
+func (m *metricsWriter) writeClientMetrics() {
+	clients := getClientStats()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Client < clients[j].Client
+	})
+	m.family("client_connections", "counter", "Connections by client IP.")
+	for _, client := range clients {
+		m.sample("client_connections_total", []string{"client", client.Client}, float64(client.Connections))
+	}
+	m.family("client_current_connections", "gauge", "Current connections by client IP.")
+	for _, client := range clients {
+		m.sample("client_current_connections", []string{"client", client.Client}, float64(client.CurrentConnections))
+	}
+	m.family("client_queries", "counter", "Queries by client IP.")
+	for _, client := range clients {
+		m.sample("client_queries_total", []string{"client", client.Client}, float64(client.Queries))
+	}
+	m.family("client_failures", "counter", "Queries answered with failure reply by client IP.")
+	for _, client := range clients {
+		m.sample("client_failures_total", []string{"client", client.Client}, float64(client.Failures))
+	}
+	m.family("client_protocol_violations", "counter", "Protocol violations by client IP.")
+	for _, client := range clients {
+		m.sample("client_protocol_violations_total", []string{"client", client.Client}, float64(client.ProtocolViolations))
+	}
+}
+
+// adminClientsHandler GET return stats of each client IP, most queries first. "limit" return only first ones.
+func adminClientsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	clients := getClientStats()
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			writeJsonError(w, http.StatusBadRequest, "Invalid limit.")
+			return
+		}
+		if limit < len(clients) {
+			clients = clients[:limit]
+		}
+	}
+	writeJson(w, http.StatusOK, clients)
+}
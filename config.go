@@ -0,0 +1,211 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v1"
+	"gopkg.in/yaml.v2"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// startupFlags is value and source of each command line flag, recorded at startup.
+var startupFlags map[string]flagValue
+
+type flagValue struct {
+	Value interface{} `json:"value" yaml:"value"`
+	// Source is "flag" if set by command line or environment, otherwise "default".
+	Source string `json:"source" yaml:"source"`
+}
+
+// recordFlags snapshot value of all flags of the app.
+func recordFlags(c *cli.Context) map[string]flagValue {
+	flags := make(map[string]flagValue)
+	for _, flag := range c.App.Flags {
+		name := strings.Split(flag.GetName(), ",")[0]
+		if name == "help" {
+			continue
+		}
+		var value interface{}
+		switch flag.(type) {
+		case cli.StringFlag:
+			value = c.String(name)
+		case cli.StringSliceFlag:
+			value = c.StringSlice(name)
+		case cli.IntFlag:
+			value = c.Int(name)
+		case cli.BoolFlag:
+			value = c.Bool(name)
+		case cli.BoolTFlag:
+			value = c.BoolT(name)
+		case cli.DurationFlag:
+			value = c.Duration(name).String()
+		case cli.Float64Flag:
+			value = c.Float64(name)
+		default:
+			continue
+		}
+
+		if secretFlags[name] && value != "" && !isSecretReference(value.(string)) {
+			value = "<redacted>"
+		}
+		if name == "admin-token" {
+			tokens := []string{}
+			for _, token := range value.([]string) {
+				tokens = append(tokens, redactAdminTokenFlag(token))
+			}
+			value = tokens
+		}
+		source := "default"
+		if c.IsSet(name) {
+			source = "flag"
+		}
+		flags[name] = flagValue{Value: value, Source: source}
+	}
+	return flags
+}
+
+func (t scheduledTarget) String() string {
+	return fmt.Sprintf("%s@%02d:%02d-%02d:%02d", t.target, t.window.start/60, t.window.start%60, t.window.end/60, t.window.end%60)
+}
+
+// String return options in mapping flag format, e.g. `label="us primary" bracket=false`.
+func (options mappingOptions) String() string {
+	values := []string{}
+	if options.label != "" {
+		values = append(values, fmt.Sprintf("label=%q", options.label))
+	}
+	if options.unbracketed {
+		values = append(values, "bracket=false")
+	}
+	if options.transport != "" {
+		values = append(values, "transport="+options.transport)
+	}
+	if options.reply != "" {
+		values = append(values, fmt.Sprintf("reply=%q", options.reply))
+	}
+	if options.businessHours != nil {
+		values = append(values, options.businessHours.String())
+	}
+	if !options.validFrom.IsZero() {
+		values = append(values, "valid_from="+options.validFrom.Format(time.RFC3339))
+	}
+	if !options.validUntil.IsZero() {
+		values = append(values, "valid_until="+options.validUntil.Format(time.RFC3339))
+	}
+	return strings.Join(values, " ")
+}
+
+// getConfig return mappings of the rule set as currently loaded.
+func (rs *ruleSet) getConfig() map[string]interface{} {
+	schedule := make(map[string][]string)
+	for country, scheduled := range rs.scheduleMap {
+		for _, target := range scheduled {
+			schedule[country] = append(schedule[country], target.String())
+		}
+	}
+	splits := make(map[string][]string)
+	for country, shares := range rs.splitMap {
+		for _, share := range shares {
+			splits[country] = append(splits[country], share.String())
+		}
+	}
+	options := make(map[string]string)
+	for key, value := range rs.mappingOptions {
+		if text := value.String(); text != "" {
+			options[key] = text
+		}
+	}
+	source := "flags"
+	if file, ok := ruleSetFiles[rs.name]; ok {
+		source = file
+	}
+
+	return map[string]interface{}{
+		"source":            source,
+		"targets":           rs.destinationMap,
+		"default":           rs.defaultTarget,
+		"schedule":          schedule,
+		"isp_targets":       rs.ispMap,
+		"anonymous_targets": rs.anonymousMap,
+		"scripts":           rs.scriptSources,
+		"rule_order":        rs.getRuleOrderNames(),
+		"geo_source":        rs.getGeoSourceNames(),
+		"allow_countries":   rs.getAllowCountries(),
+		"disallowed_reply":  rs.disallowedReply,
+		"mapping_options":   options,
+		"pools":             rs.pools,
+		"splits":            splits,
+	}
+}
+
+// getEffectiveConfig return startup flags, loaded rule sets and runtime changes.
+func getEffectiveConfig() map[string]interface{} {
+	ruleSetsLock.RLock()
+	names := make([]string, 0, len(ruleSets))
+	for name := range ruleSets {
+		names = append(names, name)
+	}
+	ruleSetsLock.RUnlock()
+	sort.Strings(names)
+
+	loaded := make(map[string]interface{})
+	for _, name := range names {
+		if rs := getRuleSet(name); rs != nil {
+			loaded[name] = rs.getConfig()
+		}
+	}
+
+	return map[string]interface{}{
+		"flags":     startupFlags,
+		"rule_sets": loaded,
+		"runtime": map[string]interface{}{
+			"static_mode":      isStaticMode(),
+			"drained":          getDrainedTargets(),
+			"shadow_rule_sets": shadowRuleSets,
+			"blue_green":       getBlueGreenSlots(),
+			"demotions":        getDemotions(),
+			"pins":             countPins(),
+			"log_level":        log.GetLevel().String(),
+		},
+	}
+}
+
+// adminConfigHandler GET return effective configuration as JSON, or YAML with "format=yaml".
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	config := getEffectiveConfig()
+	if r.URL.Query().Get("format") != "yaml" {
+		writeJson(w, http.StatusOK, config)
+		return
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
@@ -0,0 +1,43 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Reload, stats and shutdown triggers, shared by unix signals, Windows service control and admin API, so features
+// work the same on every platform.
+
+func triggerReload(source string) {
+	log.Infof("Received %s, reload rule sets.", source)
+	diffs, _, err := reloadRuleSets(false)
+	if err == nil || err == errReloadNeedConfirm {
+		recordAudit(auditEntry{Principal: "signal:" + source, Action: "reload", New: reloadChanges(diffs)})
+	}
+}
+
+func triggerStats(source string) {
+	log.Infof("Received %s, dump statistics.", source)
+	logStats()
+}
+
+// triggerShutdown drain connections then exit.
+func triggerShutdown(source string) {
+	log.Infof("Received %s, shutting down.", source)
+	shutdown()
+}
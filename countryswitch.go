@@ -0,0 +1,224 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Country switch actions.
+const (
+	// switchReroute relay all mails of the country to one target.
+	switchReroute = "reroute"
+	// switchDefer reply 400, Postfix defer mails of the country and retry later.
+	switchDefer = "defer"
+)
+
+// countrySwitchDuration is default duration of a country switch, countrySwitchMaxDuration is the longest allowed,
+// so a forgotten switch always expire.
+var countrySwitchDuration time.Duration
+var countrySwitchMaxDuration time.Duration
+
+// countrySwitch temporarily re-route or defer all mails to recipient MX in a country, e.g. during a relay incident.
+type countrySwitch struct {
+	Country string    `json:"country"`
+	Action  string    `json:"action"`
+	Target  string    `json:"target,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+var countrySwitches = make(map[string]countrySwitch)
+var countrySwitchesLock sync.Mutex
+
+func setCountrySwitch(sw countrySwitch) {
+	countrySwitchesLock.Lock()
+	countrySwitches[sw.Country] = sw
+	countrySwitchesLock.Unlock()
+	action := sw.Action
+	if sw.Target != "" {
+		action += " to " + sw.Target
+	}
+	log.Warnf("Country %s switched to %s until %s. Reason: %s", sw.Country, action, sw.Expires.UTC().Format(time.RFC3339), sw.Reason)
+	notifyChange(changeCountrySwitch, "", fmt.Sprintf("%s=%s", sw.Country, action))
+}
+
+func deleteCountrySwitch(country string) bool {
+	countrySwitchesLock.Lock()
+	_, ok := countrySwitches[country]
+	delete(countrySwitches, country)
+	countrySwitchesLock.Unlock()
+	if ok {
+		log.Warnf("Country %s switch removed.", country)
+		notifyChange(changeCountrySwitch, "", fmt.Sprintf("%s=off", country))
+	}
+	return ok
+}
+
+// getCountrySwitch return active switch of the country. Expired switch removed.
+func getCountrySwitch(country string) (countrySwitch, bool) {
+	countrySwitchesLock.Lock()
+	sw, ok := countrySwitches[country]
+	if ok && !time.Now().Before(sw.Expires) {
+		delete(countrySwitches, country)
+		ok = false
+	}
+	countrySwitchesLock.Unlock()
+	if !ok && sw.Country != "" {
+		log.Warnf("Country %s switch expired.", country)
+		notifyChange(changeCountrySwitch, "", fmt.Sprintf("%s=off", country))
+	}
+	return sw, ok
+}
+
+func getCountrySwitches() []countrySwitch {
+	countrySwitchesLock.Lock()
+	countries := make([]string, 0, len(countrySwitches))
+	for country := range countrySwitches {
+		countries = append(countries, country)
+	}
+	countrySwitchesLock.Unlock()
+
+	sort.Strings(countries)
+	switches := make([]countrySwitch, 0, len(countries))
+	for _, country := range countries {
+		if sw, ok := getCountrySwitch(country); ok {
+			switches = append(switches, sw)
+		}
+	}
+	return switches
+}
+
+// applyCountrySwitch override relay decision by switch of its country. Applied after decision cache, so a switch
+// take effect immediately and nothing cached outlive it. Drained reroute target ignored.
+func applyCountrySwitch(rs *ruleSet, d *decision) {
+	if d.Action != "" || d.Country == "" {
+		return
+	}
+	sw, ok := getCountrySwitch(d.Country)
+	if !ok {
+		return
+	}
+
+	switch sw.Action {
+	case switchReroute:
+		if isDrained(sw.Target) || sw.Target == d.Target {
+			return
+		}
+		d.Trace = append(d.Trace, fmt.Sprintf("country switch: %s reroute to %s instead of %s", d.Country, sw.Target, d.Target))
+		d.Target = sw.Target
+		d.Pool = []string{sw.Target}
+		d.Rule = "country_switch"
+		d.matchKey = ""
+		rs.applyMappingOptions(d)
+	case switchDefer:
+		d.Trace = append(d.Trace, fmt.Sprintf("country switch: %s deferred", d.Country))
+		d.Action = failTemp
+		d.Failure = "country"
+		d.ErrorCode = errorCountrySwitch
+		d.Rule = "country_switch"
+	}
+}
+
+// isKnownTarget return true if the target is in any rule set.
+func isKnownTarget(target string) bool {
+	ruleSetsLock.RLock()
+	defer ruleSetsLock.RUnlock()
+	for _, rs := range ruleSets {
+		if containsString(rs.getTargets(), target) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCountrySwitch build switch from admin API parameters.
+func parseCountrySwitch(r *http.Request) (countrySwitch, error) {
+	sw := countrySwitch{
+		Country: strings.ToUpper(r.FormValue("country")),
+		Action:  r.FormValue("action"),
+		Target:  normalizeTarget(r.FormValue("target")),
+		Reason:  r.FormValue("reason"),
+	}
+	if err := validateCountryCode(sw.Country); err != nil {
+		return sw, err
+	}
+	switch sw.Action {
+	case switchReroute:
+		if sw.Target == "" {
+			return sw, errors.New("Missing target of reroute.")
+		}
+		if !isKnownTarget(sw.Target) {
+			return sw, errors.New(fmt.Sprintf("Target %s not in any rule set.", sw.Target))
+		}
+	case switchDefer:
+		sw.Target = ""
+	default:
+		return sw, errors.New(fmt.Sprintf(`Invalid action "%s", must be reroute or defer.`, sw.Action))
+	}
+
+	duration := countrySwitchDuration
+	if value := r.FormValue("duration"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return sw, errors.New(fmt.Sprintf("Invalid duration: %s", value))
+		}
+		duration = parsed
+	}
+	if duration > countrySwitchMaxDuration {
+		return sw, errors.New(fmt.Sprintf("Duration %v longer than maximum %v.", duration, countrySwitchMaxDuration))
+	}
+	sw.Expires = time.Now().Add(duration)
+	return sw, nil
+}
+
+// adminCountrySwitchHandler GET list active country switches. PUT/POST with "country=XX", "action=reroute|defer",
+// "target=MTA" (reroute), optional "duration" and "reason" set a switch. DELETE with "country=XX" remove it.
+func adminCountrySwitchHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		sw, err := parseCountrySwitch(r)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		previous, ok := getCountrySwitch(sw.Country)
+		setCountrySwitch(sw)
+		auditRequest(r, "country_switch", sw.Country, "", auditValue(previous, ok), sw)
+	case http.MethodDelete:
+		country := strings.ToUpper(r.FormValue("country"))
+		previous, ok := getCountrySwitch(country)
+		if !deleteCountrySwitch(country) {
+			writeJsonError(w, http.StatusNotFound, "No switch of the country.")
+			return
+		}
+		auditRequest(r, "country_switch", country, "", auditValue(previous, ok), nil)
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string][]countrySwitch{"switches": getCountrySwitches()})
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+)
+
+// dashboardPage is read-only dashboard of admin API, polling /admin/stats. No external assets, so it works offline.
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// targetHealth is state of a target of any rule set.
+type targetHealth struct {
+	Target   string   `json:"target"`
+	RuleSets []string `json:"rule_sets"`
+	// Status is "drained", "saturated" (over --target-cap) or "ok".
+	Status    string `json:"status"`
+	Decisions uint64 `json:"decisions"`
+}
+
+// getTargetHealth return health of all targets of rule sets, sorted by target.
+func getTargetHealth() []targetHealth {
+	ruleSetsLock.RLock()
+	byTarget := make(map[string]*targetHealth)
+	for _, rs := range ruleSets {
+		for _, target := range rs.getTargets() {
+			health, ok := byTarget[target]
+			if !ok {
+				health = &targetHealth{Target: target}
+				byTarget[target] = health
+			}
+			health.RuleSets = append(health.RuleSets, rs.name)
+		}
+	}
+	ruleSetsLock.RUnlock()
+
+	decisionStats.Lock()
+	for target, health := range byTarget {
+		health.Decisions = decisionStats.targets[target]
+	}
+	decisionStats.Unlock()
+
+	healths := make([]targetHealth, 0, len(byTarget))
+	for target, health := range byTarget {
+		switch {
+		case isDrained(target):
+			health.Status = "drained"
+		case isSaturated(target):
+			health.Status = "saturated"
+		default:
+			health.Status = "ok"
+		}
+		sort.Strings(health.RuleSets)
+		healths = append(healths, *health)
+	}
+	sort.Slice(healths, func(i, j int) bool {
+		return healths[i].Target < healths[j].Target
+	})
+	return healths
+}
+
+// adminDashboardHandler GET serve the dashboard page.
+func adminDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write(dashboardPage)
+}
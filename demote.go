@@ -0,0 +1,198 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Demotion temporarily make a target last choice of its pools for mail to one country, e.g. when the relay report
+// blocks by a mailbox provider on its IP. Reputation monitors can set and remove it by admin API, and it is restored
+// automatically after a cool-down. A demoted target is only picked if every other pool member is demoted or drained.
+
+var demoteDuration time.Duration
+var demoteMaxDuration time.Duration
+
+type demotionKey struct {
+	country string
+	target  string
+}
+
+type demotion struct {
+	Country string    `json:"country"`
+	Target  string    `json:"target"`
+	Reason  string    `json:"reason,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+var demotions = make(map[demotionKey]demotion)
+var demotionsLock sync.Mutex
+
+func setDemotion(d demotion) {
+	demotionsLock.Lock()
+	demotions[demotionKey{country: d.Country, target: d.Target}] = d
+	demotionsLock.Unlock()
+	log.Warnf("Target %s demoted for country %s until %s. Reason: %s", d.Target, d.Country, d.Expires.UTC().Format(time.RFC3339), d.Reason)
+	notifyChange(changeDemotion, "", fmt.Sprintf("%s %s=demoted", d.Country, d.Target))
+}
+
+func deleteDemotion(country string, target string) bool {
+	key := demotionKey{country: country, target: target}
+	demotionsLock.Lock()
+	_, ok := demotions[key]
+	delete(demotions, key)
+	demotionsLock.Unlock()
+	if ok {
+		log.Warnf("Target %s restored for country %s.", target, country)
+		notifyChange(changeDemotion, "", fmt.Sprintf("%s %s=restored", country, target))
+	}
+	return ok
+}
+
+// getDemotion return active demotion of the target for the country. Expired demotion removed, the target restored.
+func getDemotion(country string, target string) (demotion, bool) {
+	key := demotionKey{country: country, target: target}
+	demotionsLock.Lock()
+	if len(demotions) == 0 {
+		demotionsLock.Unlock()
+		return demotion{}, false
+	}
+	d, ok := demotions[key]
+	if ok && !time.Now().Before(d.Expires) {
+		delete(demotions, key)
+		ok = false
+	}
+	demotionsLock.Unlock()
+	if !ok && d.Target != "" {
+		log.Warnf("Target %s demotion for country %s expired, restored.", target, country)
+		notifyChange(changeDemotion, "", fmt.Sprintf("%s %s=restored", country, target))
+	}
+	return d, ok
+}
+
+func isDemoted(country string, target string) bool {
+	if country == "" {
+		return false
+	}
+	_, ok := getDemotion(country, target)
+	return ok
+}
+
+func getDemotions() []demotion {
+	demotionsLock.Lock()
+	keys := make([]demotionKey, 0, len(demotions))
+	for key := range demotions {
+		keys = append(keys, key)
+	}
+	demotionsLock.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].country < keys[j].country || keys[i].country == keys[j].country && keys[i].target < keys[j].target
+	})
+	active := make([]demotion, 0, len(keys))
+	for _, key := range keys {
+		if d, ok := getDemotion(key.country, key.target); ok {
+			active = append(active, d)
+		}
+	}
+	return active
+}
+
+// filterDemoted return targets not demoted for the country. All targets if every one demoted, demotion never fail
+// mail.
+func filterDemoted(country string, targets []string) []string {
+	promoted := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if !isDemoted(country, target) {
+			promoted = append(promoted, target)
+		}
+	}
+	if len(promoted) == 0 {
+		return targets
+	}
+	return promoted
+}
+
+// parseDemotion build demotion from admin API parameters.
+func parseDemotion(r *http.Request) (demotion, error) {
+	d := demotion{
+		Country: strings.ToUpper(r.FormValue("country")),
+		Target:  normalizeTarget(r.FormValue("target")),
+		Reason:  r.FormValue("reason"),
+	}
+	if err := validateCountryCode(d.Country); err != nil {
+		return d, err
+	}
+	if d.Target == "" {
+		return d, errors.New("Missing target.")
+	}
+	if !isKnownTarget(d.Target) {
+		return d, errors.New(fmt.Sprintf("Target %s not in any rule set.", d.Target))
+	}
+
+	duration := demoteDuration
+	if value := r.FormValue("duration"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return d, errors.New(fmt.Sprintf("Invalid duration: %s", value))
+		}
+		duration = parsed
+	}
+	if duration > demoteMaxDuration {
+		return d, errors.New(fmt.Sprintf("Duration %v longer than maximum %v.", duration, demoteMaxDuration))
+	}
+	d.Expires = time.Now().Add(duration)
+	return d, nil
+}
+
+// adminDemoteHandler GET list active demotions. PUT/POST with "country=XX", "target=MTA", optional "duration" and
+// "reason" demote the target, or extend its demotion. DELETE with "country=XX" and "target=MTA" restore it.
+func adminDemoteHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		d, err := parseDemotion(r)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		previous, ok := getDemotion(d.Country, d.Target)
+		setDemotion(d)
+		auditRequest(r, "demote", d.Country+" "+d.Target, "", auditValue(previous, ok), d)
+	case http.MethodDelete:
+		country := strings.ToUpper(r.FormValue("country"))
+		target := normalizeTarget(r.FormValue("target"))
+		previous, ok := getDemotion(country, target)
+		if !deleteDemotion(country, target) {
+			writeJsonError(w, http.StatusNotFound, "No demotion of the target for the country.")
+			return
+		}
+		auditRequest(r, "demote", country+" "+target, "", auditValue(previous, ok), nil)
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string][]demotion{"demotions": getDemotions()})
+}
@@ -0,0 +1,192 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/oschwald/geoip2-golang"
+	log "github.com/sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v1"
+	"os"
+	"sort"
+	"strings"
+)
+
+func diffCommand() cli.Command {
+	return cli.Command{
+		Name:      "diff",
+		Usage:     "Replay recorded keys against two rule sets / GeoIP DBs and report changed decisions.",
+		ArgsUsage: "KEYS_FILE",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "a",
+				Usage: "Rule set file of side A (current).",
+			},
+			cli.StringFlag{
+				Name:  "b",
+				Usage: "Rule set file of side B (new). Same as A if empty.",
+			},
+			cli.StringFlag{
+				Name:  "geoip-db-a",
+				Usage: "GeoIP DB file of side A.",
+				Value: "GeoLite2-Country.mmdb",
+			},
+			cli.StringFlag{
+				Name:  "geoip-db-b",
+				Usage: "GeoIP DB file of side B. Same as A if empty.",
+			},
+			cli.StringFlag{
+				Name:        "isp-db",
+				Usage:       "ISP DB file, if rule sets use ISP target mapping.",
+				Destination: &ispDbPath,
+			},
+		},
+		Action: diffHandler,
+	}
+}
+
+// readKeysFile read one key per line. Empty and "#" lines ignored.
+func readKeysFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys, scanner.Err()
+}
+
+type diffSide struct {
+	rules     *ruleSet
+	countryDb *geoip2.Reader
+}
+
+func openDiffSide(name string, rulePath string, dbPath string) (diffSide, error) {
+	rs, err := loadRuleSetFile(name, rulePath)
+	if err != nil {
+		return diffSide{}, err
+	}
+	db, err := openGeoipDb(dbPath)
+	if err != nil {
+		return diffSide{}, errors.New(fmt.Sprintf("Open GeoIP DB file %s error: %s", dbPath, err.Error()))
+	}
+	return diffSide{rules: rs, countryDb: db}, nil
+}
+
+// evaluate run on this side's GeoIP DB. Not safe for concurrent use, only for diff command.
+func (side diffSide) evaluate(email string) decision {
+	countryDb = side.countryDb
+	return evaluate(side.rules, email)
+}
+
+type domainChange struct {
+	domain string
+	count  int
+	from   string
+	to     string
+}
+
+func diffHandler(c *cli.Context) error {
+	if c.NArg() != 1 || c.String("a") == "" {
+		cli.ShowCommandHelp(c, "diff")
+		return errors.New("Need KEYS_FILE and --a.")
+	}
+
+	rulePathB := c.String("b")
+	if rulePathB == "" {
+		rulePathB = c.String("a")
+	}
+	dbPathB := c.String("geoip-db-b")
+	if dbPathB == "" {
+		dbPathB = c.String("geoip-db-a")
+	}
+
+	keys, err := readKeysFile(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	sideA, err := openDiffSide("a", c.String("a"), c.String("geoip-db-a"))
+	if err != nil {
+		return err
+	}
+	sideB, err := openDiffSide("b", rulePathB, dbPathB)
+	if err != nil {
+		return err
+	}
+	if ispDbPath != "" {
+		ispDb, err = openGeoipDb(ispDbPath)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Open ISP DB file error: %s", err.Error()))
+		}
+	}
+
+	// Only report, don't flood output with per lookup logs.
+	log.SetLevel(log.ErrorLevel)
+
+	changed := 0
+	changes := make(map[string]*domainChange)
+	for _, key := range keys {
+		a := sideA.evaluate(key)
+		b := sideB.evaluate(key)
+		if sameDecision(a, b) {
+			continue
+		}
+
+		changed++
+		domain, _ := getEmailDomain(key)
+		change, ok := changes[domain]
+		if !ok {
+			change = &domainChange{domain: domain, from: fmt.Sprintf("%s(%s)", strings.Join(a.Pool, "|"), a.Rule), to: fmt.Sprintf("%s(%s)", strings.Join(b.Pool, "|"), b.Rule)}
+			changes[domain] = change
+		}
+		change.count++
+	}
+
+	sortedChanges := make([]*domainChange, 0, len(changes))
+	for _, change := range changes {
+		sortedChanges = append(sortedChanges, change)
+	}
+	sort.Slice(sortedChanges, func(i, j int) bool {
+		if sortedChanges[i].count != sortedChanges[j].count {
+			return sortedChanges[i].count > sortedChanges[j].count
+		}
+		return sortedChanges[i].domain < sortedChanges[j].domain
+	})
+
+	percent := 0.0
+	if len(keys) > 0 {
+		percent = float64(changed) * 100 / float64(len(keys))
+	}
+	fmt.Printf("Keys: %d, changed: %d (%.2f%%), affected domains: %d\n", len(keys), changed, percent, len(sortedChanges))
+	for _, change := range sortedChanges {
+		fmt.Printf("%s\t%d\t%s -> %s\n", change.domain, change.count, change.from, change.to)
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// drainedTargets are targets still in config but not receive new decision.
+var drainedTargets = make(map[string]bool)
+var drainedTargetsLock sync.RWMutex
+
+func isDrained(target string) bool {
+	drainedTargetsLock.RLock()
+	defer drainedTargetsLock.RUnlock()
+	return drainedTargets[target]
+}
+
+func setDrained(target string, drained bool) {
+	drainedTargetsLock.Lock()
+	defer drainedTargetsLock.Unlock()
+	if drained {
+		drainedTargets[target] = true
+	} else {
+		delete(drainedTargets, target)
+	}
+	log.Warnf("Target %s drain set to %v.", target, drained)
+	notifyChange(changeDrain, "", fmt.Sprintf("%s=%v", target, drained))
+}
+
+func getDrainedTargets() []string {
+	drainedTargetsLock.RLock()
+	defer drainedTargetsLock.RUnlock()
+	targets := make([]string, 0, len(drainedTargets))
+	for target := range drainedTargets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// pickTarget pick a not drained target by balance strategy. Return false if all targets drained.
+func pickTarget(targets []string) (string, bool) {
+	return pickCountryTarget("", targets)
+}
+
+// pickCountryTarget is pickTarget for mail to MX in country, empty if unknown.
+func pickCountryTarget(country string, targets []string) (string, bool) {
+	available := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if !isDrained(target) {
+			available = append(available, target)
+		}
+	}
+
+	if len(available) < 1 {
+		return "", false
+	}
+	available = filterSaturated(filterDemoted(country, available))
+	if balanceStrategy == balanceLeastRecent && len(available) > 1 {
+		return leastRecentTarget(targets, available), true
+	}
+	if balanceStrategy == balanceLatency && len(available) > 1 {
+		return latencyAwareTarget(country, available), true
+	}
+	return available[random.Intn(len(available))], true
+}
+
+// adminDrainHandler GET list drained targets. PUT/POST with "target=MTA" drain it. DELETE with "target=MTA" undrain it.
+// Target must be in a rule set, except undrain of a drained target, e.g. removed by reload.
+func adminDrainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+		target := normalizeTarget(r.FormValue("target"))
+		if target == "" {
+			writeJsonError(w, http.StatusBadRequest, "Missing target.")
+			return
+		}
+		previous := isDrained(target)
+		if !isKnownTarget(target) && !(r.Method == http.MethodDelete && previous) {
+			writeJsonError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Target %s not in any rule set.", target))
+			return
+		}
+		setDrained(target, r.Method != http.MethodDelete)
+		auditRequest(r, "drain", target, "", previous, r.Method != http.MethodDelete)
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string][]string{"drained": getDrainedTargets()})
+}
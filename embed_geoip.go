@@ -0,0 +1,30 @@
+//go:build embed_geoip
+// +build embed_geoip
+
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	_ "embed"
+)
+
+// embeddedGeoipDb is last resort country DB, used when --geoip-db can't be opened.
+// Build with "-tags embed_geoip" after copy a (possibly trimmed) country mmdb to embedded/GeoLite2-Country.mmdb.
+//
+//go:embed embedded/GeoLite2-Country.mmdb
+var embeddedGeoipDb []byte
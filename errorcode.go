@@ -0,0 +1,88 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+)
+
+// Error codes. Stable names of failure causes, used in logs, stats and failure replies.
+const (
+	errorBadKey          = "bad_key"
+	errorNoMx            = "no_mx"
+	errorNoIp            = "no_ip"
+	errorNxdomain        = "nxdomain"
+	errorResolverTimeout = "resolver_timeout"
+	errorResolverFailure = "resolver_failure"
+	errorDnssec          = "dnssec"
+	errorGeoipMiss       = "geoip_miss"
+	errorScript          = "script_error"
+	errorNoRule          = "no_rule"
+	// errorSpecialKey is special key (e.g. postmaster) configured to reply not found.
+	errorSpecialKey = "special_key"
+	// errorProtocolViolation is request line not a valid key, e.g. with NUL.
+	errorProtocolViolation = "protocol_violation"
+	// errorCountrySwitch is recipient country deferred by country switch.
+	errorCountrySwitch = "country_switch"
+	// errorCountryNotAllowed is recipient country not in allow-list.
+	errorCountryNotAllowed = "country_not_allowed"
+	// errorCountryUnverified is recipient country unknown while allow-list set, deferred.
+	errorCountryUnverified = "country_unverified"
+	// errorOutsideHours is mapping deferred outside its business hours.
+	errorOutsideHours = "outside_business_hours"
+)
+
+// errorCode classify error of a failure type.
+func errorCode(failureType string, err error) string {
+	switch failureType {
+	case "key":
+		return errorBadKey
+	case "dnssec":
+		return errorDnssec
+	case "geoip":
+		return errorGeoipMiss
+	case "script":
+		return errorScript
+	}
+
+	if err == errChaosDnsTimeout {
+		return errorResolverTimeout
+	}
+	if dnsErr, ok := err.(*dnsError); ok {
+		if dnsErr.rcode == dns.RcodeNameError {
+			return errorNxdomain
+		}
+		return errorResolverFailure
+	}
+	if netErr, ok := err.(net.Error); ok {
+		if netErr.Timeout() {
+			return errorResolverTimeout
+		}
+		return errorResolverFailure
+	}
+	if failureType == "ip" {
+		return errorNoIp
+	}
+	return errorNoMx
+}
+
+// isDnsFailure return true if the error is a DNS rcode or network error, not a missing record.
+func isDnsFailure(err error) bool {
+	code := errorCode("", err)
+	return code == errorNxdomain || code == errorResolverTimeout || code == errorResolverFailure
+}
@@ -0,0 +1,386 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// eventSink is --event-sink URL. Empty to disable decision events.
+var eventSink string
+var eventQueueSize int
+
+// Decision events are queued and published in batches by one goroutine, never block lookups. Events are dropped if
+// queue full or publish failed.
+const (
+	eventBatchSize     = 100
+	eventFlushInterval = time.Second
+	eventTimeout       = 5 * time.Second
+)
+
+var eventQueue chan decisionEvent
+var eventPublisherInstance eventPublisher
+var eventsStopped = make(chan chan struct{})
+
+var eventsPublished uint64
+var eventsDropped uint64
+var eventPublishErrors uint64
+
+// eventPublishFailing is true since a publish failed, until one succeed. Only used by publishing goroutine.
+var eventPublishFailing bool
+
+// decisionEvent is one routing decision. Only domain of the key is published, not the local part.
+type decisionEvent struct {
+	Time      string   `json:"time"`
+	Domain    string   `json:"domain"`
+	RuleSet   string   `json:"rule_set"`
+	Action    string   `json:"action,omitempty"`
+	ErrorCode string   `json:"error_code,omitempty"`
+	Target    string   `json:"target"`
+	Label     string   `json:"label,omitempty"`
+	Rule      string   `json:"rule"`
+	Country   string   `json:"country,omitempty"`
+	Anonymous []string `json:"anonymous,omitempty"`
+	Cached    bool     `json:"cached"`
+	Stale     bool     `json:"stale,omitempty"`
+	LatencyMs float64  `json:"latency_ms"`
+	// TraceId is also exemplar of the lookup in latency histogram of /metrics.
+	TraceId string `json:"trace_id"`
+}
+
+// eventPublisher send a batch of events to a broker. Publisher reconnect itself on next batch after an error.
+type eventPublisher interface {
+	publish(events []decisionEvent) error
+}
+
+// parseEventSink return publisher of "nats://[USER:PASS@]HOST:PORT/SUBJECT", or Kafka REST Proxy
+// "kafka+http://HOST:PORT/TOPIC" ("kafka+https" for TLS).
+func parseEventSink(value string) (eventPublisher, error) {
+	sinkUrl, err := url.Parse(value)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid event sink %s: %s", value, err.Error()))
+	}
+	name := strings.Trim(sinkUrl.Path, "/")
+	if sinkUrl.Host == "" || name == "" || strings.Contains(name, "/") {
+		return nil, errors.New(fmt.Sprintf("Invalid event sink %s, must be like nats://HOST:4222/SUBJECT or kafka+http://HOST:8082/TOPIC.", value))
+	}
+
+	switch sinkUrl.Scheme {
+	case "nats":
+		address := sinkUrl.Host
+		if sinkUrl.Port() == "" {
+			address = net.JoinHostPort(sinkUrl.Hostname(), "4222")
+		}
+		publisher := &natsPublisher{address: address, subject: name}
+		if sinkUrl.User != nil {
+			publisher.user = sinkUrl.User.Username()
+			publisher.pass, _ = sinkUrl.User.Password()
+		}
+		return publisher, nil
+	case "kafka+http", "kafka+https":
+		endpoint := url.URL{Scheme: strings.TrimPrefix(sinkUrl.Scheme, "kafka+"), Host: sinkUrl.Host, Path: "/topics/" + name, User: sinkUrl.User}
+		return &kafkaRestPublisher{endpoint: endpoint.String(), client: &http.Client{Timeout: eventTimeout}}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown event sink scheme %s, must be nats, kafka+http or kafka+https.", sinkUrl.Scheme))
+}
+
+// natsPublisher publish with NATS core text protocol. Each batch end with PING, so PONG confirm the server got it.
+type natsPublisher struct {
+	address string
+	subject string
+	user    string
+	pass    string
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+func (p *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.address, eventTimeout)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+	p.reader = bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(eventTimeout))
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return errors.New(fmt.Sprintf("Unexpected NATS greeting: %s", strings.TrimSpace(line)))
+	}
+	options, _ := json.Marshal(map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "GeoIpTransportMap",
+		"user":     p.user,
+		"pass":     p.pass,
+	})
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", options); err != nil {
+		return err
+	}
+	return p.waitPong()
+}
+
+// waitPong read until PONG, answer server PING. -ERR is returned as error.
+func (p *natsPublisher) waitPong() error {
+	for {
+		line, err := p.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(fmt.Sprintf("NATS error: %s", line))
+		}
+	}
+}
+
+func (p *natsPublisher) publish(events []decisionEvent) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			p.close()
+			return err
+		}
+	}
+
+	buffer := bytes.Buffer{}
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buffer, "PUB %s %d\r\n%s\r\n", p.subject, len(data), data)
+	}
+	buffer.WriteString("PING\r\n")
+	p.conn.SetDeadline(time.Now().Add(eventTimeout))
+	_, err := p.conn.Write(buffer.Bytes())
+	if err == nil {
+		err = p.waitPong()
+	}
+	if err != nil {
+		p.close()
+	}
+	return err
+}
+
+func (p *natsPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// kafkaRestPublisher produce with Kafka REST Proxy v2 JSON API. Domain is record key, so events of a domain keep
+// order in one partition.
+type kafkaRestPublisher struct {
+	endpoint string
+	client   *http.Client
+}
+
+type kafkaRecord struct {
+	Key   string        `json:"key"`
+	Value decisionEvent `json:"value"`
+}
+
+func (p *kafkaRestPublisher) publish(events []decisionEvent) error {
+	records := make([]kafkaRecord, 0, len(events))
+	for _, event := range events {
+		records = append(records, kafkaRecord{Key: event.Domain, Value: event})
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	request.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	message, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Kafka REST Proxy reply %s: %s", response.Status, strings.TrimSpace(string(message))))
+	}
+	return nil
+}
+
+// setupEvents check --event-sink. Publishing start in serve by startEvents.
+func setupEvents() error {
+	if eventSink == "" {
+		return nil
+	}
+	if eventQueueSize < 1 {
+		return errors.New("Event queue size must be at least 1.")
+	}
+	publisher, err := parseEventSink(eventSink)
+	if err != nil {
+		return err
+	}
+	eventPublisherInstance = publisher
+	eventQueue = make(chan decisionEvent, eventQueueSize)
+	return nil
+}
+
+// recordDecisionEvent queue event of a decision served to a client. Dropped if queue full.
+func recordDecisionEvent(email string, d decision, duration time.Duration, traceId string) {
+	if eventQueue == nil {
+		return
+	}
+	domain, _ := getEmailDomain(email)
+	event := decisionEvent{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Domain:    domain,
+		RuleSet:   d.RuleSet,
+		Action:    d.Action,
+		ErrorCode: d.ErrorCode,
+		Target:    d.Target,
+		Label:     d.Label,
+		Rule:      d.Rule,
+		Country:   d.Country,
+		Anonymous: d.Anonymous,
+		Cached:    d.Cached,
+		Stale:     d.Stale,
+		LatencyMs: float64(duration) / float64(time.Millisecond),
+		TraceId:   traceId,
+	}
+	select {
+	case eventQueue <- event:
+	default:
+		atomic.AddUint64(&eventsDropped, 1)
+	}
+}
+
+func publishEvents(events []decisionEvent) {
+	if len(events) < 1 {
+		return
+	}
+	if err := eventPublisherInstance.publish(events); err != nil {
+		atomic.AddUint64(&eventPublishErrors, 1)
+		atomic.AddUint64(&eventsDropped, uint64(len(events)))
+		// Log once per failure streak, not every batch while broker down.
+		if !eventPublishFailing {
+			log.Warnf("Publish decision events to %s error, drop events until recovered: %s", redactUrl(eventSink), err.Error())
+			eventPublishFailing = true
+		}
+		return
+	}
+	if eventPublishFailing {
+		log.Infof("Publish decision events to %s recovered.", redactUrl(eventSink))
+		eventPublishFailing = false
+	}
+	atomic.AddUint64(&eventsPublished, uint64(len(events)))
+}
+
+// startEvents publish queued events in batches, until stopEvents.
+func startEvents() {
+	if eventQueue == nil {
+		return
+	}
+	log.Infof("Publish decision events to %s.", redactUrl(eventSink))
+	go func() {
+		ticker := time.NewTicker(eventFlushInterval)
+		defer ticker.Stop()
+		batch := make([]decisionEvent, 0, eventBatchSize)
+		for {
+			select {
+			case event := <-eventQueue:
+				batch = append(batch, event)
+				if len(batch) < eventBatchSize {
+					continue
+				}
+			case <-ticker.C:
+			case done := <-eventsStopped:
+				for len(eventQueue) > 0 {
+					batch = append(batch, <-eventQueue)
+					if len(batch) >= eventBatchSize {
+						publishEvents(batch)
+						batch = batch[:0]
+					}
+				}
+				publishEvents(batch)
+				close(done)
+				return
+			}
+			publishEvents(batch)
+			batch = batch[:0]
+		}
+	}()
+}
+
+// stopEvents publish queued events on shutdown, up to eventTimeout.
+func stopEvents() {
+	if eventQueue == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case eventsStopped <- done:
+	case <-time.After(eventTimeout):
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(eventTimeout):
+	}
+}
+
+// redactUrl hide password of URL in logs.
+func redactUrl(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+	return parsed.Redacted()
+}
+
+func getEventStats() map[string]interface{} {
+	stats := map[string]interface{}{
+		"published": atomic.LoadUint64(&eventsPublished),
+		"dropped":   atomic.LoadUint64(&eventsDropped),
+		"errors":    atomic.LoadUint64(&eventPublishErrors),
+	}
+	if eventQueue != nil {
+		stats["queued"] = len(eventQueue)
+	}
+	return stats
+}
@@ -0,0 +1,239 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v1"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Export write decisions as Postfix transport table source, for postmap. If the daemon must be taken offline, Postfix
+// can use it as emergency fallback map, e.g. "transport_maps = hash:/etc/postfix/geoip_fallback". Each pool collapse
+// to one target, and time dependent policy like business hours can't be kept in a static map.
+
+// exportEntry is one key of exported map.
+type exportEntry struct {
+	key      string
+	decision decision
+}
+
+// exportLiveDecisions collect last good (stale cache), cached and pinned decisions of the rule set, later source win.
+func exportLiveDecisions(rs *ruleSet) []exportEntry {
+	prefix := rs.name + " "
+	decisions := make(map[string]decision)
+	for _, cache := range []*lruCache{staleCache, decisionCache} {
+		for _, item := range cache.snapshot() {
+			if strings.HasPrefix(item.key, prefix) {
+				decisions[strings.TrimPrefix(item.key, prefix)] = item.value.(decision)
+			}
+		}
+	}
+	for _, p := range getPins() {
+		if p.RuleSet == rs.name {
+			decisions[strings.ToLower(p.Domain)] = decision{RuleSet: rs.name, Target: p.Target, Pool: []string{p.Target}, Rule: "pin"}
+		}
+	}
+
+	entries := make([]exportEntry, 0, len(decisions))
+	for key, d := range decisions {
+		entries = append(entries, exportEntry{key: key, decision: d})
+	}
+	return entries
+}
+
+// formatPostfixMap return table source of entries, sorted by key, with rule set default as "*". Failure and default
+// decisions skipped, Postfix fall back to "*" for them.
+func formatPostfixMap(rs *ruleSet, entries []exportEntry, source string) []byte {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "# GeoIpTransportMap export of rule set %s from %s at %s\n", rs.name, source, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&buffer, "# Build with: postmap hash:FILE\n")
+	count := 0
+	for _, entry := range entries {
+		d := entry.decision
+		if d.Action != "" || d.Rule == "default" || strings.ContainsAny(entry.key, " \t") {
+			continue
+		}
+		target, ok := pickTarget(d.Pool)
+		if !ok {
+			continue
+		}
+		d.Target = target
+		rs.applyMappingOptions(&d)
+		applyAllowList(rs, &d)
+		if d.Action != "" {
+			continue
+		}
+		fmt.Fprintf(&buffer, "%s\t%s\n", entry.key, transportValue(d))
+		count++
+	}
+	d := rs.defaultDecision("default", nil)
+	fmt.Fprintf(&buffer, "*\t%s\n", transportValue(d))
+	fmt.Fprintf(&buffer, "# %d key(s)\n", count)
+	return buffer.Bytes()
+}
+
+// adminExportHandler GET /admin/export return Postfix table source of live decisions of rule set in "rule_set".
+func adminExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	rs, ok := requestRuleSet(r)
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, "Rule set not found.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(formatPostfixMap(rs, exportLiveDecisions(rs), "live decisions of "+getHostname()))
+}
+
+func exportCommand() cli.Command {
+	return cli.Command{
+		Name:      "export",
+		Usage:     "Write decisions as Postfix transport table, for emergency fallback map.",
+		ArgsUsage: "[KEYS_FILE]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "admin-url",
+				Usage: `Admin API of running daemon, e.g. "http://127.0.0.1:8080". Export its cached, last good and pinned decisions.`,
+			},
+			cli.StringFlag{
+				Name:  "admin-token",
+				Usage: `Token of admin API with read scope. Can be secret reference like "env:NAME".`,
+			},
+			cli.StringFlag{
+				Name:  "rule-set",
+				Usage: "Rule set name with --admin-url, or rule set file to evaluate KEYS_FILE against.",
+			},
+			cli.StringFlag{
+				Name:  "geoip-db",
+				Usage: "GeoIP DB file, to evaluate KEYS_FILE.",
+				Value: "GeoLite2-Country.mmdb",
+			},
+			cli.StringFlag{
+				Name:  "output,o",
+				Usage: "Output file. Standard output if empty.",
+			},
+		},
+		Action: exportHandler,
+	}
+}
+
+// fetchExport get export of running daemon.
+func fetchExport(adminUrl string, ruleSetName string, token string) ([]byte, error) {
+	url := strings.TrimRight(adminUrl, "/") + "/admin/export"
+	if ruleSetName != "" {
+		url += "?rule_set=" + ruleSetName
+	}
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Export from %s error: %s %s", redactUrl(adminUrl), response.Status, strings.TrimSpace(string(body))))
+	}
+	return body, nil
+}
+
+// evaluateExport evaluate keys against rule set file, like diff command.
+func evaluateExport(rulePath string, dbPath string, keysPath string) ([]byte, error) {
+	keys, err := readKeysFile(keysPath)
+	if err != nil {
+		return nil, err
+	}
+	log.SetLevel(log.ErrorLevel)
+	if err := setupDnsServers(nil); err != nil {
+		return nil, err
+	}
+	side, err := openDiffSide(defaultRuleSetName, rulePath, dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	entries := []exportEntry{}
+	for _, key := range keys {
+		mapKey := decisionKey(side.rules, key)
+		if seen[mapKey] {
+			continue
+		}
+		seen[mapKey] = true
+		entries = append(entries, exportEntry{key: mapKey, decision: side.evaluate(key)})
+	}
+	return formatPostfixMap(side.rules, entries, rulePath), nil
+}
+
+func exportHandler(c *cli.Context) error {
+	var output []byte
+	var err error
+	switch {
+	case c.String("admin-url") != "":
+		token := ""
+		if value := c.String("admin-token"); value != "" {
+			token, err = resolveSecret("admin-token", value)
+			if err != nil {
+				return err
+			}
+		}
+		output, err = fetchExport(c.String("admin-url"), c.String("rule-set"), token)
+	case c.String("rule-set") != "" && c.NArg() == 1:
+		output, err = evaluateExport(c.String("rule-set"), c.String("geoip-db"), c.Args().First())
+	default:
+		cli.ShowCommandHelp(c, "export")
+		return errors.New("Need --admin-url, or --rule-set and KEYS_FILE.")
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.String("output") == "" {
+		_, err = os.Stdout.Write(output)
+		return err
+	}
+	// Write whole file before rename, so postmap never read a partial export.
+	tmp := c.String("output") + ".tmp"
+	if err := ioutil.WriteFile(tmp, output, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.String("output"))
+}
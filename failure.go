@@ -0,0 +1,109 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Failure policies. Applied when no rule matched and lookup had a failure.
+const (
+	// failOpen use default target.
+	failOpen = "open"
+	// failTemp reply 400, Postfix defer the mail and retry later.
+	failTemp = "temp"
+	// failNotFound reply 500, Postfix use its own default transport.
+	failNotFound = "notfound"
+)
+
+// Failure types, which phase of the lookup failed.
+var failureTypes = map[string]bool{
+	"key":    true,
+	"mx":     true,
+	"ip":     true,
+	"geoip":  true,
+	"script": true,
+	"dnssec": true,
+}
+
+var failPolicy = failOpen
+
+// failPolicies override failPolicy by failure type. DNSSEC failure may be a spoofing attack, so never fail open by default.
+var failPolicies = map[string]string{
+	"dnssec": failTemp,
+}
+
+func parseFailPolicy(value string) (string, error) {
+	value = strings.ToLower(value)
+	switch value {
+	case failOpen, failTemp, failNotFound:
+		return value, nil
+	}
+	return "", errors.New(fmt.Sprintf("Invalid fail policy: %s", value))
+}
+
+// parseFailPolicyFor parse "TYPE=POLICY".
+func parseFailPolicyFor(value string) (string, string, error) {
+	splitedValue := strings.SplitN(value, "=", 2)
+	if len(splitedValue) != 2 || !failureTypes[splitedValue[0]] {
+		return "", "", errors.New(fmt.Sprintf("Invalid fail policy override: %s", value))
+	}
+	policy, err := parseFailPolicy(splitedValue[1])
+	if err != nil {
+		return "", "", err
+	}
+	return splitedValue[0], policy, nil
+}
+
+func getFailPolicy(failureType string) string {
+	if policy, ok := failPolicies[failureType]; ok {
+		return policy
+	}
+	return failPolicy
+}
+
+func hasFailure(failures []string, failureType string) bool {
+	for _, value := range failures {
+		if value == failureType {
+			return true
+		}
+	}
+	return false
+}
+
+// applyFailPolicy change default decision by policy of first failure. Return false if fail open.
+func applyFailPolicy(d *decision, failures []string) bool {
+	if len(failures) < 1 {
+		return false
+	}
+
+	policy := getFailPolicy(failures[0])
+	if policy == failOpen {
+		return false
+	}
+
+	d.Action = policy
+	d.Failure = failures[0]
+	d.Target = ""
+	d.Pool = nil
+	d.Label = ""
+	d.Nexthop = ""
+	d.Trace = append(d.Trace, fmt.Sprintf("%s failure, fail policy %s", failures[0], policy))
+	return true
+}
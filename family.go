@@ -0,0 +1,73 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Address family policies. Which MX IP is geolocated should match how the relay connect to the MX,
+// since A and AAAA records of same host can be in different countries.
+const (
+	familyAny        = "any"
+	familyIpv4       = "ipv4"
+	familyIpv6       = "ipv6"
+	familyPreferIpv4 = "prefer-ipv4"
+	familyPreferIpv6 = "prefer-ipv6"
+)
+
+var addressFamily = familyAny
+
+func parseAddressFamily(value string) (string, error) {
+	value = strings.ToLower(value)
+	switch value {
+	case familyAny, familyIpv4, familyIpv6, familyPreferIpv4, familyPreferIpv6:
+		return value, nil
+	}
+	return "", errors.New(fmt.Sprintf("Invalid address family: %s", value))
+}
+
+func filterIpsByFamily(ips []net.IP, ipv4 bool) []net.IP {
+	filtered := []net.IP{}
+	for _, ip := range ips {
+		if isIpv4(ip) == ipv4 {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+// selectIpsByFamily return IPs the relay would connect to under the address family policy.
+func selectIpsByFamily(ips []net.IP) []net.IP {
+	switch addressFamily {
+	case familyIpv4:
+		return filterIpsByFamily(ips, true)
+	case familyIpv6:
+		return filterIpsByFamily(ips, false)
+	case familyPreferIpv4, familyPreferIpv6:
+		// Like happy eyeballs, preferred family win if the host has it.
+		preferred := filterIpsByFamily(ips, addressFamily == familyPreferIpv4)
+		if len(preferred) > 0 {
+			return preferred
+		}
+		return filterIpsByFamily(ips, addressFamily != familyPreferIpv4)
+	}
+	return ips
+}
@@ -0,0 +1,387 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Relay feedback is delivery latency and deferral rate of each target, per destination country, reported by relays
+// or queried from Prometheus. With --balance latency, targets of a pool are picked at random weighted by inverse
+// cost, so better performing relays get most mail of the country, and others still get some to keep data fresh.
+
+// feedbackSmoothing is weight of a new report in moving average.
+const feedbackSmoothing = 0.3
+
+// feedbackMinCost avoid huge weight of a target with near zero cost, in seconds.
+const feedbackMinCost = 0.05
+
+var feedbackMaxAge time.Duration
+
+// feedbackDeferralPenalty is cost of 100% deferral, same unit as latency.
+var feedbackDeferralPenalty time.Duration
+
+var feedbackPrometheusUrl string
+var feedbackLatencyQuery string
+var feedbackDeferralQuery string
+var feedbackInterval time.Duration
+
+// feedbackKey is target and country, "" country for all countries.
+type feedbackKey struct {
+	country string
+	target  string
+}
+
+type relayFeedback struct {
+	// latency is moving average of delivery latency, in seconds.
+	latency       float64
+	latencyKnown  bool
+	deferralRate  float64
+	deferralKnown bool
+	reports       uint64
+	updated       time.Time
+}
+
+// feedbackReport is a report of relay for POST /admin/relay-feedback. Country empty for all countries.
+type feedbackReport struct {
+	Target    string  `json:"target"`
+	Country   string  `json:"country"`
+	Delivered uint64  `json:"delivered"`
+	Deferred  uint64  `json:"deferred"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// feedbackSummary is feedback of a target for admin API.
+type feedbackSummary struct {
+	Target       string    `json:"target"`
+	Country      string    `json:"country,omitempty"`
+	LatencyMs    *float64  `json:"latency_ms,omitempty"`
+	DeferralRate *float64  `json:"deferral_rate,omitempty"`
+	Cost         float64   `json:"cost"`
+	Reports      uint64    `json:"reports"`
+	Updated      time.Time `json:"updated"`
+	Stale        bool      `json:"stale"`
+}
+
+var feedbackStats = struct {
+	sync.Mutex
+	entries map[feedbackKey]*relayFeedback
+}{entries: make(map[feedbackKey]*relayFeedback)}
+
+func smooth(current float64, known bool, value float64) float64 {
+	if !known {
+		return value
+	}
+	return current + feedbackSmoothing*(value-current)
+}
+
+// updateFeedback add latency in seconds and/or deferral rate of target to moving averages. nil if not reported.
+// Stale feedback of other targets removed, e.g. of targets no longer in rule sets.
+func updateFeedback(country string, target string, latency *float64, deferralRate *float64) {
+	key := feedbackKey{country: strings.ToUpper(country), target: normalizeTarget(target)}
+	now := time.Now()
+	feedbackStats.Lock()
+	defer feedbackStats.Unlock()
+	for other, feedback := range feedbackStats.entries {
+		if feedback.isStale(now) {
+			delete(feedbackStats.entries, other)
+		}
+	}
+	feedback, ok := feedbackStats.entries[key]
+	if !ok {
+		feedback = &relayFeedback{}
+		feedbackStats.entries[key] = feedback
+	}
+	if latency != nil {
+		feedback.latency = smooth(feedback.latency, feedback.latencyKnown, *latency)
+		feedback.latencyKnown = true
+	}
+	if deferralRate != nil {
+		feedback.deferralRate = smooth(feedback.deferralRate, feedback.deferralKnown, *deferralRate)
+		feedback.deferralKnown = true
+	}
+	feedback.reports++
+	feedback.updated = now
+}
+
+func (feedback *relayFeedback) cost() float64 {
+	return feedback.latency + feedback.deferralRate*feedbackDeferralPenalty.Seconds()
+}
+
+func (feedback *relayFeedback) isStale(now time.Time) bool {
+	return feedbackMaxAge > 0 && now.Sub(feedback.updated) > feedbackMaxAge
+}
+
+// feedbackCost return cost of target for the country, or of all countries if the country has no fresh feedback.
+func feedbackCost(country string, target string, now time.Time) (float64, bool) {
+	feedbackStats.Lock()
+	defer feedbackStats.Unlock()
+	if feedback, ok := feedbackStats.entries[feedbackKey{country: country, target: target}]; ok && !feedback.isStale(now) {
+		return feedback.cost(), true
+	}
+	if feedback, ok := feedbackStats.entries[feedbackKey{target: target}]; ok && !feedback.isStale(now) {
+		return feedback.cost(), true
+	}
+	return 0, false
+}
+
+// latencyAwareTarget pick one of available targets at random weighted by inverse cost. Target without feedback get
+// average cost, so new relay still get mail. Random if no target has feedback.
+func latencyAwareTarget(country string, available []string) string {
+	now := time.Now()
+	costs := make([]float64, len(available))
+	known := make([]bool, len(available))
+	total := 0.0
+	count := 0
+	for i, target := range available {
+		costs[i], known[i] = feedbackCost(country, target, now)
+		if known[i] {
+			total += costs[i]
+			count++
+		}
+	}
+	if count == 0 {
+		return available[random.Intn(len(available))]
+	}
+
+	weights := make([]float64, len(available))
+	sum := 0.0
+	for i := range available {
+		cost := total / float64(count)
+		if known[i] {
+			cost = costs[i]
+		}
+		weights[i] = 1 / (cost + feedbackMinCost)
+		sum += weights[i]
+	}
+	pick := random.Float64() * sum
+	for i, weight := range weights {
+		pick -= weight
+		if pick < 0 {
+			return available[i]
+		}
+	}
+	return available[len(available)-1]
+}
+
+func validateFeedbackReport(report feedbackReport) error {
+	if normalizeTarget(report.Target) == "" {
+		return errors.New("Missing target.")
+	}
+	if !isKnownTarget(normalizeTarget(report.Target)) {
+		return errors.New(fmt.Sprintf("Unknown target %s.", report.Target))
+	}
+	if report.Country != "" {
+		if err := validateCountryCode(strings.ToUpper(report.Country)); err != nil {
+			return err
+		}
+	}
+	if report.Delivered+report.Deferred == 0 {
+		return errors.New("No delivered or deferred mail.")
+	}
+	if report.LatencyMs < 0 {
+		return errors.New("Invalid latency_ms.")
+	}
+	return nil
+}
+
+// addFeedbackReport add a validated relay report.
+func addFeedbackReport(report feedbackReport) {
+	deferralRate := float64(report.Deferred) / float64(report.Delivered+report.Deferred)
+	var latency *float64
+	if report.Delivered > 0 {
+		seconds := report.LatencyMs / 1000
+		latency = &seconds
+	}
+	updateFeedback(report.Country, report.Target, latency, &deferralRate)
+}
+
+// getFeedbackStats return feedback of targets, sorted by target and country.
+func getFeedbackStats() []feedbackSummary {
+	now := time.Now()
+	feedbackStats.Lock()
+	defer feedbackStats.Unlock()
+	summaries := make([]feedbackSummary, 0, len(feedbackStats.entries))
+	for key, feedback := range feedbackStats.entries {
+		summary := feedbackSummary{
+			Target:  key.target,
+			Country: key.country,
+			Cost:    feedback.cost(),
+			Reports: feedback.reports,
+			Updated: feedback.updated.UTC(),
+			Stale:   feedback.isStale(now),
+		}
+		if feedback.latencyKnown {
+			latencyMs := feedback.latency * 1000
+			summary.LatencyMs = &latencyMs
+		}
+		if feedback.deferralKnown {
+			deferralRate := feedback.deferralRate
+			summary.DeferralRate = &deferralRate
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Target != summaries[j].Target {
+			return summaries[i].Target < summaries[j].Target
+		}
+		return summaries[i].Country < summaries[j].Country
+	})
+	return summaries
+}
+
+// adminRelayFeedbackHandler GET return feedback of targets. POST with {"reports": [feedbackReport...]} add reports,
+// all or nothing.
+func adminRelayFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, getFeedbackStats())
+	case http.MethodPost:
+		request := struct {
+			Reports []feedbackReport `json:"reports"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err.Error()))
+			return
+		}
+		for i, report := range request.Reports {
+			if err := validateFeedbackReport(report); err != nil {
+				writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("Report %d: %s", i, err.Error()))
+				return
+			}
+		}
+		for _, report := range request.Reports {
+			addFeedbackReport(report)
+		}
+		writeJson(w, http.StatusOK, map[string]int{"accepted": len(request.Reports)})
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+	}
+}
+
+// prometheusSample is a sample of instant query, with target and country labels.
+type prometheusSample struct {
+	target  string
+	country string
+	value   float64
+}
+
+// queryPrometheus run instant query. Samples without "target" label or with NaN value skipped.
+func queryPrometheus(baseUrl string, query string) ([]prometheusSample, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Get(strings.TrimRight(baseUrl, "/") + "/api/v1/query?query=" + url.QueryEscape(query))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	result := struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric map[string]string `json:"metric"`
+				Value  []interface{}     `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s %s", response.Status, strings.TrimSpace(string(body))))
+	}
+	if result.Status != "success" {
+		return nil, errors.New(result.Error)
+	}
+	if result.Data.ResultType != "vector" {
+		return nil, errors.New(fmt.Sprintf("Query result is %s, need vector.", result.Data.ResultType))
+	}
+
+	samples := []prometheusSample{}
+	for _, item := range result.Data.Result {
+		if item.Metric["target"] == "" || len(item.Value) != 2 {
+			continue
+		}
+		text, _ := item.Value[1].(string)
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) || value < 0 {
+			continue
+		}
+		samples = append(samples, prometheusSample{target: item.Metric["target"], country: item.Metric["country"], value: value})
+	}
+	return samples, nil
+}
+
+// pollPrometheusFeedback add latency (seconds) and deferral rate (0 to 1) of each target from Prometheus queries.
+func pollPrometheusFeedback() {
+	for _, query := range []struct {
+		name     string
+		query    string
+		latency  bool
+		maxValue float64
+	}{{"latency", feedbackLatencyQuery, true, math.Inf(1)}, {"deferral", feedbackDeferralQuery, false, 1}} {
+		if query.query == "" {
+			continue
+		}
+		samples, err := queryPrometheus(feedbackPrometheusUrl, query.query)
+		if err != nil {
+			log.Warnf("Relay feedback %s query of %s failed: %s", query.name, redactUrl(feedbackPrometheusUrl), err.Error())
+			continue
+		}
+		for _, sample := range samples {
+			if sample.country != "" && validateCountryCode(strings.ToUpper(sample.country)) != nil {
+				continue
+			}
+			if !isKnownTarget(normalizeTarget(sample.target)) {
+				continue
+			}
+			value := math.Min(sample.value, query.maxValue)
+			if query.latency {
+				updateFeedback(sample.country, sample.target, &value, nil)
+			} else {
+				updateFeedback(sample.country, sample.target, nil, &value)
+			}
+		}
+		log.Debugf("Relay feedback %s query returned %d sample(s).", query.name, len(samples))
+	}
+}
+
+func startFeedbackPoller() {
+	if feedbackPrometheusUrl == "" || feedbackInterval <= 0 {
+		return
+	}
+	go func() {
+		pollPrometheusFeedback()
+		for range time.Tick(feedbackInterval) {
+			pollPrometheusFeedback()
+		}
+	}()
+}
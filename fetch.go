@@ -0,0 +1,171 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cacheDir is writable directory of downloaded DBs, so the rest of filesystem can be read-only (e.g. container).
+// Default system temp dir.
+var cacheDir string
+
+var fetchClient = &http.Client{Timeout: 2 * time.Minute}
+
+// fetchDb return the local path of a DB. For http(s) URL, download to cacheDir (mmdb or MaxMind .tar.gz) and
+// return the cached file. Cached file used if not modified or download failed.
+func fetchDb(value string) (string, error) {
+	if !isDbUrl(value) {
+		return value, nil
+	}
+	cachePath, safeUrl, err := dbCachePath(value)
+	if err != nil {
+		return "", err
+	}
+	// With refresh, only leader download. Others use cached file at startup.
+	if _, err := os.Stat(cachePath); err == nil && geoipRefreshInterval > 0 {
+		return cachePath, nil
+	}
+
+	err = downloadDb(value, cachePath)
+	if err != nil {
+		if _, statErr := os.Stat(cachePath); statErr == nil {
+			log.Warnf("Download %s error: %s. Use cached %s.", safeUrl, err.Error(), cachePath)
+			return cachePath, nil
+		}
+		return "", errors.New(fmt.Sprintf("Download %s error: %s", safeUrl, err.Error()))
+	}
+	return cachePath, nil
+}
+
+func isDbUrl(value string) bool {
+	return strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://")
+}
+
+func getCacheDir() string {
+	if cacheDir == "" {
+		return os.TempDir()
+	}
+	return cacheDir
+}
+
+// dbCachePath return cached file path of DB URL, and the URL without query for logging.
+func dbCachePath(value string) (string, string, error) {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return "", "", errors.New(fmt.Sprintf("Invalid DB URL: %s", err.Error()))
+	}
+	// Query of MaxMind download URL has license key, don't log it.
+	safeUrl := parsed.Scheme + "://" + parsed.Host + parsed.Path
+
+	name := path.Base(parsed.Path)
+	if edition := parsed.Query().Get("edition_id"); edition != "" {
+		name = edition
+	}
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".tar.gz"), ".mmdb") + ".mmdb"
+	return filepath.Join(getCacheDir(), name), safeUrl, nil
+}
+
+func downloadDb(value string, cachePath string) error {
+	request, err := http.NewRequest(http.MethodGet, value, nil)
+	if err != nil {
+		return err
+	}
+	authenticateMaxmindDownload(request)
+	if info, err := os.Stat(cachePath); err == nil {
+		request.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+
+	response, err := fetchClient.Do(request)
+	if err != nil {
+		// Error has the URL with license key.
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified {
+		log.Infof("DB %s not modified.", cachePath)
+		return nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("HTTP status %s", response.Status))
+	}
+
+	var body io.Reader = response.Body
+	if strings.Contains(value, ".tar.gz") || strings.Contains(value, "suffix=tar.gz") {
+		body, err = findMmdbInTarGz(response.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write then rename, a failed download never replace good cached file.
+	tmp, err := ioutil.TempFile(filepath.Dir(cachePath), filepath.Base(cachePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, body)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), cachePath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if modified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(cachePath, modified, modified)
+	}
+	log.Infof("Downloaded DB to %s.", cachePath)
+	return nil
+}
+
+// findMmdbInTarGz return reader of the first .mmdb file in the archive, as MaxMind download format.
+func findMmdbInTarGz(reader io.Reader) (io.Reader, error) {
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil, errors.New("No .mmdb file in archive.")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(header.Name, ".mmdb") {
+			return archive, nil
+		}
+	}
+}
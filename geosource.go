@@ -0,0 +1,144 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Geolocation sources of a rule set. Country of a domain is from MX host addresses by default. Organizations with
+// MX outsourced abroad but mail store local may be better geolocated by domain apex A/AAAA records.
+const (
+	geoSourceMx = "mx"
+	geoSourceA  = "a"
+)
+
+type geoSource struct {
+	name   string
+	weight int
+}
+
+func (s geoSource) String() string {
+	return fmt.Sprintf("%s=%d", s.name, s.weight)
+}
+
+// parseGeoSource parse "mx", "a" or weighted combination like "mx=1,a=2". Empty for MX only.
+func parseGeoSource(value string) ([]geoSource, error) {
+	sources := []geoSource{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		source := geoSource{name: item, weight: 1}
+		if sepIndex := strings.Index(item, "="); sepIndex >= 0 {
+			weight, err := strconv.Atoi(item[sepIndex+1:])
+			if err != nil || weight < 1 {
+				return nil, errors.New(fmt.Sprintf("Invalid geo source weight: %s", item))
+			}
+			source = geoSource{name: item[:sepIndex], weight: weight}
+		}
+		if source.name != geoSourceMx && source.name != geoSourceA {
+			return nil, errors.New(fmt.Sprintf("Unknown geo source: %s", source.name))
+		}
+		for _, existing := range sources {
+			if existing.name == source.name {
+				return nil, errors.New(fmt.Sprintf("Duplicated geo source: %s", source.name))
+			}
+		}
+		sources = append(sources, source)
+	}
+	if len(sources) == 1 && sources[0].name == geoSourceMx {
+		return nil, nil
+	}
+	return sources, nil
+}
+
+// geolocateApex return country of first domain apex A/AAAA address can be geolocated.
+func (l *lookup) geolocateApex() (string, bool) {
+	start := time.Now()
+	ips, err := lookupIP(l.domain)
+	l.addTiming("apex", start)
+	if err != nil {
+		l.tracef("apex A/AAAA lookup of %s failed: %v", l.domain, err)
+		return "", false
+	}
+
+	for _, ip := range selectIpsByFamily(filterUnusableIps(l.domain, l.domain, ips)) {
+		start := time.Now()
+		country, err := getCountryByIp(ip)
+		l.addTiming("geoip", start)
+		if err != nil {
+			continue
+		}
+		l.tracef("apex IP %s geolocated to %s", ip.String(), country)
+		return country, true
+	}
+	return "", false
+}
+
+// geolocateSources add weight of each source to its country, country with most weight win. Tie won by first listed.
+func (l *lookup) geolocateSources() (string, bool) {
+	weights := make(map[string]int)
+	best := ""
+	for _, source := range l.rules.geoSources {
+		var country string
+		var ok bool
+		switch source.name {
+		case geoSourceMx:
+			country, ok = l.geolocateMx()
+		case geoSourceA:
+			country, ok = l.geolocateApex()
+		}
+		if !ok {
+			continue
+		}
+		weights[country] += source.weight
+		if best == "" || weights[country] > weights[best] {
+			best = country
+		}
+	}
+
+	if len(weights) > 1 {
+		values := []string{}
+		for country, weight := range weights {
+			values = append(values, fmt.Sprintf("%s=%d", country, weight))
+		}
+		sort.Strings(values)
+		l.tracef("geo sources disagree: %s, use %s", strings.Join(values, ", "), best)
+	}
+	if best != "" {
+		lookupInfof("Got country code: %s for domain:%s", best, l.domain)
+	}
+	return best, best != ""
+}
+
+func (rs *ruleSet) getGeoSourceNames() []string {
+	if len(rs.geoSources) < 1 {
+		return []string{geoSourceMx}
+	}
+	names := make([]string, 0, len(rs.geoSources))
+	for _, source := range rs.geoSources {
+		names = append(names, source.String())
+	}
+	return names
+}
@@ -0,0 +1,268 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative lookup.proto
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+var grpcListen string
+
+type lookupServer struct {
+	UnimplementedLookupServer
+}
+
+func getRequestRuleSet(name string) (*ruleSet, error) {
+	if name == "" {
+		name = defaultRuleSetName
+	}
+	rs := getRuleSet(name)
+	if rs == nil {
+		return nil, status.Errorf(codes.NotFound, "Rule set %s not found.", name)
+	}
+	return rs, nil
+}
+
+// toProtoDecision convert decision. Trace only included if withTrace.
+func toProtoDecision(email string, d decision, withTrace bool) *Decision {
+	result := &Decision{
+		Email:     email,
+		RuleSet:   d.RuleSet,
+		Action:    d.Action,
+		Failure:   d.Failure,
+		ErrorCode: d.ErrorCode,
+		Target:    d.Target,
+		Pool:      d.Pool,
+		Rule:      d.Rule,
+		Label:     d.Label,
+		Nexthop:   d.Nexthop,
+		Country:   d.Country,
+		Anonymous: d.Anonymous,
+		Cached:    d.Cached,
+		Stale:     d.Stale,
+		Errors:    d.Errors,
+		TimingsMs: d.Timings,
+	}
+	if withTrace {
+		result.Trace = d.Trace
+	}
+	return result
+}
+
+func (s *lookupServer) Lookup(ctx context.Context, request *LookupRequest) (*Decision, error) {
+	rs, err := getRequestRuleSet(request.RuleSet)
+	if err != nil {
+		return nil, err
+	}
+	return toProtoDecision(request.Email, lookupDecision(rs, request.Email), false), nil
+}
+
+func (s *lookupServer) Explain(ctx context.Context, request *LookupRequest) (*Decision, error) {
+	rs, err := getRequestRuleSet(request.RuleSet)
+	if err != nil {
+		return nil, err
+	}
+	return toProtoDecision(request.Email, lookupDecision(rs, request.Email), true), nil
+}
+
+func (s *lookupServer) BulkLookup(ctx context.Context, request *BulkLookupRequest) (*BulkLookupResponse, error) {
+	rs, err := getRequestRuleSet(request.RuleSet)
+	if err != nil {
+		return nil, err
+	}
+	if len(request.Emails) > bulkMax {
+		return nil, status.Errorf(codes.InvalidArgument, "Too many emails, maximum %d.", bulkMax)
+	}
+	response := &BulkLookupResponse{}
+	for i, d := range bulkEvaluate(rs, request.Emails) {
+		response.Decisions = append(response.Decisions, toProtoDecision(request.Emails[i], d, false))
+	}
+	return response, nil
+}
+
+func (s *lookupServer) Watch(request *WatchRequest, stream Lookup_WatchServer) error {
+	ch := addWatcher()
+	defer removeWatcher(ch)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-ch:
+			if event.kind == changeRuleSet && request.RuleSet != "" && event.ruleSet != request.RuleSet {
+				continue
+			}
+			err := stream.Send(&ChangeEvent{Kind: event.kind, RuleSet: event.ruleSet, Detail: event.detail, UnixTime: event.unixTime})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func toProtoCacheEntry(entry cachedDecision) *CacheEntry {
+	result := &CacheEntry{Key: entry.Key, Decision: toProtoDecision(entry.Key, entry.Decision, false), TtlMs: entry.TtlMs}
+	if !entry.Expires.IsZero() {
+		result.ExpiresUnixTime = entry.Expires.Unix()
+	}
+	return result
+}
+
+func (s *lookupServer) GetCached(ctx context.Context, request *CacheRequest) (*CacheEntry, error) {
+	if decisionCacheTtl <= 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "Decision cache disabled.")
+	}
+	rs, err := getRequestRuleSet(request.RuleSet)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := readThroughDecision(rs, request.Email, request.Peek)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Not cached.")
+	}
+	result := toProtoCacheEntry(entry)
+	result.Decision.Email = request.Email
+	return result, nil
+}
+
+func (s *lookupServer) WarmCache(ctx context.Context, request *BulkLookupRequest) (*CacheEntries, error) {
+	if decisionCacheTtl <= 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "Decision cache disabled.")
+	}
+	rs, err := getRequestRuleSet(request.RuleSet)
+	if err != nil {
+		return nil, err
+	}
+	if len(request.Emails) > bulkMax {
+		return nil, status.Errorf(codes.InvalidArgument, "Too many emails, maximum %d.", bulkMax)
+	}
+	response := &CacheEntries{}
+	for _, email := range request.Emails {
+		entry, _ := readThroughDecision(rs, email, false)
+		result := toProtoCacheEntry(entry)
+		result.Decision.Email = email
+		response.Entries = append(response.Entries, result)
+	}
+	return response, nil
+}
+
+func (s *lookupServer) ListCache(ctx context.Context, request *ListCacheRequest) (*CacheEntries, error) {
+	rs, err := getRequestRuleSet(request.RuleSet)
+	if err != nil {
+		return nil, err
+	}
+	response := &CacheEntries{}
+	for _, entry := range listCachedDecisions(rs, int(request.Limit)) {
+		response.Entries = append(response.Entries, toProtoCacheEntry(entry))
+	}
+	return response, nil
+}
+
+// grpcWriteMethods change state, need write scope like admin API. Others need read scope.
+var grpcWriteMethods = map[string]bool{
+	Lookup_WarmCache_FullMethodName: true,
+}
+
+// authenticateGrpc check client certificate or "authorization: Bearer TOKEN" metadata, and scope of the method, same
+// as admin API.
+func authenticateGrpc(ctx context.Context, method string) error {
+	if !adminAuthEnabled() {
+		return nil
+	}
+	var state *tls.ConnectionState
+	remote := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	token := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, value := range md.Get("authorization") {
+			if strings.HasPrefix(value, "Bearer ") {
+				token = strings.TrimPrefix(value, "Bearer ")
+			}
+		}
+	}
+
+	principal, scope := authenticateCredentials(state, token)
+	if scope == "" {
+		atomic.AddUint64(&adminAuthFailures, 1)
+		log.Debugf("gRPC %s from %s not authenticated.", method, remote)
+		return status.Error(codes.Unauthenticated, "Authentication required.")
+	}
+	if grpcWriteMethods[method] && scope != scopeWrite {
+		atomic.AddUint64(&adminAuthFailures, 1)
+		log.Warnf("gRPC %s from %s denied, %s has no write scope.", method, remote, principal)
+		return status.Error(codes.PermissionDenied, "Write scope required.")
+	}
+	return nil
+}
+
+func grpcUnaryAuth(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := authenticateGrpc(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, request)
+}
+
+func grpcStreamAuth(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := authenticateGrpc(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(server, stream)
+}
+
+// startGrpcServer serve gRPC API with TLS and authentication of admin API.
+func startGrpcServer() {
+	if grpcListen == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", grpcListen)
+	if err != nil {
+		log.Fatalf("gRPC listen %s error: %s", grpcListen, err.Error())
+	}
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(grpcUnaryAuth), grpc.StreamInterceptor(grpcStreamAuth)}
+	if adminTlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(adminTlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	RegisterLookupServer(server, &lookupServer{})
+
+	log.Infof("gRPC API listen on %s.", grpcListen)
+	go func() {
+		err := server.Serve(listener)
+		if err != nil {
+			log.Fatalf("gRPC serve %s error: %s", grpcListen, err.Error())
+		}
+	}()
+}
@@ -0,0 +1,293 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule hits count decisions made by each mapping of rule sets, to find stale mappings never matched for days. Kept in
+// memory since startup, or persisted in a bbolt DB file if --rule-hits-db set.
+var ruleHitsDbPath string
+
+// ruleHitsFlushInterval is how often counts written to rule hits DB.
+const ruleHitsFlushInterval = time.Minute
+
+// defaultStaleDays of rule hits report.
+const defaultStaleDays = 30
+
+var ruleHitsBucket = []byte("rule_hits")
+var ruleHitsMetaBucket = []byte("meta")
+var ruleHitsSinceKey = []byte("since")
+
+var ruleHitsDb *bolt.DB
+
+type ruleHit struct {
+	Count     uint64    `json:"count"`
+	LastMatch time.Time `json:"last_match"`
+	dirty     bool
+}
+
+var ruleHits = struct {
+	sync.Mutex
+	// since is when tracking started, first open of rule hits DB or startup.
+	since   time.Time
+	entries map[string]*ruleHit
+}{since: time.Now(), entries: make(map[string]*ruleHit)}
+
+func ruleHitKey(ruleSetName string, mapping string) string {
+	return ruleSetName + " " + mapping
+}
+
+// decisionMapping return mapping made the decision, named as its flag, e.g. "target US", "isp-target google llc".
+// Return false if decision not made by a mapping, e.g. pinned.
+func decisionMapping(d decision) (string, bool) {
+	switch d.Rule {
+	case "country", "web", "tld", "default":
+		return "target " + d.matchKey, d.matchKey != ""
+	case "schedule":
+		return "schedule-target " + d.matchKey, d.matchKey != ""
+	case "isp":
+		return "isp-target " + strings.TrimPrefix(d.matchKey, "isp:"), d.matchKey != ""
+	case "anonymous":
+		return "anonymous-target " + strings.TrimPrefix(d.matchKey, "anonymous:"), d.matchKey != ""
+	case "script":
+		return "script " + strings.TrimPrefix(d.matchKey, "script:"), d.matchKey != ""
+	}
+	return "", false
+}
+
+// getMappings return names of all mappings of the rule set, same as decisionMapping.
+func (rs *ruleSet) getMappings() []string {
+	mappings := []string{}
+	for country := range rs.destinationMap {
+		mappings = append(mappings, "target "+country)
+	}
+	for country := range rs.scheduleMap {
+		mappings = append(mappings, "schedule-target "+country)
+	}
+	for isp := range rs.ispMap {
+		mappings = append(mappings, "isp-target "+isp)
+	}
+	for flag := range rs.anonymousMap {
+		mappings = append(mappings, "anonymous-target "+flag)
+	}
+	for i := range rs.scriptSources {
+		mappings = append(mappings, fmt.Sprintf("script %d", i))
+	}
+	sort.Strings(mappings)
+	return mappings
+}
+
+func recordRuleHit(d decision) {
+	mapping, ok := decisionMapping(d)
+	if !ok {
+		return
+	}
+	key := ruleHitKey(d.RuleSet, mapping)
+
+	ruleHits.Lock()
+	defer ruleHits.Unlock()
+	hit, ok := ruleHits.entries[key]
+	if !ok {
+		hit = &ruleHit{}
+		ruleHits.entries[key] = hit
+	}
+	hit.Count++
+	hit.LastMatch = time.Now()
+	hit.dirty = true
+}
+
+// openRuleHitsDb open or create rule hits DB and load counts.
+func openRuleHitsDb(path string) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Open rule hits DB %s error: %s", path, err.Error()))
+	}
+
+	since := time.Now()
+	loaded := make(map[string]*ruleHit)
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(ruleHitsMetaBucket)
+		if err != nil {
+			return err
+		}
+		if value := meta.Get(ruleHitsSinceKey); value != nil {
+			if err := since.UnmarshalText(value); err != nil {
+				return errors.New(fmt.Sprintf("Invalid tracking start time: %s", err.Error()))
+			}
+		} else {
+			value, _ := since.MarshalText()
+			if err := meta.Put(ruleHitsSinceKey, value); err != nil {
+				return err
+			}
+		}
+
+		bucket, err := tx.CreateBucketIfNotExists(ruleHitsBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(key []byte, value []byte) error {
+			hit := &ruleHit{}
+			if err := json.Unmarshal(value, hit); err != nil {
+				return errors.New(fmt.Sprintf("Invalid rule hit %s: %s", key, err.Error()))
+			}
+			loaded[string(key)] = hit
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return errors.New(fmt.Sprintf("Load rule hits DB %s error: %s", path, err.Error()))
+	}
+
+	ruleHitsDb = db
+	ruleHits.Lock()
+	ruleHits.since = since
+	ruleHits.entries = loaded
+	ruleHits.Unlock()
+	log.Infof("Loaded %d rule hit count(s) from %s, tracked since %s.", len(loaded), path, since.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// flushRuleHits write changed counts to rule hits DB.
+func flushRuleHits() {
+	if ruleHitsDb == nil {
+		return
+	}
+
+	ruleHits.Lock()
+	changed := make(map[string]ruleHit)
+	for key, hit := range ruleHits.entries {
+		if hit.dirty {
+			changed[key] = *hit
+			hit.dirty = false
+		}
+	}
+	ruleHits.Unlock()
+	if len(changed) < 1 {
+		return
+	}
+
+	err := ruleHitsDb.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(ruleHitsBucket)
+		for key, hit := range changed {
+			value, err := json.Marshal(hit)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Write rule hits DB error: %s", err.Error())
+	}
+}
+
+// startRuleHitsFlush write counts to rule hits DB every ruleHitsFlushInterval.
+func startRuleHitsFlush() {
+	if ruleHitsDb == nil {
+		return
+	}
+	go func() {
+		for range time.Tick(ruleHitsFlushInterval) {
+			flushRuleHits()
+		}
+	}()
+}
+
+type mappingHits struct {
+	Mapping   string     `json:"mapping"`
+	Count     uint64     `json:"count"`
+	LastMatch *time.Time `json:"last_match,omitempty"`
+}
+
+// getRuleHitsReport return hit counts of mappings in each rule set, and mappings not matched in staleDays. Report is
+// only complete if tracked longer than staleDays.
+func getRuleHitsReport(staleDays int) map[string]interface{} {
+	ruleSetsLock.RLock()
+	sets := make([]*ruleSet, 0, len(ruleSets))
+	for _, rs := range ruleSets {
+		sets = append(sets, rs)
+	}
+	ruleSetsLock.RUnlock()
+
+	ruleHits.Lock()
+	defer ruleHits.Unlock()
+	cutoff := time.Now().AddDate(0, 0, -staleDays)
+	report := make(map[string]interface{})
+	for _, rs := range sets {
+		all := []mappingHits{}
+		stale := []string{}
+		for _, mapping := range rs.getMappings() {
+			hits := mappingHits{Mapping: mapping}
+			if hit, ok := ruleHits.entries[ruleHitKey(rs.name, mapping)]; ok {
+				lastMatch := hit.LastMatch
+				hits.Count = hit.Count
+				hits.LastMatch = &lastMatch
+			}
+			if hits.LastMatch == nil || hits.LastMatch.Before(cutoff) {
+				stale = append(stale, mapping)
+			}
+			all = append(all, hits)
+		}
+		report[rs.name] = map[string]interface{}{
+			"mappings": all,
+			"stale":    stale,
+		}
+	}
+
+	return map[string]interface{}{
+		"since":      ruleHits.since.UTC(),
+		"stale_days": staleDays,
+		"complete":   ruleHits.since.Before(cutoff),
+		"persistent": ruleHitsDb != nil,
+		"rule_sets":  report,
+	}
+}
+
+// adminRuleHitsHandler GET report mappings and ones not matched in "days" (default 30) days.
+func adminRuleHitsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	staleDays := defaultStaleDays
+	if value := r.FormValue("days"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 1 {
+			writeJsonError(w, http.StatusBadRequest, "Invalid days.")
+			return
+		}
+		staleDays = days
+	}
+	writeJson(w, http.StatusOK, getRuleHitsReport(staleDays))
+}
@@ -0,0 +1,304 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	cli "gopkg.in/urfave/cli.v1"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// importColumns are header names accepted for each column of import CSV, lower case.
+var importColumns = map[string][]string{
+	"country": {"country", "country code", "cc", "iso"},
+	"target":  {"target", "targets", "relay", "relays", "mta", "nexthop", "next hop"},
+	"label":   {"label", "name", "comment"},
+}
+
+// targetName match relay host name, after IP literals checked.
+var targetName = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?(\.[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?)*\.?$`)
+
+// importRow is one country assignment of import CSV.
+type importRow struct {
+	country string
+	targets []string
+	label   string
+}
+
+func importCommand() cli.Command {
+	return cli.Command{
+		Name:      "import",
+		Usage:     "Convert CSV/TSV of country to relay assignments into rule set file.",
+		ArgsUsage: "CSV_FILE",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "default",
+				Usage: `Default country of the rule set. Rows with country "default" or "*" set it too.`,
+			},
+			cli.StringFlag{
+				Name:  "format",
+				Usage: `Output format, "conf", "yaml" or "json".`,
+				Value: "conf",
+			},
+			cli.StringFlag{
+				Name:  "delimiter",
+				Usage: `Column delimiter, "tab" for TSV. Guessed from file extension and first line if empty.`,
+			},
+			cli.StringFlag{
+				Name:  "output,o",
+				Usage: "Output file. Standard output if empty.",
+			},
+		},
+		Action: importHandler,
+	}
+}
+
+// guessDelimiter return tab for .tsv file or first line with more tabs than commas, else comma.
+func guessDelimiter(path string, data []byte) rune {
+	if strings.EqualFold(filepath.Ext(path), ".tsv") {
+		return '\t'
+	}
+	firstLine := strings.SplitN(string(data), "\n", 2)[0]
+	if strings.Count(firstLine, "\t") > strings.Count(firstLine, ",") {
+		return '\t'
+	}
+	if strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		return ';'
+	}
+	return ','
+}
+
+// findImportColumns return index of country, target and label column from header. Without header, columns are
+// country, target and optional label in that order.
+func findImportColumns(header []string) (map[string]int, bool) {
+	columns := make(map[string]int)
+	for index, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for column, names := range importColumns {
+			for _, candidate := range names {
+				if _, ok := columns[column]; !ok && name == candidate {
+					columns[column] = index
+				}
+			}
+		}
+	}
+	if _, ok := columns["country"]; ok {
+		if _, ok := columns["target"]; ok {
+			return columns, true
+		}
+	}
+	return map[string]int{"country": 0, "target": 1, "label": 2}, false
+}
+
+// validateTargetName check target is IP address or host name.
+func validateTargetName(target string) error {
+	if net.ParseIP(target) != nil {
+		return nil
+	}
+	if len(target) > 253 || !targetName.MatchString(target) {
+		return errors.New(fmt.Sprintf("Invalid target %s, must be host name or IP address", target))
+	}
+	return nil
+}
+
+// parseImportRows convert CSV records into rows. Errors of all lines returned, so spreadsheet fixed in one go.
+func parseImportRows(records [][]string, defaultCountry *string) ([]importRow, []string) {
+	if len(records) < 1 {
+		return nil, []string{"No rows"}
+	}
+	columns, hasHeader := findImportColumns(records[0])
+	if hasHeader {
+		records = records[1:]
+	}
+	firstLine := 1
+	if hasHeader {
+		firstLine = 2
+	}
+
+	rows := []importRow{}
+	problems := []string{}
+	for index, record := range records {
+		line := firstLine + index
+		cell := func(column string) string {
+			if columnIndex, ok := columns[column]; ok && columnIndex < len(record) {
+				return strings.TrimSpace(record[columnIndex])
+			}
+			return ""
+		}
+		country := strings.ToUpper(cell("country"))
+		if country == "" || strings.HasPrefix(country, "#") {
+			continue
+		}
+		if country == "DEFAULT" || country == "*" {
+			*defaultCountry = strings.ToUpper(cell("target"))
+			continue
+		}
+		if err := validateCountryCode(country); err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: %s", line, err.Error()))
+			continue
+		}
+
+		row := importRow{country: country, label: cell("label")}
+		for _, target := range strings.FieldsFunc(cell("target"), func(r rune) bool {
+			return r == ',' || r == ';' || r == '|' || r == ' ' || r == '\t'
+		}) {
+			target = normalizeTarget(target)
+			if err := validateTargetName(strings.Trim(target, "[]")); err != nil {
+				problems = append(problems, fmt.Sprintf("line %d: %s", line, err.Error()))
+				continue
+			}
+			row.targets = append(row.targets, target)
+		}
+		if len(row.targets) < 1 {
+			problems = append(problems, fmt.Sprintf("line %d: No target for %s", line, country))
+			continue
+		}
+		if strings.Contains(row.label, `"`) {
+			problems = append(problems, fmt.Sprintf(`line %d: Label of %s can't contain '"'`, line, country))
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, problems
+}
+
+// targetValues return row in --target format, one per target of the pool, e.g. `JP:mta1 label="apac"`.
+func (row importRow) targetValues() []string {
+	values := make([]string, 0, len(row.targets))
+	for _, target := range row.targets {
+		value := row.country + ":" + target
+		if row.label != "" {
+			value += fmt.Sprintf(` label="%s"`, row.label)
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// formatImport write rule set in format of loadRuleSetFile.
+func formatImport(format string, source string, targets []string, defaultCountry string) ([]byte, error) {
+	switch format {
+	case "conf":
+		lines := []string{"# Imported from " + filepath.Base(source)}
+		for _, target := range targets {
+			lines = append(lines, "target "+target)
+		}
+		lines = append(lines, "default "+defaultCountry)
+		return []byte(strings.Join(lines, "\n") + "\n"), nil
+	case "yaml":
+		return yaml.Marshal(yaml.MapSlice{{Key: "target", Value: targets}, {Key: "default", Value: defaultCountry}})
+	case "json":
+		data, err := json.MarshalIndent(map[string]interface{}{"target": targets, "default": defaultCountry}, "", "  ")
+		return append(data, '\n'), err
+	}
+	return nil, errors.New(fmt.Sprintf(`Unknown format %s, must be "conf", "yaml" or "json".`, format))
+}
+
+func importHandler(c *cli.Context) error {
+	if c.NArg() != 1 {
+		cli.ShowCommandHelp(c, "import")
+		return errors.New("Need CSV_FILE.")
+	}
+	path := c.Args().First()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Spreadsheet export may start with UTF-8 BOM.
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(string(data), "\ufeff")))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comma = guessDelimiter(path, data)
+	switch c.String("delimiter") {
+	case "":
+	case "tab", `\t`:
+		reader.Comma = '\t'
+	default:
+		if len([]rune(c.String("delimiter"))) != 1 {
+			return errors.New(fmt.Sprintf("Invalid delimiter %s, must be one character or \"tab\".", c.String("delimiter")))
+		}
+		reader.Comma = []rune(c.String("delimiter"))[0]
+	}
+	records := [][]string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("Read %s error: %s", path, err.Error()))
+		}
+		records = append(records, record)
+	}
+
+	defaultCountry := ""
+	rows, problems := parseImportRows(records, &defaultCountry)
+	if c.String("default") != "" {
+		defaultCountry = strings.ToUpper(c.String("default"))
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		return errors.New(fmt.Sprintf("%d problem(s) in %s, nothing written.", len(problems), path))
+	}
+	if defaultCountry == "" {
+		return errors.New(`Need --default, or a row with country "default".`)
+	}
+
+	targets := make([]string, 0, len(rows))
+	for _, row := range rows {
+		targets = append(targets, row.targetValues()...)
+	}
+	// Same validation as loading the output, e.g. default country must be mapped.
+	if _, err := newRuleSet("import", ruleSetConfig{targets: targets, defaultTarget: defaultCountry}); err != nil {
+		return err
+	}
+
+	output, err := formatImport(c.String("format"), path, targets, defaultCountry)
+	if err != nil {
+		return err
+	}
+	if c.String("output") == "" {
+		_, err = os.Stdout.Write(output)
+		return err
+	}
+	if err := ioutil.WriteFile(c.String("output"), output, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d row(s) of %d countries to %s.\n", len(rows), countImportCountries(rows), c.String("output"))
+	return nil
+}
+
+func countImportCountries(rows []importRow) int {
+	countries := make(map[string]bool)
+	for _, row := range rows {
+		countries[row.country] = true
+	}
+	return len(countries)
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// domainConcurrency cap simultaneous evaluations of one domain (one email if script or plugin used). Excess
+// queries wait for an in-flight evaluation and share its result. 0 for no limit.
+var domainConcurrency int
+
+var sharedEvaluations uint64
+
+type inflightCall struct {
+	done   chan struct{}
+	result decision
+}
+
+var inflight = struct {
+	sync.Mutex
+	// calls of each key, latest last.
+	calls map[string][]*inflightCall
+}{
+	calls: make(map[string][]*inflightCall),
+}
+
+// evaluateLimited evaluate the email, or wait for result of in-flight evaluation of same domain if limit reached.
+func evaluateLimited(rs *ruleSet, email string) decision {
+	if domainConcurrency < 1 {
+		return evaluateWithShadow(rs, email)
+	}
+
+	key := rs.name + " " + decisionKey(rs, email)
+	inflight.Lock()
+	calls := inflight.calls[key]
+	if len(calls) >= domainConcurrency {
+		call := calls[len(calls)-1]
+		inflight.Unlock()
+		<-call.done
+		atomic.AddUint64(&sharedEvaluations, 1)
+		return shareDecision(rs, call.result)
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	inflight.calls[key] = append(calls, call)
+	inflight.Unlock()
+
+	call.result = evaluateWithShadow(rs, email)
+
+	inflight.Lock()
+	calls = inflight.calls[key]
+	for i, c := range calls {
+		if c == call {
+			calls = append(calls[:i], calls[i+1:]...)
+			break
+		}
+	}
+	if len(calls) > 0 {
+		inflight.calls[key] = calls
+	} else {
+		delete(inflight.calls, key)
+	}
+	inflight.Unlock()
+	close(call.done)
+	return call.result
+}
+
+// shareDecision reuse decision of another query. Target picked again from pool.
+func shareDecision(rs *ruleSet, d decision) decision {
+	d.Cached = true
+	if d.Action == "" {
+		if target, ok := pickCountryTarget(d.Country, d.Pool); ok {
+			d.Target = target
+			rs.applyMappingOptions(&d)
+		}
+	}
+	return d
+}
@@ -0,0 +1,63 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// allowUnusableIps keep loopback, private, link-local and unspecified addresses of MX and apex records, e.g. for
+// internal domains. By default they are dropped before geolocation, GeoIP DB can't locate them.
+var allowUnusableIps bool
+var unusableIpRecords uint64
+
+// sharedAddressSpace is carrier-grade NAT range (RFC 6598), not routable on internet.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isUnusableIp(ip net.IP) bool {
+	return ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsMulticast() || sharedAddressSpace.Contains(ip)
+}
+
+// filterUnusableIps drop unusable addresses published by host of the domain, and log them.
+func filterUnusableIps(domain string, host string, ips []net.IP) []net.IP {
+	if allowUnusableIps {
+		return ips
+	}
+
+	usable := make([]net.IP, 0, len(ips))
+	dropped := []string{}
+	for _, ip := range ips {
+		if isUnusableIp(ip) {
+			dropped = append(dropped, ip.String())
+			continue
+		}
+		usable = append(usable, ip)
+	}
+	if len(dropped) > 0 {
+		atomic.AddUint64(&unusableIpRecords, 1)
+		log.WithFields(log.Fields{
+			"domain":    domain,
+			"host":      host,
+			"addresses": strings.Join(dropped, ","),
+		}).Warn("Domain publish unusable address, ignored.")
+	}
+	return usable
+}
@@ -0,0 +1,67 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// normalizeTarget return IP literal target in canonical form without brackets, e.g. "[2001:DB8::1]" to "2001:db8::1",
+// so drain, pin and stats see one target however it is written. Host name targets are returned as is.
+func normalizeTarget(target string) string {
+	literal := target
+	if strings.HasPrefix(literal, "[") && strings.HasSuffix(literal, "]") {
+		literal = literal[1 : len(literal)-1]
+	}
+	if ip := net.ParseIP(literal); ip != nil {
+		return ip.String()
+	}
+	return target
+}
+
+// isIpv6Target return true if target is an IPv6 literal. Postfix only accept it bracketed in nexthop.
+func isIpv6Target(target string) bool {
+	ip := net.ParseIP(target)
+	return ip != nil && ip.To4() == nil
+}
+
+// splitMapping split "KEY:MTA" on first ":", so MTA can be an IPv6 literal, bare or bracketed.
+func splitMapping(value string) (string, string, bool) {
+	sepIndex := strings.Index(value, ":")
+	if sepIndex < 0 {
+		return "", "", false
+	}
+	return value[:sepIndex], normalizeTarget(value[sepIndex+1:]), true
+}
+
+// validateListenAddress check listen address is "HOST:PORT", IPv6 host bracketed like "[::]:2527".
+func validateListenAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		if strings.Count(address, ":") > 1 && !strings.HasPrefix(address, "[") {
+			return errors.New(fmt.Sprintf(`Invalid listen address %s, IPv6 address must be bracketed, e.g. "[::]:2527".`, address))
+		}
+		return errors.New(fmt.Sprintf("Invalid listen address %s: %s", address, err.Error()))
+	}
+	if host != "" && net.ParseIP(host) == nil && strings.Contains(host, ":") {
+		return errors.New(fmt.Sprintf("Invalid listen address %s: %s is not an IP address.", address, host))
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/idna"
+	"net/url"
+	"strings"
+)
+
+// decodeRequestKey return key of a request line. Postfix tcp_table send "get KEY" with non printable and non
+// ASCII characters (e.g. UTF-8 of SMTPUTF8 addresses) encoded as %XX. Raw keys without "get " also accepted.
+func decodeRequestKey(line string) string {
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasPrefix(line, "get ") {
+		return line
+	}
+	key := strings.TrimPrefix(line, "get ")
+	if decoded, err := url.PathUnescape(key); err == nil {
+		return decoded
+	}
+	return key
+}
+
+// keyNormalizers are optional normalizations of local part and domain, enabled by --key-normalizer. Add
+// provider specific ones here.
+var keyNormalizers = map[string]func(local string, domain string) (string, string){
+	"subaddress": foldSubaddress,
+}
+
+var enabledKeyNormalizers []func(local string, domain string) (string, string)
+
+// subaddressSeparator separate tag of subaddress, e.g. "+" of "user+tag@example.com".
+var subaddressSeparator string
+
+func setupKeyNormalizers(names []string) error {
+	for _, name := range names {
+		normalizer, ok := keyNormalizers[name]
+		if !ok {
+			return errors.New(fmt.Sprintf("Unknown key normalizer: %s", name))
+		}
+		enabledKeyNormalizers = append(enabledKeyNormalizers, normalizer)
+	}
+	if len(names) > 0 {
+		log.Infof("Key normalizers: %v", names)
+	}
+	return nil
+}
+
+// foldSubaddress strip "+tag" of local part, so unique tags don't fragment decision cache.
+func foldSubaddress(local string, domain string) (string, string) {
+	if subaddressSeparator == "" {
+		return local, domain
+	}
+	if sepIndex := strings.Index(local, subaddressSeparator); sepIndex > 0 {
+		local = local[:sepIndex]
+	}
+	return local, domain
+}
+
+// normalizeKey trim whitespace, lower case domain and strip its trailing dot, so "User@Example.COM." and
+// "User@example.com" share decision and cache entry. Local part kept as is, unless changed by enabled key
+// normalizers.
+func normalizeKey(key string) string {
+	key = strings.TrimSpace(key)
+	sepIndex := strings.LastIndex(key, "@")
+	if sepIndex < 0 {
+		if isDomainKey(key) {
+			return strings.TrimSuffix(strings.ToLower(key), ".")
+		}
+		return key
+	}
+	local := key[:sepIndex]
+	domain := strings.TrimSuffix(strings.ToLower(key[sepIndex+1:]), ".")
+	for _, normalizer := range enabledKeyNormalizers {
+		local, domain = normalizer(local, domain)
+	}
+	return local + "@" + domain
+}
+
+// isDomainKey return true if key is a domain "example.com" or parent domain ".example.com", not an address.
+func isDomainKey(key string) bool {
+	domain := strings.TrimPrefix(key, ".")
+	if domain == "" || strings.ContainsAny(domain, "@ \t") || strings.HasPrefix(domain, ".") {
+		return false
+	}
+	return strings.Contains(domain, ".") && !strings.Contains(domain, "..")
+}
+
+// toAsciiDomain convert internationalized domain (U-label) to A-label for DNS, e.g. "bücher.example" to
+// "xn--bcher-kva.example". ASCII domains returned as is.
+func toAsciiDomain(domain string) (string, error) {
+	for _, char := range domain {
+		if char >= 0x80 {
+			ascii, err := idna.Lookup.ToASCII(domain)
+			if err != nil {
+				return "", errors.New(fmt.Sprintf("Invalid internationalized domain %s: %s", domain, err.Error()))
+			}
+			return ascii, nil
+		}
+	}
+	return domain, nil
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"syscall"
+	"unsafe"
+)
+
+// landlockAccessFs is filesystem access rights handled by each Landlock ABI version.
+var landlockAccessFs = map[int]uint64{
+	1: 0x1fff,
+	2: 0x1fff | unix.LANDLOCK_ACCESS_FS_REFER,
+	3: 0x1fff | unix.LANDLOCK_ACCESS_FS_REFER | unix.LANDLOCK_ACCESS_FS_TRUNCATE,
+}
+
+// applyLandlock deny all filesystem access of the process, files already opened still usable. Apply to all threads,
+// which need binary built without cgo.
+func applyLandlock() error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return errors.New(fmt.Sprintf("Landlock not supported by kernel: %s", errno.Error()))
+	}
+	version := int(abi)
+	if version > 3 {
+		version = 3
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: landlockAccessFs[version]}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errors.New(fmt.Sprintf("Create Landlock ruleset error: %s", errno.Error()))
+	}
+	defer unix.Close(int(fd))
+
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return errors.New(fmt.Sprintf("Set no new privileges error: %s", errno.Error()))
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return errors.New(fmt.Sprintf("Landlock restrict error: %s", errno.Error()))
+	}
+	log.Infof("Landlock (ABI %d) applied, no filesystem access.", abi)
+	return nil
+}
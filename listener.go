@@ -0,0 +1,116 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// listenerConfig is a --listen flag value.
+type listenerConfig struct {
+	address  string
+	ruleSet  string
+	protocol string
+}
+
+// parseListenFlag parse "[PROTOCOL://]ADDRESS[=RULESET]". Default protocol is --protocol, default rule set "default".
+func parseListenFlag(value string) (listenerConfig, error) {
+	config := listenerConfig{address: value, ruleSet: defaultRuleSetName, protocol: protocol}
+	if sepIndex := strings.Index(config.address, "://"); sepIndex >= 0 {
+		listenProtocol, err := parseProtocol(config.address[:sepIndex])
+		if err != nil {
+			return config, errors.New(fmt.Sprintf("Invalid protocol of listener %s: %s", value, err.Error()))
+		}
+		config.protocol = listenProtocol
+		config.address = config.address[sepIndex+3:]
+	}
+	if sepIndex := strings.LastIndex(config.address, "="); sepIndex >= 0 {
+		config.ruleSet = config.address[sepIndex+1:]
+		config.address = config.address[:sepIndex]
+	}
+	if err := validateListenAddress(config.address); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// remoteAddr is client address of HTTP request, for logTrace.
+type remoteAddr string
+
+func (a remoteAddr) Network() string {
+	return "tcp"
+}
+
+func (a remoteAddr) String() string {
+	return string(a)
+}
+
+// serveHttpListener serve GET /lookup/{email} of the listener rule set. Unlike admin API lookup, queries are
+// counted, cached and logged like other listeners. Need "Authorization: Bearer TOKEN" if --auth-token-file set.
+func serveHttpListener(listener net.Listener, config listenerConfig) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/lookup/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+			return
+		}
+		if authToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(authToken)) != 1 {
+				atomic.AddUint64(&authFailures, 1)
+				log.Warnf("Authentication of %s failed: invalid token", r.RemoteAddr)
+				writeJsonError(w, http.StatusUnauthorized, "Authentication failed.")
+				return
+			}
+		}
+		email := strings.TrimPrefix(r.URL.Path, "/lookup/")
+		if email == "" {
+			writeJsonError(w, http.StatusBadRequest, "Missing email.")
+			return
+		}
+		if violation := checkRequest(email, email); violation != "" {
+			recordProtocolViolation(remoteAddr(r.RemoteAddr), violation)
+			writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("Invalid email: %s", violation))
+			return
+		}
+
+		sampled := sampleLookupLog()
+		if sampled {
+			log.Infof("Received '%s'", email)
+		}
+		result := getResult(getRuleSet(config.ruleSet), email)
+		recordClientQuery(nil, remoteAddr(r.RemoteAddr), result)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, genJsonResponse(result))
+		logTrace(email, remoteAddr(r.RemoteAddr), result)
+		logDecision(email, result, sampled)
+	})
+
+	err := http.Serve(listener, mux)
+	if err != nil && !isShuttingDown() {
+		log.Errorf("HTTP listener %s error: %s", config.address, err.Error())
+	}
+}
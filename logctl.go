@@ -0,0 +1,233 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Lookups of traced domains or from traced client IPs log their full trace, without debug level for all.
+// tracedDomains are domain patterns, e.g. "*.example.com". Each pipeline step of their lookups also logged as it
+// happen.
+var tracedDomains = make(map[string]bool)
+var tracedClients = make(map[string]bool)
+var tracedLock sync.RWMutex
+
+// traceLog log traces at info level, even if log level set higher.
+var traceLog = &log.Logger{
+	Out:       os.Stdout,
+	Formatter: &log.JSONFormatter{},
+	Hooks:     make(log.LevelHooks),
+	Level:     log.InfoLevel,
+}
+
+func setLogLevel(value string) error {
+	level, err := log.ParseLevel(value)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid log level: %s", value))
+	}
+	log.SetLevel(level)
+	return nil
+}
+
+// setLogFormat set format of logs to stdout: json (default) or text.
+func setLogFormat(value string) error {
+	var formatter log.Formatter
+	switch value {
+	case "json":
+		formatter = &log.JSONFormatter{}
+	case "text":
+		formatter = &log.TextFormatter{FullTimestamp: true, DisableColors: true}
+	default:
+		return errors.New(fmt.Sprintf("Invalid log format: %s", value))
+	}
+	log.SetFormatter(formatter)
+	traceLog.Formatter = formatter
+	return nil
+}
+
+// setLogFile append logs to the file instead of stdout, e.g. for Windows service which has no console.
+func setLogFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Open log file %s error: %s", path, err.Error()))
+	}
+	log.SetOutput(file)
+	traceLog.Out = file
+	return nil
+}
+
+// isDomainTraced return true if the domain match any traced domain pattern.
+func isDomainTraced(domain string) bool {
+	tracedLock.RLock()
+	defer tracedLock.RUnlock()
+	for pattern := range tracedDomains {
+		if matchDomainPattern(pattern, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTraced return true if domain of the key or the client is traced.
+func isTraced(key string, client net.Addr) bool {
+	if domain, err := getEmailDomain(key); err == nil && isDomainTraced(domain) {
+		return true
+	}
+
+	tracedLock.RLock()
+	defer tracedLock.RUnlock()
+	if client != nil {
+		if host, _, err := net.SplitHostPort(client.String()); err == nil && tracedClients[net.ParseIP(host).String()] {
+			return true
+		}
+	}
+	return false
+}
+
+// logTrace log full trace of the lookup if traced.
+func logTrace(key string, client net.Addr, d decision) {
+	if !isTraced(key, client) {
+		return
+	}
+	fields := log.Fields{
+		"key":        key,
+		"rule_set":   d.RuleSet,
+		"rule":       d.Rule,
+		"target":     d.Target,
+		"country":    d.Country,
+		"cached":     d.Cached,
+		"trace":      d.Trace,
+		"errors":     d.Errors,
+		"timings_ms": d.Timings,
+	}
+	if client != nil {
+		fields["client"] = client.String()
+	}
+	traceLog.WithFields(fields).Info("Lookup trace.")
+}
+
+// setupTracedDomains trace domain patterns from --trace-domain.
+func setupTracedDomains(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New(fmt.Sprintf("Invalid trace domain pattern: %s", pattern))
+		}
+		setTraced(tracedDomains, strings.ToLower(pattern), true)
+	}
+	if len(patterns) > 0 {
+		log.Warnf("Trace lookups of domains: %v", patterns)
+	}
+	return nil
+}
+
+func setTraced(traced map[string]bool, value string, enabled bool) {
+	tracedLock.Lock()
+	defer tracedLock.Unlock()
+	if enabled {
+		traced[value] = true
+	} else {
+		delete(traced, value)
+	}
+}
+
+func hasTraced(traced map[string]bool, value string) bool {
+	tracedLock.RLock()
+	defer tracedLock.RUnlock()
+	return traced[value]
+}
+
+func getTraced(traced map[string]bool) []string {
+	tracedLock.RLock()
+	defer tracedLock.RUnlock()
+	values := make([]string, 0, len(traced))
+	for value := range traced {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// adminLogHandler GET return log level and traced domains/clients. PUT/POST with "level=debug" change log level,
+// with "domain=*.example.com" or "client=IP" trace it. DELETE with "domain" or "client" stop tracing it.
+func adminLogHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+		enabled := r.Method != http.MethodDelete
+		level := r.FormValue("level")
+		domain := strings.ToLower(strings.TrimSuffix(r.FormValue("domain"), "."))
+		client := r.FormValue("client")
+		if level == "" && domain == "" && client == "" {
+			writeJsonError(w, http.StatusBadRequest, "Missing level, domain or client.")
+			return
+		}
+		if _, err := path.Match(domain, ""); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "Invalid domain pattern.")
+			return
+		}
+		if client != "" && net.ParseIP(client) == nil {
+			writeJsonError(w, http.StatusBadRequest, "Invalid client IP.")
+			return
+		}
+
+		if level != "" {
+			if !enabled {
+				writeJsonError(w, http.StatusBadRequest, "Can't delete log level.")
+				return
+			}
+			previous := log.GetLevel().String()
+			if err := setLogLevel(level); err != nil {
+				writeJsonError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			log.Warnf("Log level set to %s.", level)
+			auditRequest(r, "log_level", "", "", previous, log.GetLevel().String())
+		}
+		if domain != "" {
+			previous := hasTraced(tracedDomains, domain)
+			setTraced(tracedDomains, domain, enabled)
+			log.Warnf("Trace of domain %s set to %v.", domain, enabled)
+			auditRequest(r, "trace_domain", domain, "", previous, enabled)
+		}
+		if client != "" {
+			client = net.ParseIP(client).String()
+			previous := hasTraced(tracedClients, client)
+			setTraced(tracedClients, client, enabled)
+			log.Warnf("Trace of client %s set to %v.", client, enabled)
+			auditRequest(r, "trace_client", client, "", previous, enabled)
+		}
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"level":   log.GetLevel().String(),
+		"domains": getTraced(tracedDomains),
+		"clients": getTraced(tracedClients),
+	})
+}
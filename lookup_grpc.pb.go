@@ -0,0 +1,385 @@
+// Copyright 2018 Alan Tang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: lookup.proto
+
+package main
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Lookup_Lookup_FullMethodName     = "/geoiptransportmap.Lookup/Lookup"
+	Lookup_Explain_FullMethodName    = "/geoiptransportmap.Lookup/Explain"
+	Lookup_BulkLookup_FullMethodName = "/geoiptransportmap.Lookup/BulkLookup"
+	Lookup_Watch_FullMethodName      = "/geoiptransportmap.Lookup/Watch"
+	Lookup_GetCached_FullMethodName  = "/geoiptransportmap.Lookup/GetCached"
+	Lookup_WarmCache_FullMethodName  = "/geoiptransportmap.Lookup/WarmCache"
+	Lookup_ListCache_FullMethodName  = "/geoiptransportmap.Lookup/ListCache"
+)
+
+// LookupClient is the client API for Lookup service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Lookup expose the routing engine to services other than Postfix.
+type LookupClient interface {
+	// Lookup return decision of one email, same as Postfix query to the listener.
+	Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*Decision, error)
+	// Explain is Lookup with evaluation trace.
+	Explain(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*Decision, error)
+	// BulkLookup return decisions of many emails, in request order. Emails of same domain evaluated once.
+	BulkLookup(ctx context.Context, in *BulkLookupRequest, opts ...grpc.CallOption) (*BulkLookupResponse, error)
+	// Watch stream an event on each rule set, drain or static mode change.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ChangeEvent], error)
+	// GetCached return cached decision of the email. Evaluated and cached if not cached, unless peek.
+	GetCached(ctx context.Context, in *CacheRequest, opts ...grpc.CallOption) (*CacheEntry, error)
+	// WarmCache evaluate and cache decisions of emails not cached yet.
+	WarmCache(ctx context.Context, in *BulkLookupRequest, opts ...grpc.CallOption) (*CacheEntries, error)
+	// ListCache return cached decisions of a rule set.
+	ListCache(ctx context.Context, in *ListCacheRequest, opts ...grpc.CallOption) (*CacheEntries, error)
+}
+
+type lookupClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLookupClient(cc grpc.ClientConnInterface) LookupClient {
+	return &lookupClient{cc}
+}
+
+func (c *lookupClient) Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*Decision, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Decision)
+	err := c.cc.Invoke(ctx, Lookup_Lookup_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *lookupClient) Explain(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*Decision, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Decision)
+	err := c.cc.Invoke(ctx, Lookup_Explain_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *lookupClient) BulkLookup(ctx context.Context, in *BulkLookupRequest, opts ...grpc.CallOption) (*BulkLookupResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BulkLookupResponse)
+	err := c.cc.Invoke(ctx, Lookup_BulkLookup_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *lookupClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ChangeEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Lookup_ServiceDesc.Streams[0], Lookup_Watch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchRequest, ChangeEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Lookup_WatchClient = grpc.ServerStreamingClient[ChangeEvent]
+
+func (c *lookupClient) GetCached(ctx context.Context, in *CacheRequest, opts ...grpc.CallOption) (*CacheEntry, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CacheEntry)
+	err := c.cc.Invoke(ctx, Lookup_GetCached_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *lookupClient) WarmCache(ctx context.Context, in *BulkLookupRequest, opts ...grpc.CallOption) (*CacheEntries, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CacheEntries)
+	err := c.cc.Invoke(ctx, Lookup_WarmCache_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *lookupClient) ListCache(ctx context.Context, in *ListCacheRequest, opts ...grpc.CallOption) (*CacheEntries, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CacheEntries)
+	err := c.cc.Invoke(ctx, Lookup_ListCache_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// LookupServer is the server API for Lookup service.
+// All implementations must embed UnimplementedLookupServer
+// for forward compatibility.
+//
+// Lookup expose the routing engine to services other than Postfix.
+type LookupServer interface {
+	// Lookup return decision of one email, same as Postfix query to the listener.
+	Lookup(context.Context, *LookupRequest) (*Decision, error)
+	// Explain is Lookup with evaluation trace.
+	Explain(context.Context, *LookupRequest) (*Decision, error)
+	// BulkLookup return decisions of many emails, in request order. Emails of same domain evaluated once.
+	BulkLookup(context.Context, *BulkLookupRequest) (*BulkLookupResponse, error)
+	// Watch stream an event on each rule set, drain or static mode change.
+	Watch(*WatchRequest, grpc.ServerStreamingServer[ChangeEvent]) error
+	// GetCached return cached decision of the email. Evaluated and cached if not cached, unless peek.
+	GetCached(context.Context, *CacheRequest) (*CacheEntry, error)
+	// WarmCache evaluate and cache decisions of emails not cached yet.
+	WarmCache(context.Context, *BulkLookupRequest) (*CacheEntries, error)
+	// ListCache return cached decisions of a rule set.
+	ListCache(context.Context, *ListCacheRequest) (*CacheEntries, error)
+	mustEmbedUnimplementedLookupServer()
+}
+
+// UnimplementedLookupServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedLookupServer struct{}
+
+func (UnimplementedLookupServer) Lookup(context.Context, *LookupRequest) (*Decision, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Lookup not implemented")
+}
+func (UnimplementedLookupServer) Explain(context.Context, *LookupRequest) (*Decision, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Explain not implemented")
+}
+func (UnimplementedLookupServer) BulkLookup(context.Context, *BulkLookupRequest) (*BulkLookupResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BulkLookup not implemented")
+}
+func (UnimplementedLookupServer) Watch(*WatchRequest, grpc.ServerStreamingServer[ChangeEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedLookupServer) GetCached(context.Context, *CacheRequest) (*CacheEntry, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCached not implemented")
+}
+func (UnimplementedLookupServer) WarmCache(context.Context, *BulkLookupRequest) (*CacheEntries, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method WarmCache not implemented")
+}
+func (UnimplementedLookupServer) ListCache(context.Context, *ListCacheRequest) (*CacheEntries, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCache not implemented")
+}
+func (UnimplementedLookupServer) mustEmbedUnimplementedLookupServer() {}
+func (UnimplementedLookupServer) testEmbeddedByValue()                {}
+
+// UnsafeLookupServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LookupServer will
+// result in compilation errors.
+type UnsafeLookupServer interface {
+	mustEmbedUnimplementedLookupServer()
+}
+
+func RegisterLookupServer(s grpc.ServiceRegistrar, srv LookupServer) {
+	// If the following call pancis, it indicates UnimplementedLookupServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Lookup_ServiceDesc, srv)
+}
+
+func _Lookup_Lookup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LookupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LookupServer).Lookup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Lookup_Lookup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LookupServer).Lookup(ctx, req.(*LookupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Lookup_Explain_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LookupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LookupServer).Explain(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Lookup_Explain_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LookupServer).Explain(ctx, req.(*LookupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Lookup_BulkLookup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BulkLookupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LookupServer).BulkLookup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Lookup_BulkLookup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LookupServer).BulkLookup(ctx, req.(*BulkLookupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Lookup_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LookupServer).Watch(m, &grpc.GenericServerStream[WatchRequest, ChangeEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Lookup_WatchServer = grpc.ServerStreamingServer[ChangeEvent]
+
+func _Lookup_GetCached_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CacheRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LookupServer).GetCached(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Lookup_GetCached_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LookupServer).GetCached(ctx, req.(*CacheRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Lookup_WarmCache_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BulkLookupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LookupServer).WarmCache(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Lookup_WarmCache_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LookupServer).WarmCache(ctx, req.(*BulkLookupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Lookup_ListCache_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCacheRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LookupServer).ListCache(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Lookup_ListCache_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LookupServer).ListCache(ctx, req.(*ListCacheRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Lookup_ServiceDesc is the grpc.ServiceDesc for Lookup service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Lookup_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "geoiptransportmap.Lookup",
+	HandlerType: (*LookupServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Lookup",
+			Handler:    _Lookup_Lookup_Handler,
+		},
+		{
+			MethodName: "Explain",
+			Handler:    _Lookup_Explain_Handler,
+		},
+		{
+			MethodName: "BulkLookup",
+			Handler:    _Lookup_BulkLookup_Handler,
+		},
+		{
+			MethodName: "GetCached",
+			Handler:    _Lookup_GetCached_Handler,
+		},
+		{
+			MethodName: "WarmCache",
+			Handler:    _Lookup_WarmCache_Handler,
+		},
+		{
+			MethodName: "ListCache",
+			Handler:    _Lookup_ListCache_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Lookup_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "lookup.proto",
+}
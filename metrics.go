@@ -0,0 +1,309 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/oschwald/geoip2-golang"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prometheus metrics on admin API /metrics. Labels are low cardinality, bounded by configuration, country codes,
+// fixed result classes and --client-stats-max client IPs, never domain or email. Latency histogram buckets carry the trace ID of their latest lookup as
+// OpenMetrics exemplar, same trace ID as slow lookup logs and decision events.
+
+const metricsNamespace = "geoip_transport"
+
+// latencyBuckets are upper bounds in seconds of lookup duration histogram.
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Result classes of lookup metrics.
+const (
+	// resultRouted is target of a matched rule.
+	resultRouted = "routed"
+	// resultFallback is default target, on no rule match or lookup error.
+	resultFallback = "fallback"
+	// resultStale is last good decision served while resolvers failed.
+	resultStale = "stale"
+	// resultDisallowed is country not in allow-list, replied disallowed reply.
+	resultDisallowed = "disallowed"
+	// resultDeferred is mapping outside business hours, replied deferral.
+	resultDeferred = "deferred"
+)
+
+type lookupSeries struct {
+	ruleSet string
+	rule    string
+	label   string
+	country string
+	pool    string
+	result  string
+}
+
+type latencySeries struct {
+	ruleSet string
+	cached  bool
+}
+
+type exemplar struct {
+	traceId string
+	value   float64
+	time    time.Time
+}
+
+type latencyHistogram struct {
+	// counts per bucket, not cumulative. Last one is +Inf.
+	counts    []uint64
+	exemplars []*exemplar
+	sum       float64
+	count     uint64
+}
+
+var lookupMetrics = struct {
+	sync.Mutex
+	counts     map[lookupSeries]uint64
+	histograms map[latencySeries]*latencyHistogram
+}{counts: make(map[lookupSeries]uint64), histograms: make(map[latencySeries]*latencyHistogram)}
+
+// newTraceId return random W3C trace context style ID of a lookup.
+func newTraceId() string {
+	return fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+}
+
+func resultClass(d decision) string {
+	switch {
+	case d.Action != "":
+		return d.Action
+	case d.Stale:
+		return resultStale
+	case d.ErrorCode == errorCountryNotAllowed:
+		return resultDisallowed
+	case d.ErrorCode == errorOutsideHours:
+		return resultDeferred
+	case d.ErrorCode != "":
+		return resultFallback
+	}
+	return resultRouted
+}
+
+// poolLabel return name of named pool of the targets, or the targets if not from a named pool.
+func (rs *ruleSet) poolLabel(targets []string) string {
+	name := ""
+	for poolName, pool := range rs.pools {
+		if equalStrings(pool, targets) && (name == "" || poolName < name) {
+			name = poolName
+		}
+	}
+	if name != "" {
+		return name
+	}
+	sorted := append([]string{}, targets...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// recordLookupMetrics count the lookup and observe its duration.
+func recordLookupMetrics(rs *ruleSet, d decision, duration time.Duration, traceId string) {
+	series := lookupSeries{ruleSet: d.RuleSet, rule: d.Rule, label: d.Label, country: d.Country, result: resultClass(d)}
+	if rs != nil && len(d.Pool) > 0 {
+		series.pool = rs.poolLabel(d.Pool)
+	}
+	seconds := duration.Seconds()
+	bucket := sort.SearchFloat64s(latencyBuckets, seconds)
+
+	lookupMetrics.Lock()
+	defer lookupMetrics.Unlock()
+	lookupMetrics.counts[series]++
+	key := latencySeries{ruleSet: d.RuleSet, cached: d.Cached}
+	histogram, ok := lookupMetrics.histograms[key]
+	if !ok {
+		histogram = &latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1), exemplars: make([]*exemplar, len(latencyBuckets)+1)}
+		lookupMetrics.histograms[key] = histogram
+	}
+	histogram.counts[bucket]++
+	histogram.exemplars[bucket] = &exemplar{traceId: traceId, value: seconds, time: time.Now()}
+	histogram.sum += seconds
+	histogram.count++
+}
+
+// metricsWriter write Prometheus text format 0.0.4, or OpenMetrics 1.0 with exemplars.
+type metricsWriter struct {
+	buffer      bytes.Buffer
+	openMetrics bool
+}
+
+// family write HELP and TYPE of a metric family. name is without "_total" suffix.
+func (m *metricsWriter) family(name string, metricType string, help string) {
+	if metricType == "counter" && !m.openMetrics {
+		name += "_total"
+	}
+	fmt.Fprintf(&m.buffer, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", metricsNamespace, name, help, metricsNamespace, name, metricType)
+}
+
+func (m *metricsWriter) sample(name string, labels []string, value float64) {
+	m.sampleWithExemplar(name, labels, value, nil)
+}
+
+// sampleWithExemplar write a sample. labels are name and value pairs.
+func (m *metricsWriter) sampleWithExemplar(name string, labels []string, value float64, e *exemplar) {
+	fmt.Fprintf(&m.buffer, "%s_%s%s %s", metricsNamespace, name, formatLabels(labels), formatMetricValue(value))
+	if e != nil && m.openMetrics {
+		fmt.Fprintf(&m.buffer, " # {trace_id=\"%s\"} %s %.3f", e.traceId, formatMetricValue(e.value), float64(e.time.UnixNano())/1e9)
+	}
+	m.buffer.WriteString("\n")
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) < 1 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (m *metricsWriter) writeLookupMetrics() {
+	lookupMetrics.Lock()
+	defer lookupMetrics.Unlock()
+
+	series := make([]lookupSeries, 0, len(lookupMetrics.counts))
+	for s := range lookupMetrics.counts {
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return fmt.Sprint(series[i]) < fmt.Sprint(series[j])
+	})
+	m.family("lookups", "counter", "Lookups by rule set, rule, mapping label, country, target pool and result class.")
+	for _, s := range series {
+		m.sample("lookups_total", []string{"rule_set", s.ruleSet, "rule", s.rule, "label", s.label, "country", s.country, "pool", s.pool, "result", s.result}, float64(lookupMetrics.counts[s]))
+	}
+
+	keys := make([]latencySeries, 0, len(lookupMetrics.histograms))
+	for key := range lookupMetrics.histograms {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ruleSet < keys[j].ruleSet || keys[i].ruleSet == keys[j].ruleSet && !keys[i].cached && keys[j].cached
+	})
+	m.family("lookup_duration_seconds", "histogram", "Lookup duration by rule set and whether decision from cache.")
+	for _, key := range keys {
+		histogram := lookupMetrics.histograms[key]
+		labels := []string{"rule_set", key.ruleSet, "cached", strconv.FormatBool(key.cached)}
+		var cumulative uint64
+		for i, count := range histogram.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = formatMetricValue(latencyBuckets[i])
+			}
+			m.sampleWithExemplar("lookup_duration_seconds_bucket", append(labels, "le", le), float64(cumulative), histogram.exemplars[i])
+		}
+		m.sample("lookup_duration_seconds_sum", labels, histogram.sum)
+		m.sample("lookup_duration_seconds_count", labels, float64(histogram.count))
+	}
+}
+
+func (m *metricsWriter) writeStateMetrics() {
+	m.family("connections", "gauge", "Current client connections.")
+	m.sample("connections", nil, float64(atomic.LoadInt64(&currentConnections)))
+
+	cacheStatsProvidersLock.Lock()
+	names := make([]string, 0, len(cacheStatsProviders))
+	caches := make(map[string]cacheStats)
+	for name, provider := range cacheStatsProviders {
+		names = append(names, name)
+		caches[name] = provider()
+	}
+	cacheStatsProvidersLock.Unlock()
+	sort.Strings(names)
+	m.family("cache_hits", "counter", "Cache hits by cache.")
+	for _, name := range names {
+		m.sample("cache_hits_total", []string{"cache", name}, float64(caches[name].Hits))
+	}
+	m.family("cache_misses", "counter", "Cache misses by cache.")
+	for _, name := range names {
+		m.sample("cache_misses_total", []string{"cache", name}, float64(caches[name].Misses))
+	}
+
+	m.family("target_healthy", "gauge", "1 if target is not drained or saturated over its cap.")
+	for _, health := range getTargetHealth() {
+		healthy := 0.0
+		if health.Status == "ok" {
+			healthy = 1
+		}
+		m.sample("target_healthy", []string{"target", health.Target}, healthy)
+	}
+
+	m.family("geoip_build_timestamp_seconds", "gauge", "Build time of loaded GeoIP DBs.")
+	for _, db := range []struct {
+		name   string
+		reader *geoip2.Reader
+	}{{"country", getCountryDb()}, {"isp", getIspDb()}, {"anonymous", getAnonymousDb()}} {
+		if db.reader != nil {
+			m.sample("geoip_build_timestamp_seconds", []string{"db", db.name}, float64(db.reader.Metadata().BuildEpoch))
+		}
+	}
+}
+
+// metricsHandler GET serve metrics. OpenMetrics with exemplars if client accept it, like Prometheus with exemplar
+// storage enabled.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	m := &metricsWriter{openMetrics: strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")}
+	m.writeLookupMetrics()
+	m.writeStateMetrics()
+	m.writeAnomalyMetrics()
+	m.writeClientMetrics()
+	if m.openMetrics {
+		m.buffer.WriteString("# EOF\n")
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	w.Write(m.buffer.Bytes())
+}
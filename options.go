@@ -0,0 +1,165 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mappingOptions are optional settings after a mapping, e.g. 'US:mta1 label="us-primary"'.
+type mappingOptions struct {
+	// label is operator friendly name of the mapping, shown in logs and stats.
+	label string
+	// unbracketed return "relay:host" instead of "relay:[host]", so Postfix lookup MX of the relay domain.
+	unbracketed bool
+	// transport is Postfix transport name in reply, e.g. "smtp-ip1" to select source IP. Default "relay".
+	transport string
+	// reply replace whole Postfix reply of the mapping, e.g. "error:5.1.2 bad destination", "discard:".
+	reply string
+	// businessHours of the mapping, nil if always open.
+	businessHours *businessHours
+	// validFrom and validUntil limit the mapping to a period, zero if unlimited.
+	validFrom  time.Time
+	validUntil time.Time
+}
+
+// optionsStart match start of first option. Mapping itself may contain space (ISP name).
+var optionsStart = regexp.MustCompile(`\s+[a-z_]+=`)
+
+// splitMappingOptions split 'MAPPING key=value key="quoted value"' into mapping and options.
+func splitMappingOptions(value string) (string, mappingOptions, error) {
+	options := mappingOptions{}
+	value = strings.TrimSpace(value)
+	location := optionsStart.FindStringIndex(value)
+	if location == nil {
+		return value, options, nil
+	}
+	mapping := value[:location[0]]
+	rest := strings.TrimSpace(value[location[0]:])
+
+	for rest != "" {
+		eqIndex := strings.Index(rest, "=")
+		if eqIndex < 1 {
+			return "", options, errors.New(fmt.Sprintf("Invalid option on %s: %s", mapping, rest))
+		}
+		key := rest[:eqIndex]
+		rest = rest[eqIndex+1:]
+
+		var optionValue string
+		if strings.HasPrefix(rest, "\"") {
+			endIndex := strings.Index(rest[1:], "\"")
+			if endIndex < 0 {
+				return "", options, errors.New(fmt.Sprintf("Unterminated quote of option %s on %s", key, mapping))
+			}
+			optionValue = rest[1 : endIndex+1]
+			rest = rest[endIndex+2:]
+		} else {
+			endIndex := strings.IndexAny(rest, " \t")
+			if endIndex < 0 {
+				endIndex = len(rest)
+			}
+			optionValue = rest[:endIndex]
+			rest = rest[endIndex:]
+		}
+		rest = strings.TrimSpace(rest)
+
+		switch key {
+		case "label":
+			options.label = optionValue
+		case "bracket":
+			bracket, err := strconv.ParseBool(optionValue)
+			if err != nil {
+				return "", options, errors.New(fmt.Sprintf("Invalid bracket option on %s: %s", mapping, optionValue))
+			}
+			options.unbracketed = !bracket
+		case "transport":
+			if optionValue == "" || strings.ContainsAny(optionValue, ":[] \t") {
+				return "", options, errors.New(fmt.Sprintf("Invalid transport option on %s: %s", mapping, optionValue))
+			}
+			options.transport = optionValue
+		case "valid_from", "valid_until":
+			t, err := parseValidityTime(optionValue)
+			if err != nil {
+				return "", options, errors.New(fmt.Sprintf("Invalid %s option on %s: %s", key, mapping, err.Error()))
+			}
+			if key == "valid_from" {
+				options.validFrom = t
+			} else {
+				options.validUntil = t
+			}
+		case "reply":
+			if !strings.Contains(optionValue, ":") {
+				return "", options, errors.New(fmt.Sprintf(`Invalid reply option on %s, must be "transport:nexthop": %s`, mapping, optionValue))
+			}
+			options.reply = optionValue
+		default:
+			ok, err := options.setBusinessHoursOption(mapping, key, optionValue)
+			if err != nil {
+				return "", options, err
+			}
+			if !ok {
+				return "", options, errors.New(fmt.Sprintf("Unknown option on %s: %s", mapping, key))
+			}
+		}
+	}
+	if !options.validFrom.IsZero() && !options.validUntil.IsZero() && !options.validUntil.After(options.validFrom) {
+		return "", options, errors.New(fmt.Sprintf("Option valid_until on %s must be after valid_from", mapping))
+	}
+	if options.businessHours != nil {
+		if err := options.businessHours.validate(mapping); err != nil {
+			return "", options, err
+		}
+	}
+	return mapping, options, nil
+}
+
+// optionsKey is key of mapping options. matchKey is country code, or "isp:" and lower case ISP name.
+func optionsKey(matchKey string, target string) string {
+	return matchKey + " " + target
+}
+
+func (rs *ruleSet) getMappingOptions(matchKey string, target string) mappingOptions {
+	return rs.mappingOptions[optionsKey(matchKey, target)]
+}
+
+// nexthop return Postfix nexthop of the target, or reply of the mapping if set. IPv6 literal is always bracketed, as
+// Postfix can't lookup MX of an address.
+func (o mappingOptions) nexthop(target string) string {
+	if o.reply != "" {
+		return o.reply
+	}
+	transport := o.transport
+	if transport == "" {
+		transport = "relay"
+	}
+	if o.unbracketed && !isIpv6Target(target) {
+		return transport + ":" + target
+	}
+	return transport + ":[" + target + "]"
+}
+
+// applyMappingOptions fill label and nexthop of the decision, from options of the mapping its target picked from.
+func (rs *ruleSet) applyMappingOptions(d *decision) {
+	options := rs.getMappingOptions(d.matchKey, d.Target)
+	d.Label = options.label
+	d.Nexthop = options.nexthop(d.Target)
+}
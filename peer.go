@@ -0,0 +1,299 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/memberlist"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Peer mode: instances gossip new decision and sticky cache entries, so a domain evaluated once per cluster and
+// keep same sticky target on every instance. All peers must have the same rule sets.
+var peerBind string
+var peerAdvertise string
+var peerJoin []string
+var peerKeyFile string
+
+var peers *memberlist.Memberlist
+var peerBroadcasts *memberlist.TransmitLimitedQueue
+
+var peerSent uint64
+var peerReceived uint64
+var peerRejected uint64
+
+// peerMaxMessage keep a gossip message in one UDP packet, larger entries (e.g. long pool) not shared.
+const peerMaxMessage = 1024
+const peerMaxQueued = 10000
+
+const (
+	peerKindDecision = "decision"
+	peerKindSticky   = "sticky"
+)
+
+type peerEntry struct {
+	Kind     string    `json:"kind"`
+	Key      string    `json:"key"`
+	Decision *decision `json:"decision,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	MatchKey string    `json:"match_key,omitempty"`
+	// TtlMs is remaining TTL, not absolute time, so peers' clock skew doesn't matter.
+	TtlMs int64 `json:"ttl_ms"`
+}
+
+type peerBroadcast []byte
+
+func (b peerBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	return false
+}
+
+func (b peerBroadcast) Message() []byte {
+	return b
+}
+
+func (b peerBroadcast) Finished() {
+}
+
+type peerDelegate struct{}
+
+func (p *peerDelegate) NodeMeta(limit int) []byte {
+	return nil
+}
+
+func (p *peerDelegate) NotifyMsg(message []byte) {
+	var entry peerEntry
+	if err := json.Unmarshal(message, &entry); err != nil {
+		log.Warnf("Invalid peer message: %s", err.Error())
+		return
+	}
+	atomic.AddUint64(&peerReceived, 1)
+	storePeerEntry(entry)
+}
+
+func (p *peerDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return peerBroadcasts.GetBroadcasts(overhead, limit)
+}
+
+// LocalState send all cached entries to a joining peer, so a new instance start warm.
+func (p *peerDelegate) LocalState(join bool) []byte {
+	if !join {
+		return nil
+	}
+	entries := make([]peerEntry, 0)
+	for _, item := range decisionCache.snapshot() {
+		d := item.value.(decision)
+		entries = append(entries, peerEntry{Kind: peerKindDecision, Key: item.key, Decision: &d, MatchKey: d.matchKey, TtlMs: int64(item.remaining / time.Millisecond)})
+	}
+	for _, item := range stickyCache.snapshot() {
+		sticky := item.value.(stickyTarget)
+		entries = append(entries, peerEntry{Kind: peerKindSticky, Key: item.key, Target: sticky.target, MatchKey: sticky.matchKey, TtlMs: int64(item.remaining / time.Millisecond)})
+	}
+	data, _ := json.Marshal(entries)
+	return data
+}
+
+func (p *peerDelegate) MergeRemoteState(buf []byte, join bool) {
+	if !join || len(buf) == 0 {
+		return
+	}
+	var entries []peerEntry
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		log.Warnf("Invalid peer state: %s", err.Error())
+		return
+	}
+	for _, entry := range entries {
+		storePeerEntry(entry)
+	}
+	log.Infof("Received %d cache entries from peer.", len(entries))
+}
+
+// validPeerTargets return true if target and pool of entry are targets of local rule sets. Entries from a peer with
+// other rule sets, or forged, are not cached.
+func validPeerTargets(entry peerEntry) bool {
+	targets := []string{entry.Target}
+	if entry.Decision != nil {
+		targets = append([]string{entry.Decision.Target}, entry.Decision.Pool...)
+		if getRuleSet(entry.Decision.RuleSet) == nil {
+			return false
+		}
+	}
+	for _, target := range targets {
+		if target == "" && entry.Kind == peerKindDecision {
+			continue
+		}
+		if !isKnownTarget(target) {
+			return false
+		}
+	}
+	return true
+}
+
+// storePeerEntry cache entry from peer. Sticky entry conflict (two peers started window at the same time) resolved
+// by keep the earlier started, so all peers converge. Entries with unknown targets rejected, and label and nexthop of
+// decisions taken from local mapping options, so a peer can't route mail to other hosts.
+func storePeerEntry(entry peerEntry) {
+	if !validPeerTargets(entry) {
+		atomic.AddUint64(&peerRejected, 1)
+		log.Debugf("Peer entry %s %s with unknown target rejected.", entry.Kind, entry.Key)
+		return
+	}
+	ttl := time.Duration(entry.TtlMs) * time.Millisecond
+	switch entry.Kind {
+	case peerKindDecision:
+		if decisionCacheTtl <= 0 || entry.Decision == nil {
+			return
+		}
+		if ttl > decisionCacheTtl {
+			ttl = decisionCacheTtl
+		}
+		d := *entry.Decision
+		d.matchKey = entry.MatchKey
+		d.Label = ""
+		d.Nexthop = ""
+		if d.Target != "" {
+			getRuleSet(d.RuleSet).applyMappingOptions(&d)
+		}
+		decisionCache.set(entry.Key, d, len(entry.Key)+128, ttl)
+	case peerKindSticky:
+		if stickyTtl <= 0 {
+			return
+		}
+		if ttl > stickyTtl {
+			ttl = stickyTtl
+		}
+		if _, remaining, ok := stickyCache.get(entry.Key); ok && remaining <= ttl {
+			return
+		}
+		sticky := stickyTarget{target: entry.Target, matchKey: entry.MatchKey, expires: time.Now().Add(ttl)}
+		stickyCache.set(entry.Key, sticky, len(entry.Key)+len(sticky.target)+len(sticky.matchKey)+64, ttl)
+	}
+}
+
+// broadcastPeerEntry queue entry to gossip. Do nothing if peer mode disabled.
+func broadcastPeerEntry(entry peerEntry) {
+	if peers == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil || len(data) > peerMaxMessage {
+		return
+	}
+	peerBroadcasts.QueueBroadcast(peerBroadcast(data))
+	if peerBroadcasts.NumQueued() > peerMaxQueued {
+		peerBroadcasts.Prune(peerMaxQueued)
+	}
+	atomic.AddUint64(&peerSent, 1)
+}
+
+// broadcastPeerDecision gossip a new decision without trace and timings, those are only meaningful locally.
+func broadcastPeerDecision(key string, d decision) {
+	d.Trace = nil
+	d.Timings = nil
+	d.Errors = nil
+	broadcastPeerEntry(peerEntry{Kind: peerKindDecision, Key: key, Decision: &d, MatchKey: d.matchKey, TtlMs: int64(decisionCacheTtl / time.Millisecond)})
+}
+
+func broadcastPeerSticky(key string, sticky stickyTarget) {
+	broadcastPeerEntry(peerEntry{Kind: peerKindSticky, Key: key, Target: sticky.target, MatchKey: sticky.matchKey, TtlMs: int64(time.Until(sticky.expires) / time.Millisecond)})
+}
+
+// startPeers start gossip on peerBind and join peerJoin addresses. Joining fail is not fatal, peers join later.
+func startPeers() error {
+	if peerBind == "" {
+		return nil
+	}
+	host, portValue, err := net.SplitHostPort(peerBind)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid peer bind address %s: %s", peerBind, err.Error()))
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid peer bind port %s.", portValue))
+	}
+
+	config := memberlist.DefaultLANConfig()
+	hostname, _ := os.Hostname()
+	config.Name = hostname + "-" + peerBind
+	config.BindAddr = host
+	config.BindPort = port
+	config.AdvertisePort = port
+	if peerAdvertise != "" {
+		advertiseHost, advertisePort, err := net.SplitHostPort(peerAdvertise)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid peer advertise address %s: %s", peerAdvertise, err.Error()))
+		}
+		config.AdvertiseAddr = advertiseHost
+		config.AdvertisePort, err = strconv.Atoi(advertisePort)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid peer advertise port %s.", advertisePort))
+		}
+	}
+	// Peers fill decision and sticky caches of each other, so gossip must be encrypted and authenticated.
+	if peerKeyFile == "" {
+		return errors.New("Peer mode need --peer-key-file.")
+	}
+	key, err := ioutil.ReadFile(peerKeyFile)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Read peer key file error: %s", err.Error()))
+	}
+	config.SecretKey = []byte(strings.TrimSpace(string(key)))
+	config.Delegate = &peerDelegate{}
+	config.Logger = stdlog.New(log.StandardLogger().WriterLevel(log.DebugLevel), "", 0)
+
+	peers, err = memberlist.Create(config)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Start peer mode error: %s", err.Error()))
+	}
+	peerBroadcasts = &memberlist.TransmitLimitedQueue{NumNodes: peers.NumMembers, RetransmitMult: 3}
+	log.Infof("Peer mode on %s as %s.", peerBind, config.Name)
+
+	if len(peerJoin) > 0 {
+		joined, err := peers.Join(peerJoin)
+		if err != nil {
+			log.Warnf("Join peers %v error: %s", peerJoin, err.Error())
+		} else {
+			log.Infof("Joined %d peer(s).", joined)
+		}
+	}
+	return nil
+}
+
+func getPeerStats() map[string]interface{} {
+	if peers == nil {
+		return nil
+	}
+	members := make([]string, 0)
+	for _, member := range peers.Members() {
+		members = append(members, member.Name)
+	}
+	return map[string]interface{}{
+		"members":  members,
+		"sent":     atomic.LoadUint64(&peerSent),
+		"received": atomic.LoadUint64(&peerReceived),
+		"rejected": atomic.LoadUint64(&peerRejected),
+	}
+}
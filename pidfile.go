@@ -0,0 +1,82 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pidFile for init systems still expect one. Written at startup, removed on shutdown.
+var pidFile string
+
+// writePidFile refuse to start if pid file belong to a running process, overwrite it if stale.
+func writePidFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid > 0 && pid != os.Getpid() && processExists(pid) {
+			return errors.New(fmt.Sprintf("Pid file %s exists, process %d still running.", path, pid))
+		}
+		log.Warnf("Remove stale pid file %s (%q).", path, strings.TrimSpace(string(data)))
+	} else if !os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("Read pid file %s error: %s", path, err.Error()))
+	}
+
+	// Write then rename, init system never read a partial file.
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Write pid file %s error: %s", path, err.Error()))
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return errors.New(fmt.Sprintf("Write pid file %s error: %s", path, err.Error()))
+	}
+
+	// Also remove on log.Fatal.
+	log.RegisterExitHandler(removePidFile)
+	return nil
+}
+
+// removePidFile remove the pid file if it is still ours. May fail after privileges dropped or sandboxed.
+func removePidFile() {
+	if pidFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return
+	}
+	if strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	err = os.Remove(pidFile)
+	if err != nil {
+		log.Warnf("Remove pid file %s error: %s", pidFile, err.Error())
+	}
+}
@@ -0,0 +1,273 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pins fix target of a recipient domain in a rule set, persisted in a bbolt DB file to survive restarts.
+var pinDbPath string
+var autoPinPatterns []string
+
+var pinBucket = []byte("pins")
+
+var pinDb *bolt.DB
+
+// pins mirror pin DB in memory, by pinKey.
+var pins = make(map[string]pin)
+var pinsLock sync.RWMutex
+
+// pin source.
+const (
+	pinManual = "manual"
+	pinAuto   = "auto"
+)
+
+type pin struct {
+	RuleSet string    `json:"rule_set"`
+	Domain  string    `json:"domain"`
+	Target  string    `json:"target"`
+	Source  string    `json:"source"`
+	Created time.Time `json:"created"`
+}
+
+func pinKey(ruleSetName string, domain string) string {
+	return ruleSetName + " " + strings.ToLower(domain)
+}
+
+// setupPins open pin DB if path set, and check auto pin patterns.
+func setupPins(dbPath string, patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New(fmt.Sprintf("Invalid auto pin pattern: %s", pattern))
+		}
+	}
+	if dbPath == "" {
+		if len(patterns) > 0 {
+			return errors.New("--auto-pin need --pin-db.")
+		}
+		return nil
+	}
+	autoPinPatterns = patterns
+	return openPinDb(dbPath)
+}
+
+// openPinDb open or create pin DB and load all pins.
+func openPinDb(path string) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Open pin DB %s error: %s", path, err.Error()))
+	}
+
+	loaded := make(map[string]pin)
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(pinBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(key []byte, value []byte) error {
+			p := pin{}
+			if err := json.Unmarshal(value, &p); err != nil {
+				return errors.New(fmt.Sprintf("Invalid pin %s: %s", key, err.Error()))
+			}
+			loaded[string(key)] = p
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return errors.New(fmt.Sprintf("Load pin DB %s error: %s", path, err.Error()))
+	}
+
+	pinDb = db
+	pinsLock.Lock()
+	pins = loaded
+	pinsLock.Unlock()
+	log.Infof("Loaded %d pin(s) from %s.", len(loaded), path)
+	return nil
+}
+
+func getPin(ruleSetName string, domain string) (pin, bool) {
+	if pinDb == nil {
+		return pin{}, false
+	}
+	pinsLock.RLock()
+	defer pinsLock.RUnlock()
+	p, ok := pins[pinKey(ruleSetName, domain)]
+	return p, ok
+}
+
+func getPins() []pin {
+	pinsLock.RLock()
+	list := make([]pin, 0, len(pins))
+	for _, p := range pins {
+		list = append(list, p)
+	}
+	pinsLock.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].RuleSet != list[j].RuleSet {
+			return list[i].RuleSet < list[j].RuleSet
+		}
+		return list[i].Domain < list[j].Domain
+	})
+	return list
+}
+
+func countPins() int {
+	pinsLock.RLock()
+	defer pinsLock.RUnlock()
+	return len(pins)
+}
+
+// setPin write the pin to DB, then memory. Cached decisions purged so the pin apply immediately.
+func setPin(p pin) error {
+	key := pinKey(p.RuleSet, p.Domain)
+	value, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	err = pinDb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pinBucket).Put([]byte(key), value)
+	})
+	if err != nil {
+		return err
+	}
+
+	pinsLock.Lock()
+	pins[key] = p
+	pinsLock.Unlock()
+	decisionCache.purge()
+	stickyCache.purge()
+	log.Warnf("Pinned domain %s of rule set %s to %s (%s).", p.Domain, p.RuleSet, p.Target, p.Source)
+	return nil
+}
+
+func deletePin(ruleSetName string, domain string) (bool, error) {
+	key := pinKey(ruleSetName, domain)
+	pinsLock.RLock()
+	_, ok := pins[key]
+	pinsLock.RUnlock()
+	if !ok {
+		return false, nil
+	}
+
+	err := pinDb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pinBucket).Delete([]byte(key))
+	})
+	if err != nil {
+		return false, err
+	}
+
+	pinsLock.Lock()
+	delete(pins, key)
+	pinsLock.Unlock()
+	decisionCache.purge()
+	stickyCache.purge()
+	log.Warnf("Unpinned domain %s of rule set %s.", domain, ruleSetName)
+	return true, nil
+}
+
+// autoPin pin domain of a relay decision if it match --auto-pin and not pinned yet.
+func autoPin(rs *ruleSet, email string, d decision) {
+	if pinDb == nil || len(autoPinPatterns) == 0 || d.Action != "" || d.Rule == "static" || d.Rule == "pin" {
+		return
+	}
+	domain, err := getEmailDomain(email)
+	if err != nil {
+		return
+	}
+	domain = strings.ToLower(domain)
+	if _, ok := getPin(rs.name, domain); ok {
+		return
+	}
+	for _, pattern := range autoPinPatterns {
+		if !matchDomainPattern(pattern, domain) {
+			continue
+		}
+		if err := setPin(pin{RuleSet: rs.name, Domain: domain, Target: d.Target, Source: pinAuto, Created: time.Now()}); err != nil {
+			log.Errorf("Auto pin %s error: %s", domain, err.Error())
+		}
+		return
+	}
+}
+
+// adminPinHandler GET list pins. PUT/POST with "domain=DOMAIN&target=MTA" pin the domain, DELETE with
+// "domain=DOMAIN" unpin it. Rule set selected by "rule_set" query.
+func adminPinHandler(w http.ResponseWriter, r *http.Request) {
+	if pinDb == nil {
+		writeJsonError(w, http.StatusNotFound, "Pin DB not enabled.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+		rs, ok := requestRuleSet(r)
+		if !ok {
+			writeJsonError(w, http.StatusNotFound, "Unknown rule set.")
+			return
+		}
+		domain := strings.ToLower(strings.TrimSuffix(r.FormValue("domain"), "."))
+		if domain == "" {
+			writeJsonError(w, http.StatusBadRequest, "Missing domain.")
+			return
+		}
+
+		previous, ok := getPin(rs.name, domain)
+		if r.Method == http.MethodDelete {
+			deleted, err := deletePin(rs.name, domain)
+			if err != nil {
+				writeJsonError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !deleted {
+				writeJsonError(w, http.StatusNotFound, "Domain not pinned.")
+				return
+			}
+			auditRequest(r, "pin", domain, rs.name, auditValue(previous.Target, ok), nil)
+			break
+		}
+
+		target := normalizeTarget(r.FormValue("target"))
+		if !containsString(rs.getTargets(), target) {
+			writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("Target %s not in rule set %s.", target, rs.name))
+			return
+		}
+		if err := setPin(pin{RuleSet: rs.name, Domain: domain, Target: target, Source: pinManual, Created: time.Now()}); err != nil {
+			writeJsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		auditRequest(r, "pin", domain, rs.name, auditValue(previous.Target, ok), target)
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string][]pin{"pins": getPins()})
+}
@@ -0,0 +1,187 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Plugin is called after rules decided a target. It can accept, override or veto the decision.
+// "http://..." or "https://..." POST JSON request to the URL. "exec:/path/to/program" write JSON request to program's stdin.
+// "wasm:/path/to/module.wasm" call WASM module, see wasm.go for the ABI.
+var pluginUrl string
+var pluginTimeout time.Duration
+
+// pluginFailClosed treat plugin error/timeout as veto. Otherwise keep the decision.
+var pluginFailClosed bool
+
+type pluginRequest struct {
+	Email   string   `json:"email"`
+	Domain  string   `json:"domain"`
+	Mx      []string `json:"mx"`
+	Ip      []string `json:"ip"`
+	Country string   `json:"country"`
+	Target  string   `json:"target"`
+	Rule    string   `json:"rule"`
+}
+
+// pluginResponse Action is "accept", "override" (use Target) or "veto" (use default target).
+type pluginResponse struct {
+	Action string `json:"action"`
+	Target string `json:"target"`
+}
+
+func parsePluginFail(value string) error {
+	switch strings.ToLower(value) {
+	case "open":
+		pluginFailClosed = false
+	case "closed":
+		pluginFailClosed = true
+	default:
+		return errors.New(fmt.Sprintf("Invalid plugin fail mode: %s", value))
+	}
+	return nil
+}
+
+func callHttpPlugin(ctx context.Context, body []byte) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodPost, pluginUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Plugin HTTP status: %s", response.Status))
+	}
+
+	buffer := new(bytes.Buffer)
+	_, err = buffer.ReadFrom(response.Body)
+	return buffer.Bytes(), err
+}
+
+func callExecPlugin(ctx context.Context, body []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, strings.TrimPrefix(pluginUrl, "exec:"))
+	cmd.Stdin = bytes.NewReader(body)
+	return cmd.Output()
+}
+
+func callPlugin(request pluginRequest) (pluginResponse, error) {
+	result := pluginResponse{}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return result, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+
+	var output []byte
+	switch {
+	case strings.HasPrefix(pluginUrl, "exec:"):
+		output, err = callExecPlugin(ctx, body)
+	case isWasmPlugin():
+		output, err = callWasmPlugin(ctx, body)
+	default:
+		output, err = callHttpPlugin(ctx, body)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	err = json.Unmarshal(output, &result)
+	return result, err
+}
+
+// applyPlugin let plugin accept, override or veto the decision. Do nothing if no plugin configured.
+func applyPlugin(l *lookup, d decision) decision {
+	if pluginUrl == "" {
+		return d
+	}
+	if l.shadow {
+		d.Trace = append(d.Trace, "plugin: not called for shadow evaluation")
+		return d
+	}
+
+	ips := []string{}
+	for _, ip := range l.getIps() {
+		ips = append(ips, ip.String())
+	}
+	country, _ := l.getMxCountry()
+
+	start := time.Now()
+	response, err := callPlugin(pluginRequest{
+		Email:   l.email,
+		Domain:  l.domain,
+		Mx:      l.getMxHosts(),
+		Ip:      ips,
+		Country: country,
+		Target:  d.Target,
+		Rule:    d.Rule,
+	})
+	l.addTiming("plugin", start)
+	d.Timings = l.getTimingsMs()
+	if err != nil {
+		log.Warnf("Plugin error on %s: %v", l.email, err)
+		if !pluginFailClosed {
+			d.Errors = append(d.Errors, fmt.Sprintf("plugin error: %v", err))
+			d.Trace = append(d.Trace, fmt.Sprintf("plugin error: %v, fail open", err))
+			return d
+		}
+		d.Errors = append(d.Errors, fmt.Sprintf("plugin error: %v", err))
+		response = pluginResponse{Action: "veto"}
+	}
+
+	switch response.Action {
+	case "override":
+		if response.Target != "" {
+			log.Infof("Plugin override %s target %s to %s", l.email, d.Target, response.Target)
+			d.Trace = append(d.Trace, fmt.Sprintf("plugin override target %s to %s", d.Target, response.Target))
+			d.Target = response.Target
+			d.Pool = []string{response.Target}
+			d.Rule = "plugin"
+			d.matchKey = ""
+			l.rules.applyMappingOptions(&d)
+		}
+	case "veto":
+		vetoed := l.rules.defaultDecision("plugin", d.Trace)
+		log.Infof("Plugin veto %s target %s, use default %s", l.email, d.Target, vetoed.Target)
+		vetoed.Trace = append(vetoed.Trace, fmt.Sprintf("plugin veto target %s, use default target %s", d.Target, vetoed.Target))
+		vetoed.Country = d.Country
+		vetoed.Errors = d.Errors
+		vetoed.Timings = d.Timings
+		d = vetoed
+	default:
+		d.Trace = append(d.Trace, "plugin accept")
+	}
+
+	return d
+}
@@ -0,0 +1,110 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strings"
+)
+
+// Postfix policy delegation protocol, see SMTPD_POLICY_README. Request is "NAME=VALUE" lines ended by an empty line,
+// reply is "action=..." and an empty line. Decision of the recipient is replied as FILTER action, which route the
+// whole message, so last recipient checked win on multi recipient messages.
+
+// maxPolicyAttributes is max lines of a policy request. Postfix send about 30.
+const maxPolicyAttributes = 256
+
+// policyDunno reply let Postfix continue as if no policy service.
+const policyDunno = "action=DUNNO\n\n"
+
+var errInvalidPolicyRequest = errors.New("invalid policy request")
+
+// readPolicyRequest read attributes of a request. Error is errInvalidPolicyRequest on protocol violation.
+func readPolicyRequest(reader *bufio.Reader) (map[string]string, string, error) {
+	attributes := make(map[string]string)
+	for {
+		data, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, violationTooLong, errInvalidPolicyRequest
+		}
+		if err != nil {
+			if err == io.EOF && len(data) > 0 {
+				return nil, violationNoNewline, errInvalidPolicyRequest
+			}
+			return nil, "", err
+		}
+		line := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+		if line == "" {
+			return attributes, "", nil
+		}
+		splitedLine := strings.SplitN(line, "=", 2)
+		if len(splitedLine) != 2 || len(attributes) >= maxPolicyAttributes {
+			return nil, violationPolicyAttribute, errInvalidPolicyRequest
+		}
+		attributes[splitedLine[0]] = splitedLine[1]
+	}
+}
+
+func genPolicyResponse(result decision) string {
+	switch result.Action {
+	case failTemp:
+		return "action=DEFER_IF_PERMIT " + failureText(result) + "\n\n"
+	case failNotFound:
+		return policyDunno
+	}
+	return "action=FILTER " + transportValue(result) + "\n\n"
+}
+
+// servePolicy answer policy requests of the connection until closed. Requests without recipient, like at MAIL FROM
+// stage, reply DUNNO.
+func servePolicy(conn net.Conn, reader *bufio.Reader, ruleSetName string, connStats *connectionStats) {
+	for {
+		attributes, violation, err := readPolicyRequest(reader)
+		if err == errInvalidPolicyRequest {
+			recordProtocolViolation(conn.RemoteAddr(), violation)
+			connStats.errors++
+			conn.Write([]byte(policyDunno))
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Read from %v error: '%s'.", conn.RemoteAddr(), err.Error())
+				connStats.errors++
+			}
+			return
+		}
+
+		key := attributes["recipient"]
+		if key == "" {
+			_, err = conn.Write([]byte(policyDunno))
+		} else if violation := checkRequest(key, key); violation != "" {
+			recordProtocolViolation(conn.RemoteAddr(), violation)
+			connStats.errors++
+			_, err = conn.Write([]byte(policyDunno))
+		} else {
+			err = answerQuery(conn, ruleSetName, key, connStats, genPolicyResponse)
+		}
+		if err != nil {
+			log.Errorf("Write to %v error: '%s'.", conn.RemoteAddr(), err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"strings"
+)
+
+// strictTargets fail startup if any configured target can't be resolved.
+var strictTargets bool
+
+// getTargets return all targets configured in the rule set, sorted. Targets returned by scripts not included.
+func (rs *ruleSet) getTargets() []string {
+	seen := make(map[string]bool)
+	for _, pool := range rs.destinationMap {
+		for _, target := range pool {
+			seen[target] = true
+		}
+	}
+	for _, scheduled := range rs.scheduleMap {
+		for _, target := range scheduled {
+			seen[target.target] = true
+		}
+	}
+	for _, pool := range rs.ispMap {
+		for _, target := range pool {
+			seen[target] = true
+		}
+	}
+	for _, pool := range rs.anonymousMap {
+		for _, target := range pool {
+			seen[target] = true
+		}
+	}
+
+	targets := make([]string, 0, len(seen))
+	for target := range seen {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// isReplyTarget return true if the target only used by mappings with reply option, so not a host.
+func (rs *ruleSet) isReplyTarget(target string) bool {
+	found := false
+	for key, options := range rs.mappingOptions {
+		if !strings.HasSuffix(key, " "+target) {
+			continue
+		}
+		if options.reply == "" {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// preflightTargets resolve every configured target, so typo found before Postfix get broken nexthop.
+func preflightTargets() error {
+	checked := make(map[string]bool)
+	failed := []string{}
+	for _, rs := range ruleSets {
+		for _, target := range rs.getTargets() {
+			if checked[target] || net.ParseIP(target) != nil || rs.isReplyTarget(target) {
+				continue
+			}
+			checked[target] = true
+
+			if _, err := lookupIP(target); err != nil {
+				log.Warnf("Target %s of rule set %s can't be resolved: %v", target, rs.name, err)
+				failed = append(failed, target)
+			}
+		}
+	}
+
+	if len(failed) > 0 && strictTargets {
+		return errors.New(fmt.Sprintf("Target(s) can't be resolved: %v", failed))
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+)
+
+func isRunningAsRoot() bool {
+	return false
+}
+
+func lookupRunIds(userName string, groupName string) (int, int, error) {
+	if userName == "" && groupName == "" {
+		return -1, -1, nil
+	}
+	return -1, -1, errors.New("--user and --group not supported on this platform.")
+}
+
+func dropPrivileges(uid int, gid int) error {
+	return nil
+}
@@ -0,0 +1,88 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+func isRunningAsRoot() bool {
+	return os.Geteuid() == 0
+}
+
+// lookupRunIds return uid and gid of the user and group, -1 if not set. Group default to primary group of the user.
+// Looked up before chroot, which hide /etc/passwd.
+func lookupRunIds(userName string, groupName string) (int, int, error) {
+	if userName == "" && groupName == "" {
+		return -1, -1, nil
+	}
+	if !isRunningAsRoot() {
+		return -1, -1, errors.New("Need to run as root to switch user or group.")
+	}
+
+	uid := -1
+	gid := -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return -1, -1, errors.New(fmt.Sprintf("Lookup user %s error: %s", userName, err.Error()))
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return -1, -1, errors.New(fmt.Sprintf("Lookup group %s error: %s", groupName, err.Error()))
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// dropPrivileges switch to the uid and gid, after listeners bound and files opened as root.
+func dropPrivileges(uid int, gid int) error {
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+
+	// Group first, can't change it after user dropped.
+	if gid >= 0 {
+		if err := unix.Setgroups([]int{gid}); err != nil {
+			return errors.New(fmt.Sprintf("Set groups error: %s", err.Error()))
+		}
+		if err := unix.Setgid(gid); err != nil {
+			return errors.New(fmt.Sprintf("Set group %d error: %s", gid, err.Error()))
+		}
+	}
+	if uid >= 0 {
+		if err := unix.Setuid(uid); err != nil {
+			return errors.New(fmt.Sprintf("Set user %d error: %s", uid, err.Error()))
+		}
+	}
+	log.Infof("Dropped privileges to uid %d, gid %d.", os.Geteuid(), os.Getegid())
+	return nil
+}
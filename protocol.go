@@ -0,0 +1,159 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Reply protocols.
+const (
+	// protocolPostfix reply Postfix tcp_table "200 relay:[target]".
+	protocolPostfix = "postfix"
+	// protocolJson reply one JSON decision object per line, for non-Postfix consumers.
+	protocolJson = "json"
+	// protocolSocketmap reply Postfix socketmap netstrings "OK relay:[target]".
+	protocolSocketmap = "socketmap"
+	// protocolPolicy is Postfix policy delegation, reply "action=FILTER relay:[target]" for the recipient.
+	protocolPolicy = "policy"
+	// protocolHttp serve GET /lookup/{email} with JSON decision, like json protocol.
+	protocolHttp = "http"
+)
+
+// protocol is default protocol of listeners.
+var protocol = protocolPostfix
+
+func parseProtocol(value string) (string, error) {
+	value = strings.ToLower(value)
+	switch value {
+	case protocolPostfix, protocolJson, protocolSocketmap, protocolPolicy, protocolHttp:
+		return value, nil
+	}
+	return "", errors.New(fmt.Sprintf("Invalid protocol: %s", value))
+}
+
+// jsonResponse is reply of json protocol.
+type jsonResponse struct {
+	Action  string `json:"action,omitempty"`
+	Failure string `json:"failure,omitempty"`
+	// ErrorCode is set on failure replies and default decisions.
+	ErrorCode string   `json:"error_code,omitempty"`
+	Target    string   `json:"target"`
+	Country   string   `json:"country,omitempty"`
+	Rule      string   `json:"rule"`
+	Label     string   `json:"label,omitempty"`
+	Nexthop   string   `json:"nexthop,omitempty"`
+	RuleSet   string   `json:"rule_set"`
+	Pool      []string `json:"pool"`
+	Cached    bool     `json:"cached"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+func genJsonResponse(result decision) string {
+	data, err := json.Marshal(jsonResponse{
+		Action:    result.Action,
+		Failure:   result.Failure,
+		ErrorCode: result.ErrorCode,
+		Target:    result.Target,
+		Country:   result.Country,
+		Rule:      result.Rule,
+		Label:     result.Label,
+		Nexthop:   result.Nexthop,
+		RuleSet:   result.RuleSet,
+		Pool:      result.Pool,
+		Cached:    result.Cached,
+		Errors:    result.Errors,
+	})
+	if err != nil {
+		log.Errorf("Encode JSON response error: %s", err.Error())
+		return `{"action":"temp","failure":"encode"}` + "\n"
+	}
+	return string(data) + "\n"
+}
+
+func genResponse(protocol string, result decision) string {
+	if protocol == protocolJson {
+		return genJsonResponse(result)
+	}
+	return genPostfixResponse(result)
+}
+
+// Protocol violations of request lines.
+const (
+	violationTooLong   = "too_long"
+	violationNoNewline = "no_newline"
+	violationControl   = "control_char"
+	violationUtf8      = "invalid_utf8"
+	// violationNetstring is malformed socketmap request.
+	violationNetstring = "invalid_netstring"
+	// violationPolicyAttribute is policy request line not "NAME=VALUE", or too many lines.
+	violationPolicyAttribute = "invalid_attribute"
+)
+
+// maxRequestLine is max bytes of a request line with newline. Keys are much shorter, even %XX encoded.
+const maxRequestLine = 4096
+
+// maxProtocolViolations close connection after this many violations.
+var maxProtocolViolations int
+
+var protocolViolations = struct {
+	sync.Mutex
+	counts map[string]uint64
+}{counts: make(map[string]uint64)}
+
+// checkRequest return violation of request line and its decoded key, or empty if valid. NUL and other control
+// characters are never in an address, Postfix encode them. Decoded key may be 8 bit, only line must be UTF-8.
+func checkRequest(line string, key string) string {
+	if !utf8.ValidString(line) {
+		return violationUtf8
+	}
+	for _, char := range key {
+		if char < 0x20 || char == 0x7f {
+			return violationControl
+		}
+	}
+	return ""
+}
+
+func recordProtocolViolation(remote net.Addr, violation string) {
+	protocolViolations.Lock()
+	protocolViolations.counts[violation]++
+	protocolViolations.Unlock()
+	recordClientViolation(remote)
+	log.WithFields(log.Fields{
+		"remote":    remote.String(),
+		"violation": violation,
+	}).Warn("Protocol violation.")
+}
+
+func getProtocolViolations() map[string]uint64 {
+	protocolViolations.Lock()
+	defer protocolViolations.Unlock()
+	return copyCounts(protocolViolations.counts)
+}
+
+// protocolViolationDecision is reply of invalid request, 500 for Postfix.
+func protocolViolationDecision(violation string) decision {
+	return decision{Action: failNotFound, Failure: "protocol", ErrorCode: errorProtocolViolation, Errors: []string{violation}}
+}
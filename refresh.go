@@ -0,0 +1,230 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/oschwald/geoip2-golang"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// geoipRefreshInterval is how often DBs refreshed, 0 to disable. URL DBs downloaded only by the leader instance into
+// shared cache dir, all instances reopen DB files changed on disk.
+var geoipRefreshInterval time.Duration
+
+// geoipDbLock guard swapping countryDb, ispDb and anonymousDb.
+var geoipDbLock sync.RWMutex
+
+// loadedDbTimes is modify time of DB files in use, by kind "country", "isp" or "anonymous".
+var loadedDbTimes = make(map[string]time.Time)
+
+var refreshStatus struct {
+	sync.Mutex
+	leader    bool
+	lastCheck time.Time
+	lastError string
+}
+
+// nodeId identify this instance in leader lease file.
+var nodeId = fmt.Sprintf("%s-%d", getHostname(), os.Getpid())
+
+const leaseFileName = ".geoip-refresh-leader"
+
+// oldDbCloseDelay let in-flight lookups finish with replaced DB before it closed.
+const oldDbCloseDelay = time.Minute
+
+func getHostname() string {
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+func getCountryDb() *geoip2.Reader {
+	geoipDbLock.RLock()
+	defer geoipDbLock.RUnlock()
+	return countryDb
+}
+
+func getIspDb() *geoip2.Reader {
+	geoipDbLock.RLock()
+	defer geoipDbLock.RUnlock()
+	return ispDb
+}
+
+// dbLocalPath return file path of DB flag value, cached file for URL.
+func dbLocalPath(value string) string {
+	if isDbUrl(value) {
+		cachePath, _, err := dbCachePath(value)
+		if err != nil {
+			return ""
+		}
+		return cachePath
+	}
+	return value
+}
+
+// recordDbTime remember modify time of opened DB file, to detect change on refresh.
+func recordDbTime(kind string, value string) {
+	if info, err := os.Stat(dbLocalPath(value)); err == nil {
+		loadedDbTimes[kind] = info.ModTime()
+	}
+}
+
+// isRefreshLeader elect leader to download DBs. In peer mode, the member with lowest name. Otherwise who hold the
+// lease file in cache dir, lease expire if holder stop renewing.
+func isRefreshLeader() bool {
+	if peers != nil {
+		names := make([]string, 0)
+		for _, member := range peers.Members() {
+			names = append(names, member.Name)
+		}
+		sort.Strings(names)
+		return len(names) > 0 && names[0] == peers.LocalNode().Name
+	}
+	return acquireLease(filepath.Join(getCacheDir(), leaseFileName), 2*geoipRefreshInterval)
+}
+
+// acquireLease take or renew lease file "HOLDER EXPIRES_UNIX". Simultaneous writers resolved by re-read after write,
+// last rename win.
+func acquireLease(path string, ttl time.Duration) bool {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && fields[0] != nodeId {
+			expires, err := strconv.ParseInt(fields[1], 10, 64)
+			if err == nil && time.Now().Unix() < expires {
+				return false
+			}
+		}
+	}
+
+	tmp := fmt.Sprintf("%s.%s", path, nodeId)
+	content := fmt.Sprintf("%s %d\n", nodeId, time.Now().Add(ttl).Unix())
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		log.Warnf("Write lease file %s error: %s", path, err.Error())
+		return false
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		log.Warnf("Write lease file %s error: %s", path, err.Error())
+		return false
+	}
+	data, err = ioutil.ReadFile(path)
+	return err == nil && strings.HasPrefix(string(data), nodeId+" ")
+}
+
+// refreshGeoipDb download DB if leader, and reopen it if file changed. Return error message, empty if no error.
+func refreshGeoipDb(kind string, value string, leader bool) string {
+	path := dbLocalPath(value)
+	if isDbUrl(value) && leader {
+		if err := downloadDb(value, path); err != nil {
+			_, safeUrl, _ := dbCachePath(value)
+			return fmt.Sprintf("Download %s error: %s", safeUrl, err.Error())
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Sprintf("Stat %s DB error: %s", kind, err.Error())
+	}
+	if !info.ModTime().After(loadedDbTimes[kind]) {
+		return ""
+	}
+
+	db, err := openGeoipDb(path)
+	if err != nil {
+		return fmt.Sprintf("Open %s DB %s error: %s", kind, path, err.Error())
+	}
+	geoipDbLock.Lock()
+	var old *geoip2.Reader
+	if kind == "country" {
+		old, countryDb = countryDb, db
+		usingEmbeddedGeoipDb = false
+	} else if kind == "isp" {
+		old, ispDb = ispDb, db
+	} else {
+		old, anonymousDb = anonymousDb, db
+	}
+	geoipDbLock.Unlock()
+	loadedDbTimes[kind] = info.ModTime()
+	if old != nil {
+		time.AfterFunc(oldDbCloseDelay, func() { old.Close() })
+	}
+
+	// Cached decisions made by old DB.
+	decisionCache.purge()
+	log.Infof("Refreshed %s DB %s, build %s.", kind, path, time.Unix(int64(db.Metadata().BuildEpoch), 0).UTC().Format(time.RFC3339))
+	return ""
+}
+
+func refreshGeoipDbs() {
+	leader := isRefreshLeader()
+	messages := make([]string, 0)
+	if message := refreshGeoipDb("country", geoipDbPath, leader); message != "" {
+		messages = append(messages, message)
+	}
+	if ispDbPath != "" {
+		if message := refreshGeoipDb("isp", ispDbPath, leader); message != "" {
+			messages = append(messages, message)
+		}
+	}
+	if anonymousDbPath != "" {
+		if message := refreshGeoipDb("anonymous", anonymousDbPath, leader); message != "" {
+			messages = append(messages, message)
+		}
+	}
+	for _, message := range messages {
+		log.Warnf("GeoIP DB refresh error: %s", message)
+	}
+
+	refreshStatus.Lock()
+	refreshStatus.leader = leader
+	refreshStatus.lastCheck = time.Now()
+	refreshStatus.lastError = strings.Join(messages, "; ")
+	refreshStatus.Unlock()
+}
+
+// startGeoipRefresh refresh DBs every geoipRefreshInterval. Not in simulation mode.
+func startGeoipRefresh() {
+	if geoipRefreshInterval <= 0 || fixtures != nil {
+		return
+	}
+	go func() {
+		for range time.Tick(geoipRefreshInterval) {
+			refreshGeoipDbs()
+		}
+	}()
+}
+
+func getRefreshStatus() map[string]interface{} {
+	if geoipRefreshInterval <= 0 {
+		return nil
+	}
+	refreshStatus.Lock()
+	defer refreshStatus.Unlock()
+	return map[string]interface{}{
+		"leader":     refreshStatus.leader,
+		"last_check": refreshStatus.lastCheck,
+		"last_error": refreshStatus.lastError,
+	}
+}
@@ -0,0 +1,256 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ruleSetFiles are rule sets loaded from --rule-set files, reloaded on SIGHUP or admin API.
+var ruleSetFiles = make(map[string]string)
+
+// reloadStatus of last reload. Config is stale when last reload failed and previous rule sets still serving.
+var reloadStatus = struct {
+	sync.Mutex
+	stale     bool
+	lastTime  time.Time
+	lastError string
+	// pending is reload waiting admin API confirmation.
+	pending        map[string]*ruleSet
+	pendingDiffs   []ruleSetDiff
+	pendingPercent float64
+}{}
+
+var errReloadNeedConfirm = errors.New("Reload need confirmation.")
+
+// reloadLock serialize reloads.
+var reloadLock sync.Mutex
+
+// loadRuleSetFiles load all rule set files. Return error of all invalid files.
+func loadRuleSetFiles() (map[string]*ruleSet, error) {
+	names := make([]string, 0, len(ruleSetFiles))
+	for name := range ruleSetFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	loaded := make(map[string]*ruleSet)
+	messages := []string{}
+	for _, name := range names {
+		rs, err := loadRuleSetFile(name, ruleSetFiles[name])
+		if err == nil {
+			err = checkRuleSetDatabases(rs)
+		}
+		if err != nil {
+			messages = append(messages, err.Error())
+			continue
+		}
+		loaded[name] = rs
+	}
+
+	if len(messages) > 0 {
+		return nil, errors.New(strings.Join(messages, "; "))
+	}
+	return loaded, nil
+}
+
+// checkRuleSetDatabases return error if the rule set need a GeoIP DB not opened.
+func checkRuleSetDatabases(rs *ruleSet) error {
+	if len(rs.ispMap) > 0 && ispDb == nil {
+		return errors.New(fmt.Sprintf("Rule set %s: ISP target mapping need --isp-db.", rs.name))
+	}
+	if len(rs.anonymousMap) > 0 && anonymousDb == nil {
+		return errors.New(fmt.Sprintf("Rule set %s: Anonymous target mapping need --anonymous-ip-db.", rs.name))
+	}
+	return nil
+}
+
+// reloadRuleSets reload rule set files. All or nothing, if any file invalid previous rule sets keep serving.
+// Changes logged before apply. With dryRun only return changes. Reload affect more than --reload-confirm-percent
+// of recent lookups kept pending until confirmed.
+func reloadRuleSets(dryRun bool) ([]ruleSetDiff, float64, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	loaded, err := loadRuleSetFiles()
+
+	reloadStatus.Lock()
+	defer reloadStatus.Unlock()
+	if err != nil {
+		if dryRun {
+			return nil, 0, err
+		}
+		reloadStatus.lastTime = time.Now()
+		reloadStatus.stale = true
+		reloadStatus.lastError = err.Error()
+		log.Errorf("Reload rule sets failed, keep previous rule sets: %s", err.Error())
+		return nil, 0, err
+	}
+
+	diffs, percent := diffRuleSets(loaded)
+	if dryRun {
+		return diffs, percent, nil
+	}
+	for _, diff := range diffs {
+		for _, change := range diff.Changes {
+			log.Infof("Reload rule set %s: %s", diff.RuleSet, change)
+		}
+	}
+
+	if reloadConfirmPercent > 0 && percent > reloadConfirmPercent {
+		reloadStatus.pending = loaded
+		reloadStatus.pendingDiffs = diffs
+		reloadStatus.pendingPercent = percent
+		log.Warnf("Reload affect %.1f%% of recent lookups, over %.1f%%. Confirm by admin API /admin/reload/confirm.", percent, reloadConfirmPercent)
+		return diffs, percent, errReloadNeedConfirm
+	}
+
+	applyRuleSets(loaded)
+	return diffs, percent, nil
+}
+
+// applyRuleSets must called with reload status lock held.
+func applyRuleSets(loaded map[string]*ruleSet) {
+	for _, rs := range loaded {
+		setRuleSet(rs)
+	}
+	decisionCache.purge()
+	stickyCache.purge()
+	reloadStatus.lastTime = time.Now()
+	reloadStatus.stale = false
+	reloadStatus.lastError = ""
+	reloadStatus.pending = nil
+	reloadStatus.pendingDiffs = nil
+	log.Infof("Reloaded %d rule set(s).", len(loaded))
+}
+
+// confirmReload apply pending reload.
+func confirmReload() bool {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	reloadStatus.Lock()
+	defer reloadStatus.Unlock()
+
+	if reloadStatus.pending == nil {
+		return false
+	}
+	log.Warnf("Pending reload affect %.1f%% of recent lookups confirmed.", reloadStatus.pendingPercent)
+	applyRuleSets(reloadStatus.pending)
+	return true
+}
+
+func getReloadStatus() map[string]interface{} {
+	reloadStatus.Lock()
+	defer reloadStatus.Unlock()
+	status := map[string]interface{}{
+		"config_stale": reloadStatus.stale,
+	}
+	if !reloadStatus.lastTime.IsZero() {
+		status["last_reload"] = reloadStatus.lastTime.UTC()
+	}
+	if reloadStatus.lastError != "" {
+		status["last_reload_error"] = reloadStatus.lastError
+	}
+	if reloadStatus.pending != nil {
+		status["pending_reload"] = map[string]interface{}{
+			"changes":          reloadStatus.pendingDiffs,
+			"affected_percent": reloadStatus.pendingPercent,
+		}
+	}
+	return status
+}
+
+// handleReloadSignal reload rule set files on SIGHUP.
+func handleReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			triggerReload("SIGHUP")
+		}
+	}()
+}
+
+// adminReloadHandler POST reload rule set files, with "dry_run=true" only return changes. GET return status of
+// last reload.
+func adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		dryRun, _ := strconv.ParseBool(r.FormValue("dry_run"))
+		diffs, percent, err := reloadRuleSets(dryRun)
+		if dryRun {
+			if err != nil {
+				writeJsonError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			writeJson(w, http.StatusOK, map[string]interface{}{"changes": diffs, "affected_percent": percent})
+			return
+		}
+		if err == errReloadNeedConfirm {
+			auditRequest(r, "reload", "pending confirm", "", nil, reloadChanges(diffs))
+			writeJson(w, http.StatusAccepted, getReloadStatus())
+			return
+		}
+		if err != nil {
+			writeJson(w, http.StatusUnprocessableEntity, getReloadStatus())
+			return
+		}
+		auditRequest(r, "reload", "", "", nil, reloadChanges(diffs))
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	writeJson(w, http.StatusOK, getReloadStatus())
+}
+
+// adminReloadConfirmHandler POST apply pending reload.
+func adminReloadConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	if !confirmReload() {
+		writeJsonError(w, http.StatusNotFound, "No pending reload.")
+		return
+	}
+	auditRequest(r, "reload_confirm", "", "", nil, nil)
+	writeJson(w, http.StatusOK, getReloadStatus())
+}
+
+// healthHandler GET return 200 while serving. Stale config still serving, so only flagged.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := getReloadStatus()
+	status["status"] = "ok"
+	if isShuttingDown() {
+		status["status"] = "shutting_down"
+		writeJson(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJson(w, http.StatusOK, status)
+}
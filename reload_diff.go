@@ -0,0 +1,187 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// reloadConfirmPercent require admin API confirmation if a reload change decisions of more than this percent of
+// recently captured lookups. 0 to apply without confirmation.
+var reloadConfirmPercent float64
+
+// ruleSetDiff is changes from old to new rule set.
+type ruleSetDiff struct {
+	RuleSet string   `json:"rule_set"`
+	Changes []string `json:"changes"`
+	// countries with changed target or schedule pool.
+	countries map[string]bool
+	// whole affect all decisions of the rule set (rule order or scripts changed, added or removed).
+	whole            bool
+	defaultChanged   bool
+	ispChanged       bool
+	anonymousChanged bool
+}
+
+func scheduleStrings(targets []scheduledTarget) []string {
+	values := []string{}
+	for _, scheduled := range targets {
+		values = append(values, fmt.Sprintf("%s@%d-%d", scheduled.target, scheduled.window.start, scheduled.window.end))
+	}
+	return values
+}
+
+// diffPoolMaps append changes of each key to diff, return changed keys.
+func diffPoolMaps(diff *ruleSetDiff, kind string, oldMap map[string][]string, newMap map[string][]string) []string {
+	keys := make(map[string]bool)
+	for key := range oldMap {
+		keys[key] = true
+	}
+	for key := range newMap {
+		keys[key] = true
+	}
+	sortedKeys := []string{}
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	changed := []string{}
+	for _, key := range sortedKeys {
+		oldPool, oldOk := oldMap[key]
+		newPool, newOk := newMap[key]
+		switch {
+		case !oldOk:
+			diff.Changes = append(diff.Changes, fmt.Sprintf("%s %s added: %v", kind, key, newPool))
+		case !newOk:
+			diff.Changes = append(diff.Changes, fmt.Sprintf("%s %s removed: %v", kind, key, oldPool))
+		case !samePool(oldPool, newPool):
+			diff.Changes = append(diff.Changes, fmt.Sprintf("%s %s changed: %v -> %v", kind, key, oldPool, newPool))
+		default:
+			continue
+		}
+		changed = append(changed, key)
+	}
+	return changed
+}
+
+// diffRuleSet return changes from current to candidate rule set. Either can be nil.
+func diffRuleSet(name string, current *ruleSet, candidate *ruleSet) ruleSetDiff {
+	diff := ruleSetDiff{RuleSet: name, Changes: []string{}, countries: make(map[string]bool)}
+	if current == nil {
+		diff.Changes = append(diff.Changes, "rule set added")
+		diff.whole = true
+		return diff
+	}
+	if candidate == nil {
+		diff.Changes = append(diff.Changes, "rule set removed")
+		diff.whole = true
+		return diff
+	}
+
+	for _, country := range diffPoolMaps(&diff, "target", current.destinationMap, candidate.destinationMap) {
+		diff.countries[country] = true
+	}
+
+	currentSchedule := make(map[string][]string)
+	for country, targets := range current.scheduleMap {
+		currentSchedule[country] = scheduleStrings(targets)
+	}
+	candidateSchedule := make(map[string][]string)
+	for country, targets := range candidate.scheduleMap {
+		candidateSchedule[country] = scheduleStrings(targets)
+	}
+	for _, country := range diffPoolMaps(&diff, "schedule-target", currentSchedule, candidateSchedule) {
+		diff.countries[country] = true
+	}
+
+	diff.ispChanged = len(diffPoolMaps(&diff, "isp-target", current.ispMap, candidate.ispMap)) > 0
+	diff.anonymousChanged = len(diffPoolMaps(&diff, "anonymous-target", current.anonymousMap, candidate.anonymousMap)) > 0
+
+	currentDefault := current.destinationMap[current.defaultTarget]
+	candidateDefault := candidate.destinationMap[candidate.defaultTarget]
+	if current.defaultTarget != candidate.defaultTarget || !samePool(currentDefault, candidateDefault) {
+		diff.Changes = append(diff.Changes, fmt.Sprintf("default changed: %s %v -> %s %v", current.defaultTarget, currentDefault, candidate.defaultTarget, candidateDefault))
+		diff.defaultChanged = true
+	}
+	if strings.Join(current.getRuleOrderNames(), ",") != strings.Join(candidate.getRuleOrderNames(), ",") {
+		diff.Changes = append(diff.Changes, fmt.Sprintf("rule order changed: %v -> %v", current.getRuleOrderNames(), candidate.getRuleOrderNames()))
+		diff.whole = true
+	}
+	if strings.Join(current.getGeoSourceNames(), ",") != strings.Join(candidate.getGeoSourceNames(), ",") {
+		diff.Changes = append(diff.Changes, fmt.Sprintf("geo source changed: %v -> %v", current.getGeoSourceNames(), candidate.getGeoSourceNames()))
+		diff.whole = true
+	}
+	if strings.Join(current.getAllowCountries(), ",") != strings.Join(candidate.getAllowCountries(), ",") || current.disallowedReply != candidate.disallowedReply {
+		diff.Changes = append(diff.Changes, fmt.Sprintf("allow-list changed: %v %s -> %v %s", current.getAllowCountries(), current.disallowedReply, candidate.getAllowCountries(), candidate.disallowedReply))
+		diff.whole = true
+	}
+	if strings.Join(current.scriptSources, "\n") != strings.Join(candidate.scriptSources, "\n") {
+		diff.Changes = append(diff.Changes, "scripts changed")
+		diff.whole = true
+	}
+	return diff
+}
+
+// affect return true if a captured lookup may get different decision after the change.
+func (diff ruleSetDiff) affect(entry captureEntry) bool {
+	switch {
+	case diff.whole:
+		return true
+	case entry.Country != "" && diff.countries[entry.Country]:
+		return true
+	case entry.Rule == "default" && diff.defaultChanged:
+		return true
+	case entry.Rule == "isp" && diff.ispChanged:
+		return true
+	case entry.Rule == "anonymous" && diff.anonymousChanged:
+		return true
+	}
+	return false
+}
+
+// diffRuleSets return changed rule sets, and percent of recently captured lookups affected.
+func diffRuleSets(loaded map[string]*ruleSet) ([]ruleSetDiff, float64) {
+	diffs := []ruleSetDiff{}
+	diffByName := make(map[string]ruleSetDiff)
+	names := []string{}
+	for name := range loaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		diff := diffRuleSet(name, getRuleSet(name), loaded[name])
+		if len(diff.Changes) > 0 {
+			diffs = append(diffs, diff)
+			diffByName[name] = diff
+		}
+	}
+
+	captures := getCaptures(0)
+	if len(captures) < 1 {
+		return diffs, 0
+	}
+	affected := 0
+	for _, entry := range captures {
+		if diff, ok := diffByName[entry.RuleSet]; ok && diff.affect(entry) {
+			affected++
+		}
+	}
+	return diffs, float64(affected) * 100 / float64(len(captures))
+}
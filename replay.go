@@ -0,0 +1,195 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v1"
+	"sort"
+	"strings"
+	"time"
+)
+
+func replayCommand() cli.Command {
+	return cli.Command{
+		Name:      "replay",
+		Usage:     "Re-run logged keys against a rule set at a controlled rate and report decision distribution.",
+		ArgsUsage: "KEYS_FILE",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "rule-set",
+				Usage: "Rule set file to replay against.",
+			},
+			cli.StringFlag{
+				Name:  "geoip-db",
+				Usage: "GeoIP DB file.",
+				Value: "GeoLite2-Country.mmdb",
+			},
+			cli.StringFlag{
+				Name:        "isp-db",
+				Usage:       "ISP DB file, if rule set use ISP target mapping.",
+				Destination: &ispDbPath,
+			},
+			cli.StringSliceFlag{
+				Name:  "dns-server",
+				Usage: "DNS server to query. Use /etc/resolv.conf if not set.",
+			},
+			cli.StringFlag{
+				Name:  "fixtures",
+				Usage: "Answer DNS and GeoIP from fixture file instead of DNS servers and GeoIP DB.",
+			},
+			cli.Float64Flag{
+				Name:  "rate",
+				Usage: "Lookups per second. 0 for no limit.",
+				Value: 10,
+			},
+		},
+		Action: replayHandler,
+	}
+}
+
+// replayKey accept a plain key, or a JSON log line of "Received '...'".
+func replayKey(line string) (string, bool) {
+	if !strings.HasPrefix(line, "{") {
+		return line, true
+	}
+	entry := struct {
+		Msg string `json:"msg"`
+	}{}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return "", false
+	}
+	if !strings.HasPrefix(entry.Msg, "Received '") || !strings.HasSuffix(entry.Msg, "'") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(entry.Msg, "Received '"), "'"), true
+}
+
+type replayCount struct {
+	name  string
+	count int
+}
+
+func sortedReplayCounts(counts map[string]int) []replayCount {
+	sorted := make([]replayCount, 0, len(counts))
+	for name, count := range counts {
+		sorted = append(sorted, replayCount{name: name, count: count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return sorted[i].name < sorted[j].name
+	})
+	return sorted
+}
+
+func printReplayCounts(title string, counts map[string]int, total int) {
+	fmt.Printf("%s:\n", title)
+	for _, entry := range sortedReplayCounts(counts) {
+		fmt.Printf("  %s\t%d\t%.2f%%\n", entry.name, entry.count, float64(entry.count)*100/float64(total))
+	}
+}
+
+func replayHandler(c *cli.Context) error {
+	if c.NArg() != 1 || c.String("rule-set") == "" {
+		cli.ShowCommandHelp(c, "replay")
+		return errors.New("Need KEYS_FILE and --rule-set.")
+	}
+	if c.Float64("rate") < 0 {
+		return errors.New("--rate can't be negative.")
+	}
+
+	lines, err := readKeysFile(c.Args().First())
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for _, line := range lines {
+		if key, ok := replayKey(line); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	rs, err := loadRuleSetFile("replay", c.String("rule-set"))
+	if err != nil {
+		return err
+	}
+	if path := c.String("fixtures"); path != "" {
+		if err := loadFixtures(path); err != nil {
+			return err
+		}
+	} else {
+		countryDb, err = openGeoipDb(c.String("geoip-db"))
+		if err != nil {
+			return errors.New(fmt.Sprintf("Open GeoIP DB file error: %s", err.Error()))
+		}
+		if ispDbPath != "" {
+			ispDb, err = openGeoipDb(ispDbPath)
+			if err != nil {
+				return errors.New(fmt.Sprintf("Open ISP DB file error: %s", err.Error()))
+			}
+		}
+		if err := setupDnsServers(c.StringSlice("dns-server")); err != nil {
+			return err
+		}
+	}
+
+	// Only report, don't flood output with per lookup logs.
+	log.SetLevel(log.ErrorLevel)
+
+	var interval time.Duration
+	if rate := c.Float64("rate"); rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+
+	targets := make(map[string]int)
+	rules := make(map[string]int)
+	countries := make(map[string]int)
+	started := time.Now()
+	for i, key := range keys {
+		if interval > 0 {
+			if wait := time.Until(started.Add(time.Duration(i) * interval)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		d := evaluate(rs, key)
+		switch {
+		case d.Action != "":
+			targets["("+d.Action+")"]++
+		default:
+			targets[d.Target]++
+		}
+		rules[d.Rule]++
+		if d.Country != "" {
+			countries[d.Country]++
+		}
+	}
+
+	fmt.Printf("Keys: %d, skipped lines: %d, duration: %s\n", len(keys), len(lines)-len(keys), time.Since(started).Round(time.Millisecond))
+	if len(keys) == 0 {
+		return nil
+	}
+	printReplayCounts("Targets", targets, len(keys))
+	printReplayCounts("Rules", rules, len(keys))
+	printReplayCounts("Countries", countries, len(keys))
+	return nil
+}
@@ -0,0 +1,324 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNSSEC modes. Validation done by the resolver (e.g. local unbound), its AD bit is trusted.
+const (
+	dnssecOff = "off"
+	// dnssecValidate fail bogus answers (validating resolver return SERVFAIL), allow unsigned zones.
+	dnssecValidate = "validate"
+	// dnssecRequire also fail answers without AD bit.
+	dnssecRequire = "require"
+)
+
+var dnssecMode = dnssecOff
+
+// dnsServers are tried in order for each query until one answer, unhealthy ones last. Use nameservers in /etc/resolv.conf if empty.
+var dnsServers []string
+var dnsTimeout time.Duration
+var dnsEdns0Size int
+
+// dnsClientSubnet is EDNS Client Subnet option sent on queries, nil to not send one and let resolver decide.
+var dnsClientSubnet *dns.EDNS0_SUBNET
+
+// ECS modes. Other values are a CIDR sent as client subnet.
+const (
+	ecsDefault = "default"
+	// ecsDisable send source prefix 0, ask resolver not to use client subnet.
+	ecsDisable = "disable"
+)
+
+var errDnssecBogus = errors.New("DNSSEC validation failed")
+var errDnssecInsecure = errors.New("DNSSEC answer not validated")
+
+// dnsError is a lookup answered with a non success rcode, e.g. NXDOMAIN.
+type dnsError struct {
+	name  string
+	rcode int
+}
+
+func (e *dnsError) Error() string {
+	return fmt.Sprintf("lookup %s: %s", e.name, dns.RcodeToString[e.rcode])
+}
+
+func parseDnssecMode(value string) (string, error) {
+	value = strings.ToLower(value)
+	switch value {
+	case dnssecOff, dnssecValidate, dnssecRequire:
+		return value, nil
+	}
+	return "", errors.New(fmt.Sprintf("Invalid DNSSEC mode: %s", value))
+}
+
+// parseEcsMode parse "default", "disable" or a CIDR into ECS option sent on queries.
+func parseEcsMode(value string) (*dns.EDNS0_SUBNET, error) {
+	switch strings.ToLower(value) {
+	case ecsDefault, "":
+		return nil, nil
+	case ecsDisable:
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 0, Address: net.IPv4zero}, nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid EDNS client subnet: %s", value))
+	}
+	ones, _ := network.Mask.Size()
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: network.IP}
+	if network.IP.To4() == nil {
+		subnet.Family = 2
+	}
+	return subnet, nil
+}
+
+// setupDnsServers add default port to configured servers, or read them from /etc/resolv.conf.
+func setupDnsServers(servers []string) error {
+	if len(servers) < 1 {
+		config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return errors.New(fmt.Sprintf("Read /etc/resolv.conf error: %s", err.Error()))
+		}
+		for _, server := range config.Servers {
+			servers = append(servers, net.JoinHostPort(server, config.Port))
+		}
+	}
+	if len(servers) < 1 {
+		return errors.New("No DNS server configured.")
+	}
+
+	dnsServers = []string{}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		dnsServers = append(dnsServers, server)
+	}
+	log.Infof("Use DNS server(s): %v", dnsServers)
+	return nil
+}
+
+// exchange send query to the server. Retry over TCP if answer truncated.
+func exchange(query *dns.Msg, server string) (*dns.Msg, error) {
+	client := &dns.Client{Timeout: dnsTimeout}
+	response, _, err := client.Exchange(query, server)
+	if err == nil && response.Truncated {
+		client.Net = "tcp"
+		response, _, err = client.Exchange(query, server)
+	}
+	return response, err
+}
+
+// dnsCacheMaxTtl cap TTL of cached answers, 0 to disable DNS cache.
+var dnsCacheMaxTtl time.Duration
+
+// dnsNegativeTtl is cache time of NXDOMAIN and empty answers.
+var dnsNegativeTtl time.Duration
+
+var dnsCache = newLruCache("dns")
+var dnsNegativeCache = newLruCache("dns_negative")
+
+// dnsQuery return answer records of the type, and minimum TTL of them. Answers cached by TTL.
+func dnsQuery(name string, queryType uint16) ([]dns.RR, uint32, error) {
+	if err := chaosDnsTimeout(name); err != nil {
+		return nil, 0, err
+	}
+	if fixtures != nil {
+		return fixtureQuery(name, queryType)
+	}
+	if dnsCacheMaxTtl <= 0 {
+		return queryDnsServers(name, queryType)
+	}
+
+	key := dns.TypeToString[queryType] + " " + strings.ToLower(dns.Fqdn(name))
+	if value, remaining, ok := dnsCache.get(key); ok {
+		return value.([]dns.RR), uint32(remaining / time.Second), nil
+	}
+	if value, _, ok := dnsNegativeCache.get(key); ok {
+		if value == nil {
+			return []dns.RR{}, 0, nil
+		}
+		return nil, 0, value.(error)
+	}
+
+	answers, ttl, err := queryDnsServers(name, queryType)
+	if dnsErr, ok := err.(*dnsError); ok && dnsErr.rcode == dns.RcodeNameError {
+		dnsNegativeCache.set(key, err, len(key)+32, dnsNegativeTtl)
+		return answers, ttl, err
+	}
+	if err != nil {
+		return answers, ttl, err
+	}
+	if len(answers) < 1 {
+		dnsNegativeCache.set(key, nil, len(key)+16, dnsNegativeTtl)
+		return answers, ttl, err
+	}
+
+	cacheTtl := time.Duration(ttl) * time.Second
+	if cacheTtl > dnsCacheMaxTtl {
+		cacheTtl = dnsCacheMaxTtl
+	}
+	dnsCache.set(key, answers, len(key)+64*len(answers), cacheTtl)
+	return answers, ttl, err
+}
+
+// queryDnsServers query servers in order until one answer.
+func queryDnsServers(name string, queryType uint16) ([]dns.RR, uint32, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), queryType)
+	query.SetEdns0(uint16(dnsEdns0Size), dnssecMode != dnssecOff)
+	if dnssecMode != dnssecOff {
+		query.AuthenticatedData = true
+	}
+	if dnsClientSubnet != nil {
+		option := query.IsEdns0()
+		option.Option = append(option.Option, dnsClientSubnet)
+	}
+
+	var response *dns.Msg
+	var err error
+	var server string
+	for _, server = range orderedDnsServers() {
+		start := time.Now()
+		response, err = exchange(query, server)
+		// SERVFAIL not count against health, validating resolver answer it for bogus domains.
+		recordResolverResult(server, time.Since(start), err != nil, err, false)
+		if err == nil && response.Rcode != dns.RcodeServerFailure {
+			break
+		}
+		log.Debugf("DNS server %s failed on %s: %v", server, name, err)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch response.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeServerFailure:
+		if dnssecMode != dnssecOff && validationFailed(query, server) {
+			return nil, 0, errDnssecBogus
+		}
+		return nil, 0, &dnsError{name: name, rcode: response.Rcode}
+	default:
+		return nil, 0, &dnsError{name: name, rcode: response.Rcode}
+	}
+
+	if dnssecMode == dnssecRequire && !response.AuthenticatedData {
+		return nil, 0, errDnssecInsecure
+	}
+
+	answers := []dns.RR{}
+	var ttl uint32
+	for _, answer := range response.Answer {
+		if answer.Header().Rrtype != queryType {
+			// CNAME chain
+			continue
+		}
+		if len(answers) < 1 || answer.Header().Ttl < ttl {
+			ttl = answer.Header().Ttl
+		}
+		answers = append(answers, answer)
+	}
+	return answers, ttl, nil
+}
+
+// validationFailed return true if the server answer the query with checking disabled. Validating resolver answer
+// SERVFAIL for bogus data, but also when authoritative servers fail, so only bogus if answered without validation.
+func validationFailed(query *dns.Msg, server string) bool {
+	unchecked := query.Copy()
+	unchecked.CheckingDisabled = true
+	response, err := exchange(unchecked, server)
+	return err == nil && response.Rcode != dns.RcodeServerFailure
+}
+
+// lookupMXWithTTL return MX list sorted by priority and TTL of the answer.
+func lookupMXWithTTL(domain string) ([]*net.MX, uint32, error) {
+	answers, ttl, err := dnsQuery(domain, dns.TypeMX)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	mxs := []*net.MX{}
+	for _, answer := range answers {
+		mx := answer.(*dns.MX)
+		mxs = append(mxs, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+	}
+	if len(mxs) < 1 {
+		return nil, 0, errors.New(fmt.Sprintf("lookup %s: no MX record", domain))
+	}
+	sortMx(mxs)
+	return mxs, ttl, nil
+}
+
+// lookupIPWithTTL return A and AAAA addresses and minimum TTL of them.
+func lookupIPWithTTL(host string) ([]net.IP, uint32, error) {
+	ips := []net.IP{}
+	var ttl uint32
+	var lastErr error
+	for _, queryType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answers, answerTtl, err := dnsQuery(host, queryType)
+		if isDnssecError(err) {
+			return nil, 0, err
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(answers) > 0 && (len(ips) < 1 || answerTtl < ttl) {
+			ttl = answerTtl
+		}
+		for _, answer := range answers {
+			switch record := answer.(type) {
+			case *dns.A:
+				ips = append(ips, record.A)
+			case *dns.AAAA:
+				ips = append(ips, record.AAAA)
+			}
+		}
+	}
+	if len(ips) < 1 {
+		if lastErr != nil {
+			return nil, 0, lastErr
+		}
+		return nil, 0, errors.New(fmt.Sprintf("lookup %s: no such host", host))
+	}
+	return ips, ttl, nil
+}
+
+// lookupMX return MX list sorted by priority.
+func lookupMX(domain string) ([]*net.MX, error) {
+	mxs, _, err := lookupMXWithTTL(domain)
+	return mxs, err
+}
+
+func lookupIP(host string) ([]net.IP, error) {
+	ips, _, err := lookupIPWithTTL(host)
+	return ips, err
+}
+
+func isDnssecError(err error) bool {
+	return err == errDnssecBogus || err == errDnssecInsecure
+}
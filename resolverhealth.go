@@ -0,0 +1,155 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// DNS servers failing resolverFailThreshold queries or probes in a row are unhealthy, tried only after healthy ones,
+// until a probe succeed. Probes query dnsProbeName of each server every dnsProbeInterval. Without probes, a
+// successful query bring server back.
+var dnsProbeInterval time.Duration
+var dnsProbeName string
+
+const resolverFailThreshold = 3
+
+// resolverLatencyWeight of newest sample in average latency.
+const resolverLatencyWeight = 0.2
+
+type resolverHealth struct {
+	Server              string     `json:"server"`
+	Healthy             bool       `json:"healthy"`
+	Queries             uint64     `json:"queries"`
+	Errors              uint64     `json:"errors"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	AvgLatencyMs        float64    `json:"avg_latency_ms"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastProbe           *time.Time `json:"last_probe,omitempty"`
+}
+
+var resolvers = struct {
+	sync.Mutex
+	health map[string]*resolverHealth
+}{health: make(map[string]*resolverHealth)}
+
+// getResolverHealth must called with resolvers locked.
+func getResolverHealth(server string) *resolverHealth {
+	health, ok := resolvers.health[server]
+	if !ok {
+		health = &resolverHealth{Server: server, Healthy: true}
+		resolvers.health[server] = health
+	}
+	return health
+}
+
+// orderedDnsServers return healthy servers in configured order, then unhealthy ones.
+func orderedDnsServers() []string {
+	resolvers.Lock()
+	defer resolvers.Unlock()
+	healthy := make([]string, 0, len(dnsServers))
+	unhealthy := []string{}
+	for _, server := range dnsServers {
+		if getResolverHealth(server).Healthy {
+			healthy = append(healthy, server)
+		} else {
+			unhealthy = append(unhealthy, server)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// recordResolverResult count query or probe result of the server, and update its health. failed is timeout or network
+// error, or SERVFAIL of probe.
+func recordResolverResult(server string, latency time.Duration, failed bool, err error, probe bool) {
+	resolvers.Lock()
+	defer resolvers.Unlock()
+	health := getResolverHealth(server)
+	if probe {
+		now := time.Now()
+		health.LastProbe = &now
+	} else {
+		health.Queries++
+	}
+
+	if failed {
+		if !probe {
+			health.Errors++
+		}
+		if err != nil {
+			health.LastError = err.Error()
+		} else {
+			health.LastError = "SERVFAIL"
+		}
+		health.ConsecutiveFailures++
+		if health.Healthy && health.ConsecutiveFailures >= resolverFailThreshold {
+			health.Healthy = false
+			log.Warnf("DNS server %s unhealthy after %d failures (%s), fail over to other servers.", server, health.ConsecutiveFailures, health.LastError)
+		}
+		return
+	}
+
+	latencyMs := float64(latency) / float64(time.Millisecond)
+	if health.AvgLatencyMs == 0 {
+		health.AvgLatencyMs = latencyMs
+	} else {
+		health.AvgLatencyMs = (1-resolverLatencyWeight)*health.AvgLatencyMs + resolverLatencyWeight*latencyMs
+	}
+	health.ConsecutiveFailures = 0
+	// Only probe bring server back if probes enabled, a lucky query may be answered from its cache.
+	if !health.Healthy && (probe || dnsProbeInterval <= 0) {
+		health.Healthy = true
+		log.Infof("DNS server %s recovered.", server)
+	}
+}
+
+func probeDnsServer(server string) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(dnsProbeName), dns.TypeNS)
+	start := time.Now()
+	response, err := exchange(query, server)
+	failed := err != nil || response.Rcode == dns.RcodeServerFailure
+	recordResolverResult(server, time.Since(start), failed, err, true)
+}
+
+// startResolverProbe probe all DNS servers every dnsProbeInterval. Not in simulation mode.
+func startResolverProbe() {
+	if dnsProbeInterval <= 0 || fixtures != nil {
+		return
+	}
+	go func() {
+		for range time.Tick(dnsProbeInterval) {
+			for _, server := range dnsServers {
+				go probeDnsServer(server)
+			}
+		}
+	}()
+}
+
+// getResolverStats return health and counts of DNS servers in configured order.
+func getResolverStats() []resolverHealth {
+	resolvers.Lock()
+	defer resolvers.Unlock()
+	stats := make([]resolverHealth, 0, len(dnsServers))
+	for _, server := range dnsServers {
+		stats = append(stats, *getResolverHealth(server))
+	}
+	return stats
+}
@@ -0,0 +1,582 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+// Rule evaluation order. First rule return a target pool with not drained target win. If no rule match, use default target.
+//
+//	script    - first --script expression return a target
+//	anonymous - MX IP flagged in --anonymous-ip-db (VPN, hosting, proxy, Tor) in --anonymous-target
+//	isp       - ISP/organization of any MX IP in --isp-target (independent of country)
+//	schedule  - country of MX in --schedule-target and inside time window
+//	country   - country of MX in --target
+//	web       - country of domain apex/www A record, only if MX can't be geolocated (--web-fallback)
+//	tld       - country from ccTLD, only if no MX IP resolved (--tld-fallback)
+const defaultRuleOrder = "script,anonymous,isp,schedule,country,web,tld"
+
+// rule return target pool. Target picked from pool by evaluate().
+type rule struct {
+	name  string
+	match func(l *lookup) ([]string, bool)
+}
+
+var availableRules = map[string]func(l *lookup) ([]string, bool){
+	"script":    matchScriptRule,
+	"anonymous": matchAnonymousRule,
+	"isp":       matchIspRule,
+	"schedule":  matchScheduleRule,
+	"country":   matchCountryRule,
+	"web":       matchWebRule,
+	"tld":       matchTldRule,
+}
+
+// decision is result of one query.
+type decision struct {
+	RuleSet string `json:"rule_set"`
+	// Action is empty to relay to Target, or fail policy "temp"/"notfound" to reply 400/500.
+	Action  string `json:"action,omitempty"`
+	Failure string `json:"failure,omitempty"`
+	// ErrorCode classify cause of a failure reply or default decision, e.g. "nxdomain", "no_rule".
+	ErrorCode string   `json:"error_code,omitempty"`
+	Target    string   `json:"target"`
+	Pool      []string `json:"pool"`
+	Rule      string   `json:"rule"`
+	// Label is label of matched mapping, if set.
+	Label string `json:"label,omitempty"`
+	// Nexthop is Postfix nexthop of Target, e.g. "relay:[mta1]".
+	Nexthop string `json:"nexthop,omitempty"`
+	Country string `json:"country,omitempty"`
+	// Anonymous is flags of MX IPs in Anonymous IP DB, e.g. "vpn", "hosting". Only if --anonymous-ip-db set.
+	Anonymous []string `json:"anonymous,omitempty"`
+	// Cached is true if decision not evaluated for this query.
+	Cached bool `json:"cached"`
+	// Stale is true if resolvers failed and last good decision of the domain served, see --serve-stale-ttl.
+	Stale  bool     `json:"stale,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+	Trace  []string `json:"trace,omitempty"`
+	// matchKey of the matched mapping, to find mapping options when target picked again from pool.
+	matchKey string
+	// Timings is milliseconds spent on each lookup phase (mx, ip, geoip, apex, isp, anonymous, web, script, plugin).
+	Timings map[string]float64 `json:"timings_ms,omitempty"`
+}
+
+// lookup hold attributes of one query. DNS and GeoIP only resolved when a rule need it.
+type lookup struct {
+	rules     *ruleSet
+	email     string
+	domain    string
+	domainErr error
+	// shadow evaluation of candidate rule set, without side effects.
+	shadow bool
+
+	mxHosts     []string
+	ips         []net.IP
+	ipsResolved bool
+	// mxBogus if MX answer failed DNSSEC validation. Bogus IP answer of a MX host only skip the host.
+	mxBogus bool
+
+	asn         uint
+	isp         string
+	ispResolved bool
+
+	anonymous         []string
+	anonymousResolved bool
+
+	mxCountry         string
+	mxCountryFound    bool
+	mxCountryResolved bool
+
+	// matchKey is country code, "isp:" and ISP name or "anonymous:" and flag of mapping matched by last rule, for mapping options.
+	matchKey string
+
+	errors   []string
+	failures []string
+	// errorCodes of failures, in same order.
+	errorCodes []string
+	trace      []string
+	timings    map[string]time.Duration
+
+	// traced log each trace step as it happen, for domains traced by --trace-domain.
+	traced bool
+	start  time.Time
+}
+
+func newLookup(rs *ruleSet, email string) *lookup {
+	l := &lookup{rules: rs, email: email, timings: make(map[string]time.Duration), start: time.Now()}
+	l.domain, l.domainErr = getEmailDomain(email)
+	if l.domainErr == nil && !strings.HasSuffix(email, "@"+l.domain) {
+		l.tracef("domain of %s converted to %s", email, l.domain)
+	}
+	l.traced = l.domainErr == nil && isDomainTraced(l.domain)
+	return l
+}
+
+func (l *lookup) addTrace(message string) {
+	l.trace = append(l.trace, message)
+	if l.traced {
+		traceLog.WithFields(log.Fields{
+			"key":        l.email,
+			"rule_set":   l.rules.name,
+			"elapsed_ms": float64(time.Since(l.start)) / float64(time.Millisecond),
+		}).Info("Trace: " + message)
+	}
+}
+
+func (l *lookup) tracef(format string, args ...interface{}) {
+	l.addTrace(fmt.Sprintf(format, args...))
+}
+
+// errorf record a failure of the failure type, classified by err. It also show in trace.
+func (l *lookup) errorf(failureType string, err error, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	l.errors = append(l.errors, message)
+	l.failures = append(l.failures, failureType)
+	l.errorCodes = append(l.errorCodes, errorCode(failureType, err))
+	l.addTrace(message)
+}
+
+// getErrorCode return error code of first failure, or no_rule if none.
+func (l *lookup) getErrorCode() string {
+	if len(l.errorCodes) > 0 {
+		return l.errorCodes[0]
+	}
+	return errorNoRule
+}
+
+// addTiming add time since start to the phase.
+func (l *lookup) addTiming(phase string, start time.Time) {
+	l.timings[phase] += time.Since(start)
+}
+
+func (l *lookup) getTimingsMs() map[string]float64 {
+	timings := make(map[string]float64, len(l.timings))
+	for phase, duration := range l.timings {
+		timings[phase] = float64(duration) / float64(time.Millisecond)
+	}
+	return timings
+}
+
+// fillDecision copy resolved attributes of the lookup to the decision.
+func (l *lookup) fillDecision(d decision) decision {
+	d.Country = l.mxCountry
+	if l.ipsResolved {
+		d.Anonymous = l.getAnonymous()
+	}
+	d.Errors = l.errors
+	d.Trace = l.trace
+	d.Timings = l.getTimingsMs()
+	return d
+}
+
+// getIps return one IP for each resolvable MX host, in MX priority order.
+func (l *lookup) getIps() []net.IP {
+	if l.ipsResolved {
+		return l.ips
+	}
+	l.ipsResolved = true
+
+	start := time.Now()
+	mxs, err := getMx(l.domain)
+	l.addTiming("mx", start)
+	if isDnssecError(err) {
+		l.mxBogus = true
+		l.errorf("dnssec", err, "MX lookup of %s failed: %v", l.domain, err)
+		return l.ips
+	}
+	if err != nil {
+		l.errorf("mx", err, "MX lookup of %s failed: %v", l.domain, err)
+		return l.ips
+	}
+
+	for _, mx := range mxs {
+		l.mxHosts = append(l.mxHosts, mx.Host)
+		start := time.Now()
+		ip, err := getIp(l.domain, mx)
+		l.addTiming("ip", start)
+		if isDnssecError(err) {
+			l.errorf("dnssec", err, "IP lookup of MX %s failed: %v", mx.Host, err)
+			continue
+		}
+		if err != nil {
+			l.errorf("ip", err, "IP lookup of MX %s failed", mx.Host)
+			continue
+		}
+		l.tracef("MX %s resolved to %s", mx.Host, ip.String())
+		l.ips = append(l.ips, ip)
+	}
+
+	return l.ips
+}
+
+func (l *lookup) getMxHosts() []string {
+	l.getIps()
+	return l.mxHosts
+}
+
+// getIsp return ASN and ISP/organization name of first MX IP found in ISP DB.
+func (l *lookup) getIsp() (uint, string) {
+	if l.ispResolved {
+		return l.asn, l.isp
+	}
+	l.ispResolved = true
+
+	if ispDb == nil {
+		return l.asn, l.isp
+	}
+
+	for _, ip := range l.getIps() {
+		start := time.Now()
+		asn, names, err := getIspByIp(ip)
+		l.addTiming("isp", start)
+		if err != nil {
+			continue
+		}
+		l.asn = asn
+		for _, name := range names {
+			if name != "" {
+				l.isp = name
+				break
+			}
+		}
+		break
+	}
+
+	return l.asn, l.isp
+}
+
+// getMxCountry return country of the domain used by rules, from --geo-source of the rule set. MX by default.
+func (l *lookup) getMxCountry() (string, bool) {
+	if l.mxCountryResolved {
+		return l.mxCountry, l.mxCountryFound
+	}
+	l.mxCountryResolved = true
+
+	if len(l.rules.geoSources) < 1 {
+		l.mxCountry, l.mxCountryFound = l.geolocateMx()
+	} else {
+		l.mxCountry, l.mxCountryFound = l.geolocateSources()
+	}
+	return l.mxCountry, l.mxCountryFound
+}
+
+// resolveAllowListCountry geolocate MX if allow-list need country of a decision, even if matched rule didn't use it,
+// e.g. tld, web or script rule.
+func (l *lookup) resolveAllowListCountry() {
+	if l.rules.allowCountries != nil {
+		l.getMxCountry()
+	}
+}
+
+// geolocateMx return country of first MX IP can be geolocated. Other MX IPs are geolocated too, to record
+// domains with MX hosts in different countries.
+func (l *lookup) geolocateMx() (string, bool) {
+	mxCountry := ""
+	found := false
+	countries := []string{}
+	for _, ip := range l.getIps() {
+		start := time.Now()
+		country, err := getCountryByIp(ip)
+		l.addTiming("geoip", start)
+		if err != nil {
+			if !found {
+				l.errorf("geoip", err, "GeoIP lookup of %s failed: %v", ip.String(), err)
+			}
+			continue
+		}
+
+		l.tracef("MX IP %s geolocated to %s", ip.String(), country)
+		if !containsString(countries, country) {
+			countries = append(countries, country)
+		}
+		if found {
+			continue
+		}
+		lookupInfof("Got country code: %s for domain:%s", country, l.domain)
+		mxCountry = country
+		found = true
+	}
+	if len(countries) > 1 {
+		l.tracef("MX hosts of %s in different countries: %s", l.domain, strings.Join(countries, ", "))
+		if !l.shadow {
+			recordAmbiguous(l.domain, countries)
+		}
+	}
+
+	return mxCountry, found
+}
+
+func matchIspRule(l *lookup) ([]string, bool) {
+	if ispDb == nil {
+		l.tracef("isp: no ISP DB")
+		return nil, false
+	}
+
+	for _, ip := range l.getIps() {
+		start := time.Now()
+		pool, isp, ok := l.rules.getIspPool(ip)
+		l.addTiming("isp", start)
+		if ok {
+			l.matchKey = "isp:" + isp
+			return pool, true
+		}
+	}
+	return nil, false
+}
+
+func matchScheduleRule(l *lookup) ([]string, bool) {
+	country, ok := l.getMxCountry()
+	if !ok {
+		return nil, false
+	}
+	pool := l.rules.getScheduledTargets(country, time.Now())
+	l.matchKey = country
+	return pool, len(pool) > 0
+}
+
+func matchCountryRule(l *lookup) ([]string, bool) {
+	country, ok := l.getMxCountry()
+	if !ok {
+		return nil, false
+	}
+
+	l.matchKey = country
+	if pool, share, ok := l.rules.getSplitPool(country, l.domain); ok {
+		l.tracef("split: domain %s in share %s of %s", l.domain, share.String(), country)
+		return pool, true
+	} else if share.name != "" {
+		l.tracef("split: all targets of share %s drained, use all targets of %s", share.String(), country)
+	}
+	pool, ok := l.rules.destinationMap[country]
+	return pool, ok
+}
+
+func matchWebRule(l *lookup) ([]string, bool) {
+	if !webFallback {
+		l.tracef("web: disabled")
+		return nil, false
+	}
+	if _, ok := l.getMxCountry(); ok {
+		l.tracef("web: MX already geolocated")
+		return nil, false
+	}
+
+	start := time.Now()
+	country, ok := getWebCountry(l.domain)
+	l.addTiming("web", start)
+	if !ok {
+		return nil, false
+	}
+	l.tracef("web: domain geolocated to %s", country)
+	l.matchKey = country
+	return l.rules.getCountryPool(country, l.domain)
+}
+
+func matchTldRule(l *lookup) ([]string, bool) {
+	if !tldFallback {
+		l.tracef("tld: disabled")
+		return nil, false
+	}
+	if len(l.getIps()) > 0 {
+		l.tracef("tld: MX resolved")
+		return nil, false
+	}
+	pool, country, ok := getTldPool(l.rules, l.domain)
+	l.matchKey = country
+	return pool, ok
+}
+
+// parseRuleOrder parse comma separated rule names into rule order.
+func parseRuleOrder(value string) ([]rule, error) {
+	rules := []rule{}
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		match, ok := availableRules[name]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Unknown rule in rule order: %s", name))
+		}
+		if seen[name] {
+			return nil, errors.New(fmt.Sprintf("Duplicated rule in rule order: %s", name))
+		}
+		seen[name] = true
+		rules = append(rules, rule{name: name, match: match})
+	}
+	return rules, nil
+}
+
+// evaluate run rules by rule order. First rule return a target win.
+func evaluate(rs *ruleSet, email string) decision {
+	return evaluateRules(rs, email, false)
+}
+
+// evaluateShadow evaluate shadow candidate rule set. Plugin not called and MX country disagreement not recorded, so
+// only the live evaluation has side effects.
+func evaluateShadow(rs *ruleSet, email string) decision {
+	return evaluateRules(rs, email, true)
+}
+
+func evaluateRules(rs *ruleSet, email string, shadow bool) decision {
+	email = normalizeKey(email)
+
+	if name, ok := getSpecialKey(email); ok {
+		return rs.specialDecision(name)
+	}
+
+	if isStaticMode() {
+		return rs.defaultDecision("static", []string{"static mode enabled"})
+	}
+
+	l := newLookup(rs, email)
+	l.shadow = shadow
+	chaosDelay(l.domain)
+	if l.domainErr != nil {
+		log.Warnln(l.domainErr.Error())
+		d := rs.defaultDecision("default", []string{l.domainErr.Error()})
+		d.Errors = []string{l.domainErr.Error()}
+		d.ErrorCode = errorBadKey
+		applyFailPolicy(&d, []string{"key"})
+		return d
+	}
+
+	if p, ok := getPin(rs.name, l.domain); ok && !isDrained(p.Target) {
+		l.tracef("domain %s pinned to %s (%s)", l.domain, p.Target, p.Source)
+		d := decision{RuleSet: rs.name, Target: p.Target, Pool: []string{p.Target}, Rule: "pin"}
+		rs.applyMappingOptions(&d)
+		return l.fillDecision(d)
+	}
+
+	for _, r := range rs.ruleOrder {
+		l.matchKey = ""
+		pool, ok := r.match(l)
+		if !ok {
+			l.tracef("rule %s not matched", r.name)
+			continue
+		}
+
+		valid := rs.validTargets(l.matchKey, pool, time.Now())
+		if len(valid) < 1 {
+			l.tracef("rule %s matched, but targets %v not valid now", r.name, pool)
+			continue
+		}
+		pool = valid
+		l.resolveAllowListCountry()
+		target, ok := pickCountryTarget(l.mxCountry, pool)
+		if !ok {
+			l.tracef("rule %s matched, but all targets %v drained", r.name, pool)
+			continue
+		}
+		l.tracef("rule %s matched, target %s", r.name, target)
+		for _, member := range pool {
+			if isDemoted(l.mxCountry, member) {
+				l.tracef("target %s demoted for %s", member, l.mxCountry)
+			}
+		}
+		if l.mxBogus {
+			// Don't trust any decision based on bogus MX answer. Bogus MX hosts were skipped, so others are
+			// still trusted.
+			d := l.fillDecision(decision{RuleSet: rs.name, Rule: r.name, ErrorCode: errorDnssec})
+			if applyFailPolicy(&d, []string{"dnssec"}) {
+				return d
+			}
+		}
+		d := decision{RuleSet: rs.name, Target: target, Pool: pool, Rule: r.name, matchKey: l.matchKey}
+		rs.applyMappingOptions(&d)
+		return applyPlugin(l, l.fillDecision(d))
+	}
+
+	l.resolveAllowListCountry()
+	d := l.fillDecision(rs.defaultDecision("default", nil))
+	d.ErrorCode = l.getErrorCode()
+	failures := l.failures
+	if hasFailure(failures, "dnssec") {
+		failures = []string{"dnssec"}
+		d.ErrorCode = errorDnssec
+	}
+	if applyFailPolicy(&d, failures) {
+		return d
+	}
+	d.Trace = append(d.Trace, fmt.Sprintf("no rule matched, default target %s", d.Target))
+	return applyPlugin(l, d)
+}
+
+// decisionKey return key of emails sharing one evaluation. Scripts and plugin can use whole email, so only
+// share by domain without them.
+func decisionKey(rs *ruleSet, email string) string {
+	email = normalizeKey(email)
+	if len(rs.scripts) > 0 || pluginUrl != "" {
+		return email
+	}
+	domain, err := getEmailDomain(email)
+	if err != nil {
+		return email
+	}
+	return strings.ToLower(domain)
+}
+
+// applyDecisionLayers apply layers after evaluation: sticky target, country switch, allow-list and business hours.
+// Shared by Postfix queries and lookup APIs, so APIs answer what Postfix get. Only Postfix queries remember, i.e. start
+// sticky window and auto pin.
+func applyDecisionLayers(rs *ruleSet, email string, d *decision, now time.Time, remember bool) {
+	if remember {
+		applySticky(rs, email, d)
+		autoPin(rs, email, *d)
+	} else {
+		peekSticky(rs, email, d)
+	}
+	applyCountrySwitch(rs, d)
+	applyAllowList(rs, d)
+	applyBusinessHours(rs, d, now)
+}
+
+func getResult(rs *ruleSet, email string) decision {
+	start := time.Now()
+	email = normalizeKey(email)
+	d, ok := getCachedDecision(rs, email)
+	if !ok {
+		d = evaluateLimited(rs, email)
+		if !serveStale(rs, email, &d) {
+			cacheDecision(rs, email, d)
+			rememberStale(rs, email, d)
+		}
+	}
+	applyDecisionLayers(rs, email, &d, time.Now(), true)
+	duration := time.Since(start)
+	traceId := newTraceId()
+	recordDecision(d)
+	recordSelection(d)
+	recordTargetLoad(d)
+	recordRuleHit(d)
+	recordUnmapped(email, d)
+	recordDistribution(d)
+	recordCapture(email, d, duration)
+	recordDecisionEvent(email, d, duration, traceId)
+	checkSlowLookup(email, d, duration, traceId)
+	recordLatency(duration)
+	recordLookupMetrics(rs, d, duration, traceId)
+	return d
+}
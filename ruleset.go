@@ -0,0 +1,387 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/google/cel-go/cel"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule set from command line flags.
+const defaultRuleSetName = "default"
+
+// ruleSetConfig is raw mapping values of a rule set, from command line flags or rule set file.
+type ruleSetConfig struct {
+	targets          []string
+	defaultTarget    string
+	scheduleTargets  []string
+	ispTargets       []string
+	anonymousTargets []string
+	scripts          []string
+	ruleOrder        string
+	geoSource        string
+	allowCountries   []string
+	disallowedReply  string
+	pools            []string
+}
+
+// ruleSet is an independent routing policy. Each listener bind to one rule set.
+type ruleSet struct {
+	name           string
+	destinationMap map[string][]string
+	defaultTarget  string
+	// scheduleMap keyed by country code. Scheduled targets take precedence over target map while in window.
+	scheduleMap map[string][]scheduledTarget
+	// ispMap keyed by lower case ISP/organization name.
+	ispMap map[string][]string
+	// anonymousMap keyed by Anonymous IP DB flag, e.g. "vpn".
+	anonymousMap  map[string][]string
+	scripts       []cel.Program
+	scriptSources []string
+	ruleOrder     []rule
+	// mappingOptions keyed by optionsKey().
+	mappingOptions map[string]mappingOptions
+	// pools are named target lists, usable in target mapping and traffic split.
+	pools map[string][]string
+	// splitMap keyed by country code. destinationMap of the country has targets of all shares.
+	splitMap map[string][]trafficShare
+	// geoSources of country, empty for MX only.
+	geoSources []geoSource
+	// allowCountries is country allow-list, nil if all countries allowed. Others get disallowedReply.
+	allowCountries  map[string]bool
+	disallowedReply string
+	// validityBoundaries are times any mapping activate or expire, sorted.
+	validityBoundaries []time.Time
+}
+
+var ruleSets = make(map[string]*ruleSet)
+var ruleSetsLock sync.RWMutex
+
+// getRuleSet return rule set of the name, or active rule set if the name is blue/green.
+func getRuleSet(name string) *ruleSet {
+	ruleSetsLock.RLock()
+	defer ruleSetsLock.RUnlock()
+	if slot, ok := blueGreenSlots[name]; ok {
+		name = slot.Active
+	}
+	return ruleSets[name]
+}
+
+func setRuleSet(rs *ruleSet) {
+	ruleSetsLock.Lock()
+	defer ruleSetsLock.Unlock()
+	ruleSets[rs.name] = rs
+	notifyChange(changeRuleSet, rs.name, "")
+}
+
+// parseTargetMapping parse "XX:MTA". MTA can be an IPv6 literal.
+func parseTargetMapping(value string) (string, string, error) {
+	country, target, ok := splitMapping(value)
+	if !ok {
+		return "", "", errors.New(fmt.Sprintf("Invalid mapping format: %s", value))
+	}
+	country = strings.ToUpper(country)
+	if err := validateCountryCode(country); err != nil {
+		return "", "", err
+	}
+	if len(target) < 1 {
+		return "", "", errors.New(fmt.Sprintf("Invalid target on %s: %s", country, target))
+	}
+	return country, target, nil
+}
+
+// parseIspMapping parse "ORG:MTA". Organization name may contain ":", so split on last one. IPv6 literal MTA must be
+// bracketed then, e.g. "Example:[2001:db8::1]".
+func parseIspMapping(value string) (string, string, error) {
+	sepIndex := strings.LastIndex(value, ":")
+	if strings.HasSuffix(value, "]") && strings.Contains(value, ":[") {
+		sepIndex = strings.LastIndex(value, ":[")
+	}
+	if sepIndex < 1 || sepIndex == len(value)-1 {
+		return "", "", errors.New(fmt.Sprintf("Invalid ISP mapping format: %s", value))
+	}
+	return strings.ToLower(strings.TrimSpace(value[:sepIndex])), normalizeTarget(value[sepIndex+1:]), nil
+}
+
+func newRuleSet(name string, config ruleSetConfig) (*ruleSet, error) {
+	rs := &ruleSet{
+		name:           name,
+		destinationMap: make(map[string][]string),
+		scheduleMap:    make(map[string][]scheduledTarget),
+		ispMap:         make(map[string][]string),
+		anonymousMap:   make(map[string][]string),
+		mappingOptions: make(map[string]mappingOptions),
+		pools:          make(map[string][]string),
+		splitMap:       make(map[string][]trafficShare),
+	}
+
+	if len(config.targets) < 1 {
+		return nil, errors.New("Can't process with empty target mapping.")
+	}
+
+	for _, value := range config.pools {
+		name, targets, err := parsePoolFlag(value)
+		if err != nil {
+			return nil, newConfigError("pool", value, err)
+		}
+		rs.pools[name] = targets
+	}
+
+	for _, value := range config.targets {
+		mapping, options, err := splitMappingOptions(value)
+		if err != nil {
+			return nil, newConfigError("target", value, err)
+		}
+		country, target, err := parseTargetMapping(mapping)
+		if err != nil {
+			return nil, newConfigError("target", value, err)
+		}
+		targets := poolTargets(target, rs.pools)
+		if isSplitTarget(target) {
+			if _, ok := rs.splitMap[country]; ok {
+				return nil, newConfigError("target", value, errors.New(fmt.Sprintf("Country %s has more than one traffic split.", country)))
+			}
+			shares, err := parseSplitTarget(target, rs.pools)
+			if err != nil {
+				return nil, newConfigError("target", value, err)
+			}
+			rs.splitMap[country] = shares
+			targets = nil
+			for _, share := range shares {
+				targets = append(targets, share.targets...)
+			}
+		}
+		for _, target := range targets {
+			if !containsString(rs.destinationMap[country], target) {
+				rs.destinationMap[country] = append(rs.destinationMap[country], target)
+			}
+			rs.mappingOptions[optionsKey(country, target)] = options
+		}
+	}
+
+	rs.defaultTarget = strings.ToUpper(config.defaultTarget)
+	if _, ok := rs.destinationMap[rs.defaultTarget]; !ok {
+		return nil, newConfigError("default", config.defaultTarget, errors.New(fmt.Sprintf(`Country %s not in target map`, rs.defaultTarget)))
+	}
+
+	for _, value := range config.scheduleTargets {
+		mapping, options, err := splitMappingOptions(value)
+		if err != nil {
+			return nil, newConfigError("schedule-target", value, err)
+		}
+		country, scheduled, err := parseScheduleMapping(mapping)
+		if err != nil {
+			return nil, newConfigError("schedule-target", value, err)
+		}
+		rs.scheduleMap[country] = append(rs.scheduleMap[country], scheduled)
+		rs.mappingOptions[optionsKey(country, scheduled.target)] = options
+	}
+
+	for _, value := range config.ispTargets {
+		mapping, options, err := splitMappingOptions(value)
+		if err != nil {
+			return nil, newConfigError("isp-target", value, err)
+		}
+		isp, target, err := parseIspMapping(mapping)
+		if err != nil {
+			return nil, newConfigError("isp-target", value, err)
+		}
+		rs.ispMap[isp] = append(rs.ispMap[isp], target)
+		rs.mappingOptions[optionsKey("isp:"+isp, target)] = options
+	}
+
+	for _, value := range config.anonymousTargets {
+		mapping, options, err := splitMappingOptions(value)
+		if err != nil {
+			return nil, newConfigError("anonymous-target", value, err)
+		}
+		flag, target, err := parseAnonymousMapping(mapping)
+		if err != nil {
+			return nil, newConfigError("anonymous-target", value, err)
+		}
+		rs.anonymousMap[flag] = append(rs.anonymousMap[flag], target)
+		rs.mappingOptions[optionsKey("anonymous:"+flag, target)] = options
+	}
+
+	scripts, err := compileScripts(config.scripts)
+	if err != nil {
+		return nil, err
+	}
+	rs.scripts = scripts
+	rs.scriptSources = config.scripts
+
+	ruleOrder := config.ruleOrder
+	if ruleOrder == "" {
+		ruleOrder = defaultRuleOrder
+	}
+	rs.ruleOrder, err = parseRuleOrder(ruleOrder)
+	if err != nil {
+		return nil, newConfigError("rule-order", ruleOrder, err)
+	}
+	rs.geoSources, err = parseGeoSource(config.geoSource)
+	if err != nil {
+		return nil, newConfigError("geo-source", config.geoSource, err)
+	}
+	rs.allowCountries, err = parseAllowCountries(config.allowCountries)
+	if err != nil {
+		return nil, err
+	}
+	rs.disallowedReply, err = parseDisallowedReply(config.disallowedReply)
+	if err != nil {
+		return nil, newConfigError("disallowed-reply", config.disallowedReply, err)
+	}
+	rs.collectValidityBoundaries()
+
+	return rs, nil
+}
+
+// loadRuleSetFile load rule set from file. Each line is "<flag name> <value>", same as command line flag.
+// e.g. "target US:mta1", "default US", "schedule-target CN:relay-a@00:00-08:00". "#" start a comment line.
+// File with .yaml, .yml or .json extension is a map of same keys instead, see ruleSetJsonSchema. "include" key merge
+// other files in place, and path can be a conf.d style directory.
+func loadRuleSetFile(name string, path string) (*ruleSet, error) {
+	return loadRuleSetSource(name, newRuleSetSource(path))
+}
+
+// loadRuleSetSource load rule set from path of the source.
+func loadRuleSetSource(name string, source *ruleSetSource) (*ruleSet, error) {
+	if err := source.load(source.path); err != nil {
+		return nil, err
+	}
+
+	rs, err := newRuleSet(name, source.config)
+	if err != nil {
+		return nil, source.locate(name, err)
+	}
+	return rs, nil
+}
+
+func loadRuleSetLines(path string, source *ruleSetSource) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Open rule set file %s error: %s", path, err.Error()))
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		splitedLine := strings.SplitN(line, " ", 2)
+		value := ""
+		if len(splitedLine) == 2 {
+			value = strings.TrimSpace(splitedLine[1])
+		}
+		if err := source.add(splitedLine[0], value, fmt.Sprint(lineNumber)); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.New(fmt.Sprintf("Read rule set file %s error: %s", path, err.Error()))
+	}
+	return nil
+}
+
+// parseRuleSetFlag parse "NAME=FILE".
+func parseRuleSetFlag(value string) (string, string, error) {
+	splitedValue := strings.SplitN(value, "=", 2)
+	if len(splitedValue) != 2 || splitedValue[0] == "" || splitedValue[1] == "" {
+		return "", "", errors.New(fmt.Sprintf("Invalid rule set format: %s", value))
+	}
+	return splitedValue[0], splitedValue[1], nil
+}
+
+// pickDefaultTarget always return a target. If all default targets drained, still use them as last resort.
+func (rs *ruleSet) pickDefaultTarget() string {
+	targets := rs.destinationMap[rs.defaultTarget]
+	if target, ok := pickTarget(targets); ok {
+		return target
+	}
+
+	log.Warnf("All default targets %v drained, ignore drain.", targets)
+	return targets[random.Intn(len(targets))]
+}
+
+func (rs *ruleSet) defaultDecision(ruleName string, trace []string) decision {
+	d := decision{
+		RuleSet:  rs.name,
+		Target:   rs.pickDefaultTarget(),
+		Pool:     rs.destinationMap[rs.defaultTarget],
+		Rule:     ruleName,
+		Trace:    trace,
+		matchKey: rs.defaultTarget,
+	}
+	rs.applyMappingOptions(&d)
+	return d
+}
+
+// getCountryPool return target pool of the country, or share of the domain if traffic split. Scheduled targets in
+// window used if any of them not drained. Return false if country not in any mapping.
+func (rs *ruleSet) getCountryPool(country string, domain string) ([]string, bool) {
+	scheduled := rs.getScheduledTargets(country, time.Now())
+	if _, ok := pickTarget(scheduled); ok {
+		return scheduled, true
+	}
+
+	if pool, _, ok := rs.getSplitPool(country, domain); ok {
+		return pool, true
+	}
+	pool, ok := rs.destinationMap[country]
+	return pool, ok
+}
+
+// getIspPool return target pool and lower case name of matched ISP mapping. Return false if no ISP rule match.
+func (rs *ruleSet) getIspPool(ipAddress net.IP) ([]string, string, bool) {
+	if ispDb == nil || len(rs.ispMap) < 1 {
+		return nil, "", false
+	}
+
+	_, names, err := getIspByIp(ipAddress)
+	if err != nil {
+		return nil, "", false
+	}
+
+	for _, name := range names {
+		if pool, ok := rs.ispMap[strings.ToLower(name)]; ok {
+			log.Infof("Got ISP: %s for IP: %s", name, ipAddress.String())
+			return pool, strings.ToLower(name), true
+		}
+	}
+
+	return nil, "", false
+}
+
+func (rs *ruleSet) getRuleOrderNames() []string {
+	names := make([]string, 0, len(rs.ruleOrder))
+	for _, r := range rs.ruleOrder {
+		names = append(names, r.name)
+	}
+	return names
+}
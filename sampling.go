@@ -0,0 +1,49 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+)
+
+// logSample log 1 in N relay decisions at info level. Failures always logged. 1 to log all.
+var logSample int
+var logSampleCounter uint64
+var logSuppressed uint64
+
+// sampleLookupLog return true if this lookup should be logged.
+func sampleLookupLog() bool {
+	if logSample <= 1 {
+		return true
+	}
+	return atomic.AddUint64(&logSampleCounter, 1)%uint64(logSample) == 1
+}
+
+// suppressLookupLog count log lines not written by sampling.
+func suppressLookupLog(lines uint64) {
+	atomic.AddUint64(&logSuppressed, lines)
+}
+
+// lookupInfof log per lookup detail at info level, or debug level if sampling enabled.
+func lookupInfof(format string, args ...interface{}) {
+	if logSample > 1 {
+		log.Debugf(format, args...)
+		return
+	}
+	log.Infof(format, args...)
+}
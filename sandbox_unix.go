@@ -0,0 +1,46 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"syscall"
+)
+
+// enterChroot chroot to the directory, normally an empty one. Must be called as root, after all files opened.
+func enterChroot(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if !isRunningAsRoot() {
+		return errors.New("Need to run as root to chroot.")
+	}
+	if err := syscall.Chroot(dir); err != nil {
+		return errors.New(fmt.Sprintf("Chroot to %s error: %s", dir, err.Error()))
+	}
+	if err := os.Chdir("/"); err != nil {
+		return errors.New(fmt.Sprintf("Chdir in chroot error: %s", err.Error()))
+	}
+	log.Infof("Chroot to %s.", dir)
+	return nil
+}
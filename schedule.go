@@ -0,0 +1,99 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeWindow is minutes from 00:00 UTC. If start > end, window cross midnight.
+type timeWindow struct {
+	start int
+	end   int
+}
+
+type scheduledTarget struct {
+	target string
+	window timeWindow
+}
+
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid time: %s", value))
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// parseScheduleMapping parse "XX:MTA@HH:MM-HH:MM".
+func parseScheduleMapping(value string) (string, scheduledTarget, error) {
+	sepIndex := strings.LastIndex(value, "@")
+	if sepIndex < 0 {
+		return "", scheduledTarget{}, errors.New(fmt.Sprintf("Invalid schedule mapping format: %s", value))
+	}
+
+	country, target, ok := splitMapping(value[:sepIndex])
+	if !ok || len(target) < 1 {
+		return "", scheduledTarget{}, errors.New(fmt.Sprintf("Invalid schedule mapping format: %s", value))
+	}
+	country = strings.ToUpper(country)
+	if err := validateCountryCode(country); err != nil {
+		return "", scheduledTarget{}, err
+	}
+
+	splitedWindow := strings.Split(value[sepIndex+1:], "-")
+	if len(splitedWindow) != 2 {
+		return "", scheduledTarget{}, errors.New(fmt.Sprintf("Invalid schedule window: %s", value[sepIndex+1:]))
+	}
+	start, err := parseClock(splitedWindow[0])
+	if err != nil {
+		return "", scheduledTarget{}, err
+	}
+	end, err := parseClock(splitedWindow[1])
+	if err != nil {
+		return "", scheduledTarget{}, err
+	}
+
+	return country, scheduledTarget{target: target, window: timeWindow{start: start, end: end}}, nil
+}
+
+func (w timeWindow) contains(now time.Time) bool {
+	now = now.UTC()
+	return w.containsMinute(now.Hour()*60 + now.Minute())
+}
+
+// containsMinute return if minute of day is in window.
+func (w timeWindow) containsMinute(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// getScheduledTargets return scheduled targets of country which active now.
+func (rs *ruleSet) getScheduledTargets(country string, now time.Time) []string {
+	targets := []string{}
+	for _, scheduled := range rs.scheduleMap[country] {
+		if scheduled.window.contains(now) {
+			targets = append(targets, scheduled.target)
+		}
+	}
+	return targets
+}
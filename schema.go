@@ -0,0 +1,500 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	cli "gopkg.in/urfave/cli.v1"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ruleSetKey describe a key of rule set file. Same name and value format as the command line flag.
+type ruleSetKey struct {
+	name        string
+	repeatable  bool
+	required    bool
+	format      string
+	example     string
+	description string
+	// pattern is loose regular expression of value for JSON Schema, empty if value is free form.
+	pattern string
+	add     func(config *ruleSetConfig, value string)
+}
+
+// ruleSetSchema is all keys of a rule set, in documented order.
+var ruleSetSchema = []ruleSetKey{
+	{
+		name:        "target",
+		repeatable:  true,
+		required:    true,
+		format:      "XX:MTA[,MTA...] [OPTIONS]",
+		example:     "US:mta1 label=us-primary",
+		description: "Country destination mapping. MTA can be a pool name, or a traffic split like 70%pool-a/30%pool-b.",
+		pattern:     `^[A-Za-z?]{2}:\S+(\s.*)?$`,
+		add: func(config *ruleSetConfig, value string) {
+			config.targets = append(config.targets, value)
+		},
+	},
+	{
+		name:        "default",
+		required:    true,
+		format:      "XX",
+		example:     "US",
+		description: "Country of target mapping used if no rule match.",
+		pattern:     `^[A-Za-z?]{2}$`,
+		add: func(config *ruleSetConfig, value string) {
+			config.defaultTarget = value
+		},
+	},
+	{
+		name:        "pool",
+		repeatable:  true,
+		format:      "NAME=MTA,MTA...",
+		example:     "pool-a=mta-a1,mta-a2",
+		description: "Named target list, usable in target mapping and traffic split.",
+		pattern:     `^[^=\s]+=\S+$`,
+		add: func(config *ruleSetConfig, value string) {
+			config.pools = append(config.pools, value)
+		},
+	},
+	{
+		name:        "schedule-target",
+		repeatable:  true,
+		format:      "XX:MTA@HH:MM-HH:MM [OPTIONS]",
+		example:     "CN:relay-a@00:00-08:00",
+		description: "Time windowed country mapping in UTC, take precedence over target mapping while in window.",
+		pattern:     `^[A-Za-z?]{2}:\S+@\d{1,2}:\d{2}-\d{1,2}:\d{2}(\s.*)?$`,
+		add: func(config *ruleSetConfig, value string) {
+			config.scheduleTargets = append(config.scheduleTargets, value)
+		},
+	},
+	{
+		name:        "isp-target",
+		repeatable:  true,
+		format:      "ORG:MTA [OPTIONS]",
+		example:     "Google LLC:mta-google",
+		description: "ISP/organization destination mapping. Need --isp-db.",
+		add: func(config *ruleSetConfig, value string) {
+			config.ispTargets = append(config.ispTargets, value)
+		},
+	},
+	{
+		name:        "anonymous-target",
+		repeatable:  true,
+		format:      "FLAG:MTA [OPTIONS]",
+		example:     "vpn:scrutiny-relay",
+		description: "Destination mapping of MX IPs flagged in Anonymous IP DB. Need --anonymous-ip-db.",
+		pattern:     `^(?i:` + strings.Join(anonymousFlags, "|") + `):\S+(\s.*)?$`,
+		add: func(config *ruleSetConfig, value string) {
+			config.anonymousTargets = append(config.anonymousTargets, value)
+		},
+	},
+	{
+		name:        "script",
+		repeatable:  true,
+		format:      "CEL_EXPRESSION",
+		example:     `country == "US" ? "relay-us" : fallthrough()`,
+		description: "CEL expression return a target, or fallthrough() to try next one.",
+		add: func(config *ruleSetConfig, value string) {
+			config.scripts = append(config.scripts, value)
+		},
+	},
+	{
+		name:        "rule-order",
+		format:      "RULE,RULE...",
+		example:     defaultRuleOrder,
+		description: "Comma separated rule evaluation order.",
+		pattern:     `^[a-z]+(\s*,\s*[a-z]+)*$`,
+		add: func(config *ruleSetConfig, value string) {
+			config.ruleOrder = value
+		},
+	},
+	{
+		name:        "allow-country",
+		repeatable:  true,
+		format:      "XX[,XX...]",
+		example:     "US,CA",
+		description: "Only relay to these countries, others get disallowed-reply.",
+		pattern:     `^[A-Za-z?]{2}(\s*,\s*[A-Za-z?]{2})*$`,
+		add: func(config *ruleSetConfig, value string) {
+			config.allowCountries = append(config.allowCountries, value)
+		},
+	},
+	{
+		name:        "disallowed-reply",
+		format:      "TRANSPORT:NEXTHOP",
+		example:     defaultDisallowedReply,
+		description: "Reply to countries not in allow-country, e.g. retry:4.7.1 to defer instead of bounce.",
+		pattern:     `^[^:\s]+:.*$`,
+		add: func(config *ruleSetConfig, value string) {
+			config.disallowedReply = value
+		},
+	},
+	{
+		name:        "include",
+		repeatable:  true,
+		format:      "FILE|DIRECTORY|GLOB",
+		example:     "conf.d",
+		description: "Merge other rule set files, relative to including file. Directory include its .conf, .yaml, .yml and .json files by name order.",
+	},
+	{
+		name:        "geo-source",
+		format:      "SOURCE[=WEIGHT],...",
+		example:     "mx=1,a=2",
+		description: "Addresses geolocated for country of a domain, mx or a.",
+		pattern:     `^(?i:(mx|a)(=\d+)?)(\s*,\s*(?i:(mx|a)(=\d+)?))*$`,
+		add: func(config *ruleSetConfig, value string) {
+			config.geoSource = value
+		},
+	},
+}
+
+func findRuleSetKey(name string) (ruleSetKey, bool) {
+	for _, key := range ruleSetSchema {
+		if key.name == name {
+			return key, true
+		}
+	}
+	return ruleSetKey{}, false
+}
+
+// configError is an invalid value of a rule set key. Located by file line, or shown as command line flag.
+type configError struct {
+	key   string
+	value string
+	err   error
+}
+
+func newConfigError(key string, value string, err error) error {
+	return &configError{key: key, value: value, err: err}
+}
+
+// detail return cause and expected format of the value.
+func (e *configError) detail() string {
+	message := strings.TrimSuffix(e.err.Error(), ".")
+	if key, ok := findRuleSetKey(e.key); ok {
+		message += fmt.Sprintf(`. Expected "%s", e.g. "%s".`, key.format, key.example)
+	}
+	return message
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("--%s %q: %s", e.key, e.value, e.detail())
+}
+
+// editDistance is Levenshtein distance, for suggesting misspelled keys.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// unknownKeyError suggest closest key of a misspelled one.
+func unknownKeyError(name string) error {
+	best := ""
+	bestDistance := 3
+	for _, key := range ruleSetSchema {
+		if distance := editDistance(name, key.name); distance < bestDistance {
+			best = key.name
+			bestDistance = distance
+		}
+	}
+	if best != "" {
+		return errors.New(fmt.Sprintf("Unknown key %q, did you mean %q?", name, best))
+	}
+	names := make([]string, 0, len(ruleSetSchema))
+	for _, key := range ruleSetSchema {
+		names = append(names, key.name)
+	}
+	return errors.New(fmt.Sprintf("Unknown key %q, must be one of: %s", name, strings.Join(names, ", ")))
+}
+
+// ruleSetSource collect values of rule set file with location of each, to locate errors of newRuleSet.
+type ruleSetSource struct {
+	path string
+	// includeDir replace directory of path for includes of path, e.g. path is a temporary file of applied content.
+	includeDir string
+	// current is file being loaded, differ from path inside included files.
+	current   string
+	config    ruleSetConfig
+	locations map[string]string
+	// seen is "FILE:LOCATION" of first value of non repeatable keys.
+	seen map[string]string
+	// loading is absolute paths of files being loaded, to detect include loop.
+	loading []string
+}
+
+func newRuleSetSource(path string) *ruleSetSource {
+	return &ruleSetSource{path: path, current: path, locations: make(map[string]string), seen: make(map[string]string)}
+}
+
+// load read a rule set file or directory, with its includes.
+func (s *ruleSetSource) load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Open rule set file %s error: %s", path, err.Error()))
+	}
+	if info.IsDir() {
+		return s.loadDirectory(path)
+	}
+
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Open rule set file %s error: %s", path, err.Error()))
+	}
+	for _, loading := range s.loading {
+		if loading == absolutePath {
+			return errors.New(fmt.Sprintf("%s: Include loop: %s.", s.current, strings.Join(append(s.loading, absolutePath), " -> ")))
+		}
+	}
+
+	parent := s.current
+	s.current = path
+	s.loading = append(s.loading, absolutePath)
+	defer func() {
+		s.current = parent
+		s.loading = s.loading[:len(s.loading)-1]
+	}()
+	if isStructuredRuleSetFile(path) {
+		return loadStructuredRuleSet(path, s)
+	}
+	return loadRuleSetLines(path, s)
+}
+
+// isRuleSetFragment return true for files included from a directory. Hidden and editor backup files are skipped.
+func isRuleSetFragment(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	return strings.ToLower(filepath.Ext(name)) == ".conf" || isStructuredRuleSetFile(name)
+}
+
+// loadDirectory load fragments of a conf.d style directory, in name order so merge result is same on every host.
+func (s *ruleSetSource) loadDirectory(path string) error {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Read rule set directory %s error: %s", path, err.Error()))
+	}
+	for _, file := range files {
+		if file.IsDir() || !isRuleSetFragment(file.Name()) {
+			continue
+		}
+		if err := s.load(filepath.Join(path, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// include load value of include key, a file, directory or glob relative to directory of current file. Glob matches
+// are loaded in name order, and no match is not an error.
+func (s *ruleSetSource) include(value string, location string) error {
+	pattern := value
+	if !filepath.IsAbs(pattern) {
+		dir := filepath.Dir(s.current)
+		if s.current == s.path && s.includeDir != "" {
+			dir = s.includeDir
+		}
+		pattern = filepath.Join(dir, pattern)
+	}
+	if !strings.ContainsAny(value, "*?[") {
+		return s.load(pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s:%s: Invalid include pattern %s: %s", s.current, location, value, err.Error()))
+	}
+	sort.Strings(matches)
+	for _, match := range matches {
+		if err := s.load(match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add validate key and add value. location is e.g. "12" line number or "target[3]" of current file.
+func (s *ruleSetSource) add(name string, value string, location string) error {
+	key, ok := findRuleSetKey(name)
+	if !ok {
+		return errors.New(fmt.Sprintf("%s:%s: %s", s.current, location, unknownKeyError(name).Error()))
+	}
+	if value == "" {
+		return errors.New(fmt.Sprintf(`%s:%s: Missing value of %s. Expected "%s", e.g. "%s".`, s.current, location, name, key.format, key.example))
+	}
+	if key.name == "include" {
+		return s.include(value, location)
+	}
+	location = s.current + ":" + location
+	if !key.repeatable {
+		if first, ok := s.seen[name]; ok {
+			return errors.New(fmt.Sprintf("%s: Duplicated key %s, already set at %s.", location, name, first))
+		}
+		s.seen[name] = location
+	}
+	key.add(&s.config, value)
+	if _, ok := s.locations[name+" "+value]; !ok {
+		s.locations[name+" "+value] = location
+	}
+	return nil
+}
+
+// locate prefix error of a value with its file and location.
+func (s *ruleSetSource) locate(ruleSetName string, err error) error {
+	if configErr, ok := err.(*configError); ok {
+		if location, ok := s.locations[configErr.key+" "+configErr.value]; ok {
+			return errors.New(fmt.Sprintf("%s: %s %q: %s", location, configErr.key, configErr.value, configErr.detail()))
+		}
+	}
+	return errors.New(fmt.Sprintf("Rule set %s (%s): %s", ruleSetName, s.path, err.Error()))
+}
+
+// isStructuredRuleSetFile return true for YAML or JSON rule set file, by extension.
+func isStructuredRuleSetFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// loadStructuredRuleSet read YAML or JSON rule set file, a map of key to string, or list of strings for repeatable
+// keys. Location of errors is "key[index]".
+func loadStructuredRuleSet(path string, source *ruleSetSource) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Open rule set file %s error: %s", path, err.Error()))
+	}
+	document := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", path, err.Error()))
+	}
+
+	for _, item := range document {
+		name := fmt.Sprint(item.Key)
+		key, known := findRuleSetKey(name)
+		switch value := item.Value.(type) {
+		case []interface{}:
+			if known && !key.repeatable {
+				return errors.New(fmt.Sprintf("%s:%s: Key %s take one value, not a list.", path, name, name))
+			}
+			for i, element := range value {
+				if err := addStructuredValue(source, name, element, fmt.Sprintf("%s[%d]", name, i)); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := addStructuredValue(source, name, value, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func addStructuredValue(source *ruleSetSource, name string, value interface{}, location string) error {
+	switch value.(type) {
+	case string, int, float64, bool:
+	case nil:
+		value = ""
+	default:
+		return errors.New(fmt.Sprintf("%s:%s: Value must be a string.", source.current, location))
+	}
+	return source.add(name, strings.TrimSpace(fmt.Sprint(value)), location)
+}
+
+// ruleSetJsonSchema return JSON Schema of YAML or JSON rule set file.
+func ruleSetJsonSchema() map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+	for _, key := range ruleSetSchema {
+		value := map[string]interface{}{"type": "string"}
+		if key.pattern != "" {
+			value["pattern"] = key.pattern
+		}
+		property := map[string]interface{}{
+			"description": fmt.Sprintf("%s Format: %s", key.description, key.format),
+		}
+		if key.repeatable {
+			value["examples"] = []string{key.example}
+			property["type"] = "array"
+			property["items"] = value
+			property["minItems"] = 1
+		} else {
+			for name, item := range value {
+				property[name] = item
+			}
+			property["examples"] = []string{key.example}
+		}
+		properties[key.name] = property
+		if key.required {
+			required = append(required, key.name)
+		}
+	}
+	return map[string]interface{}{
+		"$schema":    "https://json-schema.org/draft/2020-12/schema",
+		"title":      "GeoIpTransportMap rule set",
+		"type":       "object",
+		"properties": properties,
+		"anyOf": []map[string]interface{}{
+			{"required": required},
+			{"required": []string{"include"}},
+		},
+		"additionalProperties": false,
+	}
+}
+
+func schemaCommand() cli.Command {
+	return cli.Command{
+		Name:  "schema",
+		Usage: "Print JSON Schema of YAML/JSON rule set file.",
+		Action: func(c *cli.Context) error {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(ruleSetJsonSchema())
+		},
+	}
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Scripts are CEL expressions evaluated by "script" rule in order. Expression return target, or fallthrough() / "" to try next one.
+
+func newScriptEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("email", cel.StringType),
+		cel.Variable("domain", cel.StringType),
+		cel.Variable("mx", cel.ListType(cel.StringType)),
+		cel.Variable("ip", cel.ListType(cel.StringType)),
+		cel.Variable("country", cel.StringType),
+		cel.Variable("asn", cel.IntType),
+		cel.Variable("isp", cel.StringType),
+		cel.Variable("anonymous", cel.ListType(cel.StringType)),
+		cel.Function("fallthrough",
+			cel.Overload("fallthrough", []*cel.Type{}, cel.StringType,
+				cel.FunctionBinding(func(values ...ref.Val) ref.Val {
+					return types.String("")
+				}),
+			),
+		),
+	)
+}
+
+// compileScripts compile all script expressions. Expression must return string.
+func compileScripts(sources []string) ([]cel.Program, error) {
+	env, err := newScriptEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	programs := []cel.Program{}
+	for _, source := range sources {
+		ast, issues := env.Compile(source)
+		if issues != nil && issues.Err() != nil {
+			return nil, newConfigError("script", source, errors.New(fmt.Sprintf("Invalid script: %s", issues.Err().Error())))
+		}
+		if ast.OutputType() != cel.StringType {
+			return nil, newConfigError("script", source, errors.New(fmt.Sprintf("Script must return string, got %s", ast.OutputType())))
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, newConfigError("script", source, errors.New(fmt.Sprintf("Invalid script: %s", err.Error())))
+		}
+		programs = append(programs, program)
+	}
+	return programs, nil
+}
+
+// scriptActivation resolve variables lazily, so DNS and GeoIP only queried if script use them.
+func scriptActivation(l *lookup) map[string]interface{} {
+	return map[string]interface{}{
+		"email":  l.email,
+		"domain": l.domain,
+		"mx": func() ref.Val {
+			return types.DefaultTypeAdapter.NativeToValue(l.getMxHosts())
+		},
+		"ip": func() ref.Val {
+			ips := []string{}
+			for _, ip := range l.getIps() {
+				ips = append(ips, ip.String())
+			}
+			return types.DefaultTypeAdapter.NativeToValue(ips)
+		},
+		"country": func() ref.Val {
+			country, _ := l.getMxCountry()
+			return types.String(country)
+		},
+		"asn": func() ref.Val {
+			asn, _ := l.getIsp()
+			return types.Int(asn)
+		},
+		"isp": func() ref.Val {
+			_, isp := l.getIsp()
+			return types.String(isp)
+		},
+		"anonymous": func() ref.Val {
+			return types.DefaultTypeAdapter.NativeToValue(l.getAnonymous())
+		},
+	}
+}
+
+func matchScriptRule(l *lookup) ([]string, bool) {
+	if len(l.rules.scripts) < 1 {
+		l.tracef("script: no script")
+		return nil, false
+	}
+
+	activation := scriptActivation(l)
+	for i, program := range l.rules.scripts {
+		start := time.Now()
+		result, _, err := program.Eval(activation)
+		l.addTiming("script", start)
+		if err != nil {
+			log.Warnf("Script %q error on %s: %v", l.rules.scriptSources[i], l.email, err)
+			l.errorf("script", err, "script %d error: %v", i, err)
+			continue
+		}
+
+		target, _ := result.Value().(string)
+		if target == "" {
+			l.tracef("script %d fallthrough", i)
+			continue
+		}
+		l.tracef("script %d return %s", i, target)
+		if isDrained(target) {
+			l.tracef("script %d target %s drained", i, target)
+			continue
+		}
+		l.matchKey = fmt.Sprintf("script:%d", i)
+		return []string{target}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,191 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v1"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Secret flags take a reference instead of the secret itself, so it isn't shown in process listing or /admin/config:
+// "file:/path", "env:NAME", "vault:PATH#FIELD" (HashiCorp Vault KV, VAULT_ADDR and VAULT_TOKEN from environment) or
+// "exec:COMMAND ARGS..." (first line of stdout, e.g. a KMS or cloud secret manager CLI). Other values used as is.
+
+// secretFlags are flags whose literal value is redacted in /admin/config.
+var secretFlags = map[string]bool{
+	"maxmind-license-key": true,
+	"auth-token":          true,
+}
+
+// maxmindAccountId and maxmindLicenseKey authenticate download of MaxMind DB URLs.
+var maxmindAccountId string
+var maxmindLicenseKey string
+
+var secretClient = &http.Client{Timeout: 10 * time.Second}
+
+// isSecretReference return if value is a secret reference, not literal secret.
+func isSecretReference(value string) bool {
+	for _, prefix := range []string{"file:", "env:", "vault:", "exec:"} {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecret return secret of the reference, or value itself if not a reference. name is flag name for errors.
+func resolveSecret(name string, value string) (string, error) {
+	var secret string
+	var err error
+	switch {
+	case strings.HasPrefix(value, "file:"):
+		var data []byte
+		data, err = ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+		secret = string(data)
+	case strings.HasPrefix(value, "env:"):
+		var ok bool
+		secret, ok = os.LookupEnv(strings.TrimPrefix(value, "env:"))
+		if !ok {
+			err = errors.New(fmt.Sprintf("environment variable %s not set", strings.TrimPrefix(value, "env:")))
+		}
+	case strings.HasPrefix(value, "vault:"):
+		secret, err = readVaultSecret(strings.TrimPrefix(value, "vault:"))
+	case strings.HasPrefix(value, "exec:"):
+		secret, err = execSecret(strings.TrimPrefix(value, "exec:"))
+	default:
+		log.Warnf("--%s given as literal value, which is shown in process listing. Use file:, env:, vault: or exec: reference.", name)
+		return value, nil
+	}
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Read secret of --%s from %s error: %s", name, strings.SplitN(value, ":", 2)[0], err.Error()))
+	}
+	secret = strings.TrimSpace(strings.SplitN(secret, "\n", 2)[0])
+	if secret == "" {
+		return "", errors.New(fmt.Sprintf("Secret of --%s from %s is empty.", name, value))
+	}
+	return secret, nil
+}
+
+// readVaultSecret read "PATH#FIELD" from Vault KV. KV version 2 nest fields in data.data.
+func readVaultSecret(reference string) (string, error) {
+	splitedReference := strings.SplitN(reference, "#", 2)
+	if len(splitedReference) != 2 || splitedReference[0] == "" || splitedReference[1] == "" {
+		return "", errors.New(fmt.Sprintf("invalid reference %s, must be PATH#FIELD", reference))
+	}
+	address := os.Getenv("VAULT_ADDR")
+	token := os.Getenv("VAULT_TOKEN")
+	if address == "" || token == "" {
+		return "", errors.New("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+
+	request, err := http.NewRequest(http.MethodGet, strings.TrimRight(address, "/")+"/v1/"+strings.TrimLeft(splitedReference[0], "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-Vault-Token", token)
+	response, err := secretClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("Vault reply %s", response.Status))
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	fields := body.Data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		fields = nested
+	}
+	value, ok := fields[splitedReference[1]].(string)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("field %s not found in %s", splitedReference[1], splitedReference[0]))
+	}
+	return value, nil
+}
+
+// execSecret run command without shell and return its output.
+func execSecret(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) < 1 {
+		return "", errors.New("empty command")
+	}
+	output, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// setupSecrets resolve secret flags. Run before DBs downloaded.
+func setupSecrets(c *cli.Context) error {
+	var err error
+	if value := c.String("maxmind-license-key"); value != "" {
+		maxmindLicenseKey, err = resolveSecret("maxmind-license-key", value)
+		if err != nil {
+			return err
+		}
+	}
+	if value := c.String("auth-token"); value != "" {
+		if c.String("auth-token-file") != "" {
+			return errors.New("Only one of --auth-token and --auth-token-file can be set.")
+		}
+		authToken, err = resolveSecret("auth-token", value)
+		if err != nil {
+			return err
+		}
+		log.Info("Connections need auth token.")
+	}
+	if isSecretReference(eventSink) {
+		eventSink, err = resolveSecret("event-sink", eventSink)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authenticateMaxmindDownload add license key to request of download.maxmind.com. With account ID, by basic auth of
+// current download URLs, otherwise by license_key query parameter of legacy URLs.
+func authenticateMaxmindDownload(request *http.Request) {
+	if maxmindLicenseKey == "" || request.URL.Hostname() != "download.maxmind.com" {
+		return
+	}
+	if maxmindAccountId != "" {
+		request.SetBasicAuth(maxmindAccountId, maxmindLicenseKey)
+		return
+	}
+	query := request.URL.Query()
+	if query.Get("license_key") == "" {
+		query.Set("license_key", maxmindLicenseKey)
+		request.URL.RawQuery = query.Encode()
+	}
+}
@@ -0,0 +1,154 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	cli "gopkg.in/urfave/cli.v1"
+	"os"
+	"path/filepath"
+)
+
+const defaultServiceName = "GeoIpTransportMap"
+
+// serviceStatsCommand is user defined control code, "sc control NAME 128" dump statistics like SIGUSR1.
+const serviceStatsCommand = svc.Cmd(128)
+
+type serviceHandler struct {
+	app *cli.App
+}
+
+// runAsService run app under service control manager. Return false if not started as a service.
+func runAsService(app *cli.App) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+	// Service name is the first argument of Execute, service registered with any name works.
+	err = svc.Run("", &serviceHandler{app: app})
+	if err != nil {
+		log.Fatalf("Run as service error: %s", err.Error())
+	}
+	return true
+}
+
+// Execute start serving with args registered by "service install", handle stop (drain then exit), param change
+// (reload like SIGHUP) and stats control.
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	go func() {
+		err := h.app.Run(os.Args)
+		if err != nil {
+			log.Fatalf("Parse args error: %s", err.Error())
+		}
+	}()
+	accepts := svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			status <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			log.Info("Received service stop, shutting down.")
+			status <- svc.Status{State: svc.StopPending}
+			drainConnections()
+			removePidFile()
+			return false, 0
+		case svc.ParamChange:
+			go triggerReload("service param change")
+		case serviceStatsCommand:
+			go triggerStats("service control 128")
+		}
+	}
+	return false, 0
+}
+
+// serviceCommands install and remove Windows service.
+func serviceCommands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:            "install-service",
+			Usage:           "Install as Windows service, start automatically. Args after the command are used when service start, e.g. \"install-service --log-file C:\\gtm.log -t US:mta1 -d US\".",
+			SkipFlagParsing: true,
+			Action: func(c *cli.Context) error {
+				return installService(defaultServiceName, c.Args())
+			},
+		},
+		{
+			Name:  "remove-service",
+			Usage: "Remove the Windows service.",
+			Action: func(c *cli.Context) error {
+				return removeService(defaultServiceName)
+			},
+		},
+	}
+}
+
+func installService(name string, args []string) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Get executable path error: %s", err.Error()))
+	}
+	exePath, err = filepath.Abs(exePath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Get executable path error: %s", err.Error()))
+	}
+
+	manager, err := mgr.Connect()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Connect service manager error: %s", err.Error()))
+	}
+	defer manager.Disconnect()
+
+	config := mgr.Config{
+		DisplayName: "Postfix GeoIP transport map",
+		Description: "Postfix tcp_table transport map by recipient MX country.",
+		StartType:   mgr.StartAutomatic,
+	}
+	service, err := manager.CreateService(name, exePath, config, args...)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Create service %s error: %s", name, err.Error()))
+	}
+	defer service.Close()
+	fmt.Printf("Service %s installed, start with \"sc start %s\".\n", name, name)
+	return nil
+}
+
+func removeService(name string) error {
+	manager, err := mgr.Connect()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Connect service manager error: %s", err.Error()))
+	}
+	defer manager.Disconnect()
+
+	service, err := manager.OpenService(name)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Open service %s error: %s", name, err.Error()))
+	}
+	defer service.Close()
+	err = service.Delete()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Remove service %s error: %s", name, err.Error()))
+	}
+	fmt.Printf("Service %s removed.\n", name)
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// shadowRuleSets map live rule set or blue/green slot name to candidate rule set name. Candidate evaluated together
+// with live one without side effects, difference logged, but answer always from live one.
+var shadowRuleSets = make(map[string]string)
+
+var shadowCompared uint64
+var shadowDiffered uint64
+
+// parseShadowFlag parse "LIVE=CANDIDATE".
+func parseShadowFlag(value string) (string, string, error) {
+	splitedValue := strings.SplitN(value, "=", 2)
+	if len(splitedValue) != 2 || splitedValue[0] == "" || splitedValue[1] == "" {
+		return "", "", errors.New(fmt.Sprintf("Invalid shadow format: %s", value))
+	}
+	return splitedValue[0], splitedValue[1], nil
+}
+
+// samePool compare target pools regardless of order.
+func samePool(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sortedA := append([]string(nil), a...)
+	sortedB := append([]string(nil), b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameDecision compare target pool instead of target, so random pick in the same pool not count as difference.
+func sameDecision(live decision, candidate decision) bool {
+	if live.Action != candidate.Action {
+		return false
+	}
+	if len(live.Pool) > 0 || len(candidate.Pool) > 0 {
+		return samePool(live.Pool, candidate.Pool)
+	}
+	return live.Target == candidate.Target
+}
+
+// compareShadow log difference of candidate decision. Plugin not asked for candidate, so decisions made by plugin
+// not compared.
+func compareShadow(email string, live decision, candidateResult chan decision) {
+	candidate := <-candidateResult
+	if live.Rule == "plugin" {
+		return
+	}
+	atomic.AddUint64(&shadowCompared, 1)
+	if sameDecision(live, candidate) {
+		return
+	}
+
+	atomic.AddUint64(&shadowDiffered, 1)
+	log.WithFields(log.Fields{
+		"email":              email,
+		"live_rule_set":      live.RuleSet,
+		"live_rule":          live.Rule,
+		"live_target":        live.Target,
+		"candidate_rule_set": candidate.RuleSet,
+		"candidate_rule":     candidate.Rule,
+		"candidate_target":   candidate.Target,
+	}).Info("Shadow decision differ.")
+}
+
+// getShadowCandidate return candidate of the live rule set, by its name or name of blue/green slot it is active in.
+func getShadowCandidate(rs *ruleSet) *ruleSet {
+	name, ok := shadowRuleSets[rs.name]
+	if !ok {
+		slot, active := activeBlueGreenSlot(rs.name)
+		if !active {
+			return nil
+		}
+		if name, ok = shadowRuleSets[slot]; !ok {
+			return nil
+		}
+	}
+	candidate := getRuleSet(name)
+	if candidate == nil || candidate.name == rs.name {
+		return nil
+	}
+	return candidate
+}
+
+// evaluateWithShadow evaluate live rule set. If it has a shadow candidate, evaluate candidate in parallel and compare
+// in background. Never wait for candidate.
+func evaluateWithShadow(rs *ruleSet, email string) decision {
+	candidate := getShadowCandidate(rs)
+	if candidate == nil {
+		return evaluate(rs, email)
+	}
+
+	candidateResult := make(chan decision, 1)
+	go func() {
+		candidateResult <- evaluateShadow(candidate, email)
+	}()
+
+	live := evaluate(rs, email)
+	go compareShadow(email, live, candidateResult)
+	return live
+}
+
+// adminShadowHandler GET return shadow compare counters.
+func adminShadowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"shadow":   shadowRuleSets,
+		"compared": atomic.LoadUint64(&shadowCompared),
+		"differed": atomic.LoadUint64(&shadowDiffered),
+	})
+}
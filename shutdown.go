@@ -0,0 +1,157 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Zero downtime upgrade: start new process with --reuse-port on the same address, then send SIGTERM to old process.
+// Old process stop accepting, let existing connections finish within drainTimeout, then exit.
+var reusePort bool
+var drainTimeout time.Duration
+var shutdownDelay time.Duration
+
+// kubernetesGracePeriod is default terminationGracePeriodSeconds, after it the process is killed.
+const kubernetesGracePeriod = 30 * time.Second
+
+// TCP tuning. Keepalive keep idle proxymap connections alive through firewalls, 0 use Go default, negative disable.
+// Backlog 0 use system default.
+var tcpKeepAlive time.Duration
+var tcpNoDelay bool
+var listenBacklog int
+
+var shuttingDown int32
+
+var activeListeners []net.Listener
+var activeListenersLock sync.Mutex
+
+var activeConns = make(map[net.Conn]bool)
+var activeConnsLock sync.Mutex
+var activeConnsWait sync.WaitGroup
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+func listen(address string) (net.Listener, error) {
+	config := net.ListenConfig{KeepAlive: tcpKeepAlive}
+	if reusePort {
+		config.Control = reusePortControl
+	}
+
+	listener, err := config.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if listenBacklog > 0 {
+		if err := setListenBacklog(listener, listenBacklog); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	activeListenersLock.Lock()
+	activeListeners = append(activeListeners, listener)
+	activeListenersLock.Unlock()
+	return listener, nil
+}
+
+func trackConnection(conn net.Conn) {
+	activeConnsLock.Lock()
+	defer activeConnsLock.Unlock()
+	activeConns[conn] = true
+	activeConnsWait.Add(1)
+}
+
+func untrackConnection(conn net.Conn) {
+	activeConnsLock.Lock()
+	defer activeConnsLock.Unlock()
+	if activeConns[conn] {
+		delete(activeConns, conn)
+		activeConnsWait.Done()
+	}
+}
+
+func handleShutdownSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		received := <-signals
+		go triggerShutdown(received.String())
+
+		// Second signal, e.g. Ctrl-C again, don't wait for drain.
+		received = <-signals
+		log.Warnf("Received %v again, exit immediately.", received)
+		removePidFile()
+		os.Exit(1)
+	}()
+}
+
+// shutdown stop accepting, wait existing connections up to drainTimeout, then exit.
+func shutdown() {
+	drainConnections()
+	flushRuleHits()
+	stopEvents()
+	removePidFile()
+	os.Exit(0)
+}
+
+// drainConnections stop accepting, wait existing connections up to drainTimeout.
+func drainConnections() {
+	atomic.StoreInt32(&shuttingDown, 1)
+	if shutdownDelay > 0 {
+		log.Infof("Wait %v before stop accepting.", shutdownDelay)
+		time.Sleep(shutdownDelay)
+	}
+
+	activeListenersLock.Lock()
+	for _, listener := range activeListeners {
+		listener.Close()
+	}
+	activeListenersLock.Unlock()
+
+	// Connection closed after its next idle read timeout, Postfix will reconnect to new process.
+	deadline := time.Now().Add(drainTimeout)
+	activeConnsLock.Lock()
+	log.Infof("Draining %d connection(s), timeout %v.", len(activeConns), drainTimeout)
+	for conn := range activeConns {
+		conn.SetReadDeadline(deadline)
+	}
+	activeConnsLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		activeConnsWait.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info("All connections closed.")
+	case <-time.After(drainTimeout + time.Second):
+		log.Warn("Drain timeout, exit with connection(s) still open.")
+	}
+}
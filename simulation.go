@@ -0,0 +1,142 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strings"
+)
+
+// fixtures replace DNS and GeoIP in simulation mode, so decisions are reproducible. nil when not simulating.
+var fixtures *fixtureData
+
+// fixtureSeed seed random picks of targets and IPs in simulation mode, so same queries in same order get same
+// decisions in every run.
+const fixtureSeed = 1
+
+type fixtureNet struct {
+	ipNet   *net.IPNet
+	country string
+}
+
+type fixtureData struct {
+	// records keyed by lower case FQDN.
+	records map[string][]dns.RR
+	geoip   []fixtureNet
+}
+
+// loadFixtures load fixture file. Each line is a DNS record in zone file format
+// (e.g. "example.com. 300 IN MX 10 mx1.example.com.") or "geoip CIDR COUNTRY". "#" start a comment line.
+func loadFixtures(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Open fixture file %s error: %s", path, err.Error()))
+	}
+	defer file.Close()
+
+	data := &fixtureData{records: make(map[string][]dns.RR)}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if fields[0] == "geoip" {
+			if len(fields) != 3 {
+				return errors.New(fmt.Sprintf("%s:%d: Invalid geoip fixture: %s", path, lineNumber, line))
+			}
+			_, ipNet, err := net.ParseCIDR(fields[1])
+			if err != nil {
+				return errors.New(fmt.Sprintf("%s:%d: Invalid CIDR: %s", path, lineNumber, fields[1]))
+			}
+			// "-" simulate range without country, special codes like A2 are kept to test normalization.
+			country := strings.ToUpper(fields[2])
+			if country == "-" {
+				country = ""
+			} else if !geoipSpecialCodes[country] {
+				if err := validateCountryCode(country); err != nil {
+					return errors.New(fmt.Sprintf("%s:%d: %s", path, lineNumber, err.Error()))
+				}
+			}
+			data.geoip = append(data.geoip, fixtureNet{ipNet: ipNet, country: country})
+			continue
+		}
+
+		record, err := dns.NewRR(line)
+		if err != nil || record == nil {
+			return errors.New(fmt.Sprintf("%s:%d: Invalid DNS record: %s", path, lineNumber, line))
+		}
+		name := strings.ToLower(record.Header().Name)
+		data.records[name] = append(data.records[name], record)
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.New(fmt.Sprintf("Read fixture file %s error: %s", path, err.Error()))
+	}
+
+	fixtures = data
+	random = newRandom(fixtureSeed)
+	log.Warnf("Simulation mode, DNS and GeoIP from fixture file %s: %d name(s), %d network(s).", path, len(data.records), len(data.geoip))
+	return nil
+}
+
+// fixtureQuery answer like a resolver. Name without any record is NXDOMAIN.
+func fixtureQuery(name string, queryType uint16) ([]dns.RR, uint32, error) {
+	records, ok := fixtures.records[strings.ToLower(dns.Fqdn(name))]
+	if !ok {
+		return nil, 0, &dnsError{name: name, rcode: dns.RcodeNameError}
+	}
+
+	answers := []dns.RR{}
+	var ttl uint32
+	for _, record := range records {
+		if record.Header().Rrtype != queryType {
+			continue
+		}
+		if len(answers) < 1 || record.Header().Ttl < ttl {
+			ttl = record.Header().Ttl
+		}
+		answers = append(answers, record)
+	}
+	return answers, ttl, nil
+}
+
+// fixtureCountry return country of most specific fixture network contain the IP.
+func fixtureCountry(ip net.IP) (string, error) {
+	country := ""
+	bestSize := -1
+	for _, fixture := range fixtures.geoip {
+		size, _ := fixture.ipNet.Mask.Size()
+		if fixture.ipNet.Contains(ip) && size > bestSize {
+			country = fixture.country
+			bestSize = size
+		}
+	}
+	if bestSize < 0 {
+		return "", errors.New(fmt.Sprintf("%s not in GeoIP fixtures", ip.String()))
+	}
+	return country, nil
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency SLO, e.g. 99% of lookups under 50ms. Slow transport map lookups stall Postfix trivial-rewrite and queue
+// manager. Lookups counted in one minute buckets over sloWindow, to report error budget left and burn rates.
+var sloWindow time.Duration
+
+const sloBucketSize = time.Minute
+
+// sloFastBurnRate over both 5m and 1h is logged as warning. Common SRE page threshold, spend 2% of a 30 days budget
+// in an hour.
+const sloFastBurnRate = 14.4
+
+type latencyObjective struct {
+	// target ratio of lookups under threshold, e.g. 0.99.
+	target    float64
+	threshold time.Duration
+	source    string
+}
+
+type sloBucket struct {
+	minute int64
+	total  uint64
+	// bad count lookups over threshold of each objective.
+	bad []uint64
+}
+
+var latencyObjectives []latencyObjective
+var sloBuckets []sloBucket
+var sloLock sync.Mutex
+
+// parseLatencyObjective parse "99%<50ms".
+func parseLatencyObjective(value string) (latencyObjective, error) {
+	splited := strings.SplitN(value, "%<", 2)
+	if len(splited) != 2 {
+		return latencyObjective{}, errors.New(fmt.Sprintf("Invalid latency SLO format: %s", value))
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSpace(splited[0]), 64)
+	if err != nil || percent <= 0 || percent >= 100 {
+		return latencyObjective{}, errors.New(fmt.Sprintf("Invalid latency SLO percent of %s, must be between 0 and 100", value))
+	}
+	threshold, err := time.ParseDuration(strings.TrimSpace(splited[1]))
+	if err != nil || threshold <= 0 {
+		return latencyObjective{}, errors.New(fmt.Sprintf("Invalid latency SLO threshold of %s", value))
+	}
+	return latencyObjective{target: percent / 100, threshold: threshold, source: value}, nil
+}
+
+// setupLatencySlo parse objectives and allocate buckets of sloWindow.
+func setupLatencySlo(values []string) error {
+	for _, value := range values {
+		objective, err := parseLatencyObjective(value)
+		if err != nil {
+			return err
+		}
+		latencyObjectives = append(latencyObjectives, objective)
+	}
+	if len(latencyObjectives) < 1 {
+		return nil
+	}
+	if sloWindow < time.Hour {
+		return errors.New("--latency-slo-window must be at least 1h.")
+	}
+	sloBuckets = make([]sloBucket, int(sloWindow/sloBucketSize))
+	return nil
+}
+
+// getSloBucket return bucket of the minute, reset if it hold an older minute. Must called with sloLock held.
+func getSloBucket(minute int64) *sloBucket {
+	bucket := &sloBuckets[minute%int64(len(sloBuckets))]
+	if bucket.minute != minute {
+		bucket.minute = minute
+		bucket.total = 0
+		bucket.bad = make([]uint64, len(latencyObjectives))
+	}
+	return bucket
+}
+
+func recordLatency(duration time.Duration) {
+	if len(latencyObjectives) < 1 {
+		return
+	}
+
+	sloLock.Lock()
+	defer sloLock.Unlock()
+	bucket := getSloBucket(time.Now().Unix() / int64(sloBucketSize/time.Second))
+	bucket.total++
+	for i, objective := range latencyObjectives {
+		if duration > objective.threshold {
+			bucket.bad[i]++
+		}
+	}
+}
+
+// sumSlo return total and bad lookups of the objective in last period.
+func sumSlo(index int, period time.Duration) (uint64, uint64) {
+	now := time.Now().Unix() / int64(sloBucketSize/time.Second)
+	oldest := now - int64(period/sloBucketSize) + 1
+	var total, bad uint64
+	for _, bucket := range sloBuckets {
+		if bucket.minute >= oldest && bucket.minute <= now && bucket.bad != nil {
+			total += bucket.total
+			bad += bucket.bad[index]
+		}
+	}
+	return total, bad
+}
+
+// burnRate is how fast error budget consumed. 1 exhaust the budget exactly at end of window.
+func burnRate(objective latencyObjective, total uint64, bad uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - objective.target)
+}
+
+type sloStatus struct {
+	Objective       string  `json:"objective"`
+	ThresholdMs     float64 `json:"threshold_ms"`
+	Target          float64 `json:"target"`
+	Window          string  `json:"window"`
+	Total           uint64  `json:"total"`
+	Bad             uint64  `json:"bad"`
+	Compliance      float64 `json:"compliance"`
+	BudgetRemaining float64 `json:"error_budget_remaining"`
+	BurnRate5m      float64 `json:"burn_rate_5m"`
+	BurnRate1h      float64 `json:"burn_rate_1h"`
+}
+
+// getSloStats return status of each objective, nil if no SLO configured.
+func getSloStats() []sloStatus {
+	if len(latencyObjectives) < 1 {
+		return nil
+	}
+
+	sloLock.Lock()
+	defer sloLock.Unlock()
+	statuses := make([]sloStatus, 0, len(latencyObjectives))
+	for i, objective := range latencyObjectives {
+		total, bad := sumSlo(i, sloWindow)
+		total5m, bad5m := sumSlo(i, 5*time.Minute)
+		total1h, bad1h := sumSlo(i, time.Hour)
+		status := sloStatus{
+			Objective:       objective.source,
+			ThresholdMs:     float64(objective.threshold) / float64(time.Millisecond),
+			Target:          objective.target,
+			Window:          sloWindow.String(),
+			Total:           total,
+			Bad:             bad,
+			Compliance:      1,
+			BudgetRemaining: 1,
+			BurnRate5m:      burnRate(objective, total5m, bad5m),
+			BurnRate1h:      burnRate(objective, total1h, bad1h),
+		}
+		if total > 0 {
+			status.Compliance = 1 - float64(bad)/float64(total)
+			status.BudgetRemaining = 1 - burnRate(objective, total, bad)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// startSloCheck warn every minute while an objective burning error budget fast.
+func startSloCheck() {
+	if len(latencyObjectives) < 1 {
+		return
+	}
+	go func() {
+		for range time.Tick(sloBucketSize) {
+			for _, status := range getSloStats() {
+				if status.BurnRate5m < sloFastBurnRate || status.BurnRate1h < sloFastBurnRate {
+					continue
+				}
+				log.WithFields(log.Fields{
+					"objective":              status.Objective,
+					"burn_rate_5m":           status.BurnRate5m,
+					"burn_rate_1h":           status.BurnRate1h,
+					"error_budget_remaining": status.BudgetRemaining,
+				}).Warn("Latency SLO error budget burning fast.")
+			}
+		}
+	}()
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var slowThreshold time.Duration
+var slowLookups uint64
+
+// checkSlowLookup log and count the lookup if it take longer than slowThreshold.
+// traceId is also exemplar of the lookup in latency histogram of /metrics.
+func checkSlowLookup(key string, d decision, duration time.Duration, traceId string) {
+	if slowThreshold <= 0 || duration < slowThreshold {
+		return
+	}
+
+	count := atomic.AddUint64(&slowLookups, 1)
+	log.WithFields(log.Fields{
+		"key":         key,
+		"rule_set":    d.RuleSet,
+		"rule":        d.Rule,
+		"target":      d.Target,
+		"duration_ms": float64(duration) / float64(time.Millisecond),
+		"timings_ms":  d.Timings,
+		"errors":      d.Errors,
+		"error_code":  d.ErrorCode,
+		"slow_count":  count,
+		"trace_id":    traceId,
+	}).Warn("Slow lookup.")
+}
+
+// adminSlowHandler GET return slow lookup threshold and count.
+func adminSlowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"threshold_ms": float64(slowThreshold) / float64(time.Millisecond),
+		"count":        atomic.LoadUint64(&slowLookups),
+	})
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Postfix socketmap protocol, see socketmap_table(5). Request is netstring "NAME KEY", reply is netstring "OK VALUE",
+// "NOTFOUND ", "TEMP REASON" or "PERM REASON". Map name is ignored, listener rule set is used.
+
+var errInvalidNetstring = errors.New("invalid netstring")
+
+// readNetstring read "LENGTH:DATA,". Requests are short keys, so longer than maxRequestLine is invalid.
+func readNetstring(reader *bufio.Reader) (string, error) {
+	header, err := reader.ReadSlice(':')
+	if err == bufio.ErrBufferFull {
+		return "", errInvalidNetstring
+	}
+	if err != nil {
+		if err == io.EOF && len(header) > 0 {
+			return "", errInvalidNetstring
+		}
+		return "", err
+	}
+	digits := string(header[:len(header)-1])
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return "", errInvalidNetstring
+	}
+	length, err := strconv.Atoi(digits)
+	if err != nil || length > maxRequestLine {
+		return "", errInvalidNetstring
+	}
+
+	data := make([]byte, length+1)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", errInvalidNetstring
+	}
+	if data[length] != ',' {
+		return "", errInvalidNetstring
+	}
+	return string(data[:length]), nil
+}
+
+func netstring(value string) string {
+	return fmt.Sprintf("%d:%s,", len(value), value)
+}
+
+func genSocketmapResponse(result decision) string {
+	switch result.Action {
+	case failTemp:
+		return netstring("TEMP " + failureText(result))
+	case failNotFound:
+		return netstring("NOTFOUND ")
+	}
+	return netstring("OK " + transportValue(result))
+}
+
+// serveSocketmap answer socketmap requests of the connection until closed or too many protocol violations.
+func serveSocketmap(conn net.Conn, reader *bufio.Reader, ruleSetName string, connStats *connectionStats) {
+	violations := 0
+	for {
+		request, err := readNetstring(reader)
+		if err == errInvalidNetstring {
+			recordProtocolViolation(conn.RemoteAddr(), violationNetstring)
+			connStats.errors++
+			conn.Write([]byte(netstring("PERM invalid netstring")))
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Read from %v error: '%s'.", conn.RemoteAddr(), err.Error())
+				connStats.errors++
+			}
+			return
+		}
+
+		splitedRequest := strings.SplitN(request, " ", 2)
+		key := ""
+		violation := violationNetstring
+		if len(splitedRequest) == 2 {
+			key = splitedRequest[1]
+			violation = checkRequest(request, key)
+		}
+		if violation != "" {
+			recordProtocolViolation(conn.RemoteAddr(), violation)
+			connStats.errors++
+			violations++
+			_, err = conn.Write([]byte(netstring("PERM invalid request")))
+			if err != nil || violations >= maxProtocolViolations {
+				return
+			}
+			continue
+		}
+
+		err = answerQuery(conn, ruleSetName, key, connStats, genSocketmapResponse)
+		if err != nil {
+			log.Errorf("Write to %v error: '%s'.", conn.RemoteAddr(), err.Error())
+		}
+	}
+}
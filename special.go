@@ -0,0 +1,88 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Special keys Postfix may query, which are not email addresses.
+const (
+	specialPostmaster   = "postmaster"
+	specialDoubleBounce = "double-bounce"
+	specialEmpty        = "empty"
+)
+
+// Special key replies. Other replies are Postfix nexthop, e.g. "local:" or "relay:[mta1]".
+const (
+	// specialDefault use default target of the rule set.
+	specialDefault = "default"
+	// specialNotFound reply 500, Postfix use its own default transport.
+	specialNotFound = "notfound"
+)
+
+// specialKeyReplies keyed by special key. Keys not configured handled as invalid addresses.
+var specialKeyReplies = make(map[string]string)
+
+// parseSpecialKeyFlag parse "KEY=REPLY".
+func parseSpecialKeyFlag(value string) (string, string, error) {
+	splitedValue := strings.SplitN(value, "=", 2)
+	if len(splitedValue) != 2 || splitedValue[1] == "" {
+		return "", "", errors.New(fmt.Sprintf("Invalid special key reply format: %s", value))
+	}
+	key := strings.ToLower(splitedValue[0])
+	switch key {
+	case specialPostmaster, specialDoubleBounce, specialEmpty:
+	default:
+		return "", "", errors.New(fmt.Sprintf("Unknown special key: %s", splitedValue[0]))
+	}
+	reply := splitedValue[1]
+	if reply != specialDefault && reply != specialNotFound && !strings.Contains(reply, ":") {
+		return "", "", errors.New(fmt.Sprintf("Invalid special key reply, need default, notfound or Postfix nexthop: %s", reply))
+	}
+	return key, reply, nil
+}
+
+// getSpecialKey return special key name of the key, if configured.
+func getSpecialKey(key string) (string, bool) {
+	name := strings.ToLower(key)
+	if name == "" {
+		name = specialEmpty
+	}
+	if name != specialPostmaster && name != specialDoubleBounce && name != specialEmpty {
+		return "", false
+	}
+	_, ok := specialKeyReplies[name]
+	return name, ok
+}
+
+// specialDecision return decision of configured special key.
+func (rs *ruleSet) specialDecision(name string) decision {
+	reply := specialKeyReplies[name]
+	switch reply {
+	case specialDefault:
+		return rs.defaultDecision("special", []string{fmt.Sprintf("special key %s, default target", name)})
+	case specialNotFound:
+		return decision{RuleSet: rs.name, Rule: "special", Action: failNotFound, Failure: "special", ErrorCode: errorSpecialKey,
+			Trace: []string{fmt.Sprintf("special key %s, reply not found", name)}}
+	}
+	// No pool, so the reply never replaced by target picked again from pool.
+	return decision{RuleSet: rs.name, Rule: "special", Target: reply, Nexthop: reply,
+		Trace: []string{fmt.Sprintf("special key %s, reply %s", name, reply)}}
+}
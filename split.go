@@ -0,0 +1,115 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// trafficShare is percentage of domains of a country routed to a pool, e.g. "70%pool-a".
+type trafficShare struct {
+	percent int
+	// name is pool name, or target if not a pool.
+	name    string
+	targets []string
+}
+
+func (s trafficShare) String() string {
+	return fmt.Sprintf("%d%%%s", s.percent, s.name)
+}
+
+// parsePoolFlag parse "NAME=MTA1,MTA2".
+func parsePoolFlag(value string) (string, []string, error) {
+	splitedValue := strings.SplitN(value, "=", 2)
+	if len(splitedValue) != 2 || splitedValue[0] == "" || splitedValue[1] == "" {
+		return "", nil, errors.New(fmt.Sprintf("Invalid pool format: %s", value))
+	}
+	targets := make([]string, 0)
+	for _, target := range strings.Split(splitedValue[1], ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			return "", nil, errors.New(fmt.Sprintf("Empty target in pool %s.", splitedValue[0]))
+		}
+		targets = append(targets, normalizeTarget(target))
+	}
+	return splitedValue[0], targets, nil
+}
+
+// poolTargets return targets of the pool name, or the name itself as a target.
+func poolTargets(name string, pools map[string][]string) []string {
+	if targets, ok := pools[name]; ok {
+		return targets
+	}
+	return []string{normalizeTarget(name)}
+}
+
+func isSplitTarget(target string) bool {
+	return strings.Contains(target, "%")
+}
+
+// parseSplitTarget parse "70%pool-a/30%pool-b". Each share is a pool name or a target, percentages sum to 100.
+func parseSplitTarget(value string, pools map[string][]string) ([]trafficShare, error) {
+	shares := make([]trafficShare, 0)
+	total := 0
+	for _, part := range strings.Split(value, "/") {
+		splitedPart := strings.SplitN(strings.TrimSpace(part), "%", 2)
+		if len(splitedPart) != 2 || splitedPart[1] == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid traffic split %s, must be like 70%%pool-a/30%%pool-b.", value))
+		}
+		percent, err := strconv.Atoi(splitedPart[0])
+		if err != nil || percent < 1 || percent > 100 {
+			return nil, errors.New(fmt.Sprintf("Invalid percentage in traffic split %s: %s", value, splitedPart[0]))
+		}
+		total += percent
+		shares = append(shares, trafficShare{percent: percent, name: splitedPart[1], targets: poolTargets(splitedPart[1], pools)})
+	}
+	if len(shares) < 2 || total != 100 {
+		return nil, errors.New(fmt.Sprintf("Traffic split %s must have at least 2 shares sum to 100%%.", value))
+	}
+	return shares, nil
+}
+
+// domainBucket return 0-99 by hash of domain, so a domain always in the same share.
+func domainBucket(domain string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.ToLower(domain)))
+	return int(hash.Sum32() % 100)
+}
+
+// getSplitPool return targets of the share the domain hashed to, if traffic of the country split. Whole country pool
+// used if all targets of the share drained.
+func (rs *ruleSet) getSplitPool(country string, domain string) ([]string, trafficShare, bool) {
+	shares, ok := rs.splitMap[country]
+	if !ok {
+		return nil, trafficShare{}, false
+	}
+	bucket := domainBucket(domain)
+	for _, share := range shares {
+		if bucket < share.percent {
+			if _, ok := pickTarget(share.targets); !ok {
+				return nil, share, false
+			}
+			return share.targets, share, true
+		}
+		bucket -= share.percent
+	}
+	return nil, trafficShare{}, false
+}
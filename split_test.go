@@ -0,0 +1,141 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSplitTarget(t *testing.T) {
+	pools := map[string][]string{"pool-a": {"mta-a1", "mta-a2"}, "pool-b": {"mta-b1"}}
+	tests := []struct {
+		value  string
+		shares []trafficShare
+		ok     bool
+	}{
+		{"70%pool-a/30%pool-b", []trafficShare{{70, "pool-a", []string{"mta-a1", "mta-a2"}}, {30, "pool-b", []string{"mta-b1"}}}, true},
+		{" 50%pool-a / 50%mta-c ", []trafficShare{{50, "pool-a", []string{"mta-a1", "mta-a2"}}, {50, "mta-c", []string{"mta-c"}}}, true},
+		// Unknown pool name is a target.
+		{"60%pool-x/40%pool-b", []trafficShare{{60, "pool-x", []string{"pool-x"}}, {40, "pool-b", []string{"mta-b1"}}}, true},
+		{"50%[2001:DB8::1]/50%pool-b", []trafficShare{{50, "[2001:DB8::1]", []string{"2001:db8::1"}}, {50, "pool-b", []string{"mta-b1"}}}, true},
+		{"70%pool-a/20%pool-b", nil, false},
+		{"70%pool-a/40%pool-b", nil, false},
+		{"100%pool-a", nil, false},
+		{"0%pool-a/100%pool-b", nil, false},
+		{"-10%pool-a/110%pool-b", nil, false},
+		{"x%pool-a/50%pool-b", nil, false},
+		{"50%/50%pool-b", nil, false},
+		{"50pool-a/50%pool-b", nil, false},
+		{"", nil, false},
+	}
+	for _, test := range tests {
+		shares, err := parseSplitTarget(test.value, pools)
+		if (err == nil) != test.ok {
+			t.Errorf("parseSplitTarget(%q) error %v, want ok %v", test.value, err, test.ok)
+			continue
+		}
+		if !reflect.DeepEqual(shares, test.shares) {
+			t.Errorf("parseSplitTarget(%q) = %v, want %v", test.value, shares, test.shares)
+		}
+	}
+}
+
+func TestDomainBucket(t *testing.T) {
+	tests := []struct {
+		domains []string
+		bucket  int
+	}{
+		{[]string{"example.com", "EXAMPLE.COM", "Example.Com"}, 78},
+		{[]string{"example.org", "Example.ORG"}, 5},
+		{[]string{"c.com", "C.COM"}, 13},
+	}
+	for _, test := range tests {
+		for _, domain := range test.domains {
+			if bucket := domainBucket(domain); bucket != test.bucket {
+				t.Errorf("domainBucket(%q) = %d, want %d", domain, bucket, test.bucket)
+			}
+		}
+	}
+}
+
+func TestGetSplitPool(t *testing.T) {
+	rs := &ruleSet{splitMap: map[string][]trafficShare{
+		"JP": {{70, "pool-a", []string{"mta-a1", "mta-a2"}}, {30, "pool-b", []string{"mta-b1"}}},
+	}}
+	tests := []struct {
+		country string
+		domain  string
+		drained []string
+		pool    []string
+		share   string
+		ok      bool
+	}{
+		// example.org bucket 5, example.com bucket 78.
+		{"JP", "example.org", nil, []string{"mta-a1", "mta-a2"}, "pool-a", true},
+		{"JP", "EXAMPLE.ORG", nil, []string{"mta-a1", "mta-a2"}, "pool-a", true},
+		{"JP", "example.com", nil, []string{"mta-b1"}, "pool-b", true},
+		{"JP", "example.org", []string{"mta-a1"}, []string{"mta-a1", "mta-a2"}, "pool-a", true},
+		// All targets of the share drained, caller fall back to whole country pool.
+		{"JP", "example.org", []string{"mta-a1", "mta-a2"}, nil, "pool-a", false},
+		{"JP", "example.com", []string{"mta-b1"}, nil, "pool-b", false},
+		{"US", "example.org", nil, nil, "", false},
+	}
+	for _, test := range tests {
+		for _, target := range test.drained {
+			setDrained(target, true)
+		}
+		pool, share, ok := rs.getSplitPool(test.country, test.domain)
+		for _, target := range test.drained {
+			setDrained(target, false)
+		}
+		if ok != test.ok || share.name != test.share || !reflect.DeepEqual(pool, test.pool) {
+			t.Errorf("getSplitPool(%q, %q) drained %v = %v, %q, %v, want %v, %q, %v", test.country, test.domain, test.drained, pool, share.name, ok, test.pool, test.share, test.ok)
+		}
+	}
+}
+
+func TestMatchCountryRuleSplitFallback(t *testing.T) {
+	rs := &ruleSet{
+		destinationMap: map[string][]string{"JP": {"mta-a1", "mta-a2", "mta-b1"}},
+		splitMap: map[string][]trafficShare{
+			"JP": {{70, "pool-a", []string{"mta-a1", "mta-a2"}}, {30, "pool-b", []string{"mta-b1"}}},
+		},
+	}
+	tests := []struct {
+		drained []string
+		pool    []string
+	}{
+		{nil, []string{"mta-a1", "mta-a2"}},
+		{[]string{"mta-a1"}, []string{"mta-a1", "mta-a2"}},
+		{[]string{"mta-a1", "mta-a2"}, []string{"mta-a1", "mta-a2", "mta-b1"}},
+	}
+	for _, test := range tests {
+		for _, target := range test.drained {
+			setDrained(target, true)
+		}
+		l := newLookup(rs, "user@example.org")
+		l.mxCountry, l.mxCountryFound, l.mxCountryResolved = "JP", true, true
+		pool, ok := matchCountryRule(l)
+		for _, target := range test.drained {
+			setDrained(target, false)
+		}
+		if !ok || !reflect.DeepEqual(pool, test.pool) {
+			t.Errorf("matchCountryRule drained %v = %v, %v, want %v", test.drained, pool, ok, test.pool)
+		}
+	}
+}
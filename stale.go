@@ -0,0 +1,87 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+	"time"
+)
+
+// serveStaleTtl is how long last good decision of a domain kept, to serve while resolvers fail. 0 to disable.
+var serveStaleTtl time.Duration
+var staleServed uint64
+
+var staleCache = newLruCache("stale")
+
+// isResolverOutage return true if decision fell to default or failure reply because DNS resolvers failed.
+func isResolverOutage(d decision) bool {
+	if d.Rule != "default" && d.Action == "" {
+		return false
+	}
+	return d.ErrorCode == errorResolverTimeout || d.ErrorCode == errorResolverFailure
+}
+
+// rememberStale keep decision made by a rule, to serve while resolvers fail.
+func rememberStale(rs *ruleSet, email string, d decision) {
+	if serveStaleTtl <= 0 || d.Action != "" || d.Rule == "default" || d.Rule == "static" {
+		return
+	}
+	key := rs.name + " " + decisionKey(rs, email)
+	size := len(key) + 128
+	for _, value := range d.Pool {
+		size += len(value)
+	}
+	d.Errors = nil
+	d.Trace = nil
+	staleCache.set(key, d, size, serveStaleTtl)
+}
+
+// serveStale replace decision with last good decision of the domain if resolvers failed. Target picked again from pool.
+func serveStale(rs *ruleSet, email string, d *decision) bool {
+	if serveStaleTtl <= 0 || !isResolverOutage(*d) {
+		return false
+	}
+	value, _, ok := staleCache.get(rs.name + " " + decisionKey(rs, email))
+	if !ok {
+		return false
+	}
+
+	stale := value.(decision)
+	stale.Pool = rs.validTargets(stale.matchKey, stale.Pool, time.Now())
+	target, ok := pickCountryTarget(stale.Country, stale.Pool)
+	if !ok {
+		return false
+	}
+	stale.Target = target
+	rs.applyMappingOptions(&stale)
+	stale.Stale = true
+	stale.Errors = d.Errors
+	stale.Trace = append(d.Trace, "resolver failed, serve stale decision of rule "+stale.Rule)
+	stale.Timings = d.Timings
+
+	count := atomic.AddUint64(&staleServed, 1)
+	log.WithFields(log.Fields{
+		"key":          email,
+		"rule_set":     rs.name,
+		"error_code":   d.ErrorCode,
+		"target":       stale.Target,
+		"stale_served": count,
+	}).Warn("Resolver failed, serve stale decision.")
+	*d = stale
+	return true
+}
@@ -0,0 +1,254 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var startTime = time.Now()
+
+var totalConnections uint64
+var currentConnections int64
+var totalLookups uint64
+
+var decisionStats = struct {
+	sync.Mutex
+	countries map[string]uint64
+	targets   map[string]uint64
+	rules     map[string]uint64
+	labels    map[string]uint64
+	// errorCodes count error code of failure replies and default decisions.
+	errorCodes map[string]uint64
+}{
+	countries:  make(map[string]uint64),
+	targets:    make(map[string]uint64),
+	rules:      make(map[string]uint64),
+	labels:     make(map[string]uint64),
+	errorCodes: make(map[string]uint64),
+}
+
+type cacheStats struct {
+	Size      int     `json:"size"`
+	Bytes     int     `json:"bytes"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	HitRate   float64 `json:"hit_rate"`
+	Evictions uint64  `json:"evictions"`
+}
+
+// cacheStatsProviders let each cache report its stats by name.
+var cacheStatsProviders = make(map[string]func() cacheStats)
+var cacheStatsProvidersLock sync.Mutex
+
+func registerCacheStats(name string, provider func() cacheStats) {
+	cacheStatsProvidersLock.Lock()
+	defer cacheStatsProvidersLock.Unlock()
+	cacheStatsProviders[name] = provider
+}
+
+// connectionStats is summary of one connection, logged when it closed.
+type connectionStats struct {
+	start    time.Time
+	queries  uint64
+	failures uint64
+	errors   uint64
+	latency  time.Duration
+	// client is stats of client IP of the connection.
+	client *clientCounters
+}
+
+func newConnectionStats() *connectionStats {
+	return &connectionStats{start: time.Now()}
+}
+
+// record count a query. Failure is a decision reply with fail policy, error is a read/write error.
+func (s *connectionStats) record(d decision, duration time.Duration, writeErr error) {
+	s.queries++
+	s.latency += duration
+	if d.Action != "" {
+		s.failures++
+	}
+	if writeErr != nil {
+		s.errors++
+	}
+	recordClientQuery(s.client, nil, d)
+}
+
+func (s *connectionStats) log(conn net.Conn) {
+	averageMs := float64(0)
+	if s.queries > 0 {
+		averageMs = float64(s.latency) / float64(s.queries) / float64(time.Millisecond)
+	}
+	log.WithFields(log.Fields{
+		"remote":         conn.RemoteAddr().String(),
+		"duration":       time.Since(s.start).String(),
+		"queries":        s.queries,
+		"failures":       s.failures,
+		"errors":         s.errors,
+		"avg_latency_ms": averageMs,
+	}).Info("Connection closed.")
+}
+
+func recordConnectionOpen() {
+	atomic.AddUint64(&totalConnections, 1)
+	atomic.AddInt64(&currentConnections, 1)
+}
+
+func recordConnectionClose() {
+	atomic.AddInt64(&currentConnections, -1)
+}
+
+func recordDecision(d decision) {
+	atomic.AddUint64(&totalLookups, 1)
+
+	country := d.Country
+	if country == "" {
+		country = "unknown"
+	}
+
+	decisionStats.Lock()
+	defer decisionStats.Unlock()
+	decisionStats.countries[country]++
+	if d.Action == "" && d.Target != "" {
+		decisionStats.targets[d.Target]++
+	}
+	decisionStats.rules[d.Rule]++
+	if d.Label != "" {
+		decisionStats.labels[d.Label]++
+	}
+	if d.ErrorCode != "" {
+		decisionStats.errorCodes[d.ErrorCode]++
+	}
+}
+
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	copied := make(map[string]uint64, len(counts))
+	for key, value := range counts {
+		copied[key] = value
+	}
+	return copied
+}
+
+// getStats return a snapshot of runtime statistics.
+func getStats() map[string]interface{} {
+	caches := make(map[string]cacheStats)
+	cacheStatsProvidersLock.Lock()
+	for name, provider := range cacheStatsProviders {
+		caches[name] = provider()
+	}
+	cacheStatsProvidersLock.Unlock()
+
+	decisionStats.Lock()
+	countries := copyCounts(decisionStats.countries)
+	targets := copyCounts(decisionStats.targets)
+	rules := copyCounts(decisionStats.rules)
+	labels := copyCounts(decisionStats.labels)
+	errorCodes := copyCounts(decisionStats.errorCodes)
+	decisionStats.Unlock()
+
+	databases := make(map[string]interface{})
+	if countryDb := getCountryDb(); countryDb != nil {
+		metadata := countryDb.Metadata()
+		databases["country"] = map[string]interface{}{
+			"type":     metadata.DatabaseType,
+			"build":    time.Unix(int64(metadata.BuildEpoch), 0).UTC(),
+			"embedded": usingEmbeddedGeoipDb,
+		}
+	}
+	if ispDb := getIspDb(); ispDb != nil {
+		metadata := ispDb.Metadata()
+		databases["isp"] = map[string]interface{}{
+			"type":  metadata.DatabaseType,
+			"build": time.Unix(int64(metadata.BuildEpoch), 0).UTC(),
+		}
+	}
+	if anonymousDb := getAnonymousDb(); anonymousDb != nil {
+		metadata := anonymousDb.Metadata()
+		databases["anonymous"] = map[string]interface{}{
+			"type":  metadata.DatabaseType,
+			"build": time.Unix(int64(metadata.BuildEpoch), 0).UTC(),
+		}
+	}
+
+	stats := map[string]interface{}{
+		"uptime":              time.Since(startTime).String(),
+		"total_connections":   atomic.LoadUint64(&totalConnections),
+		"current_connections": atomic.LoadInt64(&currentConnections),
+		"total_lookups":       atomic.LoadUint64(&totalLookups),
+		"shared_lookups":      atomic.LoadUint64(&sharedEvaluations),
+		"ambiguous_domains":   countAmbiguousDomains(),
+		"ambiguous_lookups":   atomic.LoadUint64(&ambiguousLookups),
+		"sticky_overrides":    atomic.LoadUint64(&stickyOverrides),
+		"stale_served":        atomic.LoadUint64(&staleServed),
+		"events":              getEventStats(),
+		"unusable_ip_records": atomic.LoadUint64(&unusableIpRecords),
+		"pins":                countPins(),
+		"log_suppressed":      atomic.LoadUint64(&logSuppressed),
+		"protocol_violations": getProtocolViolations(),
+		"clients":             countClients(),
+		"auth_failures":       atomic.LoadUint64(&authFailures),
+		"admin_auth_failures": atomic.LoadUint64(&adminAuthFailures),
+		"countries":           countries,
+		"targets":             targets,
+		"rules":               rules,
+		"labels":              labels,
+		"error_codes":         errorCodes,
+		"caches":              caches,
+		"selections":          getSelectionStats(),
+		"relay_feedback":      getFeedbackStats(),
+		"demotions":           getDemotions(),
+		"target_load":         getTargetLoadStats(),
+		"target_health":       getTargetHealth(),
+		"resolvers":           getResolverStats(),
+		"databases":           databases,
+	}
+	if status := getRefreshStatus(); status != nil {
+		databases["refresh"] = status
+	}
+	if anomalyStats := getAnomalyStats(); anomalyStats != nil {
+		stats["routing_anomalies"] = anomalyStats
+	}
+	if sloStats := getSloStats(); sloStats != nil {
+		stats["latency_slo"] = sloStats
+	}
+	if peerStats := getPeerStats(); peerStats != nil {
+		stats["peers"] = peerStats
+	}
+	for key, value := range getReloadStatus() {
+		stats[key] = value
+	}
+	return stats
+}
+
+func logStats() {
+	log.WithFields(log.Fields(getStats())).Info("Runtime statistics.")
+}
+
+// adminStatsHandler GET return runtime statistics.
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	writeJson(w, http.StatusOK, getStats())
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// stickyTtl is how long a recipient domain keep its first target, 0 to disable. Not extended by later lookups, so
+// a domain move to new target at most stickyTtl after its MX changed.
+var stickyTtl time.Duration
+var stickyOverrides uint64
+
+var stickyCache = newLruCache("sticky")
+
+type stickyTarget struct {
+	target   string
+	matchKey string
+	expires  time.Time
+}
+
+// applySticky replace target of the decision by the target first picked for its domain in sticky window, and
+// start the window if none. Failure replies, static mode and drained sticky targets not sticky.
+func applySticky(rs *ruleSet, email string, d *decision) {
+	key, ok := stickyKey(rs, email, d)
+	if !ok {
+		return
+	}
+	target := d.Target
+	if useSticky(rs, key, d) {
+		if d.Target != target {
+			atomic.AddUint64(&stickyOverrides, 1)
+		}
+		return
+	}
+
+	sticky := stickyTarget{target: d.Target, matchKey: d.matchKey, expires: time.Now().Add(stickyTtl)}
+	stickyCache.set(key, sticky, len(key)+len(sticky.target)+len(sticky.matchKey)+64, stickyTtl)
+	broadcastPeerSticky(key, sticky)
+}
+
+// peekSticky replace target of the decision by current sticky target like applySticky, but not start a window.
+func peekSticky(rs *ruleSet, email string, d *decision) {
+	if key, ok := stickyKey(rs, email, d); ok {
+		useSticky(rs, key, d)
+	}
+}
+
+// stickyKey return sticky cache key of the decision. False if the decision can't be sticky.
+func stickyKey(rs *ruleSet, email string, d *decision) (string, bool) {
+	if stickyTtl <= 0 || d.Action != "" || d.Rule == "static" {
+		return "", false
+	}
+	domain, err := getEmailDomain(email)
+	if err != nil {
+		return "", false
+	}
+	return rs.name + " " + strings.ToLower(domain), true
+}
+
+// useSticky replace target of the decision by sticky target of the key. False if no usable sticky target.
+func useSticky(rs *ruleSet, key string, d *decision) bool {
+	value, _, ok := stickyCache.get(key)
+	if !ok {
+		return false
+	}
+	sticky := value.(stickyTarget)
+	demoted := isDemoted(d.Country, sticky.target) && !isDemoted(d.Country, d.Target)
+	if isDrained(sticky.target) || demoted || !rs.getMappingOptions(sticky.matchKey, sticky.target).validAt(time.Now()) {
+		return false
+	}
+	if sticky.target != d.Target {
+		d.Trace = append(d.Trace, fmt.Sprintf("sticky: keep %s instead of %s until %s", sticky.target, d.Target, sticky.expires.UTC().Format(time.RFC3339)))
+		d.Target = sticky.target
+		d.matchKey = sticky.matchKey
+		rs.applyMappingOptions(d)
+	}
+	return true
+}
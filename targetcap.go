@@ -0,0 +1,148 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// targetCaps is soft cap of decisions per targetCapWindow of each target. Saturated target skipped while other pool
+// members are under cap, used anyway if all are saturated.
+var targetCaps = make(map[string]uint64)
+var targetCapWindow time.Duration
+
+type targetLoad struct {
+	windowStart time.Time
+	current     uint64
+	previous    uint64
+	overCap     uint64
+}
+
+var targetLoads = make(map[string]*targetLoad)
+var targetLoadsLock sync.Mutex
+
+// parseTargetCapFlag parse "MTA=N". IP literal MTA normalized like targets of mappings.
+func parseTargetCapFlag(value string) (string, uint64, error) {
+	sepIndex := strings.LastIndex(value, "=")
+	if sepIndex < 1 {
+		return "", 0, errors.New(fmt.Sprintf("Invalid target cap format: %s", value))
+	}
+	limit, err := strconv.ParseUint(value[sepIndex+1:], 10, 64)
+	if err != nil || limit < 1 {
+		return "", 0, errors.New(fmt.Sprintf("Invalid target cap of %s: %s", value[:sepIndex], value[sepIndex+1:]))
+	}
+	return normalizeTarget(value[:sepIndex]), limit, nil
+}
+
+// roll move window forward. Must called with targetLoadsLock held.
+func (t *targetLoad) roll(now time.Time) {
+	elapsed := now.Sub(t.windowStart)
+	if elapsed < targetCapWindow {
+		return
+	}
+	if elapsed < 2*targetCapWindow {
+		t.previous = t.current
+		t.windowStart = t.windowStart.Add(targetCapWindow)
+	} else {
+		t.previous = 0
+		t.windowStart = now
+	}
+	t.current = 0
+}
+
+// estimate is sliding window count, previous window weighted by its part still in the sliding window.
+func (t *targetLoad) estimate(now time.Time) float64 {
+	t.roll(now)
+	weight := 1 - float64(now.Sub(t.windowStart))/float64(targetCapWindow)
+	return float64(t.previous)*weight + float64(t.current)
+}
+
+func isSaturated(target string) bool {
+	limit, ok := targetCaps[target]
+	if !ok {
+		return false
+	}
+	targetLoadsLock.Lock()
+	defer targetLoadsLock.Unlock()
+	load, ok := targetLoads[target]
+	return ok && load.estimate(time.Now()) >= float64(limit)
+}
+
+// filterSaturated return targets under cap, or all targets if all saturated.
+func filterSaturated(targets []string) []string {
+	if len(targetCaps) == 0 {
+		return targets
+	}
+	unsaturated := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if !isSaturated(target) {
+			unsaturated = append(unsaturated, target)
+		}
+	}
+	if len(unsaturated) == 0 {
+		return targets
+	}
+	return unsaturated
+}
+
+// recordTargetLoad count relay decision of capped target.
+func recordTargetLoad(d decision) {
+	limit, ok := targetCaps[d.Target]
+	if d.Action != "" || !ok {
+		return
+	}
+	now := time.Now()
+	targetLoadsLock.Lock()
+	defer targetLoadsLock.Unlock()
+	load, ok := targetLoads[d.Target]
+	if !ok {
+		load = &targetLoad{windowStart: now}
+		targetLoads[d.Target] = load
+	}
+	if load.estimate(now) >= float64(limit) {
+		load.overCap++
+	}
+	load.current++
+}
+
+// getTargetLoadStats return load, cap and saturation (load / cap) of capped targets.
+func getTargetLoadStats() map[string]interface{} {
+	now := time.Now()
+	targetLoadsLock.Lock()
+	defer targetLoadsLock.Unlock()
+	stats := make(map[string]interface{})
+	for target, limit := range targetCaps {
+		var estimate float64
+		var overCap uint64
+		if load, ok := targetLoads[target]; ok {
+			estimate = load.estimate(now)
+			overCap = load.overCap
+		}
+		stats[target] = map[string]interface{}{
+			"cap":        limit,
+			"load":       estimate,
+			"saturation": estimate / float64(limit),
+			"over_cap":   overCap,
+		}
+	}
+	return stats
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+var tldFallback bool
+
+// ccTLDs which not same as ISO alpha-2 country code.
+var tldCountryException = map[string]string{
+	"uk": "GB",
+}
+
+// ccTLDs which not a country, or widely used as generic TLD. Those can't hint a country.
+var tldIgnore = map[string]bool{
+	"ac": true,
+	"ai": true,
+	"cc": true,
+	"co": true,
+	"eu": true,
+	"fm": true,
+	"gg": true,
+	"io": true,
+	"ly": true,
+	"me": true,
+	"su": true,
+	"tv": true,
+	"ws": true,
+}
+
+// getCountryByTld guess country from domain's ccTLD. Return false if domain not under a usable ccTLD.
+func getCountryByTld(domain string) (string, bool) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	tld := domain[strings.LastIndex(domain, ".")+1:]
+	if len(tld) != 2 || tldIgnore[tld] {
+		return "", false
+	}
+
+	if country, ok := tldCountryException[tld]; ok {
+		return country, true
+	}
+
+	return strings.ToUpper(tld), true
+}
+
+// getTldPool is best effort fallback when DNS resolution fails. Only used when --tld-fallback enabled.
+func getTldPool(rs *ruleSet, domain string) ([]string, string, bool) {
+	if !tldFallback {
+		return nil, "", false
+	}
+
+	country, ok := getCountryByTld(domain)
+	if !ok {
+		return nil, "", false
+	}
+
+	pool, ok := rs.getCountryPool(country, domain)
+	if !ok {
+		return nil, "", false
+	}
+
+	log.Infof("DNS resolution failed for domain:%s, use country code: %s from TLD", domain, country)
+	return pool, country, true
+}
@@ -0,0 +1,163 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Unmapped countries are geolocated countries of lookups fell through to default target. Most seen ones are
+// candidates of explicit target mapping.
+
+var unmappedReportInterval time.Duration
+
+// unmappedReportTop is number of countries per rule set in periodic report.
+const unmappedReportTop = 10
+
+// unmappedDomainSamples is max number of example domains kept per country.
+const unmappedDomainSamples = 5
+
+type unmappedCountry struct {
+	RuleSet  string    `json:"rule_set"`
+	Country  string    `json:"country"`
+	Count    uint64    `json:"count"`
+	Domains  []string  `json:"domains"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+var unmappedCountries = struct {
+	sync.Mutex
+	// countries keyed by rule set name and country code.
+	countries map[string]*unmappedCountry
+}{countries: make(map[string]*unmappedCountry)}
+
+// recordUnmapped record country of decision made by default rule, if MX geolocated.
+func recordUnmapped(email string, d decision) {
+	if d.Rule != "default" || d.Action != "" || d.Country == "" {
+		return
+	}
+	domain, err := getEmailDomain(email)
+	if err != nil {
+		return
+	}
+
+	key := d.RuleSet + " " + d.Country
+	unmappedCountries.Lock()
+	defer unmappedCountries.Unlock()
+	entry, ok := unmappedCountries.countries[key]
+	if !ok {
+		entry = &unmappedCountry{RuleSet: d.RuleSet, Country: d.Country}
+		unmappedCountries.countries[key] = entry
+	}
+	entry.Count++
+	entry.LastSeen = time.Now()
+	if len(entry.Domains) < unmappedDomainSamples && !containsString(entry.Domains, domain) {
+		entry.Domains = append(entry.Domains, domain)
+	}
+}
+
+// getUnmappedCountries return unmapped countries of the rule set (all if empty), most seen first. Up to top per rule
+// set, 0 for all.
+func getUnmappedCountries(ruleSetName string, top int) []unmappedCountry {
+	unmappedCountries.Lock()
+	countries := make([]unmappedCountry, 0, len(unmappedCountries.countries))
+	for _, entry := range unmappedCountries.countries {
+		if ruleSetName == "" || entry.RuleSet == ruleSetName {
+			copied := *entry
+			copied.Domains = append([]string{}, entry.Domains...)
+			countries = append(countries, copied)
+		}
+	}
+	unmappedCountries.Unlock()
+
+	sort.Slice(countries, func(i, j int) bool {
+		if countries[i].RuleSet != countries[j].RuleSet {
+			return countries[i].RuleSet < countries[j].RuleSet
+		}
+		if countries[i].Count != countries[j].Count {
+			return countries[i].Count > countries[j].Count
+		}
+		return countries[i].Country < countries[j].Country
+	})
+	if top < 1 {
+		return countries
+	}
+
+	limited := make([]unmappedCountry, 0, len(countries))
+	perRuleSet := make(map[string]int)
+	for _, entry := range countries {
+		if perRuleSet[entry.RuleSet] < top {
+			limited = append(limited, entry)
+			perRuleSet[entry.RuleSet]++
+		}
+	}
+	return limited
+}
+
+// startUnmappedReport log top unmapped countries every unmappedReportInterval.
+func startUnmappedReport() {
+	if unmappedReportInterval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(unmappedReportInterval) {
+			countries := getUnmappedCountries("", unmappedReportTop)
+			if len(countries) == 0 {
+				continue
+			}
+			lines := make(map[string][]string)
+			for _, entry := range countries {
+				lines[entry.RuleSet] = append(lines[entry.RuleSet], fmt.Sprintf("%s=%d", entry.Country, entry.Count))
+			}
+			for ruleSetName, countryLines := range lines {
+				log.WithFields(log.Fields{
+					"rule_set":  ruleSetName,
+					"countries": countryLines,
+				}).Warn("Top unmapped countries use default target.")
+			}
+		}
+	}()
+}
+
+// adminUnmappedHandler GET return countries of lookups use default target, most seen first. "rule_set" query filter
+// rule set, "top" limit countries per rule set.
+func adminUnmappedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	top := 0
+	if value := r.FormValue("top"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			writeJsonError(w, http.StatusBadRequest, "Invalid top.")
+			return
+		}
+		top = parsed
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"countries": getUnmappedCountries(r.FormValue("rule_set"), top),
+	})
+}
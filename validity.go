@@ -0,0 +1,92 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Mappings with valid_from or valid_until option only take part in lookups within that period, so temporary routing
+// change like migration or incident workaround activate and expire without config change. Outside the period the
+// mapping act as if not configured.
+
+// validityFormats of valid_from and valid_until. Time without zone is UTC.
+var validityFormats = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+func parseValidityTime(value string) (time.Time, error) {
+	for _, format := range validityFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("Invalid time %s, must be like 2006-01-02T15:04:05Z07:00 or 2006-01-02", value))
+}
+
+// validAt return if mapping is within its valid period at the time.
+func (o mappingOptions) validAt(now time.Time) bool {
+	if !o.validFrom.IsZero() && now.Before(o.validFrom) {
+		return false
+	}
+	if !o.validUntil.IsZero() && !now.Before(o.validUntil) {
+		return false
+	}
+	return true
+}
+
+// validTargets return targets of the pool whose mapping is valid now. Same pool returned if all valid.
+func (rs *ruleSet) validTargets(matchKey string, pool []string, now time.Time) []string {
+	if len(rs.validityBoundaries) < 1 {
+		return pool
+	}
+	valid := make([]string, 0, len(pool))
+	for _, target := range pool {
+		if rs.getMappingOptions(matchKey, target).validAt(now) {
+			valid = append(valid, target)
+		}
+	}
+	if len(valid) == len(pool) {
+		return pool
+	}
+	return valid
+}
+
+// collectValidityBoundaries keep times any mapping activate or expire, sorted.
+func (rs *ruleSet) collectValidityBoundaries() {
+	rs.validityBoundaries = nil
+	for _, options := range rs.mappingOptions {
+		for _, boundary := range []time.Time{options.validFrom, options.validUntil} {
+			if !boundary.IsZero() {
+				rs.validityBoundaries = append(rs.validityBoundaries, boundary)
+			}
+		}
+	}
+	sort.Slice(rs.validityBoundaries, func(i, j int) bool {
+		return rs.validityBoundaries[i].Before(rs.validityBoundaries[j])
+	})
+}
+
+// validityChanged return if any mapping activated or expired after since and by now. Decision made before that is
+// out of date.
+func (rs *ruleSet) validityChanged(since time.Time, now time.Time) bool {
+	index := sort.Search(len(rs.validityBoundaries), func(i int) bool {
+		return rs.validityBoundaries[i].After(since)
+	})
+	return index < len(rs.validityBoundaries) && !rs.validityBoundaries[index].After(now)
+}
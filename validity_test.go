@@ -0,0 +1,111 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidAt(t *testing.T) {
+	tests := []struct {
+		mapping string
+		now     time.Time
+		valid   bool
+	}{
+		{"US:mta-us", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		// valid_from inclusive, valid_until exclusive.
+		{"US:mta-us valid_from=2026-03-01T00:00:00Z", time.Date(2026, 2, 28, 23, 59, 59, 0, time.UTC), false},
+		{"US:mta-us valid_from=2026-03-01T00:00:00Z", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), true},
+		{"US:mta-us valid_until=2026-03-01T00:00:00Z", time.Date(2026, 2, 28, 23, 59, 59, 0, time.UTC), true},
+		{"US:mta-us valid_until=2026-03-01T00:00:00Z", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), false},
+		// Time without zone is UTC.
+		{"US:mta-us valid_until=2026-03-01T09:00", time.Date(2026, 3, 1, 8, 59, 0, 0, time.UTC), true},
+		{"US:mta-us valid_until=2026-03-01T09:00", time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC), false},
+		{"US:mta-us valid_until=2026-03-01", time.Date(2026, 3, 1, 0, 0, 0, 0, time.FixedZone("JST", 9*3600)), true},
+		{"US:mta-us valid_until=2026-03-01", time.Date(2026, 3, 1, 9, 0, 0, 0, time.FixedZone("JST", 9*3600)), false},
+		{"US:mta-us valid_until=2026-03-01T09:00:00+09:00", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), false},
+		{"US:mta-us valid_from=2026-03-01 valid_until=2026-03-02", time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), true},
+		{"US:mta-us valid_from=2026-03-01 valid_until=2026-03-02", time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		_, options, err := splitMappingOptions(test.mapping)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid := options.validAt(test.now); valid != test.valid {
+			t.Errorf("%s valid at %s = %v, want %v", test.mapping, test.now.Format(time.RFC3339), valid, test.valid)
+		}
+	}
+}
+
+func TestValidityChanged(t *testing.T) {
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	rs := &ruleSet{mappingOptions: map[string]mappingOptions{
+		"US:mta-us": {validFrom: from, validUntil: until},
+	}}
+	rs.collectValidityBoundaries()
+	tests := []struct {
+		since   time.Time
+		now     time.Time
+		changed bool
+	}{
+		// Decision made just before a boundary is out of date once it passed.
+		{from.Add(-time.Second), from, true},
+		{from.Add(-time.Second), from.Add(-time.Millisecond), false},
+		{until.Add(-time.Minute), until.Add(time.Minute), true},
+		// Decision made at or after the boundary is up to date.
+		{from, from.Add(time.Minute), false},
+		{from.Add(time.Hour), until.Add(-time.Second), false},
+		{until, until.Add(time.Hour), false},
+		{from.Add(-time.Hour), until.Add(time.Hour), true},
+	}
+	for _, test := range tests {
+		if changed := rs.validityChanged(test.since, test.now); changed != test.changed {
+			t.Errorf("validityChanged(%s, %s) = %v, want %v", test.since.Format(time.RFC3339Nano), test.now.Format(time.RFC3339Nano), changed, test.changed)
+		}
+	}
+}
+
+func TestGetCachedDecisionValidityBoundary(t *testing.T) {
+	savedTtl, savedEntries := decisionCacheTtl, cacheMaxEntries
+	decisionCacheTtl, cacheMaxEntries = time.Minute, 100
+	defer func() { decisionCacheTtl, cacheMaxEntries = savedTtl, savedEntries }()
+
+	now := time.Now()
+	tests := []struct {
+		boundary time.Time
+		cached   bool
+	}{
+		// Cached now, boundary already passed by lookup.
+		{now.Add(time.Millisecond), false},
+		{now.Add(time.Hour), true},
+	}
+	for _, test := range tests {
+		rs := &ruleSet{name: "validity", mappingOptions: map[string]mappingOptions{
+			"US:mta-us": {validUntil: test.boundary},
+		}}
+		rs.collectValidityBoundaries()
+		decisionCache.set(rs.name+" example.com", decision{RuleSet: rs.name, Target: "mta-us", Pool: []string{"mta-us"}, Country: "US"}, 128, decisionCacheTtl)
+		time.Sleep(5 * time.Millisecond)
+		if _, cached := getCachedDecision(rs, "user@example.com"); cached != test.cached {
+			t.Errorf("cached decision with boundary in %s = %v, want %v", test.boundary.Sub(now), cached, test.cached)
+		}
+		decisionCache.purge()
+	}
+}
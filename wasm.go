@@ -0,0 +1,139 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WASM plugin ABI. Module export:
+//
+//	memory
+//	allocate(size i32) i32                 - return pointer of size bytes, host write plugin request JSON into it
+//	route(ptr i32, len i32) i64            - return (pointer << 32 | length) of plugin response JSON
+//
+// Request and response JSON same as HTTP/exec plugin. Each call run on a new module instance, so module can keep no state between calls.
+var wasmRuntime wazero.Runtime
+var wasmModule wazero.CompiledModule
+var wasmLock sync.RWMutex
+
+func isWasmPlugin() bool {
+	return strings.HasPrefix(pluginUrl, "wasm:")
+}
+
+// loadWasmPlugin compile the module file. Replace current module only if compile success.
+func loadWasmPlugin() error {
+	path := strings.TrimPrefix(pluginUrl, "wasm:")
+	binary, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Read WASM plugin %s error: %s", path, err.Error()))
+	}
+
+	ctx := context.Background()
+	wasmLock.Lock()
+	defer wasmLock.Unlock()
+
+	if wasmRuntime == nil {
+		wasmRuntime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+		wasi_snapshot_preview1.MustInstantiate(ctx, wasmRuntime)
+	}
+
+	compiled, err := wasmRuntime.CompileModule(ctx, binary)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Compile WASM plugin %s error: %s", path, err.Error()))
+	}
+
+	if wasmModule != nil {
+		wasmModule.Close(ctx)
+	}
+	wasmModule = compiled
+	log.Infof("WASM plugin %s loaded.", path)
+	return nil
+}
+
+func callWasmPlugin(ctx context.Context, body []byte) ([]byte, error) {
+	wasmLock.RLock()
+	defer wasmLock.RUnlock()
+
+	if wasmModule == nil {
+		return nil, errors.New("WASM plugin not loaded.")
+	}
+
+	// Empty name allow multiple instances at the same time. Run "_initialize" for reactor style module if exist.
+	module, err := wasmRuntime.InstantiateModule(ctx, wasmModule, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, err
+	}
+	defer module.Close(ctx)
+
+	allocate := module.ExportedFunction("allocate")
+	route := module.ExportedFunction("route")
+	if allocate == nil || route == nil {
+		return nil, errors.New("WASM plugin must export allocate and route.")
+	}
+
+	results, err := allocate.Call(ctx, uint64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	pointer := uint32(results[0])
+	if !module.Memory().Write(pointer, body) {
+		return nil, errors.New("WASM plugin allocate return invalid pointer.")
+	}
+
+	results, err = route.Call(ctx, uint64(pointer), uint64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	output, ok := module.Memory().Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return nil, errors.New("WASM plugin route return invalid pointer.")
+	}
+
+	// Memory gone after module close, so copy it.
+	return append([]byte(nil), output...), nil
+}
+
+// adminPluginReloadHandler POST/PUT reload WASM plugin from disk.
+func adminPluginReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		writeJsonError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	if !isWasmPlugin() {
+		writeJsonError(w, http.StatusBadRequest, "No WASM plugin configured.")
+		return
+	}
+
+	err := loadWasmPlugin()
+	if err != nil {
+		log.Errorf("Reload WASM plugin error: %s", err.Error())
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	auditRequest(r, "plugin_reload", pluginUrl, "", nil, nil)
+	writeJson(w, http.StatusOK, map[string]string{"plugin": pluginUrl})
+}
@@ -0,0 +1,70 @@
+/*
+   Copyright 2018 Alan Tang
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Change kinds sent to watchers.
+const (
+	changeRuleSet = "rule_set"
+	changeDrain   = "drain"
+	changeStatic  = "static"
+	// changeCountrySwitch is country switch set, removed or expired.
+	changeCountrySwitch = "country_switch"
+	// changeDemotion is target demoted for a country, or restored.
+	changeDemotion = "demotion"
+)
+
+type changeEvent struct {
+	kind     string
+	ruleSet  string
+	detail   string
+	unixTime int64
+}
+
+// watchers receive change events. Event dropped for slow watcher, so routing never blocked by it.
+var watchers = make(map[chan changeEvent]bool)
+var watchersLock sync.Mutex
+
+func addWatcher() chan changeEvent {
+	watchersLock.Lock()
+	defer watchersLock.Unlock()
+	ch := make(chan changeEvent, 16)
+	watchers[ch] = true
+	return ch
+}
+
+func removeWatcher(ch chan changeEvent) {
+	watchersLock.Lock()
+	defer watchersLock.Unlock()
+	delete(watchers, ch)
+}
+
+func notifyChange(kind string, ruleSet string, detail string) {
+	event := changeEvent{kind: kind, ruleSet: ruleSet, detail: detail, unixTime: time.Now().Unix()}
+	watchersLock.Lock()
+	defer watchersLock.Unlock()
+	for ch := range watchers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}